@@ -0,0 +1,699 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/pelletier/go-toml/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// AdminServer exposes an authenticated HTTP API for inspecting the running proxy
+type AdminServer struct {
+	config  AdminConfig
+	manager *MultiServerManager
+	logger  *zap.Logger
+	audit   *zap.Logger
+	server  *http.Server
+}
+
+// poolStatus describes a single load balancer pool
+type poolStatus struct {
+	Method    string           `json:"method"`
+	Upstreams []UpstreamStatus `json:"upstreams"`
+}
+
+// serverPoolsStatus describes the load balancer pools of a server instance
+type serverPoolsStatus struct {
+	Server    string     `json:"server"`
+	Address   string     `json:"address"`
+	HTTP      poolStatus `json:"http"`
+	WebSocket poolStatus `json:"websocket"`
+}
+
+// NewAdminServer creates a new admin API server
+func NewAdminServer(cfg AdminConfig, manager *MultiServerManager, logger *zap.Logger) *AdminServer {
+	return &AdminServer{
+		config:  cfg,
+		manager: manager,
+		logger:  logger,
+	}
+}
+
+// Start starts the admin API in the background
+func (a *AdminServer) Start(errorChan chan<- error) error {
+	if a.config.Token == "" && len(a.config.Tokens) == 0 && a.config.ClientCAFile == "" {
+		return fmt.Errorf("admin API enabled but no token or client CA configured")
+	}
+
+	tlsConfig, err := a.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	audit, err := NewAuditLogger(a.config.AuditLog)
+	if err != nil {
+		return fmt.Errorf("failed to setup admin audit log: %w", err)
+	}
+	a.audit = audit
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/upstreams", a.handleUpstreams)
+	mux.HandleFunc("POST /admin/upstreams/{name}/{action}", a.handleUpstreamAction)
+	mux.HandleFunc("POST /admin/reload", a.handleReload)
+	mux.HandleFunc("GET /admin/config", a.handleConfig)
+	mux.HandleFunc("GET /admin/servers/{server}/log-level", a.handleGetLogLevel)
+	mux.HandleFunc("PUT /admin/servers/{server}/log-level", a.handleSetLogLevel)
+	mux.HandleFunc("GET /admin/connections", a.handleConnections)
+	mux.HandleFunc("DELETE /admin/connections", a.handleCloseUpstreamConnections)
+	mux.HandleFunc("DELETE /admin/connections/{id}", a.handleCloseConnection)
+	mux.HandleFunc("DELETE /admin/cache", a.handlePurgeCache)
+	mux.HandleFunc("GET /admin/splits", a.handleSplits)
+	mux.HandleFunc("PUT /admin/splits", a.handleSetSplit)
+	mux.HandleFunc("GET /admin/maintenance", a.handleMaintenance)
+	mux.HandleFunc("PUT /admin/maintenance", a.handleSetMaintenance)
+	mux.HandleFunc("GET /metrics", a.handleMetrics)
+
+	addr := fmt.Sprintf("%s:%d", a.config.Host, a.config.Port)
+	a.server = &http.Server{
+		Addr:      addr,
+		Handler:   recoverPanics(a.authenticate(mux), a.logger, nil),
+		TLSConfig: tlsConfig,
+	}
+
+	go func() {
+		a.logger.Info("Admin API started", zap.String("address", addr), zap.Bool("tls", tlsConfig != nil))
+		ln, err := listenHandover("tcp", addr, func() (net.Listener, error) {
+			return net.Listen("tcp", addr)
+		})
+		switch {
+		case err != nil:
+		case tlsConfig != nil:
+			err = a.server.ServeTLS(ln, "", "")
+		default:
+			err = a.server.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			errorChan <- fmt.Errorf("admin API error: %w", err)
+		}
+	}()
+
+	return nil
+}
+
+// Shutdown gracefully stops the admin API
+func (a *AdminServer) Shutdown(ctx context.Context) error {
+	if a.server == nil {
+		return nil
+	}
+	if a.audit != nil {
+		defer a.audit.Sync()
+	}
+	return a.server.Shutdown(ctx)
+}
+
+// handleUpstreams lists the HTTP and WebSocket pools of every server instance
+func (a *AdminServer) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	instances := a.manager.GetServerInstances()
+	result := make([]serverPoolsStatus, 0, len(instances))
+	for _, instance := range instances {
+		result = append(result, serverPoolsStatus{
+			Server:    instance.name,
+			Address:   instance.config.Address(),
+			HTTP:      newPoolStatus(instance.loadBalancer),
+			WebSocket: newPoolStatus(instance.wsLoadBalancer),
+		})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// upstreamActions maps admin actions to the administrative upstream state they set
+var upstreamActions = map[string]int32{
+	"enable":  UpstreamEnabled,
+	"disable": UpstreamDisabled,
+	"drain":   UpstreamDraining,
+}
+
+// upstreamActionResult reports a pool affected by an upstream state change
+type upstreamActionResult struct {
+	Server   string `json:"server"`
+	Pool     string `json:"pool"`
+	Upstream string `json:"upstream"`
+	State    string `json:"state"`
+}
+
+// handleUpstreamAction enables, disables or drains an upstream in every pool that contains it.
+// The optional "server" query parameter limits the change to a single server instance.
+func (a *AdminServer) handleUpstreamAction(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	action := r.PathValue("action")
+	state, ok := upstreamActions[action]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("unknown action %q", action))
+		return
+	}
+
+	serverFilter := r.URL.Query().Get("server")
+	var results []upstreamActionResult
+	closed := []ConnectionInfo{}
+	for _, instance := range a.manager.GetServerInstances() {
+		if serverFilter != "" && instance.name != serverFilter {
+			continue
+		}
+		affected := len(results)
+		for _, pool := range instancePools(instance) {
+			if pool.lb == nil {
+				continue
+			}
+			previous, found := pool.lb.SetUpstreamState(name, state)
+			if !found {
+				continue
+			}
+			results = append(results, upstreamActionResult{
+				Server:   instance.name,
+				Pool:     pool.name,
+				Upstream: name,
+				State:    upstreamStateNames[state],
+			})
+			a.auditMutation(r, "upstream."+action, instance.name+"/"+pool.name+"/"+name,
+				upstreamStateNames[previous], upstreamStateNames[state])
+		}
+		// Unlike draining, disabling also cuts the keep-alive connections and
+		// WebSocket tunnels still open to the upstream
+		if state == UpstreamDisabled && len(results) > affected {
+			closed = append(closed, a.closeUpstreamConnections(instance, name)...)
+		}
+	}
+
+	if len(results) == 0 {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("upstream %q not found", name))
+		return
+	}
+	if state == UpstreamDisabled {
+		a.auditMutation(r, "connection.close_upstream", name, closed, nil)
+	}
+
+	a.logger.Warn("Upstream state changed through admin API",
+		zap.String("upstream", name),
+		zap.String("state", upstreamStateNames[state]),
+		zap.String("target_server", serverFilter),
+		zap.Int("closed", len(closed)),
+		zap.String("remote", r.RemoteAddr))
+	writeJSON(w, http.StatusOK, results)
+}
+
+// handleReload re-reads the configuration and applies it to all server instances
+func (a *AdminServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	previous := a.manager.Config()
+	changes, err := reloadFromDisk(a.manager, a.logger)
+	if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	cfg := a.manager.Config()
+
+	a.logger.Info("Configuration reloaded through admin API", zap.String("remote", r.RemoteAddr))
+	a.auditMutation(r, "config.reload", "configuration", previous.EffectiveConfig(), cfg.EffectiveConfig())
+	if changes == nil {
+		changes = []ConfigChange{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "reloaded", "changes": changes})
+}
+
+// handleConfig returns the effective configuration as JSON, or as TOML with ?format=toml
+func (a *AdminServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	cfg := a.manager.Config()
+	if cfg == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "configuration not loaded")
+		return
+	}
+	effective := cfg.EffectiveConfig()
+
+	if r.URL.Query().Get("format") == "toml" {
+		data, err := toml.Marshal(effective)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/toml")
+		w.Write(data)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, effective)
+}
+
+// logLevelBody is the request and response body of the log level endpoints
+type logLevelBody struct {
+	Server string `json:"server,omitempty"`
+	Level  string `json:"level"`
+}
+
+// findInstance returns the server instance named in the request path
+func (a *AdminServer) findInstance(w http.ResponseWriter, r *http.Request) *ServerInstance {
+	name := r.PathValue("server")
+	for _, instance := range a.manager.GetServerInstances() {
+		if instance.name == name {
+			return instance
+		}
+	}
+	writeJSONError(w, http.StatusNotFound, fmt.Sprintf("server %q not found", name))
+	return nil
+}
+
+// handleGetLogLevel returns the current log level of a server instance
+func (a *AdminServer) handleGetLogLevel(w http.ResponseWriter, r *http.Request) {
+	instance := a.findInstance(w, r)
+	if instance == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, logLevelBody{Server: instance.name, Level: instance.logLevel.String()})
+}
+
+// handleSetLogLevel changes the log level of a server instance without a restart
+func (a *AdminServer) handleSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	instance := a.findInstance(w, r)
+	if instance == nil {
+		return
+	}
+
+	var body logLevelBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(body.Level)); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid log level %q", body.Level))
+		return
+	}
+
+	previous := instance.logLevel.Level()
+	instance.logLevel.SetLevel(level)
+	a.auditMutation(r, "log_level.set", instance.name, previous.String(), level.String())
+	a.logger.Info("Log level changed through admin API",
+		zap.String("target_server", instance.name),
+		zap.Stringer("previous", previous),
+		zap.Stringer("level", level),
+		zap.String("remote", r.RemoteAddr))
+	writeJSON(w, http.StatusOK, logLevelBody{Server: instance.name, Level: level.String()})
+}
+
+// handleConnections lists active client connections, optionally filtered by ?server= and ?upstream=
+func (a *AdminServer) handleConnections(w http.ResponseWriter, r *http.Request) {
+	serverFilter := r.URL.Query().Get("server")
+	upstreamFilter := r.URL.Query().Get("upstream")
+
+	result := []ConnectionInfo{}
+	for _, instance := range a.manager.GetServerInstances() {
+		if serverFilter != "" && instance.name != serverFilter {
+			continue
+		}
+		for _, tc := range instance.connections.List() {
+			info := tc.info()
+			if upstreamFilter != "" && info.Upstream != upstreamFilter {
+				continue
+			}
+			result = append(result, info)
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleCloseConnection forcibly closes a single client connection
+func (a *AdminServer) handleCloseConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid connection id")
+		return
+	}
+
+	for _, instance := range a.manager.GetServerInstances() {
+		tc, ok := instance.connections.Get(id)
+		if !ok {
+			continue
+		}
+		info := tc.info()
+		if err := tc.Close(); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		a.auditMutation(r, "connection.close", strconv.FormatUint(id, 10), info, nil)
+		a.logger.Warn("Connection closed through admin API",
+			zap.Uint64("id", id),
+			zap.String("target_server", info.Server),
+			zap.String("client", info.Remote),
+			zap.String("remote", r.RemoteAddr))
+		writeJSON(w, http.StatusOK, info)
+		return
+	}
+
+	writeJSONError(w, http.StatusNotFound, fmt.Sprintf("connection %d not found", id))
+}
+
+// handleCloseUpstreamConnections closes every client connection whose latest request went to ?upstream=
+func (a *AdminServer) handleCloseUpstreamConnections(w http.ResponseWriter, r *http.Request) {
+	upstream := r.URL.Query().Get("upstream")
+	if upstream == "" {
+		writeJSONError(w, http.StatusBadRequest, "upstream query parameter is required")
+		return
+	}
+
+	closed := []ConnectionInfo{}
+	for _, instance := range a.manager.GetServerInstances() {
+		closed = append(closed, a.closeUpstreamConnections(instance, upstream)...)
+	}
+	a.auditMutation(r, "connection.close_upstream", upstream, closed, nil)
+
+	a.logger.Warn("Upstream connections closed through admin API",
+		zap.String("upstream", upstream),
+		zap.Int("closed", len(closed)),
+		zap.String("remote", r.RemoteAddr))
+	writeJSON(w, http.StatusOK, closed)
+}
+
+// closeUpstreamConnections closes the client connections of a server instance
+// whose latest request went to upstream
+func (a *AdminServer) closeUpstreamConnections(instance *ServerInstance, upstream string) []ConnectionInfo {
+	var closed []ConnectionInfo
+	for _, tc := range instance.connections.List() {
+		if tc.Upstream() != upstream {
+			continue
+		}
+		if err := tc.Close(); err != nil {
+			a.logger.Warn("Failed to close connection", zap.Uint64("id", tc.ID), zap.Error(err))
+			continue
+		}
+		closed = append(closed, tc.info())
+	}
+	return closed
+}
+
+// cachePurgeResult reports the cached responses a purge dropped on a server
+type cachePurgeResult struct {
+	Server string `json:"server"`
+	Purged int    `json:"purged"`
+}
+
+// handlePurgeCache drops cached responses by exact ?key=, path ?prefix= or surrogate
+// ?tag=. The optional "server" query parameter limits the purge to a single server instance.
+func (a *AdminServer) handlePurgeCache(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var selector, target string
+	for _, name := range []string{"key", "prefix", "tag"} {
+		if value := query.Get(name); value != "" {
+			if selector != "" {
+				writeJSONError(w, http.StatusBadRequest, "only one of key, prefix and tag may be given")
+				return
+			}
+			selector, target = name, value
+		}
+	}
+	if selector == "" {
+		writeJSONError(w, http.StatusBadRequest, "key, prefix or tag query parameter is required")
+		return
+	}
+
+	serverFilter := query.Get("server")
+	results := []cachePurgeResult{}
+	for _, instance := range a.manager.GetServerInstances() {
+		if serverFilter != "" && instance.name != serverFilter {
+			continue
+		}
+		cache := instance.proxyServer.Cache()
+		if cache == nil {
+			continue
+		}
+		var purged int
+		switch selector {
+		case "key":
+			purged = cache.PurgeKey(target)
+		case "prefix":
+			purged = cache.PurgePrefix(target)
+		case "tag":
+			purged = cache.PurgeTag(target)
+		}
+		results = append(results, cachePurgeResult{Server: instance.name, Purged: purged})
+	}
+	a.auditMutation(r, "cache.purge_"+selector, target, nil, results)
+
+	a.logger.Info("Cache purged through admin API",
+		zap.String(selector, target),
+		zap.String("target_server", serverFilter),
+		zap.String("remote", r.RemoteAddr))
+	writeJSON(w, http.StatusOK, results)
+}
+
+// splitStatus reports the traffic split of a route
+type splitStatus struct {
+	Server string             `json:"server"`
+	Route  string             `json:"route"`
+	Sticky bool               `json:"sticky"`
+	Groups []SplitGroupStatus `json:"groups"`
+}
+
+// splitWeightsBody is the request body of the split update endpoint
+type splitWeightsBody struct {
+	Weights map[string]int `json:"weights"`
+}
+
+// splitStatuses lists the traffic splits of every server instance, optionally
+// limited to one server and one route
+func (a *AdminServer) splitStatuses(serverFilter, routeFilter string) []splitStatus {
+	result := []splitStatus{}
+	for _, instance := range a.manager.GetServerInstances() {
+		if serverFilter != "" && instance.name != serverFilter {
+			continue
+		}
+		router := instance.proxyServer.Router()
+		if router == nil {
+			continue
+		}
+		for _, route := range router.routes {
+			if route.split == nil || (routeFilter != "" && route.Name != routeFilter) {
+				continue
+			}
+			result = append(result, splitStatus{
+				Server: instance.name,
+				Route:  route.Name,
+				Sticky: route.split.sticky,
+				Groups: route.split.Status(),
+			})
+		}
+	}
+	return result
+}
+
+// handleSplits lists the traffic splits of every route, filterable by ?server= and ?route=
+func (a *AdminServer) handleSplits(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.splitStatuses(r.URL.Query().Get("server"), r.URL.Query().Get("route")))
+}
+
+// handleSetSplit changes the group weights of the traffic split of ?route=. The
+// optional "server" query parameter limits the change to a single server instance.
+func (a *AdminServer) handleSetSplit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name := query.Get("route")
+	if name == "" {
+		writeJSONError(w, http.StatusBadRequest, "route query parameter is required")
+		return
+	}
+
+	var body splitWeightsBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Weights) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body, expected {\"weights\": {\"group\": weight}}")
+		return
+	}
+
+	// Check every split before changing any, so a bad request changes nothing
+	serverFilter := query.Get("server")
+	var splits []*trafficSplit
+	var targets []string
+	for _, instance := range a.manager.GetServerInstances() {
+		if serverFilter != "" && instance.name != serverFilter {
+			continue
+		}
+		router := instance.proxyServer.Router()
+		if router == nil {
+			continue
+		}
+		for _, route := range router.routes {
+			if route.Name != name || route.split == nil {
+				continue
+			}
+			if err := route.split.CheckWeights(body.Weights); err != nil {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("server %q: %v", instance.name, err))
+				return
+			}
+			splits = append(splits, route.split)
+			targets = append(targets, instance.name+"/"+name)
+		}
+	}
+	if len(splits) == 0 {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("route %q with a traffic split not found", name))
+		return
+	}
+
+	for i, split := range splits {
+		previous := split.Status()
+		if err := split.SetWeights(body.Weights); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("%s: %v", targets[i], err))
+			return
+		}
+		a.auditMutation(r, "split.set", targets[i], previous, split.Status())
+	}
+
+	a.logger.Warn("Traffic split changed through admin API",
+		zap.String("route", name),
+		zap.Any("weights", body.Weights),
+		zap.String("target_server", serverFilter),
+		zap.String("remote", r.RemoteAddr))
+	writeJSON(w, http.StatusOK, a.splitStatuses(serverFilter, name))
+}
+
+// maintenanceStatus reports whether a server, or one of its routes, is in maintenance
+type maintenanceStatus struct {
+	Server  string `json:"server"`
+	Route   string `json:"route,omitempty"`
+	Enabled bool   `json:"enabled"`
+}
+
+// maintenanceBody is the request body of the maintenance switch endpoint
+type maintenanceBody struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// maintenanceTarget is a server's or route's maintenance mode reachable through the admin API
+type maintenanceTarget struct {
+	status maintenanceStatus
+	mode   *maintenanceMode
+}
+
+// maintenanceTargets lists the maintenance modes of every server instance and its
+// routes, optionally limited to one server and to the server itself or one route
+func (a *AdminServer) maintenanceTargets(serverFilter, routeFilter string, routes bool) []maintenanceTarget {
+	var result []maintenanceTarget
+	for _, instance := range a.manager.GetServerInstances() {
+		if serverFilter != "" && instance.name != serverFilter {
+			continue
+		}
+		if routeFilter == "" {
+			result = append(result, maintenanceTarget{maintenanceStatus{Server: instance.name}, instance.proxyServer.Maintenance()})
+		}
+		router := instance.proxyServer.Router()
+		if !routes || router == nil {
+			continue
+		}
+		for _, route := range router.routes {
+			if routeFilter != "" && route.Name != routeFilter {
+				continue
+			}
+			result = append(result, maintenanceTarget{maintenanceStatus{Server: instance.name, Route: route.Name}, route.maintenance})
+		}
+	}
+	return result
+}
+
+// maintenanceStatuses reports whether maintenance targets are in maintenance
+func maintenanceStatuses(targets []maintenanceTarget) []maintenanceStatus {
+	result := []maintenanceStatus{}
+	for _, target := range targets {
+		target.status.Enabled = target.mode.Enabled()
+		result = append(result, target.status)
+	}
+	return result
+}
+
+// handleMaintenance lists whether every server and route is in maintenance,
+// filterable by ?server= and ?route=
+func (a *AdminServer) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	writeJSON(w, http.StatusOK, maintenanceStatuses(a.maintenanceTargets(query.Get("server"), query.Get("route"), true)))
+}
+
+// handleSetMaintenance switches maintenance mode on or off for whole servers, or
+// for the route named by ?route=. The optional "server" query parameter limits
+// the change to a single server instance. The switch lasts until a reload
+// changes the maintenance settings.
+func (a *AdminServer) handleSetMaintenance(w http.ResponseWriter, r *http.Request) {
+	var body maintenanceBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Enabled == nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body, expected {\"enabled\": true|false}")
+		return
+	}
+
+	query := r.URL.Query()
+	serverFilter, routeFilter := query.Get("server"), query.Get("route")
+	targets := a.maintenanceTargets(serverFilter, routeFilter, routeFilter != "")
+	if len(targets) == 0 {
+		if routeFilter != "" {
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("route %q not found", routeFilter))
+		} else {
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("server %q not found", serverFilter))
+		}
+		return
+	}
+
+	for _, target := range targets {
+		previous := target.mode.Enabled()
+		target.mode.SetEnabled(*body.Enabled)
+		name := target.status.Server
+		if target.status.Route != "" {
+			name += "/" + target.status.Route
+		}
+		a.auditMutation(r, "maintenance.set", name, previous, *body.Enabled)
+	}
+
+	a.logger.Warn("Maintenance mode changed through admin API",
+		zap.Bool("enabled", *body.Enabled),
+		zap.String("route", routeFilter),
+		zap.String("target_server", serverFilter),
+		zap.String("remote", r.RemoteAddr))
+	writeJSON(w, http.StatusOK, maintenanceStatuses(targets))
+}
+
+// handleMetrics renders the metrics of all server instances in Prometheus text format
+func (a *AdminServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	a.manager.Metrics().WritePrometheus(w)
+}
+
+// namedPool pairs a load balancer with the pool name used by the admin API
+type namedPool struct {
+	name string
+	lb   *LoadBalancer
+}
+
+// instancePools returns the HTTP and WebSocket pools of a server instance
+func instancePools(instance *ServerInstance) []namedPool {
+	return []namedPool{
+		{name: "http", lb: instance.loadBalancer},
+		{name: "websocket", lb: instance.wsLoadBalancer},
+	}
+}
+
+func newPoolStatus(lb *LoadBalancer) poolStatus {
+	if lb == nil {
+		return poolStatus{Upstreams: []UpstreamStatus{}}
+	}
+	return poolStatus{
+		Method:    lb.Method(),
+		Upstreams: lb.Snapshot(),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
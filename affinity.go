@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Session affinity modes of the load_balancer section
+const (
+	AffinityNone   = ""
+	AffinityIP     = "ip"
+	AffinityCookie = "cookie"
+	AffinityHeader = "header"
+)
+
+// defaultAffinityTTL is how long an idle client stays pinned to its upstreams
+const defaultAffinityTTL = 30 * time.Minute
+
+// affinityModes are the accepted values of load_balancer affinity
+var affinityModes = map[string]bool{
+	AffinityNone:   true,
+	"none":         true,
+	AffinityIP:     true,
+	AffinityCookie: true,
+	AffinityHeader: true,
+}
+
+// AffinityStore remembers which upstream each client was sent to, per pool. The
+// HTTP and WebSocket balancers of a server share one store, so a client that keeps
+// using either keeps both of its pins alive.
+type AffinityStore struct {
+	mu        sync.Mutex
+	entries   map[string]*affinityEntry
+	lastSweep time.Time
+}
+
+// affinityEntry holds the pinned upstream of a client in each pool
+type affinityEntry struct {
+	upstreams map[string]string // pool -> upstream name
+	expires   time.Time
+}
+
+// NewAffinityStore creates an empty affinity store
+func NewAffinityStore() *AffinityStore {
+	return &AffinityStore{entries: make(map[string]*affinityEntry), lastSweep: time.Now()}
+}
+
+// Lookup returns the upstream a client is pinned to in a pool, or ""
+func (s *AffinityStore) Lookup(pool, key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return ""
+	}
+	return entry.upstreams[pool]
+}
+
+// Remember pins a client to an upstream of a pool and extends the pin's lifetime
+func (s *AffinityStore) Remember(pool, key, upstream string, ttl time.Duration) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Expired pins are dropped once per TTL rather than on every request
+	if now.Sub(s.lastSweep) > ttl {
+		for k, entry := range s.entries {
+			if now.After(entry.expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	entry, ok := s.entries[key]
+	if !ok || now.After(entry.expires) {
+		entry = &affinityEntry{upstreams: make(map[string]string, 2)}
+		s.entries[key] = entry
+	}
+	entry.upstreams[pool] = upstream
+	entry.expires = now.Add(ttl)
+}
+
+// SetAffinity attaches the balancer to a shared affinity store under a pool name
+func (lb *LoadBalancer) SetAffinity(store *AffinityStore, pool string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.affinity = store
+	lb.pool = pool
+}
+
+// GetUpstreamFor returns the upstream a client is pinned to when it is still
+// available, and otherwise balances normally and pins the client to the result.
+// An empty key (affinity disabled, or no cookie or header) balances normally.
+func (lb *LoadBalancer) GetUpstreamFor(key string) *Upstream {
+	return lb.getUpstreamIn(key, nil)
+}
+
+// getUpstreamIn is GetUpstreamFor limited to the upstreams named in group, or
+// not limited when group is nil. A client pinned outside the group is pinned anew.
+func (lb *LoadBalancer) getUpstreamIn(key string, group map[string]bool) *Upstream {
+	lb.mu.RLock()
+	store, pool, ttl := lb.affinity, lb.pool, lb.affinityTTL
+	lb.mu.RUnlock()
+	if store == nil || key == "" {
+		return lb.getUpstreamAmong(group)
+	}
+
+	if name := store.Lookup(pool, key); name != "" && (group == nil || group[name]) {
+		if upstream := lb.GetUpstreamByName(name); upstream != nil {
+			store.Remember(pool, key, name, ttl)
+			return upstream
+		}
+	}
+	upstream := lb.getUpstreamAmong(group)
+	if upstream != nil {
+		store.Remember(pool, key, upstream.Name, ttl)
+	}
+	return upstream
+}
+
+// affinityKeyFastHTTP returns the key identifying the client of a gnet request, or
+// "" when affinity is disabled or the request lacks the configured cookie or header
+func (lb *LoadBalancer) affinityKeyFastHTTP(req *fasthttp.Request, ip string) string {
+	lb.mu.RLock()
+	mode, name := lb.affinityMode, lb.affinityName
+	lb.mu.RUnlock()
+	switch mode {
+	case AffinityIP:
+		return ip
+	case AffinityCookie:
+		return string(req.Header.Cookie(name))
+	case AffinityHeader:
+		return string(req.Header.Peek(name))
+	}
+	return ""
+}
+
+// affinityKey returns the key identifying the client of a net/http request
+func (lb *LoadBalancer) affinityKey(r *http.Request) string {
+	lb.mu.RLock()
+	mode, name := lb.affinityMode, lb.affinityName
+	lb.mu.RUnlock()
+	switch mode {
+	case AffinityIP:
+		return clientIP(r.RemoteAddr)
+	case AffinityCookie:
+		if cookie, err := r.Cookie(name); err == nil {
+			return cookie.Value
+		}
+	case AffinityHeader:
+		return r.Header.Get(name)
+	}
+	return ""
+}
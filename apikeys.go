@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/valyala/fasthttp"
+)
+
+// defaultAPIKeyHeader is the header read when api_keys.header is not set
+const defaultAPIKeyHeader = "X-API-Key"
+
+// APIKeyAuth authenticates requests by API key and applies the key's route
+// restrictions and rate limit. Keys are indexed by digest, so the lookup does
+// not leak how much of a key matched through timing.
+type APIKeyAuth struct {
+	config     APIKeyConfig
+	header     string
+	queryParam string
+	keys       map[[sha256.Size]byte]*apiKey
+}
+
+// apiKey is a configured key with its route restrictions and rate limit
+type apiKey struct {
+	name    string
+	routes  map[string]bool // nil allows every route
+	limiter *tokenBuckets   // nil when the key is not rate limited
+}
+
+// NewAPIKeyAuth creates the authenticator of a server, or returns nil when API keys are disabled
+func NewAPIKeyAuth(cfg APIKeyConfig) (*APIKeyAuth, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	auth := &APIKeyAuth{
+		config:     cfg,
+		header:     cfg.Header,
+		queryParam: cfg.QueryParam,
+		keys:       make(map[[sha256.Size]byte]*apiKey),
+	}
+	if auth.header == "" {
+		auth.header = defaultAPIKeyHeader
+	}
+
+	names := make(map[string]bool)
+	for _, entry := range cfg.entries() {
+		if entry.Name == "" || entry.Key == "" {
+			return nil, errors.New("every key needs a name and a key")
+		}
+		if names[entry.Name] {
+			return nil, fmt.Errorf("duplicate key name %q", entry.Name)
+		}
+		names[entry.Name] = true
+
+		digest := sha256.Sum256([]byte(entry.Key))
+		if _, exists := auth.keys[digest]; exists {
+			return nil, fmt.Errorf("key %q is also used by another key", entry.Name)
+		}
+		if entry.RequestsPerSecond < 0 || entry.Burst < 0 {
+			return nil, fmt.Errorf("key %q: rate and burst must not be negative", entry.Name)
+		}
+
+		key := &apiKey{name: entry.Name, limiter: newTokenBuckets(entry.RequestsPerSecond, entry.Burst)}
+		if len(entry.Routes) > 0 {
+			key.routes = make(map[string]bool, len(entry.Routes))
+			for _, route := range entry.Routes {
+				key.routes[route] = true
+			}
+		}
+		auth.keys[digest] = key
+	}
+	if len(auth.keys) == 0 {
+		return nil, errors.New("enabled without any key")
+	}
+	return auth, nil
+}
+
+// entries returns the inline keys followed by the ones read from the keys file
+func (cfg APIKeyConfig) entries() []APIKeyEntry {
+	return append(append([]APIKeyEntry(nil), cfg.Keys...), cfg.fileKeys...)
+}
+
+// readAPIKeysFile reads the [[keys]] of a keys file, with warnings for unknown settings
+func readAPIKeysFile(path string) ([]APIKeyEntry, []string, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType("toml")
+	if err := v.ReadInConfig(); err != nil {
+		return nil, nil, err
+	}
+
+	var file struct {
+		Keys []APIKeyEntry `mapstructure:"keys"`
+	}
+	warnings, err := unmarshalStrict(v, &file, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file.Keys, warnings, nil
+}
+
+// Config returns the settings the authenticator was created with
+func (a *APIKeyAuth) Config() APIKeyConfig {
+	if a == nil {
+		return APIKeyConfig{}
+	}
+	return a.config
+}
+
+// Check authenticates a key for a route. It returns 0 when the request may proceed,
+// or the status to reject it with: 401 for a missing or unknown key, 403 for a
+// key not allowed on the route and 429 (with the wait time) for a rate-limited key.
+func (a *APIKeyAuth) Check(route *Route, value string) (int, time.Duration) {
+	if a == nil {
+		return 0, 0
+	}
+	if value == "" {
+		return http.StatusUnauthorized, 0
+	}
+	key, ok := a.keys[sha256.Sum256([]byte(value))]
+	if !ok {
+		return http.StatusUnauthorized, 0
+	}
+	if key.routes != nil && !key.routes[route.RouteName()] {
+		return http.StatusForbidden, 0
+	}
+	if allowed, retryAfter := key.limiter.Take(globalBucketKey); !allowed {
+		return http.StatusTooManyRequests, retryAfter
+	}
+	return 0, 0
+}
+
+// takeFastHTTP returns the key of a gnet request and removes it from the request,
+// so it never reaches the upstream
+func (a *APIKeyAuth) takeFastHTTP(req *fasthttp.Request) string {
+	if a == nil {
+		return ""
+	}
+	value := string(req.Header.Peek(a.header))
+	req.Header.Del(a.header)
+	if a.queryParam != "" {
+		args := req.URI().QueryArgs()
+		if value == "" {
+			value = string(args.Peek(a.queryParam))
+		}
+		if args.Has(a.queryParam) {
+			args.Del(a.queryParam)
+			// The upstream request is built from the request URI, not the parsed arguments
+			req.SetRequestURIBytes(append([]byte(nil), req.URI().RequestURI()...))
+		}
+	}
+	return value
+}
+
+// take returns the key of a net/http request and removes it from the request,
+// so it never reaches the upstream
+func (a *APIKeyAuth) take(r *http.Request) string {
+	if a == nil {
+		return ""
+	}
+	value := r.Header.Get(a.header)
+	r.Header.Del(a.header)
+	if a.queryParam != "" {
+		query := r.URL.Query()
+		if value == "" {
+			value = query.Get(a.queryParam)
+		}
+		if query.Has(a.queryParam) {
+			query.Del(a.queryParam)
+			r.URL.RawQuery = query.Encode()
+		}
+	}
+	return value
+}
+
+// writeAPIKeyError rejects a net/http request with the status returned by APIKeyAuth.Check
+func writeAPIKeyError(w http.ResponseWriter, status int, retryAfter time.Duration) {
+	if status == http.StatusTooManyRequests {
+		writeTooManyRequests(w, retryAfter)
+		return
+	}
+	http.Error(w, http.StatusText(status), status)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/panjf2000/gnet/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// authenticate runs the authentication checks of a net/http request in order. When
+// one fails it writes the rejection and reports false.
+func (rc *RuntimeConfig) authenticate(w http.ResponseWriter, r *http.Request, route *Route) bool {
+	if authorized, challenge := route.Authorize(r.Header.Get("Authorization")); !authorized {
+		writeUnauthorized(w, challenge)
+		return false
+	}
+
+	// Signatures cover the request as sent, so they are checked before anything is stripped
+	if verified, err := rc.Signatures.verify(route, r, rc.Proxy.MaxBodySize); !verified {
+		writeSignatureError(w, err)
+		return false
+	}
+
+	// The API key is taken out of the request so it never reaches the upstream
+	if status, retryAfter := rc.APIKeys.Check(route, rc.APIKeys.take(r)); status != 0 {
+		writeAPIKeyError(w, status, retryAfter)
+		return false
+	}
+
+	// Bearer tokens are introspected, and the subject and scopes passed to the upstream
+	info, status, challenge := rc.OAuth2.Authenticate(r.Context(), r.Header.Get("Authorization"))
+	if status != 0 {
+		writeOAuth2Error(w, status, challenge)
+		return false
+	}
+	rc.OAuth2.setTokenHeaders(r.Header, info)
+	return true
+}
+
+// authenticateTraffic runs the authentication checks of a gnet request in order.
+// When one fails it sends the rejection and reports false.
+func (h *HTTPHandler) authenticateTraffic(c gnet.Conn, entry *AccessEntry, rc *RuntimeConfig, route *Route, req *fasthttp.Request) bool {
+	if authorized, challenge := route.Authorize(string(req.Header.Peek("Authorization"))); !authorized {
+		h.sendTrafficErrorHeader(c, entry, fasthttp.StatusUnauthorized, "Unauthorized", "WWW-Authenticate", challenge)
+		return false
+	}
+
+	// Signatures cover the request as sent, so they are checked before anything is stripped
+	if !rc.Signatures.verifyFastHTTP(route, req) {
+		h.sendTrafficError(c, entry, fasthttp.StatusUnauthorized, "Invalid signature")
+		return false
+	}
+
+	// The API key is taken out of the request so it never reaches the upstream
+	if status, retryAfter := rc.APIKeys.Check(route, rc.APIKeys.takeFastHTTP(req)); status != 0 {
+		if status == fasthttp.StatusTooManyRequests {
+			h.sendTooManyRequests(c, entry, retryAfter)
+		} else {
+			h.sendTrafficError(c, entry, status, fasthttp.StatusMessage(status))
+		}
+		return false
+	}
+
+	// Bearer tokens are introspected, and the subject and scopes passed to the upstream
+	info, status, challenge := rc.OAuth2.Authenticate(context.Background(), string(req.Header.Peek("Authorization")))
+	if status != 0 {
+		if challenge != "" {
+			h.sendTrafficErrorHeader(c, entry, status, fasthttp.StatusMessage(status), "WWW-Authenticate", challenge)
+		} else {
+			h.sendTrafficError(c, entry, status, fasthttp.StatusMessage(status))
+		}
+		return false
+	}
+	rc.OAuth2.setTokenHeadersFastHTTP(req, info)
+	return true
+}
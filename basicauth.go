@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// defaultBasicAuthRealm is the realm announced when a route doesn't set one
+const defaultBasicAuthRealm = "Restricted"
+
+// basicAuthCacheSize bounds the credentials remembered after a successful check
+const basicAuthCacheSize = 1024
+
+// BasicAuth checks HTTP Basic credentials against bcrypt hashes. bcrypt is slow on
+// purpose, so credentials that passed once are remembered by digest.
+type BasicAuth struct {
+	realm string
+	users map[string][]byte // username to bcrypt hash
+
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]struct{}
+}
+
+// NewBasicAuth creates the checker of a route, or returns nil when the route has no users
+func NewBasicAuth(cfg BasicAuthConfig) (*BasicAuth, error) {
+	users, err := cfg.users()
+	if err != nil || len(users) == 0 {
+		return nil, err
+	}
+	realm := cfg.Realm
+	if realm == "" {
+		realm = defaultBasicAuthRealm
+	}
+	return &BasicAuth{
+		realm:    realm,
+		users:    users,
+		verified: make(map[[sha256.Size]byte]struct{}),
+	}, nil
+}
+
+// users merges the inline entries with the ones read from the htpasswd file
+func (cfg BasicAuthConfig) users() (map[string][]byte, error) {
+	entries := append(append([]string(nil), cfg.Users...), cfg.htpasswd...)
+	users := make(map[string][]byte, len(entries))
+	for _, entry := range entries {
+		name, hash, ok := strings.Cut(entry, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid user entry, expected user:hash")
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("user %q: only bcrypt hashes are supported (htpasswd -B)", name)
+		}
+		if _, exists := users[name]; exists {
+			return nil, fmt.Errorf("duplicate user %q", name)
+		}
+		users[name] = []byte(hash)
+	}
+	return users, nil
+}
+
+// readHtpasswdFile returns the user:hash lines of an htpasswd file, skipping blank lines and comments
+func readHtpasswdFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	return entries, scanner.Err()
+}
+
+// Check validates the value of an Authorization header
+func (a *BasicAuth) Check(authorization string) bool {
+	if a == nil {
+		return true
+	}
+
+	scheme, encoded, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return false
+	}
+	hash, ok := a.users[username]
+	if !ok {
+		return false
+	}
+
+	digest := sha256.Sum256(decoded)
+	a.mu.Lock()
+	_, cached := a.verified[digest]
+	a.mu.Unlock()
+	if cached {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+
+	a.mu.Lock()
+	if len(a.verified) >= basicAuthCacheSize {
+		a.verified = make(map[[sha256.Size]byte]struct{})
+	}
+	a.verified[digest] = struct{}{}
+	a.mu.Unlock()
+	return true
+}
+
+// Challenge returns the WWW-Authenticate header value sent with 401 responses
+func (a *BasicAuth) Challenge() string {
+	return fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", a.realm)
+}
+
+// writeUnauthorized rejects a net/http request with 401 and a Basic challenge
+func writeUnauthorized(w http.ResponseWriter, challenge string) {
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
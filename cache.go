@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// cacheEntryOverhead approximates the memory of an entry besides its key, headers
+// and body, so that many tiny responses cannot exceed the budget unnoticed
+const cacheEntryOverhead = 256
+
+// How a cache handles responses carrying Vary
+const (
+	CacheVaryKey    = "key"    // cached only when the cache key covers every header they vary by
+	CacheVaryIgnore = "ignore" // cached as if they did not vary
+)
+
+// cacheVaryModes are the supported vary settings
+var cacheVaryModes = map[string]bool{
+	CacheVaryKey:    true,
+	CacheVaryIgnore: true,
+}
+
+// cacheableStatuses are the statuses cached without explicit freshness (RFC 9110
+// section 15.1), less the error ones
+var cacheableStatuses = map[int]bool{
+	fasthttp.StatusOK:                   true,
+	fasthttp.StatusNonAuthoritativeInfo: true,
+	fasthttp.StatusNoContent:            true,
+	fasthttp.StatusMultipleChoices:      true,
+	fasthttp.StatusMovedPermanently:     true,
+	fasthttp.StatusPermanentRedirect:    true,
+}
+
+// ResponseCache keeps upstream responses in memory within a byte budget, evicting
+// the least recently used ones first
+type ResponseCache struct {
+	config CacheConfig
+	// negative are the error statuses cached for negative_ttl, nil when disabled
+	negative map[int]bool
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // most recently used first
+	size    int64
+	tags    map[string]map[string]bool // surrogate keys to the keys of their entries
+}
+
+// cacheEntry is a stored response
+type cacheEntry struct {
+	key          string
+	path         string
+	tags         []string
+	status       int
+	headers      [][2][]byte
+	body         []byte
+	etag         []byte
+	lastModified []byte
+	size         int64
+
+	received   time.Time
+	initialAge time.Duration // age when received
+	lifetime   time.Duration // freshness lifetime
+}
+
+// age returns the current age of the stored response (RFC 9111 section 4.2.3)
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.initialAge + now.Sub(e.received)
+}
+
+// revalidatable reports whether the upstream can confirm the stored response is
+// still current once it is stale, instead of sending it again
+func (e *cacheEntry) revalidatable() bool {
+	return e.status == fasthttp.StatusOK && (len(e.etag) > 0 || len(e.lastModified) > 0)
+}
+
+// cachePolicy is how the responses of a route are cached: the server's cache
+// settings with the route's overrides
+type cachePolicy struct {
+	enabled       bool
+	ttl           time.Duration
+	maxObjectSize int64 // 0 for no limit besides the memory budget
+	ignoreVary    bool
+}
+
+// NewResponseCache creates a cache, or returns nil when neither the server nor
+// any of its routes enables caching. A nil cache stores nothing.
+func NewResponseCache(cfg CacheConfig, routes []RouteConfig) *ResponseCache {
+	enabled := cfg.Enabled
+	for _, route := range routes {
+		if route.Cache.Enabled != nil && *route.Cache.Enabled {
+			enabled = true
+		}
+	}
+	if !enabled {
+		return nil
+	}
+	c := &ResponseCache{
+		config:  cfg,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		tags:    make(map[string]map[string]bool),
+	}
+	if cfg.NegativeTTL > 0 {
+		c.negative = make(map[int]bool, len(cfg.NegativeStatuses))
+		for _, status := range cfg.NegativeStatuses {
+			c.negative[status] = true
+		}
+	}
+	return c
+}
+
+// Config returns the settings the cache was created with
+func (c *ResponseCache) Config() CacheConfig {
+	if c == nil {
+		return CacheConfig{}
+	}
+	return c.config
+}
+
+// Key returns the cache key of a request for path on route, reporting false when
+// its response must not be cached: only GET and HEAD requests on routes caching
+// responses, without credentials or Cache-Control: no-store, are
+func (c *ResponseCache) Key(req *fasthttp.Request, path string, route *Route) (CacheKey, bool) {
+	if c == nil || !(req.Header.IsGet() || req.Header.IsHead()) || len(req.Header.Peek("Authorization")) > 0 {
+		return CacheKey{}, false
+	}
+	policy := route.CachePolicy(c.config)
+	if !policy.enabled || requestCacheControl(req).noStore {
+		return CacheKey{}, false
+	}
+	key := cacheKeyFor(req, path, route.CacheKeyConfig())
+	key.policy = policy
+	return key, true
+}
+
+// Get copies the response stored under key into resp, with its Age, reporting
+// false when there is none fresh enough for req. Requests with Cache-Control:
+// no-cache are never answered from the cache, and max-age limits the age of the
+// response they accept. Conditional requests matching the stored response get
+// 304 Not Modified. Stale responses with validators are kept for Revalidate.
+func (c *ResponseCache) Get(key CacheKey, req *fasthttp.Request, resp *fasthttp.Response) bool {
+	if c == nil {
+		return false
+	}
+	cc := requestCacheControl(req)
+	if cc.noCache {
+		return false
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	element, ok := c.entries[key.Value]
+	if !ok {
+		c.mu.Unlock()
+		return false
+	}
+	entry := element.Value.(*cacheEntry)
+	age := entry.age(now)
+	if age >= entry.lifetime {
+		if !entry.revalidatable() {
+			c.remove(element)
+		}
+		c.mu.Unlock()
+		return false
+	}
+	if cc.maxAge >= 0 && age > cc.maxAge {
+		c.mu.Unlock()
+		return false
+	}
+	c.lru.MoveToFront(element)
+	c.mu.Unlock()
+
+	// Entries are never modified once stored, so they are copied outside the lock.
+	// A 304 keeps the stored Content-Length, which describes the full response.
+	resp.Reset()
+	resp.SetStatusCode(entry.status)
+	for _, header := range entry.headers {
+		resp.Header.AddBytesKV(header[0], header[1])
+	}
+	resp.Header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	if entry.status == fasthttp.StatusOK && notModified(req, entry.etag, entry.lastModified) {
+		resp.SetStatusCode(fasthttp.StatusNotModified)
+		return true
+	}
+	resp.SetBody(entry.body)
+	return true
+}
+
+// Store keeps a copy of the upstream response to the request with key, tagged
+// with the surrogate keys of the response, unless its status is not cacheable,
+// its Cache-Control forbids a shared cache to store or serve it without
+// revalidation, it is stale already, it sets cookies or varies by request headers
+// the key leaves out, or it is larger than the route allows or the memory budget.
+// Its freshness comes from Cache-Control or Expires, and is the route's TTL
+// without them; error responses cached by negative_statuses stay at most
+// negative_ttl.
+func (c *ResponseCache) Store(key CacheKey, resp *fasthttp.Response) {
+	if c == nil {
+		return
+	}
+	negative := c.negative[resp.StatusCode()]
+	if !negative && !cacheableStatuses[resp.StatusCode()] {
+		return
+	}
+	if len(resp.Header.Peek("Set-Cookie")) > 0 || (!key.policy.ignoreVary && !key.coversVary(resp.Header.Peek("Vary"))) {
+		return
+	}
+	body := resp.Body()
+	if key.policy.maxObjectSize > 0 && int64(len(body)) > key.policy.maxObjectSize {
+		return
+	}
+	cc := parseCacheControl(resp.Header.Peek("Cache-Control"))
+	if cc.noStore || cc.noCache || cc.private {
+		return
+	}
+	now := time.Now()
+	lifetime := freshnessLifetime(resp, cc, now, key.policy.ttl)
+	if negative && lifetime > c.config.NegativeTTL {
+		lifetime = c.config.NegativeTTL
+	}
+	age := initialAge(resp, now)
+	if age >= lifetime {
+		return
+	}
+
+	entry := &cacheEntry{
+		key:          key.Value,
+		path:         key.Path,
+		tags:         strings.Fields(string(resp.Header.Peek(c.config.SurrogateKeyHeader))),
+		status:       resp.StatusCode(),
+		body:         append([]byte(nil), body...),
+		etag:         append([]byte(nil), resp.Header.Peek("ETag")...),
+		lastModified: append([]byte(nil), resp.Header.Peek("Last-Modified")...),
+		size:         int64(len(key.Value)+len(body)) + cacheEntryOverhead,
+		received:     now,
+		initialAge:   age,
+		lifetime:     lifetime,
+	}
+	connection := resp.Header.Peek("Connection")
+	resp.Header.VisitAll(func(name, value []byte) {
+		// Age is computed when the response is served
+		if isHopHeader(name, connection) || bytes.EqualFold(name, []byte("Age")) {
+			return
+		}
+		entry.headers = append(entry.headers, [2][]byte{append([]byte(nil), name...), append([]byte(nil), value...)})
+		entry.size += int64(len(name) + len(value))
+	})
+	if entry.size > c.config.MaxMemory {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[entry.key]; ok {
+		c.remove(element)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += entry.size
+	for _, tag := range entry.tags {
+		if c.tags[tag] == nil {
+			c.tags[tag] = make(map[string]bool)
+		}
+		c.tags[tag][entry.key] = true
+	}
+	for c.size > c.config.MaxMemory {
+		c.remove(c.lru.Back())
+	}
+}
+
+// MarkResponse adds X-Cache to a response when x_cache_header is on: HIT when
+// it is answered from the cache, MISS when an upstream was asked
+func (c *ResponseCache) MarkResponse(resp *fasthttp.Response, hit bool) {
+	if c == nil || !c.config.XCacheHeader {
+		return
+	}
+	if hit {
+		resp.Header.Set("X-Cache", "HIT")
+	} else {
+		resp.Header.Set("X-Cache", "MISS")
+	}
+}
+
+// Revalidate makes req conditional on the stale response stored under key, with
+// its ETag and Last-Modified, so that the upstream can answer 304 Not Modified
+// instead of sending the body again. It returns the stale response for Refresh,
+// or nil when there is none to revalidate or the client made req conditional
+// itself, leaving the 304 to the client.
+func (c *ResponseCache) Revalidate(key CacheKey, req *fasthttp.Request) *cacheEntry {
+	if c == nil || len(req.Header.Peek("If-None-Match")) > 0 || len(req.Header.Peek("If-Modified-Since")) > 0 {
+		return nil
+	}
+	c.mu.Lock()
+	element, ok := c.entries[key.Value]
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	if !entry.revalidatable() || entry.age(time.Now()) < entry.lifetime {
+		return nil
+	}
+	if len(entry.etag) > 0 {
+		req.Header.SetBytesV("If-None-Match", entry.etag)
+	}
+	if len(entry.lastModified) > 0 {
+		req.Header.SetBytesV("If-Modified-Since", entry.lastModified)
+	}
+	return entry
+}
+
+// Refresh turns the 304 Not Modified the upstream answered a revalidation with
+// into the stale response, updated with the headers of the 304 (RFC 9111 section
+// 4.3.4), and stores it again, so that it is fresh for another lifetime
+func (c *ResponseCache) Refresh(key CacheKey, stale *cacheEntry, resp *fasthttp.Response) {
+	notModified := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(notModified)
+	resp.Header.CopyTo(&notModified.Header)
+
+	resp.Reset()
+	resp.SetStatusCode(stale.status)
+	for _, header := range stale.headers {
+		resp.Header.AddBytesKV(header[0], header[1])
+	}
+	connection := notModified.Header.Peek("Connection")
+	updated := func(name []byte) bool {
+		return !isHopHeader(name, connection) && !bytes.EqualFold(name, []byte("Content-Length"))
+	}
+	notModified.Header.VisitAll(func(name, value []byte) {
+		if updated(name) {
+			resp.Header.DelBytes(name)
+		}
+	})
+	notModified.Header.VisitAll(func(name, value []byte) {
+		if updated(name) {
+			resp.Header.AddBytesKV(name, value)
+		}
+	})
+	resp.SetBody(stale.body)
+
+	// The stale response goes even when the 304 makes it uncacheable
+	c.PurgeKey(key.Value)
+	c.Store(key, resp)
+}
+
+// PurgeKey drops the response stored under key, returning how many were dropped
+func (c *ResponseCache) PurgeKey(key string) int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return 0
+	}
+	c.remove(element)
+	return 1
+}
+
+// PurgePrefix drops the responses to requests whose path starts with prefix,
+// whatever their host and query, returning how many were dropped
+func (c *ResponseCache) PurgePrefix(prefix string) int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	purged := 0
+	for element := c.lru.Front(); element != nil; {
+		next := element.Next()
+		if strings.HasPrefix(element.Value.(*cacheEntry).path, prefix) {
+			c.remove(element)
+			purged++
+		}
+		element = next
+	}
+	return purged
+}
+
+// PurgeTag drops the responses tagged with a surrogate key, returning how many
+// were dropped
+func (c *ResponseCache) PurgeTag(tag string) int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	purged := 0
+	for key := range c.tags[tag] {
+		if element, ok := c.entries[key]; ok {
+			c.remove(element)
+			purged++
+		}
+	}
+	return purged
+}
+
+// remove drops an entry; the caller holds mu
+func (c *ResponseCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+	for _, tag := range entry.tags {
+		delete(c.tags[tag], entry.key)
+		if len(c.tags[tag]) == 0 {
+			delete(c.tags, tag)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// cacheControl holds the Cache-Control directives the response cache acts on
+// (RFC 9111 section 5.2). Qualified no-cache="..." and private="..." forms are
+// treated as their unqualified ones, which is the safe reading for a shared cache.
+type cacheControl struct {
+	noStore bool
+	noCache bool
+	private bool
+	maxAge  time.Duration // -1 when absent
+	sMaxAge time.Duration // -1 when absent
+}
+
+// parseCacheControl parses a Cache-Control header value. Directives are
+// case-insensitive; unknown ones and malformed ages are ignored.
+func parseCacheControl(value []byte) cacheControl {
+	cc := cacheControl{maxAge: -1, sMaxAge: -1}
+	for len(value) > 0 {
+		var directive []byte
+		directive, value, _ = bytes.Cut(value, []byte(","))
+		name, arg, _ := bytes.Cut(bytes.TrimSpace(directive), []byte("="))
+		arg = bytes.Trim(bytes.TrimSpace(arg), `"`)
+		switch string(bytes.ToLower(bytes.TrimSpace(name))) {
+		case "no-store":
+			cc.noStore = true
+		case "no-cache":
+			cc.noCache = true
+		case "private":
+			cc.private = true
+		case "max-age":
+			cc.maxAge = parseDeltaSeconds(arg, cc.maxAge)
+		case "s-maxage":
+			cc.sMaxAge = parseDeltaSeconds(arg, cc.sMaxAge)
+		}
+	}
+	return cc
+}
+
+// parseDeltaSeconds parses a delta-seconds value, returning fallback when it is
+// not one
+func parseDeltaSeconds(value []byte, fallback time.Duration) time.Duration {
+	seconds, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil || seconds < 0 {
+		return fallback
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// requestCacheControl returns the directives of a request, reading the HTTP/1.0
+// Pragma: no-cache when it sends no Cache-Control
+func requestCacheControl(req *fasthttp.Request) cacheControl {
+	value := req.Header.Peek("Cache-Control")
+	if len(value) == 0 && bytes.EqualFold(bytes.TrimSpace(req.Header.Peek("Pragma")), []byte("no-cache")) {
+		value = []byte("no-cache")
+	}
+	return parseCacheControl(value)
+}
+
+// freshnessLifetime returns how long a response stays fresh after it was
+// generated (RFC 9111 section 4.2.1): its s-maxage, max-age or Expires, in that
+// order, or fallback when it sets none. An invalid Expires means already expired.
+func freshnessLifetime(resp *fasthttp.Response, cc cacheControl, now time.Time, fallback time.Duration) time.Duration {
+	switch {
+	case cc.sMaxAge >= 0:
+		return cc.sMaxAge
+	case cc.maxAge >= 0:
+		return cc.maxAge
+	}
+	expires := resp.Header.Peek("Expires")
+	if len(expires) == 0 {
+		return fallback
+	}
+	expiresAt, err := fasthttp.ParseHTTPDate(expires)
+	if err != nil {
+		return 0
+	}
+	return expiresAt.Sub(responseDate(resp, now))
+}
+
+// initialAge returns how old a response already was when it arrived (RFC 9111
+// section 4.2.3): the larger of its Age header and the time since its Date
+func initialAge(resp *fasthttp.Response, now time.Time) time.Duration {
+	age := parseDeltaSeconds(bytes.TrimSpace(resp.Header.Peek("Age")), 0)
+	if apparent := now.Sub(responseDate(resp, now)); apparent > age {
+		age = apparent
+	}
+	return age
+}
+
+// responseDate returns the Date of a response, or now when it has none
+func responseDate(resp *fasthttp.Response, now time.Time) time.Time {
+	if date, err := fasthttp.ParseHTTPDate(resp.Header.Peek("Date")); err == nil {
+		return date
+	}
+	return now
+}
+
+// notModified reports whether a conditional request is answered 304 Not Modified
+// by a stored response with etag and lastModified (RFC 9110 section 13.2.2):
+// If-None-Match is checked when sent, using weak comparison, and If-Modified-Since
+// otherwise
+func notModified(req *fasthttp.Request, etag, lastModified []byte) bool {
+	if ifNoneMatch := req.Header.Peek("If-None-Match"); len(ifNoneMatch) > 0 {
+		if len(etag) == 0 {
+			return false
+		}
+		for len(ifNoneMatch) > 0 {
+			var candidate []byte
+			candidate, ifNoneMatch, _ = bytes.Cut(ifNoneMatch, []byte(","))
+			candidate = bytes.TrimSpace(candidate)
+			if bytes.Equal(candidate, []byte("*")) || bytes.Equal(weakETag(candidate), weakETag(etag)) {
+				return true
+			}
+		}
+		return false
+	}
+	ifModifiedSince, err := fasthttp.ParseHTTPDate(req.Header.Peek("If-Modified-Since"))
+	if err != nil || len(lastModified) == 0 {
+		return false
+	}
+	modified, err := fasthttp.ParseHTTPDate(lastModified)
+	return err == nil && !modified.After(ifModifiedSince)
+}
+
+// weakETag returns an entity tag without its weak W/ prefix
+func weakETag(etag []byte) []byte {
+	return bytes.TrimPrefix(etag, []byte("W/"))
+}
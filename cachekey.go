@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// CacheKey identifies the cached response of a request
+type CacheKey struct {
+	Value string // Method, host, path and query, then the route's extra components
+	Path  string // Request path, matched by purges by prefix
+
+	// headers are the request headers in the key, which responses may vary by
+	headers []string
+	// policy is how the route of the request caches responses
+	policy cachePolicy
+}
+
+// cacheKeyFor composes the cache key of a request for path on route. By default
+// it is the method, host, path and query as sent, as in GET example.com/a?b=1;
+// routes can normalize the query and add headers and cookies, so that content
+// negotiated by Accept-Language or an A/B cookie is cached per variant.
+func cacheKeyFor(req *fasthttp.Request, path string, cfg CacheKeyConfig) CacheKey {
+	uri, query, _ := bytes.Cut(req.RequestURI(), []byte("?"))
+
+	key := make([]byte, 0, 64)
+	key = append(key, req.Header.Method()...)
+	key = append(key, ' ')
+	key = append(key, bytes.ToLower(req.Host())...)
+	key = append(key, uri...)
+	if query = normalizeCacheQuery(query, cfg); len(query) > 0 {
+		key = append(key, '?')
+		key = append(key, query...)
+	}
+
+	// Values are quoted so that they cannot pass for other components
+	headers := make([]string, 0, len(cfg.Headers))
+	for _, name := range cfg.Headers {
+		name = http.CanonicalHeaderKey(name)
+		headers = append(headers, name)
+		key = append(key, " header:"...)
+		key = append(key, name...)
+		key = append(key, '=')
+		key = strconv.AppendQuote(key, string(req.Header.Peek(name)))
+	}
+	for _, name := range cfg.Cookies {
+		key = append(key, " cookie:"...)
+		key = append(key, name...)
+		key = append(key, '=')
+		key = strconv.AppendQuote(key, string(req.Header.Cookie(name)))
+	}
+	return CacheKey{Value: string(key), Path: path, headers: headers}
+}
+
+// normalizeCacheQuery returns the query of the key: as sent, or with its
+// parameters sorted, and only the listed ones kept when query_params is set.
+// Queries that do not parse are kept as sent.
+func normalizeCacheQuery(query []byte, cfg CacheKeyConfig) []byte {
+	if len(query) == 0 || (!cfg.SortQuery && len(cfg.QueryParams) == 0) {
+		return query
+	}
+	values, err := url.ParseQuery(string(query))
+	if err != nil {
+		return query
+	}
+	if len(cfg.QueryParams) > 0 {
+		kept := make(url.Values, len(cfg.QueryParams))
+		for _, name := range cfg.QueryParams {
+			if value, ok := values[name]; ok {
+				kept[name] = value
+			}
+		}
+		values = kept
+	}
+	// Encode sorts the parameters by name
+	return []byte(values.Encode())
+}
+
+// coversVary reports whether responses varying by the request headers of a Vary
+// header can be cached under the key: every header must be part of it
+func (k CacheKey) coversVary(vary []byte) bool {
+	for len(vary) > 0 {
+		var field []byte
+		field, vary, _ = bytes.Cut(vary, []byte(","))
+		field = bytes.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+		covered := false
+		for _, name := range k.headers {
+			if strings.EqualFold(name, string(field)) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// checkUpstreamsCmd runs one round of health checks from the proxy's host
+var checkUpstreamsCmd = &cobra.Command{
+	Use:   "check-upstreams",
+	Short: "Health check every HTTP and WebSocket upstream once and print which are reachable",
+	Long: `Loads the configuration and checks every upstream once, the way the running proxy
+would, from the host it runs on: HTTP upstreams must answer their health_check path with
+200, WebSocket upstreams must accept a connection, and complete the TLS handshake for wss.
+
+Exits non-zero when any upstream is unreachable, which makes it handy before flipping
+traffic to a new proxy box.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE:         runCheckUpstreams,
+}
+
+func init() {
+	rootCmd.AddCommand(checkUpstreamsCmd)
+}
+
+// upstreamCheck is the outcome of checking one upstream
+type upstreamCheck struct {
+	kind     string
+	upstream *Upstream
+	err      error
+	elapsed  time.Duration
+}
+
+func runCheckUpstreams(cmd *cobra.Command, args []string) error {
+	cfg, err := loadConfiguration()
+	if err != nil {
+		return err
+	}
+
+	lb, err := NewLoadBalancer(cfg.Upstreams, cfg.LoadBalancer)
+	if err != nil {
+		return err
+	}
+	wsLB, err := NewWebSocketLoadBalancer(cfg.WebSocketUpstreams, cfg.LoadBalancer)
+	if err != nil {
+		return err
+	}
+
+	var checks []*upstreamCheck
+	for _, u := range lb.upstreams {
+		checks = append(checks, &upstreamCheck{kind: "http", upstream: u})
+	}
+	for _, u := range wsLB.upstreams {
+		checks = append(checks, &upstreamCheck{kind: "websocket", upstream: u})
+	}
+	if len(checks) == 0 {
+		return fmt.Errorf("no upstreams found in configuration")
+	}
+
+	client := newHealthCheckClient(newUpstreamResolver(cfg.Proxy))
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			if check.kind == "websocket" {
+				conn, err := dialWebSocketUpstream(check.upstream, cfg.Proxy)
+				if err == nil {
+					conn.Close()
+				}
+				check.err = err
+			} else {
+				check.err = checkHealth(client, check.upstream, check.upstream.HealthCheck)
+			}
+			check.elapsed = time.Since(start)
+		}()
+	}
+	wg.Wait()
+
+	green := color.New(color.FgGreen, color.Bold)
+	red := color.New(color.FgRed, color.Bold)
+	unreachable := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tNAME\tURL\tSTATUS\tTIME\tDETAIL")
+	for _, check := range checks {
+		status, detail := green.Sprint("reachable"), ""
+		if check.err != nil {
+			status, detail = red.Sprint("unreachable"), check.err.Error()
+			unreachable++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", check.kind, check.upstream.Name, check.upstream.URL,
+			status, check.elapsed.Round(time.Millisecond), detail)
+	}
+	w.Flush()
+
+	if unreachable > 0 {
+		return fmt.Errorf("%d of %d upstreams unreachable", unreachable, len(checks))
+	}
+	return nil
+}
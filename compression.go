@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/valyala/fasthttp"
+)
+
+// Content codings responses are compressed with
+const (
+	encodingBrotli = "br"
+	encodingZstd   = "zstd"
+	encodingGzip   = "gzip"
+)
+
+// How the proxy asks upstreams to encode responses
+const (
+	UpstreamEncodingPassthrough = "passthrough" // the client's Accept-Encoding is sent on
+	UpstreamEncodingIdentity    = "identity"    // upstreams are asked for plain bodies
+	UpstreamEncodingDecompress  = "decompress"  // gzip bodies are accepted and decompressed by the proxy
+)
+
+// upstreamEncodingModes are the supported upstream_encoding settings
+var upstreamEncodingModes = map[string]bool{
+	UpstreamEncodingPassthrough: true,
+	UpstreamEncodingIdentity:    true,
+	UpstreamEncodingDecompress:  true,
+}
+
+// compressionEncodings are the supported content codings, with their highest level
+var compressionEncodings = map[string]int{
+	encodingBrotli: brotli.BestCompression,
+	encodingZstd:   int(zstd.SpeedBestCompression),
+	encodingGzip:   gzip.BestCompression,
+}
+
+// incompressibleTypes are content type prefixes never compressed, whatever
+// compression_types lists: gRPC frames its own messages, and event streams must
+// reach the client as they are written
+var incompressibleTypes = []string{"application/grpc", "text/event-stream"}
+
+// matchesMediaType reports whether a Content-Type value has one of the media
+// types of patterns, which may end in /* to match a whole top-level type
+func matchesMediaType(contentType string, patterns []string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if prefix, wildcard := strings.CutSuffix(pattern, "*"); wildcard {
+			if strings.HasPrefix(mediaType, prefix) {
+				return true
+			}
+		} else if mediaType == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateEncoding returns the content coding of encodings an Accept-Encoding
+// header value gives the highest weight (RFC 9110 section 12.5.3), the earliest
+// listed among equal ones, or "" when it accepts none of them
+func negotiateEncoding(acceptEncoding []byte, encodings []string) string {
+	weights := make(map[string]float64)
+	for len(acceptEncoding) > 0 {
+		var item []byte
+		item, acceptEncoding, _ = bytes.Cut(acceptEncoding, []byte(","))
+		coding, params, _ := bytes.Cut(item, []byte(";"))
+		weights[strings.ToLower(string(bytes.TrimSpace(coding)))] = qvalue(params)
+	}
+
+	best, bestWeight := "", 0.0
+	for _, encoding := range encodings {
+		weight, ok := weights[encoding]
+		if !ok {
+			weight, ok = weights["*"]
+		}
+		if ok && weight > bestWeight {
+			best, bestWeight = encoding, weight
+		}
+	}
+	return best
+}
+
+// qvalue returns the weight among the parameters of an Accept-Encoding item, 1
+// when it has none and 0 when it is malformed
+func qvalue(params []byte) float64 {
+	for len(params) > 0 {
+		var param []byte
+		param, params, _ = bytes.Cut(params, []byte(";"))
+		name, value, _ := bytes.Cut(bytes.TrimSpace(param), []byte("="))
+		if !bytes.EqualFold(bytes.TrimSpace(name), []byte("q")) {
+			continue
+		}
+		q, err := strconv.ParseFloat(string(bytes.TrimSpace(value)), 64)
+		if err != nil || q < 0 || q > 1 {
+			return 0
+		}
+		return q
+	}
+	return 1
+}
+
+// compressor encodes bodies with one content coding at one level
+type compressor struct {
+	encoding string
+	level    int
+}
+
+// compressorFor returns the compressor of the coding, among the ones enabled in
+// p, that an Accept-Encoding header value prefers, reporting false when it
+// accepts none of them
+func compressorFor(p ProxyConfig, acceptEncoding []byte) (compressor, bool) {
+	switch encoding := negotiateEncoding(acceptEncoding, p.CompressionEncodings); encoding {
+	case encodingBrotli:
+		return compressor{encoding, p.BrotliQuality}, true
+	case encodingZstd:
+		return compressor{encoding, p.ZstdLevel}, true
+	case encodingGzip:
+		return compressor{encoding, p.GzipLevel}, true
+	}
+	return compressor{}, false
+}
+
+// appendCompressed appends the compressed src to dst
+func (c compressor) appendCompressed(dst, src []byte) []byte {
+	switch c.encoding {
+	case encodingBrotli:
+		return fasthttp.AppendBrotliBytesLevel(dst, src, c.level)
+	case encodingZstd:
+		return fasthttp.AppendZstdBytesLevel(dst, src, c.level)
+	default:
+		return fasthttp.AppendGzipBytesLevel(dst, src, c.level)
+	}
+}
+
+// streamEncoder compresses a body as it is written, and can be pointed at
+// another writer for reuse
+type streamEncoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// encoderPools hold the stream encoders of each compressor for reuse
+var encoderPools sync.Map // compressor to *sync.Pool
+
+// encoder returns a stream encoder writing to w, which release returns to its
+// pool once closed
+func (c compressor) encoder(w io.Writer) streamEncoder {
+	pool, _ := encoderPools.LoadOrStore(c, &sync.Pool{
+		New: func() any {
+			switch c.encoding {
+			case encodingBrotli:
+				return brotli.NewWriterLevel(io.Discard, c.level)
+			case encodingZstd:
+				encoder, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderLevel(zstd.EncoderLevel(c.level)), zstd.WithEncoderConcurrency(1))
+				return encoder
+			default:
+				encoder, _ := gzip.NewWriterLevel(io.Discard, c.level)
+				return encoder
+			}
+		},
+	})
+	encoder := pool.(*sync.Pool).Get().(streamEncoder)
+	encoder.Reset(w)
+	return encoder
+}
+
+// release returns a closed stream encoder of c to its pool
+func (c compressor) release(encoder streamEncoder) {
+	if pool, ok := encoderPools.Load(c); ok {
+		pool.(*sync.Pool).Put(encoder)
+	}
+}
+
+// compressible reports whether p allows compressing a response: one with a body
+// of at least compression_min_size bytes (length is -1 when unknown), of one of
+// compression_types, not encoded or ranged already, and without
+// Cache-Control: no-transform
+func compressible(p ProxyConfig, status int, header func(string) string, length int64) bool {
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusPartialContent || status == http.StatusNotModified {
+		return false
+	}
+	if length >= 0 && length < p.CompressionMinSize {
+		return false
+	}
+	// Compressing an encoded body again costs CPU and gains nothing
+	if encoding := header("Content-Encoding"); (encoding != "" && !strings.EqualFold(encoding, "identity")) || header("Content-Range") != "" {
+		return false
+	}
+	contentType := header("Content-Type")
+	if !matchesMediaType(contentType, p.CompressionTypes) {
+		return false
+	}
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(strings.ToLower(contentType), prefix) {
+			return false
+		}
+	}
+	return !strings.Contains(strings.ToLower(header("Cache-Control")), "no-transform")
+}
+
+// varyAcceptEncoding returns a Vary header value that names Accept-Encoding, so
+// that caches keep the encodings of a response apart, or "" when vary already does
+func varyAcceptEncoding(vary string) string {
+	for _, name := range strings.Split(vary, ",") {
+		name = strings.TrimSpace(name)
+		if name == "*" || strings.EqualFold(name, "Accept-Encoding") {
+			return ""
+		}
+	}
+	if vary == "" {
+		return "Accept-Encoding"
+	}
+	return vary + ", Accept-Encoding"
+}
+
+// withoutVaryAcceptEncoding returns a Vary header value without Accept-Encoding
+func withoutVaryAcceptEncoding(vary string) string {
+	names := strings.Split(vary, ",")
+	kept := names[:0]
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" && !strings.EqualFold(name, "Accept-Encoding") {
+			kept = append(kept, name)
+		}
+	}
+	return strings.Join(kept, ", ")
+}
+
+// setUpstreamAcceptEncoding sets the Accept-Encoding of a request toward an
+// upstream under mode. decompress asks for gzip only when the client accepts it
+// too, so that a response relayed before it could be decompressed still reaches
+// a client that can read it.
+func setUpstreamAcceptEncoding(h *fasthttp.RequestHeader, mode string) {
+	switch mode {
+	case UpstreamEncodingIdentity:
+		h.Set("Accept-Encoding", "identity")
+	case UpstreamEncodingDecompress:
+		if negotiateEncoding(h.Peek("Accept-Encoding"), []string{encodingGzip}) != "" {
+			h.Set("Accept-Encoding", encodingGzip)
+		} else {
+			h.Set("Accept-Encoding", "identity")
+		}
+	}
+}
+
+// setStandardUpstreamAcceptEncoding sets the Accept-Encoding of a net/http
+// request toward an upstream under mode. Without one the transport asks for gzip
+// and decompresses the response as it arrives, which decompress relies on.
+func setStandardUpstreamAcceptEncoding(h http.Header, mode string) {
+	switch mode {
+	case UpstreamEncodingIdentity:
+		h.Set("Accept-Encoding", "identity")
+	case UpstreamEncodingDecompress:
+		h.Del("Accept-Encoding")
+	}
+}
+
+// decodeUpstreamResponse makes a buffered upstream response plain when the proxy
+// manages upstream encodings, so that the cache and the proxy's own compression
+// see the plain body: decompress decodes gzip bodies, and a plain response no
+// longer varies by the Accept-Encoding the upstream did not get from the client.
+// The proxy's compression names it again where it applies.
+func decodeUpstreamResponse(resp *fasthttp.Response, mode string) {
+	if mode != UpstreamEncodingIdentity && mode != UpstreamEncodingDecompress {
+		return
+	}
+	if mode == UpstreamEncodingDecompress && bytes.EqualFold(resp.Header.Peek("Content-Encoding"), []byte(encodingGzip)) {
+		body, err := resp.BodyGunzip()
+		if err != nil {
+			// A corrupt body is passed on as the upstream sent it
+			return
+		}
+		resp.SetBody(body)
+		resp.Header.Del("Content-Encoding")
+		resp.Header.SetContentLength(len(body))
+	}
+	if vary := resp.Header.Peek("Vary"); len(vary) > 0 && len(resp.Header.Peek("Content-Encoding")) == 0 {
+		if kept := withoutVaryAcceptEncoding(string(vary)); kept != "" {
+			resp.Header.Set("Vary", kept)
+		} else {
+			resp.Header.Del("Vary")
+		}
+	}
+}
+
+// decodeStandardUpstreamResponse drops Accept-Encoding from the Vary of a plain
+// net/http upstream response when the proxy manages upstream encodings
+func decodeStandardUpstreamResponse(h http.Header, mode string) {
+	if mode != UpstreamEncodingIdentity && mode != UpstreamEncodingDecompress || h.Get("Content-Encoding") != "" || h.Get("Vary") == "" {
+		return
+	}
+	if kept := withoutVaryAcceptEncoding(strings.Join(h.Values("Vary"), ",")); kept != "" {
+		h.Set("Vary", kept)
+	} else {
+		h.Del("Vary")
+	}
+}
+
+// weakenETag marks a strong entity tag weak, since the compressed body is no
+// longer byte-for-byte the one it was computed for
+func weakenETag(etag string) string {
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return "W/" + etag
+}
+
+// compressFastHTTP compresses the buffered body of resp for a client sending
+// acceptEncoding when it is eligible. Every eligible response gets
+// Vary: Accept-Encoding, whether compressed or not.
+func compressFastHTTP(resp *fasthttp.Response, p ProxyConfig, acceptEncoding []byte) {
+	body := resp.Body()
+	header := func(name string) string {
+		return string(resp.Header.Peek(name))
+	}
+	if !compressible(p, resp.StatusCode(), header, int64(len(body))) {
+		return
+	}
+	if vary := varyAcceptEncoding(header("Vary")); vary != "" {
+		resp.Header.Set("Vary", vary)
+	}
+	c, ok := compressorFor(p, acceptEncoding)
+	if !ok {
+		return
+	}
+
+	compressed := c.appendCompressed(nil, body)
+	resp.SetBody(compressed)
+	resp.Header.SetContentLength(len(compressed))
+	resp.Header.Set("Content-Encoding", c.encoding)
+	if etag := header("ETag"); etag != "" {
+		resp.Header.Set("ETag", weakenETag(etag))
+	}
+}
+
+// compressResponse prepares a net/http response, whose headers are in
+// w.Header() but not written yet, for compression toward the client of r, and
+// returns where its body is to be written: w itself, or an encoder over it
+// that close flushes. length is the body's length, -1 when unknown.
+func compressResponse(w http.ResponseWriter, r *http.Request, p ProxyConfig, status int, length int64) (io.Writer, func()) {
+	h := w.Header()
+	if !compressible(p, status, h.Get, length) {
+		return w, func() {}
+	}
+	if vary := varyAcceptEncoding(strings.Join(h.Values("Vary"), ", ")); vary != "" {
+		h.Set("Vary", vary)
+	}
+	c, ok := compressorFor(p, []byte(strings.Join(r.Header.Values("Accept-Encoding"), ",")))
+	if !ok || r.Method == http.MethodHead {
+		return w, func() {}
+	}
+
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", c.encoding)
+	if etag := h.Get("ETag"); etag != "" {
+		h.Set("ETag", weakenETag(etag))
+	}
+	encoder := c.encoder(w)
+	return encoder, func() {
+		encoder.Close()
+		c.release(encoder)
+	}
+}
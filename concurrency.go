@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// defaultQueueTimeout is how long a request waits for a route's concurrency slot
+// when queue_timeout is not set
+const defaultQueueTimeout = time.Second
+
+// concurrencyLimiter caps the requests of a route in flight to its upstreams.
+// Requests beyond the cap wait in a queue of limited depth for a slot to free up,
+// and are turned away when the queue is full or their wait times out.
+type concurrencyLimiter struct {
+	config  RouteConcurrencyConfig
+	timeout time.Duration
+	slots   chan struct{} // one per request in flight
+	queued  atomic.Int64
+}
+
+// newConcurrencyLimiter creates the limiter of a route, or returns nil when the
+// route's concurrency is not limited
+func newConcurrencyLimiter(config RouteConcurrencyConfig) *concurrencyLimiter {
+	if config.MaxInFlight <= 0 {
+		return nil
+	}
+	timeout := config.QueueTimeout
+	if timeout <= 0 {
+		timeout = defaultQueueTimeout
+	}
+	return &concurrencyLimiter{
+		config:  config,
+		timeout: timeout,
+		slots:   make(chan struct{}, config.MaxInFlight),
+	}
+}
+
+// TryAcquire takes a free slot for a request without waiting, reporting false when
+// all are taken. A nil limiter admits every request.
+func (l *concurrencyLimiter) TryAcquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Acquire takes a slot for a request, waiting in the queue when all are taken. It
+// reports false when the queue is full, the wait times out or done is closed, as
+// when the client went away. A nil limiter admits every request.
+func (l *concurrencyLimiter) Acquire(done <-chan struct{}) bool {
+	if l.TryAcquire() {
+		return true
+	}
+
+	if l.queued.Add(1) > int64(l.config.QueueDepth) {
+		l.queued.Add(-1)
+		return false
+	}
+	defer l.queued.Add(-1)
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-done:
+		return false
+	}
+}
+
+// Release frees a slot taken by Acquire
+func (l *concurrencyLimiter) Release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
+
+// Concurrency returns the concurrency limiter of the route, nil when it has none
+func (r *Route) Concurrency() *concurrencyLimiter {
+	if r == nil {
+		return nil
+	}
+	return r.concurrency
+}
+
+// InheritConcurrency keeps the limiters of routes whose name and limits did not
+// change, so that requests in flight during a reload still count
+func (rt *Router) InheritConcurrency(previous *Router) {
+	if rt == nil || previous == nil {
+		return
+	}
+	for _, route := range rt.routes {
+		for _, old := range previous.routes {
+			if old.Name == route.Name && old.concurrency != nil && route.concurrency != nil &&
+				old.concurrency.config == route.concurrency.config {
+				route.concurrency = old.concurrency
+				break
+			}
+		}
+	}
+}
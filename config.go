@@ -11,45 +11,198 @@ import (
 )
 
 type Config struct {
-	Servers            []ServerConfig       `mapstructure:"servers"`
-	Upstreams          []UpstreamConfig     `mapstructure:"upstreams"`
-	WebSocketUpstreams []UpstreamConfig     `mapstructure:"websocket_upstreams"`
-	LoadBalancer       LoadBalancerConfig   `mapstructure:"load_balancer"`
-	Logging            LoggingConfig        `mapstructure:"logging"`
-	Proxy              ProxyConfig          `mapstructure:"proxy"`
-	CORS               CORSConfig           `mapstructure:"cors"`
-	GlobalDefaults     *GlobalDefaults      `mapstructure:"global_defaults"`
+	Servers            []ServerConfig        `mapstructure:"servers"`
+	Upstreams          []UpstreamConfig      `mapstructure:"upstreams"`
+	WebSocketUpstreams []UpstreamConfig      `mapstructure:"websocket_upstreams"`
+	LoadBalancer       LoadBalancerConfig    `mapstructure:"load_balancer"`
+	Logging            LoggingConfig         `mapstructure:"logging"`
+	Proxy              ProxyConfig           `mapstructure:"proxy"`
+	CORS               CORSConfig            `mapstructure:"cors"`
+	SecurityHeaders    SecurityHeadersConfig `mapstructure:"security_headers"`
+	RateLimit          RateLimitConfig       `mapstructure:"rate_limit"`
+	Access             AccessConfig          `mapstructure:"access"`
+	UserAgents         UserAgentConfig       `mapstructure:"user_agents"`
+	APIKeys            APIKeyConfig          `mapstructure:"api_keys"`
+	Signatures         SignatureConfig       `mapstructure:"signatures"`
+	OAuth2             OAuth2Config          `mapstructure:"oauth2"`
+	Cache              CacheConfig           `mapstructure:"cache"`
+	LoadShedding       LoadSheddingConfig    `mapstructure:"load_shedding"`
+	Maintenance        MaintenanceConfig     `mapstructure:"maintenance"`
+	RequestHeaders     HeaderRulesConfig     `mapstructure:"request_headers"`
+	ErrorPages         ErrorPagesConfig      `mapstructure:"error_pages"`
+	Admin              AdminConfig           `mapstructure:"admin"`
+	Reload             ReloadConfig          `mapstructure:"reload"`
+	Include            []string              `mapstructure:"include"` // Glob patterns of extra upstream files, relative to the config file
+	GlobalDefaults     *GlobalDefaults       `mapstructure:"global_defaults"`
+
+	// Warnings lists non-fatal problems found while loading, such as unknown keys
+	Warnings []string `mapstructure:"-"`
 }
 
 // GlobalDefaults contains fallback configurations
 type GlobalDefaults struct {
-	LoadBalancer LoadBalancerConfig `mapstructure:"load_balancer"`
-	Logging      LoggingConfig      `mapstructure:"logging"`
-	Proxy        ProxyConfig        `mapstructure:"proxy"`
-	CORS         CORSConfig         `mapstructure:"cors"`
+	LoadBalancer    LoadBalancerConfig    `mapstructure:"load_balancer"`
+	Logging         LoggingConfig         `mapstructure:"logging"`
+	Proxy           ProxyConfig           `mapstructure:"proxy"`
+	CORS            CORSConfig            `mapstructure:"cors"`
+	SecurityHeaders SecurityHeadersConfig `mapstructure:"security_headers"`
+	RateLimit       RateLimitConfig       `mapstructure:"rate_limit"`
+	Access          AccessConfig          `mapstructure:"access"`
+	UserAgents      UserAgentConfig       `mapstructure:"user_agents"`
+	APIKeys         APIKeyConfig          `mapstructure:"api_keys"`
+	Signatures      SignatureConfig       `mapstructure:"signatures"`
+	OAuth2          OAuth2Config          `mapstructure:"oauth2"`
+	Cache           CacheConfig           `mapstructure:"cache"`
+	LoadShedding    LoadSheddingConfig    `mapstructure:"load_shedding"`
+	Maintenance     MaintenanceConfig     `mapstructure:"maintenance"`
+	RequestHeaders  HeaderRulesConfig     `mapstructure:"request_headers"`
+	ErrorPages      ErrorPagesConfig      `mapstructure:"error_pages"`
+}
+
+// IncludeFileConfig represents a file pulled in by the include directive
+type IncludeFileConfig struct {
+	Upstreams          []UpstreamConfig `mapstructure:"upstreams"`
+	WebSocketUpstreams []UpstreamConfig `mapstructure:"websocket_upstreams"`
 }
 
 // ServerFileConfig represents a single server configuration file
 type ServerFileConfig struct {
-	Server       ServerConfig       `mapstructure:"server"`
-	LoadBalancer LoadBalancerConfig `mapstructure:"load_balancer"`
-	Logging      LoggingConfig      `mapstructure:"logging"`
-	Proxy        ProxyConfig        `mapstructure:"proxy"`
-	CORS         CORSConfig         `mapstructure:"cors"`
+	Server          ServerConfig          `mapstructure:"server"`
+	LoadBalancer    LoadBalancerConfig    `mapstructure:"load_balancer"`
+	Logging         LoggingConfig         `mapstructure:"logging"`
+	Proxy           ProxyConfig           `mapstructure:"proxy"`
+	CORS            CORSConfig            `mapstructure:"cors"`
+	SecurityHeaders SecurityHeadersConfig `mapstructure:"security_headers"`
+	RateLimit       RateLimitConfig       `mapstructure:"rate_limit"`
+	Access          AccessConfig          `mapstructure:"access"`
+	UserAgents      UserAgentConfig       `mapstructure:"user_agents"`
+	APIKeys         APIKeyConfig          `mapstructure:"api_keys"`
+	Signatures      SignatureConfig       `mapstructure:"signatures"`
+	OAuth2          OAuth2Config          `mapstructure:"oauth2"`
+	Cache           CacheConfig           `mapstructure:"cache"`
+	LoadShedding    LoadSheddingConfig    `mapstructure:"load_shedding"`
+	Maintenance     MaintenanceConfig     `mapstructure:"maintenance"`
+	RequestHeaders  HeaderRulesConfig     `mapstructure:"request_headers"`
+	ErrorPages      ErrorPagesConfig      `mapstructure:"error_pages"`
+	Routes          []RouteConfig         `mapstructure:"routes"`
 }
 
 type ServerConfig struct {
-	Name          string              `mapstructure:"name"`
-	Port          int                 `mapstructure:"port"`
-	Host          string              `mapstructure:"host"`
-	WebSocketPort int                 `mapstructure:"websocket_port"`
-	Upstreams     []string            `mapstructure:"upstreams"`
-	Enabled       bool                `mapstructure:"enabled"`
+	Name          string        `mapstructure:"name"`
+	Port          int           `mapstructure:"port"`
+	Host          string        `mapstructure:"host"`
+	WebSocketPort int           `mapstructure:"websocket_port"`
+	Upstreams     []string      `mapstructure:"upstreams"`
+	Enabled       bool          `mapstructure:"enabled"`
+	Routes        []RouteConfig `mapstructure:"routes"`
+	// Instead of host and port, the server can listen on a Unix socket or on a
+	// socket opened by systemd socket activation
+	UnixSocket    string `mapstructure:"unix_socket"`    // Path of the Unix socket
+	SystemdSocket string `mapstructure:"systemd_socket"` // FileDescriptorName= of the systemd socket unit
 	// Per-server configurations (optional, falls back to global if not set)
-	LoadBalancer  *LoadBalancerConfig `mapstructure:"load_balancer,omitempty"`
-	Logging       *LoggingConfig      `mapstructure:"logging,omitempty"`
-	Proxy         *ProxyConfig        `mapstructure:"proxy,omitempty"`
-	CORS          *CORSConfig         `mapstructure:"cors,omitempty"`
+	LoadBalancer    *LoadBalancerConfig    `mapstructure:"load_balancer,omitempty"`
+	Logging         *LoggingConfig         `mapstructure:"logging,omitempty"`
+	Proxy           *ProxyConfig           `mapstructure:"proxy,omitempty"`
+	CORS            *CORSConfig            `mapstructure:"cors,omitempty"`
+	SecurityHeaders *SecurityHeadersConfig `mapstructure:"security_headers,omitempty"`
+	RateLimit       *RateLimitConfig       `mapstructure:"rate_limit,omitempty"`
+	Access          *AccessConfig          `mapstructure:"access,omitempty"`
+	UserAgents      *UserAgentConfig       `mapstructure:"user_agents,omitempty"`
+	APIKeys         *APIKeyConfig          `mapstructure:"api_keys,omitempty"`
+	Signatures      *SignatureConfig       `mapstructure:"signatures,omitempty"`
+	OAuth2          *OAuth2Config          `mapstructure:"oauth2,omitempty"`
+	Cache           *CacheConfig           `mapstructure:"cache,omitempty"`
+	LoadShedding    *LoadSheddingConfig    `mapstructure:"load_shedding,omitempty"`
+	Maintenance     *MaintenanceConfig     `mapstructure:"maintenance,omitempty"`
+	RequestHeaders  *HeaderRulesConfig     `mapstructure:"request_headers,omitempty"`
+	ErrorPages      *ErrorPagesConfig      `mapstructure:"error_pages,omitempty"`
+}
+
+// RouteConfig configures a path prefix of a server
+type RouteConfig struct {
+	Name            string                 `mapstructure:"name"`             // Route name used in logs and metrics (defaults to the prefix)
+	PathPrefix      string                 `mapstructure:"path_prefix"`      // Requests whose path starts with this prefix use the route
+	Latency         time.Duration          `mapstructure:"latency"`          // Synthetic delay added before forwarding (staging parity)
+	Jitter          time.Duration          `mapstructure:"jitter"`           // Maximum random delay added on top of latency
+	JitterSeed      int64                  `mapstructure:"jitter_seed"`      // Seed for the jitter sequence, making delays reproducible
+	RateLimit       RateLimitRule          `mapstructure:"rate_limit"`       // Limits of this route, applied after the server's
+	Access          AccessConfig           `mapstructure:"access"`           // Client IP lists of this route, applied after the server's
+	BasicAuth       BasicAuthConfig        `mapstructure:"basic_auth"`       // Require HTTP Basic credentials for this route
+	SecurityHeaders SecurityHeadersConfig  `mapstructure:"security_headers"` // Security headers of this route, overriding the server's
+	CORSPassthrough bool                   `mapstructure:"cors_passthrough"` // Forward preflights to the upstream, which handles CORS itself
+	GRPCWeb         bool                   `mapstructure:"grpc_web"`         // Translate gRPC-Web requests to gRPC for an h2 or h2c upstream
+	Cache           RouteCacheConfig       `mapstructure:"cache"`            // Cache policy of this route, overriding the server's
+	CacheKey        CacheKeyConfig         `mapstructure:"cache_key"`        // Request components cached responses of this route are told apart by
+	Compression     RouteCompressionConfig `mapstructure:"compression"`      // Compression levels of this route, overriding the server's
+	Mirror          RouteMirrorConfig      `mapstructure:"mirror"`           // Shadow upstream receiving copies of this route's requests
+	Concurrency     RouteConcurrencyConfig `mapstructure:"concurrency"`      // Requests of this route in flight to upstreams at once
+	Maintenance     MaintenanceConfig      `mapstructure:"maintenance"`      // Maintenance page of this route, unset fields falling back to the server's
+	Fallback        FallbackConfig         `mapstructure:"fallback"`         // Response when no upstream of this route is healthy, instead of a plain 503
+	RequestHeaders  HeaderRulesConfig      `mapstructure:"request_headers"`  // Header rules applied after the server's
+	StripPrefix     bool                   `mapstructure:"strip_prefix"`     // Remove path_prefix from the path sent to the upstream
+	Rewrite         []PathRewriteConfig    `mapstructure:"rewrite"`          // Regex rewrites of the path sent to the upstream, the first match applying
+	CookieDomain    []CookieRewriteConfig  `mapstructure:"cookie_domain"`    // Rewrites of the Domain of cookies the upstream sets, the first match applying
+	CookiePath      []CookieRewriteConfig  `mapstructure:"cookie_path"`      // Rewrites of the Path of cookies the upstream sets, the first match applying
+	// Retries of failed upstream requests, overriding the load balancer's when set
+	MaxRetries         *int           `mapstructure:"max_retries"`
+	RetryNonIdempotent *bool          `mapstructure:"retry_non_idempotent"`
+	RetryOnStatus      []int          `mapstructure:"retry_on_status"`
+	TryTimeout         *time.Duration `mapstructure:"try_timeout"`
+	// Weighted split of the route's requests between groups of the server's
+	// upstreams, e.g. for canary releases
+	Split       []TrafficSplitConfig `mapstructure:"split"`
+	SplitSticky bool                 `mapstructure:"split_sticky"` // Keep each client in one group, by affinity key or IP
+	SplitCookie string               `mapstructure:"split_cookie"` // Cookie the proxy sets to keep each browser in its group
+}
+
+// TrafficSplitConfig is an upstream group of a route's traffic split. A group
+// with a match rule takes every request carrying its header or cookie,
+// whatever the weights.
+type TrafficSplitConfig struct {
+	Name        string   `mapstructure:"name"`         // Group name, used by the admin API and split_cookie
+	Upstreams   []string `mapstructure:"upstreams"`    // Names of the server's upstreams in the group
+	Weight      int      `mapstructure:"weight"`       // Share of requests relative to the other groups, e.g. 95 and 5
+	MatchHeader string   `mapstructure:"match_header"` // Header selecting the group, e.g. X-Beta
+	MatchCookie string   `mapstructure:"match_cookie"` // Cookie selecting the group
+	MatchValue  string   `mapstructure:"match_value"`  // Value the header or cookie must have, any non-empty one when unset
+}
+
+// RouteConcurrencyConfig caps the requests of a route in flight to its upstreams,
+// queueing the excess briefly
+type RouteConcurrencyConfig struct {
+	MaxInFlight  int           `mapstructure:"max_in_flight"` // Requests forwarded at once, 0 for no limit
+	QueueDepth   int           `mapstructure:"queue_depth"`   // Requests waiting for a slot before more get 503, 0 for no queue
+	QueueTimeout time.Duration `mapstructure:"queue_timeout"` // Time a request waits for a slot before it gets 503 (default 1s)
+}
+
+// RouteMirrorConfig sends copies of a route's requests, or a sample of them, to
+// a shadow upstream, whose responses are discarded
+type RouteMirrorConfig struct {
+	Upstream    string        `mapstructure:"upstream"`      // Name of the shadow upstream, any of [[upstreams]]
+	Timeout     time.Duration `mapstructure:"timeout"`       // Time a mirrored request may take (default: the upstream's request timeout)
+	MaxInFlight int           `mapstructure:"max_in_flight"` // Mirrored requests pending at once before more are skipped (default 100)
+	SampleRate  float64       `mapstructure:"sample_rate"`   // Share of the selected requests mirrored, e.g. 0.01 for 1% (default 1: all)
+	Methods     []string      `mapstructure:"methods"`       // Methods mirrored, e.g. ["GET", "HEAD"] (default: all)
+	Paths       []string      `mapstructure:"paths"`         // Path prefixes mirrored within the route (default: all)
+}
+
+// RouteCompressionConfig sets the compression levels of a route's responses,
+// zero keeping the server's
+type RouteCompressionConfig struct {
+	GzipLevel     int `mapstructure:"gzip_level"`     // 1 (fastest) to 9 (smallest)
+	BrotliQuality int `mapstructure:"brotli_quality"` // 1 (fastest) to 11 (smallest)
+	ZstdLevel     int `mapstructure:"zstd_level"`     // 1 (fastest) to 4 (smallest)
+}
+
+// BasicAuthConfig protects a route with HTTP Basic authentication.
+// Users are "name:hash" entries with bcrypt hashes, as written by htpasswd -B.
+type BasicAuthConfig struct {
+	Realm        string   `mapstructure:"realm"`         // Realm shown by browsers (default "Restricted")
+	Users        []string `mapstructure:"users"`         // Inline user:bcrypt-hash entries
+	HtpasswdFile string   `mapstructure:"htpasswd_file"` // htpasswd file with more entries, re-read on reload
+
+	// htpasswd holds the entries read from HtpasswdFile
+	htpasswd []string
 }
 
 type UpstreamConfig struct {
@@ -57,72 +210,496 @@ type UpstreamConfig struct {
 	URL         string `mapstructure:"url"`
 	Weight      int    `mapstructure:"weight"`
 	HealthCheck string `mapstructure:"health_check"`
+	// Concurrent connections (WebSocket sessions, or in-flight requests) the upstream accepts, 0 for no limit
+	MaxConnections int `mapstructure:"max_connections"`
+	// Per-upstream overrides of the server's proxy settings (zero keeps the server value)
+	ConnectTimeout      time.Duration `mapstructure:"connect_timeout"`       // Timeout for establishing connections
+	TLSHandshakeTimeout time.Duration `mapstructure:"tls_handshake_timeout"` // Timeout for the TLS handshake, connect_timeout when unset
+	FirstByteTimeout    time.Duration `mapstructure:"first_byte_timeout"`    // Wait for the first byte of a response once the request is sent, 0 for none
+	RequestTimeout      time.Duration `mapstructure:"request_timeout"`       // Timeout for requests to this upstream
+	MaxConnsPerHost     int           `mapstructure:"max_conns_per_host"`    // Maximum connections to this upstream
+	BufferSize          int           `mapstructure:"buffer_size"`           // Read/write buffer size for this upstream
+	Protocol            string        `mapstructure:"protocol"`              // http1 (default), h2 over TLS or cleartext h2c
+}
+
+// Overrides returns the connection settings this upstream overrides
+func (uc UpstreamConfig) Overrides() UpstreamOverrides {
+	return UpstreamOverrides{
+		ConnectTimeout:      uc.ConnectTimeout,
+		TLSHandshakeTimeout: uc.TLSHandshakeTimeout,
+		FirstByteTimeout:    uc.FirstByteTimeout,
+		RequestTimeout:      uc.RequestTimeout,
+		MaxConnsPerHost:     uc.MaxConnsPerHost,
+		BufferSize:          uc.BufferSize,
+		Protocol:            uc.Protocol,
+	}
 }
 
 type LoadBalancerConfig struct {
 	Method     string        `mapstructure:"method"`
 	Timeout    time.Duration `mapstructure:"timeout"`
 	MaxRetries int           `mapstructure:"max_retries"`
+	// Only idempotent methods are retried, unless this allows retrying others whose
+	// body the proxy buffered, for upstreams that deduplicate requests themselves
+	RetryNonIdempotent bool `mapstructure:"retry_non_idempotent"`
+	// Wait before a retry: retry_backoff, doubled after each attempt up to
+	// retry_max_backoff, with random jitter so clients failing together spread out
+	RetryBackoff    time.Duration `mapstructure:"retry_backoff"`     // default 50ms
+	RetryMaxBackoff time.Duration `mapstructure:"retry_max_backoff"` // default 1s
+	RetryOnStatus   []int         `mapstructure:"retry_on_status"`   // Upstream statuses retried like failures, e.g. 502 and 503
+	TryTimeout      time.Duration `mapstructure:"try_timeout"`       // Wait for the response of each attempt, 0 for the request timeout only
+	// Session affinity: "ip", "cookie" or "header" pin clients to the upstream they were first sent to
+	Affinity    string        `mapstructure:"affinity"`
+	AffinityKey string        `mapstructure:"affinity_key"` // Cookie or header name identifying the client
+	AffinityTTL time.Duration `mapstructure:"affinity_ttl"` // How long an idle client stays pinned
 }
 
 type LoggingConfig struct {
-	Level string `mapstructure:"level"`
-	File  string `mapstructure:"file"`
+	Level     string `mapstructure:"level"`
+	File      string `mapstructure:"file"`
+	AccessLog bool   `mapstructure:"access_log"` // Write one log entry per handled request
 }
 
 type ProxyConfig struct {
-	MaxBodySize         int64         `mapstructure:"max_body_size"`          // Maximum request body size in bytes
-	RequestTimeout      time.Duration `mapstructure:"request_timeout"`       // Request timeout
-	ResponseTimeout     time.Duration `mapstructure:"response_timeout"`      // Response timeout
-	MaxHeaderSize       int           `mapstructure:"max_header_size"`       // Maximum header size in bytes
-	KeepAliveTimeout    time.Duration `mapstructure:"keep_alive_timeout"`    // Keep-alive timeout
-	MaxConnections      int           `mapstructure:"max_connections"`       // Maximum concurrent connections
-	BufferSize          int           `mapstructure:"buffer_size"`           // Buffer size for reading/writing
-	EnableCompression   bool          `mapstructure:"enable_compression"`    // Enable gzip compression
-	MaxIdleConns        int           `mapstructure:"max_idle_conns"`        // Maximum idle connections in pool
+	MaxBodySize         int64         `mapstructure:"max_body_size"`           // Maximum request body size in bytes
+	RequestTimeout      time.Duration `mapstructure:"request_timeout"`         // Request timeout
+	ResponseTimeout     time.Duration `mapstructure:"response_timeout"`        // Response timeout
+	MaxHeaderSize       int           `mapstructure:"max_header_size"`         // Maximum header size in bytes
+	KeepAliveTimeout    time.Duration `mapstructure:"keep_alive_timeout"`      // Keep-alive timeout
+	HeaderReadTimeout   time.Duration `mapstructure:"header_read_timeout"`     // Time a client may take to send request headers
+	BodyReadTimeout     time.Duration `mapstructure:"body_read_timeout"`       // Time a client may take to send the request body
+	RequestReadTimeout  time.Duration `mapstructure:"request_read_timeout"`    // Total time a client may take to send a request
+	MaxConnections      int           `mapstructure:"max_connections"`         // Maximum concurrent connections
+	MaxConnectionsPerIP int           `mapstructure:"max_connections_per_ip"`  // Maximum open connections per client IP (0 = unlimited)
+	BufferSize          int           `mapstructure:"buffer_size"`             // Buffer size for reading/writing
+	EnableCompression   bool          `mapstructure:"enable_compression"`      // Compress responses for clients accepting it
+	MaxIdleConns        int           `mapstructure:"max_idle_conns"`          // Maximum idle connections in pool
 	MaxIdleConnsPerHost int           `mapstructure:"max_idle_conns_per_host"` // Maximum idle connections per host
-	MaxConnsPerHost     int           `mapstructure:"max_conns_per_host"`    // Maximum connections per host
-	IdleConnTimeout     time.Duration `mapstructure:"idle_conn_timeout"`     // Idle connection timeout
+	MaxConnsPerHost     int           `mapstructure:"max_conns_per_host"`      // Maximum connections per host
+	IdleConnTimeout     time.Duration `mapstructure:"idle_conn_timeout"`       // Idle connection timeout
+	// Content codings responses are compressed with when enable_compression is on
+	CompressionEncodings []string `mapstructure:"compression_encodings"` // Preferred first among those the client weighs equally (default br, zstd, gzip)
+	GzipLevel            int      `mapstructure:"gzip_level"`            // 1 (fastest) to 9 (smallest), default 6
+	BrotliQuality        int      `mapstructure:"brotli_quality"`        // 1 (fastest) to 11 (smallest), default 4
+	ZstdLevel            int      `mapstructure:"zstd_level"`            // 1 (fastest) to 4 (smallest), default 2
+	CompressionTypes     []string `mapstructure:"compression_types"`     // Media types compressed, type/* matching a whole type (default text and structured data)
+	CompressionMinSize   int64    `mapstructure:"compression_min_size"`  // Smallest body compressed in bytes (default 256)
+	// passthrough (default) sends the client's Accept-Encoding on; identity and
+	// decompress have upstreams send plain bodies, or gzip ones the proxy decodes,
+	// so that the cache and compression work on plain bodies
+	UpstreamEncoding string `mapstructure:"upstream_encoding"`
 	// Protocol support
 	EnableHTTP2         bool          `mapstructure:"enable_http2"`          // Enable HTTP/2 support
 	EnableHTTP3         bool          `mapstructure:"enable_http3"`          // Enable HTTP/3 support
+	EnableH2C           bool          `mapstructure:"enable_h2c"`            // Serve HTTP/2 without TLS (h2c)
 	EnableWebSocket     bool          `mapstructure:"enable_websocket"`      // Enable WebSocket support
 	HTTP3Port           int           `mapstructure:"http3_port"`            // HTTP/3 UDP port
 	TLSCertFile         string        `mapstructure:"tls_cert_file"`         // TLS certificate file for HTTPS/HTTP2/HTTP3
 	TLSKeyFile          string        `mapstructure:"tls_key_file"`          // TLS private key file
 	WebSocketTimeout    time.Duration `mapstructure:"websocket_timeout"`     // WebSocket connection timeout
 	WebSocketBufferSize int           `mapstructure:"websocket_buffer_size"` // WebSocket buffer size
+	// Keepalive: pings detect dead peers, the idle timeout closes connections carrying no data
+	WebSocketPingInterval time.Duration `mapstructure:"websocket_ping_interval"` // Ping both sides this often
+	WebSocketIdleTimeout  time.Duration `mapstructure:"websocket_idle_timeout"`  // Close after this long without data (0 never)
+	// Caps concurrent WebSocket sessions so a spike cannot exhaust the proxy's memory
+	WebSocketMaxConnections int `mapstructure:"websocket_max_connections"` // 0 for no limit
+	// Client handshake headers passed on when dialing the upstream (the gnet listener passes all)
+	WebSocketForwardHeaders []string `mapstructure:"websocket_forward_headers"`
+	// permessage-deflate, negotiated with clients and upstreams when enabled
+	WebSocketCompression      bool `mapstructure:"websocket_compression"`       // Offer and accept permessage-deflate
+	WebSocketCompressionLevel int  `mapstructure:"websocket_compression_level"` // Deflate level, 1 (fastest) to 9 (smallest)
+	// Open sessions are sent 1001 Going Away on shutdown and given this long to close
+	WebSocketDrainTimeout time.Duration `mapstructure:"websocket_drain_timeout"`
+	// QUIC transport of the HTTP/3 server; zero keeps quic-go's default
+	QUICMaxIdleTimeout          time.Duration `mapstructure:"quic_max_idle_timeout"`          // Close silent connections after this long (default keep_alive_timeout)
+	QUICMaxStreams              int           `mapstructure:"quic_max_streams"`               // Concurrent request streams per connection (default 100)
+	QUICMaxUniStreams           int           `mapstructure:"quic_max_uni_streams"`           // Concurrent unidirectional streams per connection (default 100)
+	QUICStreamReceiveWindow     int           `mapstructure:"quic_stream_receive_window"`     // Largest receive window of a stream in bytes (default 6MB)
+	QUICConnectionReceiveWindow int           `mapstructure:"quic_connection_receive_window"` // Largest receive window of a connection in bytes (default 15MB)
+	QUICDatagrams               bool          `mapstructure:"quic_datagrams"`                 // Enable HTTP/3 datagrams (RFC 9297)
+	// 0-RTT early data can be replayed by an attacker, so only the listed methods are
+	// served from it and other requests are answered 425 Too Early
+	QUIC0RTT        bool     `mapstructure:"quic_0rtt"`         // Accept 0-RTT early data on the HTTP/3 server
+	QUIC0RTTMethods []string `mapstructure:"quic_0rtt_methods"` // Idempotent methods served from early data (default GET, HEAD, OPTIONS)
+	// Bodies of unknown length or above stream_threshold are relayed in buffer_size
+	// chunks on the gnet listener instead of being held whole in memory
+	StreamBodies    bool  `mapstructure:"stream_bodies"`    // Stream large request and response bodies
+	StreamThreshold int64 `mapstructure:"stream_threshold"` // Largest body still buffered, in bytes (default 1MB)
+	// Headers describing the client's request to upstreams, next to Via
+	ForwardedHeaders string `mapstructure:"forwarded_headers"` // x_forwarded (default), forwarded (RFC 7239) or both
+	// Proxies in front of the server whose X-Forwarded-For and Forwarded headers are
+	// extended; anyone else's are replaced, since clients can forge them
+	TrustedProxies []string `mapstructure:"trusted_proxies"` // IP addresses and CIDR networks
+	// Location headers naming an upstream are pointed back at the scheme and host
+	// the client used, so redirects do not lead clients to internal addresses
+	RewriteLocation bool `mapstructure:"rewrite_location"`
+	// Header telling upstreams how long they have left to answer, so they can drop
+	// work the proxy will not wait for: milliseconds, or gRPC's format for grpc-timeout
+	DeadlineHeader string `mapstructure:"deadline_header"` // e.g. X-Request-Timeout-Ms, none when empty
+	// Connections start with a PROXY protocol (v1 or v2) header carrying the client's
+	// address, as sent by L4 balancers such as AWS NLB; required on every connection
+	ProxyProtocol bool `mapstructure:"proxy_protocol"`
+	// Request paths are checked before routing, so that upstreams resolving %2e%2e
+	// or dot segments themselves cannot be reached past the routes
+	PathNormalization string `mapstructure:"path_normalization"` // off (default), normalize or reject
+	// Resolution of upstream host names, by the system's nameservers unless set
+	DNSServers  []string      `mapstructure:"dns_servers"`   // Nameservers queried in turn, as IP or IP:port
+	DNSTimeout  time.Duration `mapstructure:"dns_timeout"`   // Bounds each lookup (default: the dial timeout)
+	DNSCacheTTL time.Duration `mapstructure:"dns_cache_ttl"` // How long resolved addresses are reused on the gnet listener (default 10m)
+}
+
+type AdminConfig struct {
+	Enabled      bool               `mapstructure:"enabled"`        // Enable the admin API
+	Host         string             `mapstructure:"host"`           // Admin API listen host
+	Port         int                `mapstructure:"port"`           // Admin API listen port
+	Token        string             `mapstructure:"token"`          // Bearer token accepted on admin requests (audited as "admin")
+	TokenFile    string             `mapstructure:"token_file"`     // Read the token from a file (Docker/Kubernetes secrets)
+	Tokens       []AdminTokenConfig `mapstructure:"tokens"`         // Additional named bearer tokens, audited by name
+	TLSCertFile  string             `mapstructure:"tls_cert_file"`  // Serve the admin API over TLS
+	TLSKeyFile   string             `mapstructure:"tls_key_file"`   // TLS private key of the admin API
+	ClientCAFile string             `mapstructure:"client_ca_file"` // CA verifying client certificates (mTLS)
+	AuditLog     string             `mapstructure:"audit_log"`      // Audit log file (default logs/admin-audit.log)
+}
+
+// ReloadConfig controls automatic configuration reloads
+type ReloadConfig struct {
+	Watch    bool          `mapstructure:"watch"`    // Reload automatically when configuration files change
+	Debounce time.Duration `mapstructure:"debounce"` // Quiet period after the last change before reloading (default 1s)
+}
+
+// AdminTokenConfig is a named bearer token for the admin API
+type AdminTokenConfig struct {
+	Name      string `mapstructure:"name"`
+	Token     string `mapstructure:"token"`
+	TokenFile string `mapstructure:"token_file"` // Read the token from a file instead
 }
 
 type CORSConfig struct {
-	Enabled          bool     `mapstructure:"enabled"`            // Enable CORS
-	AllowedOrigins   []string `mapstructure:"allowed_origins"`    // Allowed origins
-	AllowedMethods   []string `mapstructure:"allowed_methods"`    // Allowed HTTP methods
-	AllowedHeaders   []string `mapstructure:"allowed_headers"`    // Allowed headers
-	ExposedHeaders   []string `mapstructure:"exposed_headers"`    // Exposed headers
-	AllowCredentials bool     `mapstructure:"allow_credentials"`  // Allow credentials
-	MaxAge           int      `mapstructure:"max_age"`            // Preflight cache duration in seconds
+	Enabled          bool     `mapstructure:"enabled"`           // Enable CORS
+	AllowedOrigins   []string `mapstructure:"allowed_origins"`   // Allowed origins
+	AllowedMethods   []string `mapstructure:"allowed_methods"`   // Allowed HTTP methods
+	AllowedHeaders   []string `mapstructure:"allowed_headers"`   // Allowed headers
+	ExposedHeaders   []string `mapstructure:"exposed_headers"`   // Exposed headers
+	AllowCredentials bool     `mapstructure:"allow_credentials"` // Allow credentials
+	MaxAge           int      `mapstructure:"max_age"`           // Preflight cache duration in seconds
+	// Private Network Access: answer Access-Control-Request-Private-Network preflights
+	AllowPrivateNetwork   bool     `mapstructure:"allow_private_network"`   // Allow public sites to reach this (private) server
+	PrivateNetworkOrigins []string `mapstructure:"private_network_origins"` // Origins allowed to do so (empty allows every allowed origin)
+}
+
+// RateLimitConfig limits requests with token buckets
+type RateLimitConfig struct {
+	Enabled bool `mapstructure:"enabled"` // Enable rate limiting
+
+	// Limits of HTTP requests
+	RateLimitRule `mapstructure:",squash"`
+
+	// Limits of WebSocket upgrades, separate from HTTP requests
+	WebSocket RateLimitRule `mapstructure:"websocket"`
+}
+
+// RateLimitRule is a token bucket per client IP and one shared by all clients.
+// A zero rate disables that bucket; a zero burst defaults to the rate.
+type RateLimitRule struct {
+	RequestsPerSecond       float64 `mapstructure:"requests_per_second"`        // Sustained requests per second per client IP
+	Burst                   int     `mapstructure:"burst"`                      // Requests a client IP may send at once
+	GlobalRequestsPerSecond float64 `mapstructure:"global_requests_per_second"` // Sustained requests per second of all clients together
+	GlobalBurst             int     `mapstructure:"global_burst"`               // Requests all clients may send at once
+}
+
+// SecurityHeadersConfig adds security headers to proxied responses. Empty values
+// are not sent.
+type SecurityHeadersConfig struct {
+	HSTS                  string `mapstructure:"hsts"`                    // Strict-Transport-Security, e.g. "max-age=63072000; includeSubDomains"
+	ContentTypeOptions    string `mapstructure:"content_type_options"`    // X-Content-Type-Options, e.g. "nosniff"
+	FrameOptions          string `mapstructure:"frame_options"`           // X-Frame-Options, e.g. "DENY"
+	ContentSecurityPolicy string `mapstructure:"content_security_policy"` // Content-Security-Policy
+	ReferrerPolicy        string `mapstructure:"referrer_policy"`         // Referrer-Policy, e.g. "strict-origin-when-cross-origin"
+	Override              bool   `mapstructure:"override"`                // Replace headers the upstream already set (kept by default)
+}
+
+// AccessConfig admits or rejects clients by IP address or CIDR network.
+// Denied clients are always rejected; a non-empty allow list admits only its clients.
+type AccessConfig struct {
+	Allow []string `mapstructure:"allow"` // IPs and CIDRs allowed to connect (empty allows everyone)
+	Deny  []string `mapstructure:"deny"`  // IPs and CIDRs rejected with 403
+}
+
+// UserAgentConfig rejects clients by User-Agent. Patterns are case-insensitive
+// regular expressions matched anywhere in the header; an agent matching an allow
+// pattern is never rejected by a deny pattern, so known crawlers can be exempted.
+type UserAgentConfig struct {
+	Deny       []string `mapstructure:"deny"`        // Patterns of rejected agents
+	Allow      []string `mapstructure:"allow"`       // Patterns exempted from the deny patterns
+	BlockEmpty bool     `mapstructure:"block_empty"` // Reject requests without a User-Agent
+	Status     int      `mapstructure:"status"`      // Status of rejected requests (default 403)
+	Body       string   `mapstructure:"body"`        // Body of rejected requests (default "Forbidden")
+}
+
+// APIKeyConfig requires clients to present an API key
+type APIKeyConfig struct {
+	Enabled    bool          `mapstructure:"enabled"`     // Require an API key on every request of the server
+	Header     string        `mapstructure:"header"`      // Header carrying the key (default X-API-Key)
+	QueryParam string        `mapstructure:"query_param"` // Query parameter carrying the key when the header is absent (disabled if empty)
+	Keys       []APIKeyEntry `mapstructure:"keys"`        // Inline keys
+	KeysFile   string        `mapstructure:"keys_file"`   // TOML file with more [[keys]], re-read on reload
+
+	// fileKeys holds the keys read from KeysFile
+	fileKeys []APIKeyEntry
+}
+
+// APIKeyEntry is a single API key with what it may access
+type APIKeyEntry struct {
+	Name              string   `mapstructure:"name"`                // Key name used in logs
+	Key               string   `mapstructure:"key"`                 // The secret value clients send
+	Routes            []string `mapstructure:"routes"`              // Route names the key may use (empty allows all)
+	RequestsPerSecond float64  `mapstructure:"requests_per_second"` // Sustained requests per second of the key (0 = unlimited)
+	Burst             int      `mapstructure:"burst"`               // Requests the key may send at once (defaults to requests_per_second)
+}
+
+// SignatureConfig requires requests to carry an HMAC-SHA256 signature made with the
+// shared secret of a consumer, as webhook senders do
+type SignatureConfig struct {
+	Enabled         bool                `mapstructure:"enabled"`          // Verify signatures before forwarding
+	Header          string              `mapstructure:"header"`           // Header carrying the hex signature, optionally prefixed "sha256=" (default X-Signature)
+	TimestampHeader string              `mapstructure:"timestamp_header"` // Header with the Unix time of signing, included in the signature (disabled if empty)
+	MaxSkew         time.Duration       `mapstructure:"max_skew"`         // How far the timestamp may be from the proxy clock (default 5m)
+	ConsumerHeader  string              `mapstructure:"consumer_header"`  // Header carrying the verified consumer upstream (default X-Signature-Consumer)
+	Routes          []string            `mapstructure:"routes"`           // Route names requiring signatures (empty requires them everywhere)
+	Consumers       []SignatureConsumer `mapstructure:"consumers"`        // Callers and their shared secrets
+}
+
+// SignatureConsumer is a caller allowed to sign requests
+type SignatureConsumer struct {
+	Name       string `mapstructure:"name"`        // Consumer name passed to the upstream
+	Secret     string `mapstructure:"secret"`      // Shared secret (or use secret_file)
+	SecretFile string `mapstructure:"secret_file"` // Read the secret from a file instead
+}
+
+// OAuth2Config validates bearer tokens with an OAuth2 token introspection endpoint (RFC 7662)
+type OAuth2Config struct {
+	Enabled          bool          `mapstructure:"enabled"`            // Require a valid bearer token on every request of the server
+	IntrospectionURL string        `mapstructure:"introspection_url"`  // Token introspection endpoint of the authorization server
+	ClientID         string        `mapstructure:"client_id"`          // Client credentials used to call the endpoint
+	ClientSecret     string        `mapstructure:"client_secret"`      // Client secret (or use client_secret_file)
+	ClientSecretFile string        `mapstructure:"client_secret_file"` // Read the client secret from a file instead
+	RequiredScopes   []string      `mapstructure:"required_scopes"`    // Scopes every token must have
+	CacheTTL         time.Duration `mapstructure:"cache_ttl"`          // How long answers are cached, never past token expiry (default 1m)
+	Timeout          time.Duration `mapstructure:"timeout"`            // Introspection request timeout (default 5s)
+	SubjectHeader    string        `mapstructure:"subject_header"`     // Header carrying the token subject upstream (default X-Auth-Subject)
+	ScopesHeader     string        `mapstructure:"scopes_header"`      // Header carrying the granted scopes upstream (default X-Auth-Scopes)
+}
+
+// CacheConfig keeps upstream responses in memory, so that repeated GET and HEAD
+// requests are answered by the gnet listener without reaching an upstream
+type CacheConfig struct {
+	Enabled   bool          `mapstructure:"enabled"`    // Cache responses of the server
+	MaxMemory int64         `mapstructure:"max_memory"` // Memory budget of cached responses in bytes, least recently used go first (default 64MB)
+	TTL       time.Duration `mapstructure:"ttl"`        // Freshness of responses without Cache-Control max-age or Expires (default 1m)
+	// Response header listing space-separated tags the admin API purges entries by
+	SurrogateKeyHeader string `mapstructure:"surrogate_key_header"` // default Surrogate-Key
+	// Error responses cached briefly, so that repeated identical misses do not all
+	// reach a struggling upstream
+	NegativeTTL      time.Duration `mapstructure:"negative_ttl"`      // How long error responses are cached (0 disables)
+	NegativeStatuses []int         `mapstructure:"negative_statuses"` // Statuses cached for negative_ttl (default 404 and 410)
+	// Routes can override these
+	MaxObjectSize int64  `mapstructure:"max_object_size"` // Largest body cached in bytes (0 = up to max_memory)
+	Vary          string `mapstructure:"vary"`            // key (default): responses varying by headers outside the cache key are not cached; ignore: Vary is disregarded
+	// Adds X-Cache: HIT or MISS to responses, for debugging from the client side
+	XCacheHeader bool `mapstructure:"x_cache_header"`
+}
+
+// LoadSheddingConfig rejects part of the traffic with 503 while the proxy is
+// overloaded, so that it keeps serving the rest instead of collapsing. Each
+// threshold left at 0 is not checked.
+type LoadSheddingConfig struct {
+	Enabled            bool          `mapstructure:"enabled"`
+	MaxEventLoopLag    time.Duration `mapstructure:"max_event_loop_lag"`   // How late the proxy's timers may fire, a sign of starved event loops
+	MaxPendingRequests int           `mapstructure:"max_pending_requests"` // Requests of the server being handled at once
+	MaxMemory          int64         `mapstructure:"max_memory"`           // Bytes of live heap of the whole process
+	ShedFraction       float64       `mapstructure:"shed_fraction"`        // Share of requests rejected while a threshold is exceeded (default 0.5)
+	RetryAfter         time.Duration `mapstructure:"retry_after"`          // Retry-After of rejected requests (default 5s)
+}
+
+// MaintenanceConfig answers the requests of a server or route with a static 503
+// page, letting only the clients on its allow list through to the upstreams. The
+// admin API switches it on and off at runtime.
+type MaintenanceConfig struct {
+	Enabled     bool          `mapstructure:"enabled"`
+	Allow       []string      `mapstructure:"allow"`        // IPs and CIDRs still let through, such as the office or CI
+	Body        string        `mapstructure:"body"`         // Page served to everyone else
+	BodyFile    string        `mapstructure:"body_file"`    // File with the page instead of body, re-read on reload
+	ContentType string        `mapstructure:"content_type"` // Content-Type of the page (default text/html; charset=utf-8)
+	RetryAfter  time.Duration `mapstructure:"retry_after"`  // Retry-After of the page, 0 to send none
+
+	page string // contents of body_file, read by resolvePages
+}
+
+// PathRewriteConfig rewrites the path of requests sent to the upstream. The
+// pattern is matched against the escaped path, after strip_prefix.
+type PathRewriteConfig struct {
+	Match       string `mapstructure:"match"`       // Regular expression, e.g. "^/old/(.*)$"
+	Replacement string `mapstructure:"replacement"` // New path, with $1 or ${name} for capture groups, e.g. "/new/$1"
+}
+
+// CookieRewriteConfig rewrites an attribute of the cookies an upstream sets. For
+// cookie_domain, Match is a domain compared case-insensitively and an empty
+// Replacement removes the attribute; for cookie_path, Match is a path prefix
+// Replacement takes the place of. "*" matches any value.
+type CookieRewriteConfig struct {
+	Match       string `mapstructure:"match"`       // Domain or path prefix matched, e.g. "backend.internal" or "/app/"
+	Replacement string `mapstructure:"replacement"` // New domain or path prefix, e.g. "example.com" or "/"
+}
+
+// HeaderRulesConfig adds, replaces and removes the headers of requests before
+// they are forwarded to an upstream. Removals come first, then set, then add;
+// the proxy's own forwarding headers are written afterwards.
+type HeaderRulesConfig struct {
+	Add    []string `mapstructure:"add"`    // "Name: value" headers added next to any the client sent
+	Set    []string `mapstructure:"set"`    // "Name: value" headers replacing any the client sent
+	Remove []string `mapstructure:"remove"` // Header names removed; "X-Forwarded-*" removes every name with the prefix
+}
+
+// ErrorPagesConfig replaces the plain text bodies of the errors the proxy
+// answers itself, such as 502 Bad Gateway or 429 Too Many Requests, with pages
+type ErrorPagesConfig struct {
+	Pages    []ErrorPageConfig `mapstructure:"pages"`
+	Upstream bool              `mapstructure:"upstream"` // Also replace the bodies of upstream responses with these statuses
+}
+
+// ErrorPageConfig is the page of one error status
+type ErrorPageConfig struct {
+	Status      int    `mapstructure:"status"`       // Status the page is answered with, 400 to 599
+	Body        string `mapstructure:"body"`         // Page contents
+	BodyFile    string `mapstructure:"body_file"`    // File with the page instead of body, re-read on reload
+	ContentType string `mapstructure:"content_type"` // Content-Type of the page (default text/html; charset=utf-8)
+
+	page string // contents of body_file, read by resolvePages
+}
+
+// FallbackConfig is the static response of a route while none of its upstreams
+// is healthy
+type FallbackConfig struct {
+	Status      int      `mapstructure:"status"`       // Status code (default 503)
+	Body        string   `mapstructure:"body"`         // Response body
+	BodyFile    string   `mapstructure:"body_file"`    // File with the body instead of body, re-read on reload
+	ContentType string   `mapstructure:"content_type"` // Content-Type of the body (default text/html; charset=utf-8)
+	Headers     []string `mapstructure:"headers"`      // Extra "Name: value" response headers
+
+	page string // contents of body_file, read by resolvePages
+}
+
+// RouteCacheConfig overrides the server's cache settings on a route; unset
+// values keep the server's
+type RouteCacheConfig struct {
+	Enabled       *bool         `mapstructure:"enabled"`         // Cache the route's responses, even when the server caches nothing
+	TTL           time.Duration `mapstructure:"ttl"`             // Freshness of responses without Cache-Control max-age or Expires
+	MaxObjectSize int64         `mapstructure:"max_object_size"` // Largest body cached in bytes
+	Vary          string        `mapstructure:"vary"`            // key or ignore
 }
 
-func LoadConfig(configPath string) (*Config, error) {
+// CacheKeyConfig adds request components to the cache keys of a route, which are
+// otherwise the method, host, path and query as sent
+type CacheKeyConfig struct {
+	Headers     []string `mapstructure:"headers"`      // Request headers whose values are part of the key, e.g. Accept-Language
+	Cookies     []string `mapstructure:"cookies"`      // Cookies whose values are part of the key, e.g. an A/B test variant
+	SortQuery   bool     `mapstructure:"sort_query"`   // Sort query parameters, so ?b=2&a=1 and ?a=1&b=2 share responses
+	QueryParams []string `mapstructure:"query_params"` // Keep only these query parameters, sorted (empty keeps them all)
+}
+
+// IsZero reports whether the rule sets no limit
+func (r RateLimitRule) IsZero() bool {
+	return r.RequestsPerSecond <= 0 && r.GlobalRequestsPerSecond <= 0
+}
+
+// LoadConfig loads a single configuration file; overrides and SURIKITI_* environment
+// variables take precedence over the file
+func LoadConfig(configPath string, overrides ConfigOverrides) (*Config, error) {
 	viper.SetConfigFile(configPath)
 	viper.SetConfigType("toml")
 
 	if err := viper.ReadInConfig(); err != nil {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
+	bindEnv(viper.GetViper())
+	applyOverrides(overrides, viper.GetViper(), viper.GetViper())
 
 	var config Config
-	if err := viper.Unmarshal(&config); err != nil {
+	warnings, err := unmarshalStrict(viper.GetViper(), &config, filepath.Base(configPath))
+	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
+	config.Warnings = warnings
 
-	return &config, nil
+	if _, err := loadIncludes(&config, filepath.Dir(configPath)); err != nil {
+		return nil, err
+	}
+
+	return finalizeConfig(&config)
+}
+
+// loadIncludes appends the upstreams of every file matched by the include directive,
+// resolving patterns relative to baseDir, and returns the loaded file paths
+func loadIncludes(config *Config, baseDir string) (map[string]bool, error) {
+	included := make(map[string]bool)
+	for _, pattern := range config.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(baseDir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include pattern %q: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			config.Warnings = append(config.Warnings, fmt.Sprintf("include %q matched no files", pattern))
+		}
+
+		for _, path := range matches {
+			path = filepath.Clean(path)
+			if included[path] {
+				continue
+			}
+			included[path] = true
+
+			includeViper := viper.New()
+			includeViper.SetConfigFile(path)
+			includeViper.SetConfigType("toml")
+			if err := includeViper.ReadInConfig(); err != nil {
+				return nil, fmt.Errorf("failed to read included config file %s: %w", path, err)
+			}
+
+			var includeConfig IncludeFileConfig
+			warnings, err := unmarshalStrict(includeViper, &includeConfig, path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to unmarshal included config %s: %w", path, err)
+			}
+			config.Warnings = append(config.Warnings, warnings...)
+			config.Upstreams = append(config.Upstreams, includeConfig.Upstreams...)
+			config.WebSocketUpstreams = append(config.WebSocketUpstreams, includeConfig.WebSocketUpstreams...)
+		}
+	}
+	return included, nil
+}
+
+// finalizeConfig applies defaults and validates a freshly loaded configuration
+func finalizeConfig(config *Config) (*Config, error) {
+	if err := config.resolveSecrets(); err != nil {
+		return nil, err
+	}
+	if err := config.resolvePages(); err != nil {
+		return nil, err
+	}
+	config.ApplyDefaults()
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return config, nil
 }
 
 // LoadMultiFileConfig loads configuration from multiple files
-// configDir should contain: global.toml and any number of server .toml files
-func LoadMultiFileConfig(configDir string) (*Config, error) {
+// configDir should contain: global.toml and any number of server .toml files.
+// Overrides and SURIKITI_* environment variables apply to every file defining the key.
+func LoadMultiFileConfig(configDir string, overrides ConfigOverrides) (*Config, error) {
 	// Load global configuration first
 	globalPath := filepath.Join(configDir, "global.toml")
 	globalViper := viper.New()
@@ -132,11 +709,7 @@ func LoadMultiFileConfig(configDir string) (*Config, error) {
 	if err := globalViper.ReadInConfig(); err != nil {
 		return nil, fmt.Errorf("failed to read global config file: %w", err)
 	}
-
-	var config Config
-	if err := globalViper.Unmarshal(&config); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal global config: %w", err)
-	}
+	bindEnv(globalViper)
 
 	// Scan directory for all .toml files (except global.toml)
 	serverFiles, err := scanConfigDirectory(configDir)
@@ -144,33 +717,112 @@ func LoadMultiFileConfig(configDir string) (*Config, error) {
 		return nil, fmt.Errorf("failed to scan config directory: %w", err)
 	}
 
-	// Load individual server configurations
+	// Read server files up front so overrides can target any of them
+	serverVipers := make(map[string]*viper.Viper, len(serverFiles))
+	files := []*viper.Viper{globalViper}
 	for _, serverFile := range serverFiles {
-		serverPath := filepath.Join(configDir, serverFile)
 		serverViper := viper.New()
-		serverViper.SetConfigFile(serverPath)
+		serverViper.SetConfigFile(filepath.Join(configDir, serverFile))
 		serverViper.SetConfigType("toml")
 
 		if err := serverViper.ReadInConfig(); err != nil {
 			// Skip if file doesn't exist or can't be read
 			continue
 		}
+		bindEnv(serverViper)
+		serverVipers[serverFile] = serverViper
+		files = append(files, serverViper)
+	}
+	applyOverrides(overrides, globalViper, files...)
+
+	var config Config
+	warnings, err := unmarshalStrict(globalViper, &config, "global.toml")
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal global config: %w", err)
+	}
+	config.Warnings = warnings
+
+	// Load upstream files referenced by the include directive
+	included, err := loadIncludes(&config, configDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load individual server configurations
+	for _, serverFile := range serverFiles {
+		serverViper, ok := serverVipers[serverFile]
+		if !ok {
+			continue
+		}
+		if included[filepath.Clean(filepath.Join(configDir, serverFile))] {
+			// Included files hold upstreams, not servers
+			continue
+		}
 
 		var serverConfig ServerFileConfig
-		if err := serverViper.Unmarshal(&serverConfig); err != nil {
+		warnings, err := unmarshalStrict(serverViper, &serverConfig, serverFile)
+		if err != nil {
 			return nil, fmt.Errorf("failed to unmarshal server config %s: %w", serverFile, err)
 		}
+		config.Warnings = append(config.Warnings, warnings...)
 
 		// Only add server if it's enabled
 		if !serverConfig.Server.Enabled {
 			continue
 		}
 
-		// Set per-server configurations
-		serverConfig.Server.LoadBalancer = &serverConfig.LoadBalancer
-		serverConfig.Server.Logging = &serverConfig.Logging
-		serverConfig.Server.Proxy = &serverConfig.Proxy
-		serverConfig.Server.CORS = &serverConfig.CORS
+		// Set per-server configurations; absent sections fall back to the global ones
+		if serverViper.IsSet("load_balancer") {
+			serverConfig.Server.LoadBalancer = &serverConfig.LoadBalancer
+		}
+		if serverViper.IsSet("logging") {
+			serverConfig.Server.Logging = &serverConfig.Logging
+		}
+		if serverViper.IsSet("proxy") {
+			serverConfig.Server.Proxy = &serverConfig.Proxy
+		}
+		if serverViper.IsSet("cors") {
+			serverConfig.Server.CORS = &serverConfig.CORS
+		}
+		if serverViper.IsSet("security_headers") {
+			serverConfig.Server.SecurityHeaders = &serverConfig.SecurityHeaders
+		}
+		if serverViper.IsSet("rate_limit") {
+			serverConfig.Server.RateLimit = &serverConfig.RateLimit
+		}
+		if serverViper.IsSet("access") {
+			serverConfig.Server.Access = &serverConfig.Access
+		}
+		if serverViper.IsSet("user_agents") {
+			serverConfig.Server.UserAgents = &serverConfig.UserAgents
+		}
+		if serverViper.IsSet("api_keys") {
+			serverConfig.Server.APIKeys = &serverConfig.APIKeys
+		}
+		if serverViper.IsSet("signatures") {
+			serverConfig.Server.Signatures = &serverConfig.Signatures
+		}
+		if serverViper.IsSet("oauth2") {
+			serverConfig.Server.OAuth2 = &serverConfig.OAuth2
+		}
+		if serverViper.IsSet("cache") {
+			serverConfig.Server.Cache = &serverConfig.Cache
+		}
+		if serverViper.IsSet("load_shedding") {
+			serverConfig.Server.LoadShedding = &serverConfig.LoadShedding
+		}
+		if serverViper.IsSet("maintenance") {
+			serverConfig.Server.Maintenance = &serverConfig.Maintenance
+		}
+		if serverViper.IsSet("request_headers") {
+			serverConfig.Server.RequestHeaders = &serverConfig.RequestHeaders
+		}
+		if serverViper.IsSet("error_pages") {
+			serverConfig.Server.ErrorPages = &serverConfig.ErrorPages
+		}
+		if len(serverConfig.Routes) > 0 {
+			serverConfig.Server.Routes = serverConfig.Routes
+		}
 
 		// Add server to config
 		config.Servers = append(config.Servers, serverConfig.Server)
@@ -182,9 +834,21 @@ func LoadMultiFileConfig(configDir string) (*Config, error) {
 		config.Logging = config.GlobalDefaults.Logging
 		config.Proxy = config.GlobalDefaults.Proxy
 		config.CORS = config.GlobalDefaults.CORS
+		config.SecurityHeaders = config.GlobalDefaults.SecurityHeaders
+		config.RateLimit = config.GlobalDefaults.RateLimit
+		config.Access = config.GlobalDefaults.Access
+		config.UserAgents = config.GlobalDefaults.UserAgents
+		config.APIKeys = config.GlobalDefaults.APIKeys
+		config.Signatures = config.GlobalDefaults.Signatures
+		config.OAuth2 = config.GlobalDefaults.OAuth2
+		config.Cache = config.GlobalDefaults.Cache
+		config.LoadShedding = config.GlobalDefaults.LoadShedding
+		config.Maintenance = config.GlobalDefaults.Maintenance
+		config.RequestHeaders = config.GlobalDefaults.RequestHeaders
+		config.ErrorPages = config.GlobalDefaults.ErrorPages
 	}
 
-	return &config, nil
+	return finalizeConfig(&config)
 }
 
 // scanConfigDirectory scans the config directory for all .toml files except global.toml
@@ -231,12 +895,22 @@ func scanConfigDirectory(configDir string) ([]string, error) {
 func (c *Config) GetServerAddress(serverName string) string {
 	for _, server := range c.Servers {
 		if server.Name == serverName {
-			return fmt.Sprintf("%s:%d", server.Host, server.Port)
+			return server.Address()
 		}
 	}
 	return ""
 }
 
+// GetServer returns the server with the given name
+func (c *Config) GetServer(serverName string) (ServerConfig, bool) {
+	for _, server := range c.Servers {
+		if server.Name == serverName {
+			return server, true
+		}
+	}
+	return ServerConfig{}, false
+}
+
 // GetEnabledServers returns only enabled servers
 func (c *Config) GetEnabledServers() []ServerConfig {
 	var enabled []ServerConfig
@@ -318,4 +992,124 @@ func (c *Config) GetCORSConfig(serverName string) CORSConfig {
 		}
 	}
 	return c.CORS
-}
\ No newline at end of file
+}
+
+// GetRateLimitConfig returns rate limit config for a server (per-server or global)
+func (c *Config) GetRateLimitConfig(serverName string) RateLimitConfig {
+	for _, server := range c.Servers {
+		if server.Name == serverName && server.RateLimit != nil {
+			return *server.RateLimit
+		}
+	}
+	return c.RateLimit
+}
+
+// GetAccessConfig returns access config for a server (per-server or global)
+func (c *Config) GetAccessConfig(serverName string) AccessConfig {
+	for _, server := range c.Servers {
+		if server.Name == serverName && server.Access != nil {
+			return *server.Access
+		}
+	}
+	return c.Access
+}
+
+// GetAPIKeyConfig returns API key config for a server (per-server or global)
+func (c *Config) GetAPIKeyConfig(serverName string) APIKeyConfig {
+	for _, server := range c.Servers {
+		if server.Name == serverName && server.APIKeys != nil {
+			return *server.APIKeys
+		}
+	}
+	return c.APIKeys
+}
+
+// GetOAuth2Config returns OAuth2 config for a server (per-server or global)
+func (c *Config) GetOAuth2Config(serverName string) OAuth2Config {
+	for _, server := range c.Servers {
+		if server.Name == serverName && server.OAuth2 != nil {
+			return *server.OAuth2
+		}
+	}
+	return c.OAuth2
+}
+
+// GetUserAgentConfig returns user agent rules for a server (per-server or global)
+func (c *Config) GetUserAgentConfig(serverName string) UserAgentConfig {
+	for _, server := range c.Servers {
+		if server.Name == serverName && server.UserAgents != nil {
+			return *server.UserAgents
+		}
+	}
+	return c.UserAgents
+}
+
+// GetCacheConfig returns response cache config for a server (per-server or global)
+func (c *Config) GetCacheConfig(serverName string) CacheConfig {
+	for _, server := range c.Servers {
+		if server.Name == serverName && server.Cache != nil {
+			return *server.Cache
+		}
+	}
+	return c.Cache
+}
+
+// GetLoadSheddingConfig returns load shedding config for a server (per-server or global)
+func (c *Config) GetLoadSheddingConfig(serverName string) LoadSheddingConfig {
+	for _, server := range c.Servers {
+		if server.Name == serverName && server.LoadShedding != nil {
+			return *server.LoadShedding
+		}
+	}
+	return c.LoadShedding
+}
+
+// GetMaintenanceConfig returns maintenance mode config for a server (per-server or global)
+func (c *Config) GetMaintenanceConfig(serverName string) MaintenanceConfig {
+	for _, server := range c.Servers {
+		if server.Name == serverName && server.Maintenance != nil {
+			return *server.Maintenance
+		}
+	}
+	return c.Maintenance
+}
+
+// GetRequestHeadersConfig returns request header rules for a server (per-server or global)
+func (c *Config) GetRequestHeadersConfig(serverName string) HeaderRulesConfig {
+	for _, server := range c.Servers {
+		if server.Name == serverName && server.RequestHeaders != nil {
+			return *server.RequestHeaders
+		}
+	}
+	return c.RequestHeaders
+}
+
+// GetErrorPagesConfig returns error pages config for a server (per-server or global)
+func (c *Config) GetErrorPagesConfig(serverName string) ErrorPagesConfig {
+	for _, server := range c.Servers {
+		if server.Name == serverName && server.ErrorPages != nil {
+			return *server.ErrorPages
+		}
+	}
+	return c.ErrorPages
+}
+
+// GetSignatureConfig returns signature verification config for a server (per-server or global)
+func (c *Config) GetSignatureConfig(serverName string) SignatureConfig {
+	for _, server := range c.Servers {
+		if server.Name == serverName && server.Signatures != nil {
+			return *server.Signatures
+		}
+	}
+	return c.Signatures
+}
+
+// GetSecurityHeadersConfig returns security headers config for a server (per-server or global)
+func (c *Config) GetSecurityHeadersConfig(serverName string) SecurityHeadersConfig {
+	for _, server := range c.Servers {
+		if server.Name == serverName && server.SecurityHeaders != nil {
+			return *server.SecurityHeaders
+		}
+	}
+	return c.SecurityHeaders
+}
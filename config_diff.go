@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// ConfigChange is a single difference between two configurations
+type ConfigChange struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// Kind describes the change as "added", "removed" or "changed"
+func (c ConfigChange) Kind() string {
+	switch {
+	case c.Old == nil:
+		return "added"
+	case c.New == nil:
+		return "removed"
+	default:
+		return "changed"
+	}
+}
+
+// DiffConfigs compares the effective configurations and lists what changed, ordered by path.
+// Servers and upstreams are matched by name, so paths read like servers[api].proxy.max_body_size.
+func DiffConfigs(previous, current *Config) []ConfigChange {
+	var changes []ConfigChange
+	diffValues("", previous.EffectiveConfig(), current.EffectiveConfig(), &changes)
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+func diffValues(path string, previous, current interface{}, changes *[]ConfigChange) {
+	// A nil map from EffectiveConfig is an absent configuration
+	if m, ok := previous.(map[string]interface{}); ok && m == nil {
+		previous = nil
+	}
+	if m, ok := current.(map[string]interface{}); ok && m == nil {
+		current = nil
+	}
+
+	previousMap, previousIsMap := previous.(map[string]interface{})
+	currentMap, currentIsMap := current.(map[string]interface{})
+	if previousIsMap && currentIsMap {
+		for key, value := range previousMap {
+			diffValues(joinConfigPath(path, key), value, currentMap[key], changes)
+		}
+		for key, value := range currentMap {
+			if _, ok := previousMap[key]; !ok {
+				diffValues(joinConfigPath(path, key), nil, value, changes)
+			}
+		}
+		return
+	}
+
+	previousNamed, previousOK := namedEntries(previous)
+	currentNamed, currentOK := namedEntries(current)
+	if previousOK && currentOK {
+		for name, value := range previousNamed {
+			diffValues(fmt.Sprintf("%s[%s]", path, name), value, currentNamed[name], changes)
+		}
+		for name, value := range currentNamed {
+			if _, ok := previousNamed[name]; !ok {
+				diffValues(fmt.Sprintf("%s[%s]", path, name), nil, value, changes)
+			}
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(previous, current) {
+		*changes = append(*changes, ConfigChange{Path: path, Old: previous, New: current})
+	}
+}
+
+// namedEntries indexes a list of maps by their "name" key (servers, upstreams, routes).
+// It reports false for anything else, including lists with missing or duplicate names.
+func namedEntries(value interface{}) (map[string]interface{}, bool) {
+	if value == nil {
+		return map[string]interface{}{}, true
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	named := make(map[string]interface{}, len(list))
+	for _, item := range list {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		name, ok := entry["name"].(string)
+		if !ok || name == "" {
+			return nil, false
+		}
+		if _, exists := named[name]; exists {
+			return nil, false
+		}
+		named[name] = entry
+	}
+	return named, true
+}
+
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// redactedValue replaces secrets in configuration dumps
+const redactedValue = "******"
+
+// EffectiveConfig returns the configuration as it is actually applied: every server
+// carries its resolved load balancer, logging, proxy, CORS, rate limit, access, API key, OAuth2 and cache settings (per-server
+// values or the global fallback) and secrets are redacted.
+func (c *Config) EffectiveConfig() map[string]interface{} {
+	if c == nil {
+		return nil
+	}
+	effective := Config{
+		Upstreams:          c.Upstreams,
+		WebSocketUpstreams: c.WebSocketUpstreams,
+		Admin:              c.Admin,
+	}
+	if effective.Admin.Token != "" {
+		effective.Admin.Token = redactedValue
+	}
+	effective.Admin.Tokens = make([]AdminTokenConfig, len(c.Admin.Tokens))
+	for i, named := range c.Admin.Tokens {
+		effective.Admin.Tokens[i] = AdminTokenConfig{Name: named.Name, Token: redactedValue, TokenFile: named.TokenFile}
+	}
+
+	for _, server := range c.Servers {
+		lbConfig := c.GetLoadBalancerConfig(server.Name)
+		loggingConfig := c.GetLoggingConfig(server.Name)
+		proxyConfig := c.GetProxyConfig(server.Name)
+		corsConfig := c.GetCORSConfig(server.Name)
+		securityHeadersConfig := c.GetSecurityHeadersConfig(server.Name)
+		rateLimitConfig := c.GetRateLimitConfig(server.Name)
+		accessConfig := c.GetAccessConfig(server.Name)
+		userAgentConfig := c.GetUserAgentConfig(server.Name)
+		apiKeyConfig := c.GetAPIKeyConfig(server.Name)
+		apiKeyConfig.Keys = redactAPIKeys(apiKeyConfig.Keys)
+		signatureConfig := c.GetSignatureConfig(server.Name)
+		signatureConfig.Consumers = redactSignatureConsumers(signatureConfig.Consumers)
+		cacheConfig := c.GetCacheConfig(server.Name)
+		loadSheddingConfig := c.GetLoadSheddingConfig(server.Name)
+		maintenanceConfig := c.GetMaintenanceConfig(server.Name)
+		requestHeadersConfig := redactHeaderRules(c.GetRequestHeadersConfig(server.Name))
+		errorPagesConfig := c.GetErrorPagesConfig(server.Name)
+		oauth2Config := c.GetOAuth2Config(server.Name)
+		if oauth2Config.ClientSecret != "" {
+			oauth2Config.ClientSecret = redactedValue
+		}
+
+		server.LoadBalancer = &lbConfig
+		server.Logging = &loggingConfig
+		server.Proxy = &proxyConfig
+		server.CORS = &corsConfig
+		server.SecurityHeaders = &securityHeadersConfig
+		server.RateLimit = &rateLimitConfig
+		server.Access = &accessConfig
+		server.UserAgents = &userAgentConfig
+		server.APIKeys = &apiKeyConfig
+		server.Signatures = &signatureConfig
+		server.OAuth2 = &oauth2Config
+		server.Cache = &cacheConfig
+		server.LoadShedding = &loadSheddingConfig
+		server.Maintenance = &maintenanceConfig
+		server.RequestHeaders = &requestHeadersConfig
+		server.ErrorPages = &errorPagesConfig
+		server.Routes = redactRoutes(server.Routes)
+		effective.Servers = append(effective.Servers, server)
+	}
+
+	dump := configToMap(reflect.ValueOf(effective)).(map[string]interface{})
+
+	// Global sections are already folded into each server above
+	for _, key := range []string{"load_balancer", "logging", "proxy", "cors", "security_headers", "rate_limit", "access", "user_agents", "api_keys", "signatures", "oauth2", "cache", "load_shedding", "maintenance", "request_headers", "error_pages", "global_defaults"} {
+		delete(dump, key)
+	}
+	return dump
+}
+
+// configToMap converts configuration structs into plain maps keyed by their
+// mapstructure names, so they can be encoded as JSON or TOML with the same keys
+// used in the configuration files. Durations are rendered as strings like "30s".
+func configToMap(v reflect.Value) interface{} {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		return time.Duration(v.Int()).String()
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return configToMap(v.Elem())
+	case reflect.Struct:
+		result := make(map[string]interface{}, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			tag := field.Tag.Get("mapstructure")
+			if field.Anonymous && strings.Contains(tag, ",squash") {
+				// Squashed structs share the keys of their parent
+				if nested, ok := configToMap(v.Field(i)).(map[string]interface{}); ok {
+					for key, value := range nested {
+						result[key] = value
+					}
+				}
+				continue
+			}
+			name := strings.Split(tag, ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			if value := configToMap(v.Field(i)); value != nil {
+				result[name] = value
+			}
+		}
+		return result
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		result := make([]interface{}, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			result[i] = configToMap(v.Index(i))
+		}
+		return result
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		result := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			result[iter.Key().String()] = configToMap(iter.Value())
+		}
+		return result
+	default:
+		return v.Interface()
+	}
+}
+
+// redactRoutes copies routes with their basic auth hashes and header rule values redacted
+func redactRoutes(routes []RouteConfig) []RouteConfig {
+	if routes == nil {
+		return nil
+	}
+	redacted := make([]RouteConfig, len(routes))
+	for i, route := range routes {
+		if len(route.BasicAuth.Users) > 0 {
+			users := make([]string, len(route.BasicAuth.Users))
+			for j, entry := range route.BasicAuth.Users {
+				name, _, _ := strings.Cut(entry, ":")
+				users[j] = name + ":" + redactedValue
+			}
+			route.BasicAuth.Users = users
+		}
+		route.RequestHeaders = redactHeaderRules(route.RequestHeaders)
+		redacted[i] = route
+	}
+	return redacted
+}
+
+// redactSignatureConsumers copies signature consumers with their shared secrets redacted
+func redactSignatureConsumers(consumers []SignatureConsumer) []SignatureConsumer {
+	if consumers == nil {
+		return nil
+	}
+	redacted := make([]SignatureConsumer, len(consumers))
+	for i, consumer := range consumers {
+		consumer.Secret = redactedValue
+		redacted[i] = consumer
+	}
+	return redacted
+}
+
+// redactAPIKeys copies API keys with their secret values redacted
+func redactAPIKeys(keys []APIKeyEntry) []APIKeyEntry {
+	if keys == nil {
+		return nil
+	}
+	redacted := make([]APIKeyEntry, len(keys))
+	for i, key := range keys {
+		key.Key = redactedValue
+		redacted[i] = key
+	}
+	return redacted
+}
+
+// redactHeaderRules copies header rules with the values they add or set redacted,
+// as they may be tokens injected for the upstream, keeping the header names
+func redactHeaderRules(rules HeaderRulesConfig) HeaderRulesConfig {
+	rules.Add = redactHeaderValues(rules.Add)
+	rules.Set = redactHeaderValues(rules.Set)
+	return rules
+}
+
+// redactHeaderValues copies "Name: value" entries with their values redacted
+func redactHeaderValues(entries []string) []string {
+	if entries == nil {
+		return nil
+	}
+	redacted := make([]string, len(entries))
+	for i, entry := range entries {
+		name, _, _ := strings.Cut(entry, ":")
+		redacted[i] = strings.TrimSpace(name) + ": " + redactedValue
+	}
+	return redacted
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// configEnvPrefix prefixes environment variables overriding configuration keys,
+// e.g. SURIKITI_SERVER_PORT overrides server.port
+const configEnvPrefix = "SURIKITI"
+
+// ConfigOverrides are key=value settings given on the command line (--set) that
+// take precedence over the configuration files and the environment
+type ConfigOverrides map[string]string
+
+// ParseConfigOverrides parses key=value pairs; later pairs win over earlier ones
+func ParseConfigOverrides(pairs []string) (ConfigOverrides, error) {
+	overrides := make(ConfigOverrides, len(pairs))
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid override %q, expected key=value", pair)
+		}
+		overrides[key] = value
+	}
+	return overrides, nil
+}
+
+// keys returns the override keys in a stable order
+func (o ConfigOverrides) keys() []string {
+	keys := make([]string, 0, len(o))
+	for key := range o {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// bindEnv makes every key defined in a configuration file overridable through
+// SURIKITI_<KEY> environment variables, with dots replaced by underscores
+func bindEnv(v *viper.Viper) {
+	v.SetEnvPrefix(configEnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+}
+
+// applyOverrides sets every override on the files that define its key. Keys that
+// no file defines are set on the fallback file (global.toml or the single config file).
+func applyOverrides(overrides ConfigOverrides, fallback *viper.Viper, files ...*viper.Viper) {
+	for _, key := range overrides.keys() {
+		applied := false
+		for _, v := range files {
+			if v.IsSet(key) {
+				v.Set(key, overrides[key])
+				applied = true
+			}
+		}
+		if !applied {
+			fallback.Set(key, overrides[key])
+		}
+	}
+}
@@ -0,0 +1,933 @@
+package main
+
+import (
+	"compress/flate"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// Built-in defaults for settings left unset in both the server and global sections
+const (
+	defaultLoadBalancerMethod    = "round_robin"
+	defaultLoadBalancerTimeout   = 30 * time.Second
+	defaultRetryBackoff          = 50 * time.Millisecond
+	defaultRetryMaxBackoff       = time.Second
+	defaultLogLevel              = "info"
+	defaultMaxBodySize           = 10 << 20 // 10MB
+	defaultRequestTimeout        = 30 * time.Second
+	defaultResponseTimeout       = 30 * time.Second
+	defaultKeepAliveTimeout      = 60 * time.Second
+	defaultHeaderReadTimeout     = 10 * time.Second
+	defaultBodyReadTimeout       = 30 * time.Second
+	defaultRequestReadTimeout    = 60 * time.Second
+	defaultBufferSize            = 16 << 10 // 16KB, also the smallest valid HTTP/2 frame size
+	defaultMaxIdleConns          = 100
+	defaultMaxIdleConnsPerHost   = 10
+	defaultIdleConnTimeout       = 90 * time.Second
+	defaultWebSocketBufferSize   = 4096
+	defaultWebSocketPingInterval = 30 * time.Second
+	defaultWebSocketDrainTimeout = 10 * time.Second
+	defaultStreamThreshold       = 1 << 20 // 1MB
+	defaultDNSCacheTTL           = 10 * time.Minute
+	defaultCacheMaxMemory        = 64 << 20 // 64MB
+	defaultCacheTTL              = time.Minute
+	defaultSurrogateKeyHeader    = "Surrogate-Key"
+	defaultCacheVary             = CacheVaryKey
+	defaultShedFraction          = 0.5
+	defaultShedRetryAfter        = 5 * time.Second
+	// Fastest deflate level, the usual choice for small chat and telemetry messages
+	defaultWebSocketCompressionLevel = 1
+	// Response compression levels trading little speed for most of the savings
+	defaultGzipLevel     = 6
+	defaultBrotliQuality = 4
+	defaultZstdLevel     = 2
+	// Smaller bodies hardly shrink, and can grow by the encoding's overhead
+	defaultCompressionMinSize = 256
+)
+
+// defaultCompressionEncodings prefer the codings that compress best, which every
+// current browser accepts
+var defaultCompressionEncodings = []string{encodingBrotli, encodingZstd, encodingGzip}
+
+// defaultCompressionTypes are text and structured data; images, video, archives
+// and fonts are compressed already
+var defaultCompressionTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/ld+json",
+	"application/manifest+json",
+	"application/problem+json",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// defaultWebSocketForwardHeaders are the handshake headers upstreams usually authenticate with
+var defaultWebSocketForwardHeaders = []string{"Authorization", "Cookie", "User-Agent", "Origin"}
+
+// defaultQUIC0RTTMethods are the safe methods, which a replay cannot change state with
+var defaultQUIC0RTTMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+
+// defaultNegativeStatuses are the errors that say nothing about the upstream's health
+var defaultNegativeStatuses = []int{http.StatusNotFound, http.StatusGone}
+
+// idempotentMethods are the methods quic_0rtt_methods may list (RFC 9110 section 9.2.2)
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// loadBalancerMethods are the supported load balancing algorithms
+var loadBalancerMethods = map[string]bool{
+	"round_robin":          true,
+	"weighted_round_robin": true,
+	"least_connections":    true,
+	"single":               true,
+}
+
+// logLevels are the supported log levels
+var logLevels = map[string]bool{
+	"debug": true,
+	"info":  true,
+	"warn":  true,
+	"error": true,
+}
+
+// unmarshalStrict decodes a viper configuration and reports keys that do not
+// map to any configuration field, prefixed with the file they came from
+func unmarshalStrict(v *viper.Viper, target interface{}, source string) ([]string, error) {
+	var metadata mapstructure.Metadata
+	if err := v.Unmarshal(target, func(dc *mapstructure.DecoderConfig) {
+		dc.Metadata = &metadata
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(metadata.Unused)
+	warnings := make([]string, 0, len(metadata.Unused))
+	for _, key := range metadata.Unused {
+		warnings = append(warnings, fmt.Sprintf("%s: unknown key %q is ignored", source, key))
+	}
+	return warnings, nil
+}
+
+// logConfigWarnings logs the non-fatal problems found while loading the configuration
+func logConfigWarnings(cfg *Config, logger *zap.Logger) {
+	for _, warning := range cfg.Warnings {
+		logger.Warn("Configuration warning", zap.String("warning", warning))
+	}
+}
+
+// ApplyDefaults fills settings that were left unset with built-in defaults
+func (c *Config) ApplyDefaults() {
+	c.LoadBalancer.applyDefaults()
+	c.Logging.applyDefaults()
+	c.Proxy.applyDefaults()
+	c.APIKeys.applyDefaults()
+	c.Signatures.applyDefaults()
+	c.OAuth2.applyDefaults()
+	c.Cache.applyDefaults()
+	c.LoadShedding.applyDefaults()
+
+	for i := range c.Servers {
+		server := &c.Servers[i]
+		if server.LoadBalancer != nil {
+			server.LoadBalancer.applyDefaults()
+		}
+		if server.Logging != nil {
+			server.Logging.applyDefaults()
+		}
+		if server.Proxy != nil {
+			server.Proxy.applyDefaults()
+		}
+		if server.APIKeys != nil {
+			server.APIKeys.applyDefaults()
+		}
+		if server.Signatures != nil {
+			server.Signatures.applyDefaults()
+		}
+		if server.OAuth2 != nil {
+			server.OAuth2.applyDefaults()
+		}
+		if server.Cache != nil {
+			server.Cache.applyDefaults()
+		}
+		if server.LoadShedding != nil {
+			server.LoadShedding.applyDefaults()
+		}
+	}
+}
+
+func (lb *LoadBalancerConfig) applyDefaults() {
+	if lb.Method == "" {
+		lb.Method = defaultLoadBalancerMethod
+	}
+	if lb.Timeout == 0 {
+		lb.Timeout = defaultLoadBalancerTimeout
+	}
+	if lb.RetryBackoff == 0 {
+		lb.RetryBackoff = defaultRetryBackoff
+	}
+	if lb.RetryMaxBackoff == 0 {
+		lb.RetryMaxBackoff = defaultRetryMaxBackoff
+	}
+	if lb.Affinity == "none" {
+		lb.Affinity = AffinityNone
+	}
+	if lb.Affinity != AffinityNone && lb.AffinityTTL == 0 {
+		lb.AffinityTTL = defaultAffinityTTL
+	}
+}
+
+func (l *LoggingConfig) applyDefaults() {
+	if l.Level == "" {
+		l.Level = defaultLogLevel
+	}
+}
+
+func (a *APIKeyConfig) applyDefaults() {
+	if a.Header == "" {
+		a.Header = defaultAPIKeyHeader
+	}
+}
+
+func (s *SignatureConfig) applyDefaults() {
+	if s.Header == "" {
+		s.Header = defaultSignatureHeader
+	}
+	if s.ConsumerHeader == "" {
+		s.ConsumerHeader = defaultSignatureConsumerHeader
+	}
+	if s.MaxSkew == 0 {
+		s.MaxSkew = defaultSignatureMaxSkew
+	}
+}
+
+func (o *OAuth2Config) applyDefaults() {
+	if o.CacheTTL == 0 {
+		o.CacheTTL = defaultOAuth2CacheTTL
+	}
+	if o.Timeout == 0 {
+		o.Timeout = defaultOAuth2Timeout
+	}
+	if o.SubjectHeader == "" {
+		o.SubjectHeader = defaultOAuth2SubjectHeader
+	}
+	if o.ScopesHeader == "" {
+		o.ScopesHeader = defaultOAuth2ScopesHeader
+	}
+}
+
+func (c *CacheConfig) applyDefaults() {
+	if c.MaxMemory == 0 {
+		c.MaxMemory = defaultCacheMaxMemory
+	}
+	if c.TTL == 0 {
+		c.TTL = defaultCacheTTL
+	}
+	if c.SurrogateKeyHeader == "" {
+		c.SurrogateKeyHeader = defaultSurrogateKeyHeader
+	}
+	if c.NegativeStatuses == nil {
+		c.NegativeStatuses = defaultNegativeStatuses
+	}
+	if c.Vary == "" {
+		c.Vary = defaultCacheVary
+	}
+}
+
+func (l *LoadSheddingConfig) applyDefaults() {
+	if l.ShedFraction == 0 {
+		l.ShedFraction = defaultShedFraction
+	}
+	if l.RetryAfter == 0 {
+		l.RetryAfter = defaultShedRetryAfter
+	}
+}
+
+func (p *ProxyConfig) applyDefaults() {
+	if p.MaxBodySize == 0 {
+		p.MaxBodySize = defaultMaxBodySize
+	}
+	if p.RequestTimeout == 0 {
+		p.RequestTimeout = defaultRequestTimeout
+	}
+	if p.ResponseTimeout == 0 {
+		p.ResponseTimeout = defaultResponseTimeout
+	}
+	if p.KeepAliveTimeout == 0 {
+		p.KeepAliveTimeout = defaultKeepAliveTimeout
+	}
+	if p.HeaderReadTimeout == 0 {
+		p.HeaderReadTimeout = defaultHeaderReadTimeout
+	}
+	if p.BodyReadTimeout == 0 {
+		p.BodyReadTimeout = defaultBodyReadTimeout
+	}
+	if p.RequestReadTimeout == 0 {
+		p.RequestReadTimeout = defaultRequestReadTimeout
+	}
+	if p.BufferSize == 0 {
+		p.BufferSize = defaultBufferSize
+	}
+	if p.MaxIdleConns == 0 {
+		p.MaxIdleConns = defaultMaxIdleConns
+	}
+	if p.MaxIdleConnsPerHost == 0 {
+		p.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if p.IdleConnTimeout == 0 {
+		p.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	if p.WebSocketBufferSize == 0 {
+		p.WebSocketBufferSize = defaultWebSocketBufferSize
+	}
+	if p.WebSocketForwardHeaders == nil {
+		p.WebSocketForwardHeaders = defaultWebSocketForwardHeaders
+	}
+	if p.WebSocketPingInterval == 0 {
+		p.WebSocketPingInterval = defaultWebSocketPingInterval
+	}
+	if p.WebSocketCompressionLevel == 0 {
+		p.WebSocketCompressionLevel = defaultWebSocketCompressionLevel
+	}
+	if p.WebSocketDrainTimeout == 0 {
+		p.WebSocketDrainTimeout = defaultWebSocketDrainTimeout
+	}
+	if p.CompressionEncodings == nil {
+		p.CompressionEncodings = defaultCompressionEncodings
+	}
+	if p.GzipLevel == 0 {
+		p.GzipLevel = defaultGzipLevel
+	}
+	if p.BrotliQuality == 0 {
+		p.BrotliQuality = defaultBrotliQuality
+	}
+	if p.ZstdLevel == 0 {
+		p.ZstdLevel = defaultZstdLevel
+	}
+	if p.CompressionTypes == nil {
+		p.CompressionTypes = defaultCompressionTypes
+	}
+	if p.CompressionMinSize == 0 {
+		p.CompressionMinSize = defaultCompressionMinSize
+	}
+	if p.UpstreamEncoding == "" {
+		p.UpstreamEncoding = UpstreamEncodingPassthrough
+	}
+	if p.QUIC0RTTMethods == nil {
+		p.QUIC0RTTMethods = defaultQUIC0RTTMethods
+	}
+	if p.StreamThreshold == 0 {
+		p.StreamThreshold = defaultStreamThreshold
+	}
+	if p.DNSCacheTTL == 0 {
+		p.DNSCacheTTL = defaultDNSCacheTTL
+	}
+}
+
+// Validate rejects configurations that cannot work, reporting every problem at once
+func (c *Config) Validate() error {
+	var errs []error
+
+	upstreams := make(map[string]bool, len(c.Upstreams))
+	for _, uc := range c.Upstreams {
+		errs = append(errs, validateUpstream("upstream", uc, upstreams)...)
+	}
+	wsUpstreams := make(map[string]bool, len(c.WebSocketUpstreams))
+	for _, uc := range c.WebSocketUpstreams {
+		errs = append(errs, validateUpstream("websocket upstream", uc, wsUpstreams)...)
+	}
+
+	servers := make(map[string]bool, len(c.Servers))
+	for _, server := range c.Servers {
+		if server.Name == "" {
+			errs = append(errs, fmt.Errorf("server on port %d has no name", server.Port))
+		} else if servers[server.Name] {
+			errs = append(errs, fmt.Errorf("duplicate server name %q", server.Name))
+		}
+		servers[server.Name] = true
+
+		prefix := fmt.Sprintf("server %q", server.Name)
+		switch {
+		case server.UnixSocket != "" && server.SystemdSocket != "":
+			errs = append(errs, fmt.Errorf("%s: unix_socket and systemd_socket are mutually exclusive", prefix))
+		case server.UnixSocket != "" || server.SystemdSocket != "":
+		case server.Port <= 0 || server.Port > 65535:
+			errs = append(errs, fmt.Errorf("%s: port %d is out of range", prefix, server.Port))
+		}
+		if server.WebSocketPort < 0 || server.WebSocketPort > 65535 {
+			errs = append(errs, fmt.Errorf("%s: websocket_port %d is out of range", prefix, server.WebSocketPort))
+		}
+		for _, name := range server.Upstreams {
+			if !upstreams[name] && !wsUpstreams[name] {
+				errs = append(errs, fmt.Errorf("%s: unknown upstream %q", prefix, name))
+			}
+		}
+		serverUpstreams := make(map[string]bool, len(server.Upstreams))
+		for _, name := range server.Upstreams {
+			serverUpstreams[name] = true
+		}
+		for _, route := range server.Routes {
+			errs = append(errs, validateRoute(prefix, route, upstreams, serverUpstreams)...)
+		}
+
+		lbConfig := c.GetLoadBalancerConfig(server.Name)
+		errs = append(errs, lbConfig.validate(prefix)...)
+		loggingConfig := c.GetLoggingConfig(server.Name)
+		errs = append(errs, loggingConfig.validate(prefix)...)
+		proxyConfig := c.GetProxyConfig(server.Name)
+		errs = append(errs, proxyConfig.validate(prefix)...)
+		rateLimitConfig := c.GetRateLimitConfig(server.Name)
+		errs = append(errs, rateLimitConfig.validate(prefix)...)
+		accessConfig := c.GetAccessConfig(server.Name)
+		errs = append(errs, accessConfig.validate(prefix+": access")...)
+		userAgentConfig := c.GetUserAgentConfig(server.Name)
+		errs = append(errs, userAgentConfig.validate(prefix)...)
+		apiKeyConfig := c.GetAPIKeyConfig(server.Name)
+		errs = append(errs, apiKeyConfig.validate(prefix, server.Routes)...)
+		signatureConfig := c.GetSignatureConfig(server.Name)
+		errs = append(errs, signatureConfig.validate(prefix, server.Routes)...)
+		oauth2Config := c.GetOAuth2Config(server.Name)
+		errs = append(errs, oauth2Config.validate(prefix)...)
+		cacheConfig := c.GetCacheConfig(server.Name)
+		errs = append(errs, cacheConfig.validate(prefix)...)
+		loadSheddingConfig := c.GetLoadSheddingConfig(server.Name)
+		errs = append(errs, loadSheddingConfig.validate(prefix)...)
+		maintenanceConfig := c.GetMaintenanceConfig(server.Name)
+		errs = append(errs, maintenanceConfig.validate(prefix+": maintenance")...)
+		requestHeadersConfig := c.GetRequestHeadersConfig(server.Name)
+		errs = append(errs, requestHeadersConfig.validate(prefix+": request_headers")...)
+		errorPagesConfig := c.GetErrorPagesConfig(server.Name)
+		errs = append(errs, errorPagesConfig.validate(prefix+": error_pages")...)
+	}
+
+	if c.Admin.Enabled && (c.Admin.Port <= 0 || c.Admin.Port > 65535) {
+		errs = append(errs, fmt.Errorf("admin: port %d is out of range", c.Admin.Port))
+	}
+	if c.Reload.Debounce < 0 {
+		errs = append(errs, fmt.Errorf("reload: debounce must not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateUpstream(kind string, uc UpstreamConfig, seen map[string]bool) []error {
+	var errs []error
+	if uc.Name == "" {
+		errs = append(errs, fmt.Errorf("%s %s has no name", kind, uc.URL))
+	} else if seen[uc.Name] {
+		errs = append(errs, fmt.Errorf("duplicate %s name %q", kind, uc.Name))
+	}
+	seen[uc.Name] = true
+
+	parsed, err := url.Parse(uc.URL)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		errs = append(errs, fmt.Errorf("%s %q: invalid URL %q", kind, uc.Name, uc.URL))
+	}
+	if uc.Weight < 0 {
+		errs = append(errs, fmt.Errorf("%s %q: weight must not be negative", kind, uc.Name))
+	}
+	if uc.MaxConnections < 0 {
+		errs = append(errs, fmt.Errorf("%s %q: max_connections must not be negative", kind, uc.Name))
+	}
+	if uc.ConnectTimeout < 0 || uc.TLSHandshakeTimeout < 0 || uc.FirstByteTimeout < 0 || uc.RequestTimeout < 0 ||
+		uc.MaxConnsPerHost < 0 || uc.BufferSize < 0 {
+		errs = append(errs, fmt.Errorf("%s %q: connection overrides must not be negative", kind, uc.Name))
+	}
+	if !upstreamProtocols[uc.Protocol] {
+		errs = append(errs, fmt.Errorf("%s %q: unknown protocol %q (expected http1, h2 or h2c)", kind, uc.Name, uc.Protocol))
+	} else if err == nil && uc.Protocol == UpstreamH2 && parsed.Scheme != "https" {
+		errs = append(errs, fmt.Errorf("%s %q: protocol h2 requires an https URL; use h2c for cleartext HTTP/2", kind, uc.Name))
+	} else if err == nil && uc.Protocol == UpstreamH2C && parsed.Scheme != "http" {
+		errs = append(errs, fmt.Errorf("%s %q: protocol h2c requires an http URL; use h2 over TLS", kind, uc.Name))
+	}
+	return errs
+}
+
+func validateRoute(prefix string, route RouteConfig, upstreams, serverUpstreams map[string]bool) []error {
+	var errs []error
+	if !strings.HasPrefix(route.PathPrefix, "/") {
+		errs = append(errs, fmt.Errorf("%s: route path_prefix %q must start with /", prefix, route.PathPrefix))
+	}
+	if route.Latency < 0 || route.Jitter < 0 {
+		errs = append(errs, fmt.Errorf("%s: route %q latency and jitter must not be negative", prefix, route.PathPrefix))
+	}
+	errs = append(errs, route.RateLimit.validate(fmt.Sprintf("%s: route %q rate_limit", prefix, route.PathPrefix))...)
+	errs = append(errs, route.Access.validate(fmt.Sprintf("%s: route %q access", prefix, route.PathPrefix))...)
+	if _, err := route.BasicAuth.users(); err != nil {
+		errs = append(errs, fmt.Errorf("%s: route %q basic_auth: %w", prefix, route.PathPrefix, err))
+	}
+	if route.Cache.TTL < 0 || route.Cache.MaxObjectSize < 0 {
+		errs = append(errs, fmt.Errorf("%s: route %q cache ttl and max_object_size must not be negative", prefix, route.PathPrefix))
+	}
+	if route.Cache.Vary != "" && !cacheVaryModes[route.Cache.Vary] {
+		errs = append(errs, fmt.Errorf("%s: route %q: unknown cache vary %q (expected key or ignore)", prefix, route.PathPrefix, route.Cache.Vary))
+	}
+	routeLevels := []struct {
+		name  string
+		level int
+		max   int
+	}{
+		{"gzip_level", route.Compression.GzipLevel, compressionEncodings[encodingGzip]},
+		{"brotli_quality", route.Compression.BrotliQuality, compressionEncodings[encodingBrotli]},
+		{"zstd_level", route.Compression.ZstdLevel, compressionEncodings[encodingZstd]},
+	}
+	for _, l := range routeLevels {
+		if l.level < 0 || l.level > l.max {
+			errs = append(errs, fmt.Errorf("%s: route %q compression %s must be between 1 and %d", prefix, route.PathPrefix, l.name, l.max))
+		}
+	}
+	if mirror := route.Mirror; mirror.Upstream != "" && !upstreams[mirror.Upstream] {
+		errs = append(errs, fmt.Errorf("%s: route %q mirror: unknown upstream %q", prefix, route.PathPrefix, mirror.Upstream))
+	}
+	if route.Mirror.Timeout < 0 || route.Mirror.MaxInFlight < 0 {
+		errs = append(errs, fmt.Errorf("%s: route %q mirror: timeout and max_in_flight must not be negative", prefix, route.PathPrefix))
+	}
+	if route.Mirror.SampleRate < 0 || route.Mirror.SampleRate > 1 {
+		errs = append(errs, fmt.Errorf("%s: route %q mirror: sample_rate must be between 0 and 1", prefix, route.PathPrefix))
+	}
+	for _, path := range route.Mirror.Paths {
+		if !strings.HasPrefix(path, "/") {
+			errs = append(errs, fmt.Errorf("%s: route %q mirror: path %q must start with /", prefix, route.PathPrefix, path))
+		}
+	}
+	if c := route.Concurrency; c.MaxInFlight < 0 || c.QueueDepth < 0 || c.QueueTimeout < 0 {
+		errs = append(errs, fmt.Errorf("%s: route %q concurrency: max_in_flight, queue_depth and queue_timeout must not be negative", prefix, route.PathPrefix))
+	} else if c.MaxInFlight == 0 && c.QueueDepth > 0 {
+		errs = append(errs, fmt.Errorf("%s: route %q concurrency: queue_depth needs max_in_flight", prefix, route.PathPrefix))
+	}
+	errs = append(errs, route.Maintenance.validate(fmt.Sprintf("%s: route %q maintenance", prefix, route.PathPrefix))...)
+	errs = append(errs, route.Fallback.validate(fmt.Sprintf("%s: route %q fallback", prefix, route.PathPrefix))...)
+	errs = append(errs, route.RequestHeaders.validate(fmt.Sprintf("%s: route %q request_headers", prefix, route.PathPrefix))...)
+	for _, rule := range route.CookieDomain {
+		if rule.Match == "" {
+			errs = append(errs, fmt.Errorf("%s: route %q cookie_domain: match is required", prefix, route.PathPrefix))
+		}
+	}
+	for _, rule := range route.CookiePath {
+		if rule.Match == "" || (rule.Match != "*" && !strings.HasPrefix(rule.Match, "/")) {
+			errs = append(errs, fmt.Errorf("%s: route %q cookie_path: match %q must be a path starting with / or *", prefix, route.PathPrefix, rule.Match))
+		}
+	}
+	for _, rewrite := range route.Rewrite {
+		if rewrite.Match == "" {
+			errs = append(errs, fmt.Errorf("%s: route %q rewrite: match is required", prefix, route.PathPrefix))
+		} else if _, err := regexp.Compile(rewrite.Match); err != nil {
+			errs = append(errs, fmt.Errorf("%s: route %q rewrite: invalid match %q: %w", prefix, route.PathPrefix, rewrite.Match, err))
+		}
+	}
+	errs = append(errs, validateSplit(fmt.Sprintf("%s: route %q split", prefix, route.PathPrefix), route.Split, serverUpstreams)...)
+	if route.MaxRetries != nil && *route.MaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("%s: route %q max_retries must not be negative", prefix, route.PathPrefix))
+	}
+	if route.TryTimeout != nil && *route.TryTimeout < 0 {
+		errs = append(errs, fmt.Errorf("%s: route %q try_timeout must not be negative", prefix, route.PathPrefix))
+	}
+	errs = append(errs, validateRetryStatuses(fmt.Sprintf("%s: route %q", prefix, route.PathPrefix), route.RetryOnStatus)...)
+	return errs
+}
+
+func (lb LoadBalancerConfig) validate(prefix string) []error {
+	var errs []error
+	if !loadBalancerMethods[lb.Method] {
+		errs = append(errs, fmt.Errorf("%s: unknown load_balancer method %q", prefix, lb.Method))
+	}
+	if lb.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("%s: load_balancer timeout must not be negative", prefix))
+	}
+	if lb.MaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("%s: load_balancer max_retries must not be negative", prefix))
+	}
+	if lb.RetryBackoff < 0 || lb.RetryMaxBackoff < 0 {
+		errs = append(errs, fmt.Errorf("%s: load_balancer retry_backoff and retry_max_backoff must not be negative", prefix))
+	}
+	if lb.TryTimeout < 0 {
+		errs = append(errs, fmt.Errorf("%s: load_balancer try_timeout must not be negative", prefix))
+	}
+	errs = append(errs, validateRetryStatuses(prefix+": load_balancer", lb.RetryOnStatus)...)
+	if !affinityModes[lb.Affinity] {
+		errs = append(errs, fmt.Errorf("%s: unknown load_balancer affinity %q", prefix, lb.Affinity))
+	}
+	if (lb.Affinity == AffinityCookie || lb.Affinity == AffinityHeader) && lb.AffinityKey == "" {
+		errs = append(errs, fmt.Errorf("%s: load_balancer affinity %q needs an affinity_key", prefix, lb.Affinity))
+	}
+	if lb.AffinityTTL < 0 {
+		errs = append(errs, fmt.Errorf("%s: load_balancer affinity_ttl must not be negative", prefix))
+	}
+	return errs
+}
+
+func (l LoggingConfig) validate(prefix string) []error {
+	if !logLevels[l.Level] {
+		return []error{fmt.Errorf("%s: unknown log level %q", prefix, l.Level)}
+	}
+	return nil
+}
+
+func (p ProxyConfig) validate(prefix string) []error {
+	var errs []error
+	if p.MaxBodySize < 0 {
+		errs = append(errs, fmt.Errorf("%s: proxy max_body_size must not be negative", prefix))
+	}
+	timeouts := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"request_timeout", p.RequestTimeout},
+		{"response_timeout", p.ResponseTimeout},
+		{"keep_alive_timeout", p.KeepAliveTimeout},
+		{"header_read_timeout", p.HeaderReadTimeout},
+		{"body_read_timeout", p.BodyReadTimeout},
+		{"request_read_timeout", p.RequestReadTimeout},
+		{"idle_conn_timeout", p.IdleConnTimeout},
+		{"websocket_timeout", p.WebSocketTimeout},
+		{"websocket_ping_interval", p.WebSocketPingInterval},
+		{"websocket_idle_timeout", p.WebSocketIdleTimeout},
+		{"websocket_drain_timeout", p.WebSocketDrainTimeout},
+		{"quic_max_idle_timeout", p.QUICMaxIdleTimeout},
+		{"dns_timeout", p.DNSTimeout},
+		{"dns_cache_ttl", p.DNSCacheTTL},
+	}
+	for _, timeout := range timeouts {
+		if timeout.value < 0 {
+			errs = append(errs, fmt.Errorf("%s: proxy %s must not be negative", prefix, timeout.name))
+		}
+	}
+	if p.StreamThreshold < 0 {
+		errs = append(errs, fmt.Errorf("%s: proxy stream_threshold must not be negative", prefix))
+	}
+	if _, err := NewIPSet(p.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("%s: proxy trusted_proxies: %w", prefix, err))
+	}
+	if !forwardedStyles[p.ForwardedHeaders] {
+		errs = append(errs, fmt.Errorf("%s: unknown proxy forwarded_headers %q (expected x_forwarded, forwarded or both)", prefix, p.ForwardedHeaders))
+	}
+	for _, server := range p.DNSServers {
+		if _, err := nameserverAddr(server); err != nil {
+			errs = append(errs, fmt.Errorf("%s: proxy dns_servers: %w", prefix, err))
+		}
+	}
+	if p.DeadlineHeader != "" && (strings.ContainsAny(p.DeadlineHeader, ": \t") || isHopHeader([]byte(p.DeadlineHeader), nil)) {
+		errs = append(errs, fmt.Errorf("%s: proxy deadline_header %q is not a usable header name", prefix, p.DeadlineHeader))
+	}
+	if !pathNormalizations[p.PathNormalization] {
+		errs = append(errs, fmt.Errorf("%s: unknown proxy path_normalization %q (expected off, normalize or reject)", prefix, p.PathNormalization))
+	}
+	if p.BufferSize < 0 || p.WebSocketBufferSize < 0 {
+		errs = append(errs, fmt.Errorf("%s: proxy buffer sizes must not be negative", prefix))
+	}
+	if p.MaxIdleConns < 0 || p.MaxIdleConnsPerHost < 0 || p.MaxConnsPerHost < 0 || p.MaxConnections < 0 || p.MaxConnectionsPerIP < 0 || p.WebSocketMaxConnections < 0 {
+		errs = append(errs, fmt.Errorf("%s: proxy connection limits must not be negative", prefix))
+	}
+	for _, header := range p.WebSocketForwardHeaders {
+		if websocketHandshakeHeaders[http.CanonicalHeaderKey(header)] {
+			errs = append(errs, fmt.Errorf("%s: proxy websocket_forward_headers cannot include the handshake header %q", prefix, header))
+		}
+	}
+	if p.QUICMaxStreams < 0 || p.QUICMaxUniStreams < 0 || p.QUICStreamReceiveWindow < 0 || p.QUICConnectionReceiveWindow < 0 {
+		errs = append(errs, fmt.Errorf("%s: proxy quic stream limits and receive windows must not be negative", prefix))
+	}
+	for _, method := range p.QUIC0RTTMethods {
+		if !idempotentMethods[strings.ToUpper(method)] {
+			errs = append(errs, fmt.Errorf("%s: proxy quic_0rtt_methods cannot include %q, which is not idempotent and unsafe to replay", prefix, method))
+		}
+	}
+	if p.EnableH2C && !p.EnableHTTP2 {
+		errs = append(errs, fmt.Errorf("%s: proxy enable_h2c requires enable_http2", prefix))
+	}
+	if p.WebSocketCompressionLevel < 0 || p.WebSocketCompressionLevel > flate.BestCompression {
+		errs = append(errs, fmt.Errorf("%s: proxy websocket_compression_level must be between 1 and 9", prefix))
+	}
+	for _, encoding := range p.CompressionEncodings {
+		if _, ok := compressionEncodings[encoding]; !ok {
+			errs = append(errs, fmt.Errorf("%s: proxy compression_encodings: unknown encoding %q (expected br, zstd or gzip)", prefix, encoding))
+		}
+	}
+	for _, mediaType := range p.CompressionTypes {
+		if !strings.Contains(mediaType, "/") {
+			errs = append(errs, fmt.Errorf("%s: proxy compression_types: %q is not a media type such as text/html or text/*", prefix, mediaType))
+		}
+	}
+	if p.CompressionMinSize < 0 {
+		errs = append(errs, fmt.Errorf("%s: proxy compression_min_size must not be negative", prefix))
+	}
+	if !upstreamEncodingModes[p.UpstreamEncoding] {
+		errs = append(errs, fmt.Errorf("%s: unknown proxy upstream_encoding %q (expected passthrough, identity or decompress)", prefix, p.UpstreamEncoding))
+	}
+	levels := []struct {
+		name  string
+		level int
+		max   int
+	}{
+		{"gzip_level", p.GzipLevel, compressionEncodings[encodingGzip]},
+		{"brotli_quality", p.BrotliQuality, compressionEncodings[encodingBrotli]},
+		{"zstd_level", p.ZstdLevel, compressionEncodings[encodingZstd]},
+	}
+	for _, l := range levels {
+		if l.level < 1 || l.level > l.max {
+			errs = append(errs, fmt.Errorf("%s: proxy %s must be between 1 and %d", prefix, l.name, l.max))
+		}
+	}
+	return errs
+}
+
+func (r RateLimitConfig) validate(prefix string) []error {
+	if !r.Enabled {
+		return nil
+	}
+	var errs []error
+	if r.RateLimitRule.IsZero() && r.WebSocket.IsZero() {
+		errs = append(errs, fmt.Errorf("%s: rate_limit is enabled but sets no limit", prefix))
+	}
+	errs = append(errs, r.RateLimitRule.validate(prefix+": rate_limit")...)
+	errs = append(errs, r.WebSocket.validate(prefix+": rate_limit.websocket")...)
+	return errs
+}
+
+func (r RateLimitRule) validate(prefix string) []error {
+	if r.RequestsPerSecond < 0 || r.Burst < 0 || r.GlobalRequestsPerSecond < 0 || r.GlobalBurst < 0 {
+		return []error{fmt.Errorf("%s rates and bursts must not be negative", prefix)}
+	}
+	return nil
+}
+
+func (a AccessConfig) validate(prefix string) []error {
+	if _, err := NewIPFilter(a); err != nil {
+		return []error{fmt.Errorf("%s %w", prefix, err)}
+	}
+	return nil
+}
+
+func (u UserAgentConfig) validate(prefix string) []error {
+	if _, err := NewUserAgentFilter(u); err != nil {
+		return []error{fmt.Errorf("%s: user_agents %w", prefix, err)}
+	}
+	return nil
+}
+
+func (a APIKeyConfig) validate(prefix string, routes []RouteConfig) []error {
+	if _, err := NewAPIKeyAuth(a); err != nil {
+		return []error{fmt.Errorf("%s: api_keys %w", prefix, err)}
+	}
+
+	names := make(map[string]bool, len(routes))
+	for _, route := range NewRouter(routes).routes {
+		names[route.Name] = true
+	}
+	var errs []error
+	for _, entry := range a.entries() {
+		for _, route := range entry.Routes {
+			if !names[route] {
+				errs = append(errs, fmt.Errorf("%s: api_keys key %q: unknown route %q", prefix, entry.Name, route))
+			}
+		}
+	}
+	return errs
+}
+
+func (s SignatureConfig) validate(prefix string, routes []RouteConfig) []error {
+	if _, err := NewSignatureVerifier(s); err != nil {
+		return []error{fmt.Errorf("%s: signatures %w", prefix, err)}
+	}
+	if !s.Enabled {
+		return nil
+	}
+
+	names := make(map[string]bool, len(routes))
+	for _, route := range NewRouter(routes).routes {
+		names[route.Name] = true
+	}
+	var errs []error
+	for _, route := range s.Routes {
+		if !names[route] {
+			errs = append(errs, fmt.Errorf("%s: signatures: unknown route %q", prefix, route))
+		}
+	}
+	return errs
+}
+
+func (o OAuth2Config) validate(prefix string) []error {
+	if !o.Enabled {
+		return nil
+	}
+	var errs []error
+	parsed, err := url.Parse(o.IntrospectionURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		errs = append(errs, fmt.Errorf("%s: oauth2 introspection_url %q must be an http(s) URL", prefix, o.IntrospectionURL))
+	}
+	if o.CacheTTL < 0 || o.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("%s: oauth2 cache_ttl and timeout must not be negative", prefix))
+	}
+	return errs
+}
+
+func (c CacheConfig) validate(prefix string) []error {
+	var errs []error
+	if c.MaxMemory < 0 {
+		errs = append(errs, fmt.Errorf("%s: cache max_memory must not be negative", prefix))
+	}
+	if c.TTL < 0 || c.NegativeTTL < 0 {
+		errs = append(errs, fmt.Errorf("%s: cache ttl and negative_ttl must not be negative", prefix))
+	}
+	if c.MaxObjectSize < 0 {
+		errs = append(errs, fmt.Errorf("%s: cache max_object_size must not be negative", prefix))
+	}
+	if !cacheVaryModes[c.Vary] {
+		errs = append(errs, fmt.Errorf("%s: unknown cache vary %q (expected key or ignore)", prefix, c.Vary))
+	}
+	for _, status := range c.NegativeStatuses {
+		if status < 400 || status > 599 {
+			errs = append(errs, fmt.Errorf("%s: cache negative_statuses: %d is not an error status", prefix, status))
+		}
+	}
+	return errs
+}
+
+func (l LoadSheddingConfig) validate(prefix string) []error {
+	var errs []error
+	if l.MaxEventLoopLag < 0 || l.MaxPendingRequests < 0 || l.MaxMemory < 0 || l.RetryAfter < 0 {
+		errs = append(errs, fmt.Errorf("%s: load_shedding thresholds and retry_after must not be negative", prefix))
+	}
+	if l.ShedFraction <= 0 || l.ShedFraction > 1 {
+		errs = append(errs, fmt.Errorf("%s: load_shedding shed_fraction %g must be above 0 and at most 1", prefix, l.ShedFraction))
+	}
+	if l.Enabled && l.MaxEventLoopLag == 0 && l.MaxPendingRequests == 0 && l.MaxMemory == 0 {
+		errs = append(errs, fmt.Errorf("%s: load_shedding is enabled without max_event_loop_lag, max_pending_requests or max_memory", prefix))
+	}
+	return errs
+}
+
+func (m MaintenanceConfig) validate(prefix string) []error {
+	var errs []error
+	if _, err := NewIPSet(m.Allow); err != nil {
+		errs = append(errs, fmt.Errorf("%s: allow: %w", prefix, err))
+	}
+	if m.RetryAfter < 0 {
+		errs = append(errs, fmt.Errorf("%s: retry_after must not be negative", prefix))
+	}
+	return errs
+}
+
+func (f FallbackConfig) validate(prefix string) []error {
+	var errs []error
+	if f.Status != 0 && (f.Status < 200 || f.Status > 599) {
+		errs = append(errs, fmt.Errorf("%s: status must be between 200 and 599", prefix))
+	}
+	for _, header := range f.Headers {
+		if _, _, ok := parseHeaderEntry(header); !ok {
+			errs = append(errs, fmt.Errorf("%s: header %q must be \"Name: value\"", prefix, header))
+		}
+	}
+	return errs
+}
+
+func (e ErrorPagesConfig) validate(prefix string) []error {
+	var errs []error
+	seen := make(map[int]bool, len(e.Pages))
+	for _, page := range e.Pages {
+		switch {
+		case page.Status < 400 || page.Status > 599:
+			errs = append(errs, fmt.Errorf("%s: status %d must be between 400 and 599", prefix, page.Status))
+		case seen[page.Status]:
+			errs = append(errs, fmt.Errorf("%s: more than one page for status %d", prefix, page.Status))
+		case page.Body == "" && page.BodyFile == "":
+			errs = append(errs, fmt.Errorf("%s: page for status %d needs body or body_file", prefix, page.Status))
+		}
+		seen[page.Status] = true
+	}
+	return errs
+}
+
+func (h HeaderRulesConfig) validate(prefix string) []error {
+	var errs []error
+	for _, rule := range []struct {
+		name    string
+		entries []string
+	}{{"add", h.Add}, {"set", h.Set}} {
+		for _, header := range rule.entries {
+			name, _, ok := parseHeaderEntry(header)
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: %s: header %q must be \"Name: value\"", prefix, rule.name, header))
+			} else if strings.EqualFold(name, "Host") {
+				errs = append(errs, fmt.Errorf("%s: %s: the Host header cannot be changed", prefix, rule.name))
+			}
+		}
+	}
+	for _, name := range h.Remove {
+		if trimmed := strings.TrimSuffix(name, "*"); trimmed == "" || strings.ContainsAny(trimmed, ": *") {
+			errs = append(errs, fmt.Errorf("%s: remove: invalid header name %q", prefix, name))
+		} else if strings.EqualFold(name, "Host") {
+			errs = append(errs, fmt.Errorf("%s: remove: the Host header cannot be removed", prefix))
+		}
+	}
+	return errs
+}
+
+// validateRetryStatuses checks the upstream statuses of a retry_on_status setting
+func validateRetryStatuses(prefix string, statuses []int) []error {
+	var errs []error
+	for _, status := range statuses {
+		if status < 400 || status > 599 {
+			errs = append(errs, fmt.Errorf("%s: retry_on_status %d is not an error status (400-599)", prefix, status))
+		}
+	}
+	return errs
+}
+
+// validateSplit checks the groups of a traffic split: named once each, made of the
+// server's upstreams, with non-negative weights that are not all zero
+func validateSplit(prefix string, groups []TrafficSplitConfig, serverUpstreams map[string]bool) []error {
+	var errs []error
+	names := make(map[string]bool, len(groups))
+	total := 0
+	for _, group := range groups {
+		switch {
+		case group.Name == "":
+			errs = append(errs, fmt.Errorf("%s: every group needs a name", prefix))
+		case names[group.Name]:
+			errs = append(errs, fmt.Errorf("%s: duplicate group %q", prefix, group.Name))
+		}
+		names[group.Name] = true
+		if len(group.Upstreams) == 0 {
+			errs = append(errs, fmt.Errorf("%s: group %q lists no upstreams", prefix, group.Name))
+		}
+		for _, name := range group.Upstreams {
+			if !serverUpstreams[name] {
+				errs = append(errs, fmt.Errorf("%s: group %q: upstream %q is not an upstream of the server", prefix, group.Name, name))
+			}
+		}
+		if group.Weight < 0 {
+			errs = append(errs, fmt.Errorf("%s: group %q weight must not be negative", prefix, group.Name))
+		}
+		if group.MatchHeader != "" && group.MatchCookie != "" {
+			errs = append(errs, fmt.Errorf("%s: group %q: match_header and match_cookie are mutually exclusive", prefix, group.Name))
+		}
+		if group.MatchValue != "" && group.MatchHeader == "" && group.MatchCookie == "" {
+			errs = append(errs, fmt.Errorf("%s: group %q: match_value needs match_header or match_cookie", prefix, group.Name))
+		}
+		total += group.Weight
+	}
+	if len(groups) > 0 && total == 0 {
+		errs = append(errs, fmt.Errorf("%s: at least one group needs a positive weight", prefix))
+	}
+	return errs
+}
@@ -0,0 +1,38 @@
+package main
+
+import "sync"
+
+// ConnLimiter counts the open connections of each client IP, so a single client
+// cannot exhaust the event loops by opening connections it never uses
+type ConnLimiter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// NewConnLimiter creates an empty limiter
+func NewConnLimiter() *ConnLimiter {
+	return &ConnLimiter{counts: make(map[string]int)}
+}
+
+// Acquire counts a new connection of the client IP, or reports false when the
+// client already has limit connections open. A limit of 0 allows any number.
+func (l *ConnLimiter) Acquire(ip string, limit int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limit > 0 && l.counts[ip] >= limit {
+		return false
+	}
+	l.counts[ip]++
+	return true
+}
+
+// Release forgets a connection counted by Acquire
+func (l *ConnLimiter) Release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts[ip] <= 1 {
+		delete(l.counts, ip)
+		return
+	}
+	l.counts[ip]--
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// connectionIDs issues process-wide unique connection IDs
+var connectionIDs uint64
+
+// TrackedConn is an active client connection known to the admin API
+type TrackedConn struct {
+	ID       uint64
+	Server   string
+	Remote   string
+	Protocol string
+	Opened   time.Time
+
+	mu       sync.Mutex
+	route    string
+	upstream string
+	closeFn  func() error
+}
+
+// ConnectionInfo is the admin API view of a tracked connection
+type ConnectionInfo struct {
+	ID       uint64 `json:"id"`
+	Server   string `json:"server"`
+	Remote   string `json:"remote"`
+	Protocol string `json:"protocol"`
+	Opened   string `json:"opened"`
+	Duration string `json:"duration"`
+	Route    string `json:"route"`
+	Upstream string `json:"upstream"`
+}
+
+// SetTarget records the route and upstream of the latest request on the connection
+func (tc *TrackedConn) SetTarget(route, upstream string) {
+	if tc == nil {
+		return
+	}
+	tc.mu.Lock()
+	tc.route = route
+	tc.upstream = upstream
+	tc.mu.Unlock()
+}
+
+// SetProtocol records a protocol switch on the connection, such as a WebSocket upgrade
+func (tc *TrackedConn) SetProtocol(protocol string) {
+	if tc == nil {
+		return
+	}
+	tc.mu.Lock()
+	tc.Protocol = protocol
+	tc.mu.Unlock()
+}
+
+// SetRemote records the client's address once a PROXY protocol header tells it
+func (tc *TrackedConn) SetRemote(remote string) {
+	if tc == nil {
+		return
+	}
+	tc.mu.Lock()
+	tc.Remote = remote
+	tc.mu.Unlock()
+}
+
+// Upstream returns the upstream of the latest request on the connection
+func (tc *TrackedConn) Upstream() string {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.upstream
+}
+
+// Close forcibly closes the underlying client connection
+func (tc *TrackedConn) Close() error {
+	return tc.closeFn()
+}
+
+func (tc *TrackedConn) info() ConnectionInfo {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return ConnectionInfo{
+		ID:       tc.ID,
+		Server:   tc.Server,
+		Remote:   tc.Remote,
+		Protocol: tc.Protocol,
+		Opened:   tc.Opened.Format(time.RFC3339),
+		Duration: time.Since(tc.Opened).Round(time.Millisecond).String(),
+		Route:    tc.route,
+		Upstream: tc.upstream,
+	}
+}
+
+// ConnectionTracker keeps the active client connections of a server instance
+type ConnectionTracker struct {
+	server string
+	mu     sync.RWMutex
+	conns  map[uint64]*TrackedConn
+
+	// httpConns maps net/http connections to their tracked entry
+	httpConns sync.Map
+}
+
+// NewConnectionTracker creates a tracker for the named server instance
+func NewConnectionTracker(server string) *ConnectionTracker {
+	return &ConnectionTracker{
+		server: server,
+		conns:  make(map[uint64]*TrackedConn),
+	}
+}
+
+// Track registers a new connection; closeFn must be safe to call from any goroutine
+func (t *ConnectionTracker) Track(remote, protocol string, closeFn func() error) *TrackedConn {
+	tc := &TrackedConn{
+		ID:       atomic.AddUint64(&connectionIDs, 1),
+		Server:   t.server,
+		Remote:   remote,
+		Protocol: protocol,
+		Opened:   time.Now(),
+		closeFn:  closeFn,
+	}
+
+	t.mu.Lock()
+	t.conns[tc.ID] = tc
+	t.mu.Unlock()
+	return tc
+}
+
+// Untrack removes a connection from the tracker
+func (t *ConnectionTracker) Untrack(tc *TrackedConn) {
+	if tc == nil {
+		return
+	}
+	t.mu.Lock()
+	delete(t.conns, tc.ID)
+	t.mu.Unlock()
+}
+
+// Get returns the tracked connection with the given ID
+func (t *ConnectionTracker) Get(id uint64) (*TrackedConn, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tc, ok := t.conns[id]
+	return tc, ok
+}
+
+// List returns all tracked connections ordered by ID
+func (t *ConnectionTracker) List() []*TrackedConn {
+	t.mu.RLock()
+	conns := make([]*TrackedConn, 0, len(t.conns))
+	for _, tc := range t.conns {
+		conns = append(conns, tc)
+	}
+	t.mu.RUnlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	return conns
+}
+
+// ConnContext tracks connections accepted by a net/http server and stores the
+// tracked entry in the connection context (use as http.Server.ConnContext)
+func (t *ConnectionTracker) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	tc := t.Track(c.RemoteAddr().String(), "HTTP/1.1", c.Close)
+	t.httpConns.Store(c, tc)
+	return context.WithValue(ctx, trackedConnKey{}, tc)
+}
+
+// ConnState untracks net/http connections once they are closed or hijacked
+// (use as http.Server.ConnState); hijacked WebSocket sessions are tracked separately
+func (t *ConnectionTracker) ConnState(c net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	if value, ok := t.httpConns.LoadAndDelete(c); ok {
+		t.Untrack(value.(*TrackedConn))
+	}
+}
+
+// connContext is the per-connection state stored in gnet.Conn.Context()
+type connContext struct {
+	tracked  *TrackedConn
+	deadline *readDeadline
+	clientIP string         // counted against the per-IP connection limit once set
+	remote   string         // the client's address, from the PROXY protocol header behind a balancer
+	tunnel   *wsTunnel      // set once the connection is upgraded to a WebSocket
+	stream   *trafficStream // set while an exchange finishes outside the event loop
+	closed   chan struct{}  // closed once the connection is
+	reply    replyMode      // how the request being answered expects its response
+
+	// Progress of the request being received, zero between requests
+	readStart   time.Time
+	headersRead time.Time
+	continued   bool // 100 Continue was sent for the body
+
+	proxyHeader bool // the PROXY protocol header has yet to arrive
+}
+
+// remoteAddr returns the address of the client of a gnet connection
+func remoteAddr(c gnet.Conn) string {
+	if cc, ok := c.Context().(*connContext); ok {
+		return cc.remote
+	}
+	return c.RemoteAddr().String()
+}
+
+// trackedConnKey is the context key of the tracked connection of a net/http request
+type trackedConnKey struct{}
+
+// trackedConnFromContext returns the tracked connection of a net/http request, if any
+func trackedConnFromContext(ctx context.Context) *TrackedConn {
+	tc, _ := ctx.Value(trackedConnKey{}).(*TrackedConn)
+	return tc
+}
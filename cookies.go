@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// RewritesCookies reports whether the route changes the cookies its upstreams set
+func (r *Route) RewritesCookies() bool {
+	return r != nil && (len(r.config.CookieDomain) > 0 || len(r.config.CookiePath) > 0)
+}
+
+// rewriteCookieDomain returns the Domain attribute value after the first rule
+// matching it, and false when no rule does
+func rewriteCookieDomain(rules []CookieRewriteConfig, domain string) (string, bool) {
+	bare := strings.TrimPrefix(domain, ".")
+	for _, rule := range rules {
+		if rule.Match == "*" || strings.EqualFold(strings.TrimPrefix(rule.Match, "."), bare) {
+			return rule.Replacement, true
+		}
+	}
+	return domain, false
+}
+
+// rewriteCookiePath returns the Path attribute value after the first rule whose
+// prefix it starts with, the prefix replaced
+func rewriteCookiePath(rules []CookieRewriteConfig, path string) string {
+	for _, rule := range rules {
+		if rule.Match == "*" {
+			return rule.Replacement
+		}
+		if strings.HasPrefix(path, rule.Match) {
+			return rule.Replacement + path[len(rule.Match):]
+		}
+	}
+	return path
+}
+
+// rewriteSetCookie applies the route's cookie_domain and cookie_path rules to a
+// Set-Cookie value. A Domain rewritten to nothing is dropped, which binds the
+// cookie to the host the client used.
+func (r *Route) rewriteSetCookie(value string) string {
+	attributes := strings.Split(value, ";")
+	kept := attributes[:1]
+	for _, attribute := range attributes[1:] {
+		name, attrValue, _ := strings.Cut(strings.TrimSpace(attribute), "=")
+		switch {
+		case strings.EqualFold(name, "Domain"):
+			domain, matched := rewriteCookieDomain(r.config.CookieDomain, attrValue)
+			if !matched {
+				kept = append(kept, attribute)
+			} else if domain != "" {
+				kept = append(kept, " "+name+"="+domain)
+			}
+		case strings.EqualFold(name, "Path") && len(r.config.CookiePath) > 0:
+			kept = append(kept, " "+name+"="+rewriteCookiePath(r.config.CookiePath, attrValue))
+		default:
+			kept = append(kept, attribute)
+		}
+	}
+	return strings.Join(kept, ";")
+}
+
+// rewriteStandardCookies rewrites the cookies set by a response to a net/http client
+func (r *Route) rewriteStandardCookies(h http.Header) {
+	if !r.RewritesCookies() {
+		return
+	}
+	cookies := h.Values("Set-Cookie")
+	for i, cookie := range cookies {
+		cookies[i] = r.rewriteSetCookie(cookie)
+	}
+}
+
+// rewriteFastHTTPCookies rewrites the cookies set by a response to a gnet client
+func (r *Route) rewriteFastHTTPCookies(h *fasthttp.ResponseHeader) {
+	if !r.RewritesCookies() {
+		return
+	}
+	var cookies []string
+	h.VisitAllCookie(func(_, value []byte) {
+		cookies = append(cookies, r.rewriteSetCookie(string(value)))
+	})
+	if len(cookies) == 0 {
+		return
+	}
+	h.DelAllCookies()
+	for _, cookie := range cookies {
+		h.Add("Set-Cookie", cookie)
+	}
+}
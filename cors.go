@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/exp/slices"
+)
+
+// allowedOrigin returns the Access-Control-Allow-Origin value for a request origin,
+// or "" when the request has no origin or the origin is not allowed. Listed origins
+// are reflected. With no list or a "*" entry any origin is allowed: as "*", or
+// reflected when credentials are allowed, since browsers reject "*" on credentialed requests.
+func (c CORSConfig) allowedOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	if slices.Contains(c.AllowedOrigins, origin) {
+		return origin
+	}
+	if len(c.AllowedOrigins) == 0 || slices.Contains(c.AllowedOrigins, "*") {
+		if c.AllowCredentials {
+			return origin
+		}
+		return "*"
+	}
+	return ""
+}
+
+// allowPrivateNetwork reports whether a preflight from origin asking for Private
+// Network Access is granted. The origin must already be allowed by allowedOrigin.
+func (c CORSConfig) allowPrivateNetwork(origin string) bool {
+	if !c.AllowPrivateNetwork {
+		return false
+	}
+	return len(c.PrivateNetworkOrigins) == 0 || slices.Contains(c.PrivateNetworkOrigins, origin)
+}
+
+// responseHeaders returns the CORS headers of an actual (non-preflight) response
+// to a request from origin
+func (c CORSConfig) responseHeaders(origin string) [][2]string {
+	allowed := c.allowedOrigin(origin)
+	if allowed == "" {
+		return nil
+	}
+	headers := [][2]string{{"Access-Control-Allow-Origin", allowed}}
+	if len(c.ExposedHeaders) > 0 {
+		headers = append(headers, [2]string{"Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", ")})
+	}
+	if c.AllowCredentials {
+		headers = append(headers, [2]string{"Access-Control-Allow-Credentials", "true"})
+	}
+	return headers
+}
+
+// applyCORSFastHTTP adds the CORS headers to a gnet response. The response depends
+// on the request origin, so caches are told with Vary: Origin. On routes that
+// delegate CORS, headers set by the upstream are kept and only missing ones added.
+func applyCORSFastHTTP(h *fasthttp.ResponseHeader, cfg CORSConfig, origin string, delegated bool) {
+	if !cfg.Enabled {
+		return
+	}
+	for _, header := range cfg.responseHeaders(origin) {
+		if delegated && len(h.Peek(header[0])) > 0 {
+			continue
+		}
+		h.Set(header[0], header[1])
+	}
+	if !varyIncludes(string(h.Peek("Vary")), "Origin") {
+		h.Add("Vary", "Origin")
+	}
+}
+
+// applyCORS adds the CORS headers to a net/http response
+func applyCORS(h http.Header, cfg CORSConfig, origin string, delegated bool) {
+	if !cfg.Enabled {
+		return
+	}
+	for _, header := range cfg.responseHeaders(origin) {
+		if delegated && h.Get(header[0]) != "" {
+			continue
+		}
+		h.Set(header[0], header[1])
+	}
+	if !varyIncludes(strings.Join(h.Values("Vary"), ","), "Origin") {
+		h.Add("Vary", "Origin")
+	}
+}
+
+// isPreflight reports whether a request is a CORS preflight
+func isPreflight(method, origin, requestMethod string) bool {
+	return method == http.MethodOptions && origin != "" && requestMethod != ""
+}
+
+// varyIncludes reports whether a Vary value already lists a header (or is "*")
+func varyIncludes(vary, header string) bool {
+	for _, field := range strings.Split(vary, ",") {
+		field = strings.TrimSpace(field)
+		if field == "*" || strings.EqualFold(field, header) {
+			return true
+		}
+	}
+	return false
+}
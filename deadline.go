@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// grpcTimeoutHeader is sent in gRPC's own format when it is the deadline header
+const grpcTimeoutHeader = "Grpc-Timeout"
+
+// grpcTimeoutUnits are the units of a grpc-timeout value, by their letter
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// parseDeadlineValue reads a timeout of the deadline header: milliseconds, or
+// gRPC's format of at most eight digits and a unit for grpc-timeout
+func parseDeadlineValue(name, value string) (time.Duration, bool) {
+	if !strings.EqualFold(name, grpcTimeoutHeader) {
+		ms, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || ms < 0 || ms > math.MaxInt64/int64(time.Millisecond) {
+			return 0, false
+		}
+		return time.Duration(ms) * time.Millisecond, true
+	}
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+	unit, ok := grpcTimeoutUnits[value[len(value)-1]]
+	if !ok {
+		return 0, false
+	}
+	amount, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	// Eight digits of hours do not fit a time.Duration
+	if err != nil || amount < 0 || amount > math.MaxInt64/int64(unit) {
+		return 0, false
+	}
+	return time.Duration(amount) * unit, true
+}
+
+// formatDeadlineValue writes a timeout for the deadline header, rounded up to
+// whole milliseconds so an upstream is never told it has no time left
+func formatDeadlineValue(name string, remaining time.Duration) string {
+	ms := max((remaining+time.Millisecond-1)/time.Millisecond, 1)
+	if !strings.EqualFold(name, grpcTimeoutHeader) {
+		return strconv.FormatInt(int64(ms), 10)
+	}
+	// gRPC allows eight digits, about 27 hours in milliseconds
+	if ms < 1e8 {
+		return strconv.FormatInt(int64(ms), 10) + "m"
+	}
+	return strconv.FormatInt(int64(min((remaining+time.Second-1)/time.Second, 1e8-1)), 10) + "S"
+}
+
+// deadlineValue returns the value of the deadline header sent to an upstream
+// with remaining time to answer, kept shorter when the client, or a proxy in
+// front, already asked for less
+func deadlineValue(name, current string, remaining time.Duration) string {
+	if asked, ok := parseDeadlineValue(name, current); ok && asked < remaining {
+		remaining = asked
+	}
+	return formatDeadlineValue(name, remaining)
+}
+
+// setDeadlineHeader tells a net/http upstream request sent under ctx how long it
+// has left before the deadline of ctx, in the deadline_header when one is configured
+func setDeadlineHeader(ctx context.Context, h http.Header, name string) {
+	deadline, ok := ctx.Deadline()
+	if name == "" || !ok {
+		return
+	}
+	h.Set(name, deadlineValue(name, h.Get(name), time.Until(deadline)))
+}
+
+// setFastHTTPDeadlineHeader is setDeadlineHeader for a gnet upstream request
+// with timeout to answer
+func setFastHTTPDeadlineHeader(h *fasthttp.RequestHeader, name string, timeout time.Duration) {
+	if name == "" || timeout <= 0 {
+		return
+	}
+	h.Set(name, deadlineValue(name, string(h.Peek(name)), timeout))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/valyala/fasthttp"
+)
+
+// errorPage is the body answered with one error status
+type errorPage struct {
+	contentType string
+	body        []byte
+}
+
+// ErrorPages replaces the plain text bodies of the errors a server answers
+// itself, and optionally those of its upstreams, with configured pages
+type ErrorPages struct {
+	config ErrorPagesConfig
+	pages  map[int]errorPage
+}
+
+// NewErrorPages creates the error pages of a server, or returns nil when it has none
+func NewErrorPages(config ErrorPagesConfig) *ErrorPages {
+	if len(config.Pages) == 0 {
+		return nil
+	}
+	e := &ErrorPages{config: config, pages: make(map[int]errorPage, len(config.Pages))}
+	for _, page := range config.Pages {
+		body := page.Body
+		if page.BodyFile != "" {
+			body = page.page
+		}
+		contentType := page.ContentType
+		if contentType == "" {
+			contentType = defaultPageContentType
+		}
+		e.pages[page.Status] = errorPage{contentType: contentType, body: []byte(body)}
+	}
+	return e
+}
+
+// page returns the page of an error status, for a response of an upstream when
+// fromUpstream is set
+func (e *ErrorPages) page(status int, fromUpstream bool) (errorPage, bool) {
+	if e == nil || (fromUpstream && !e.config.Upstream) {
+		return errorPage{}, false
+	}
+	page, ok := e.pages[status]
+	return page, ok
+}
+
+// Response sources of an errorPageWriter
+const (
+	responseFromProxy    = iota // an error the proxy answers itself
+	responseFromUpstream        // relayed from an upstream
+	responseOwnPage             // a page of its own, such as maintenance, never replaced
+)
+
+// errorPageWriter replaces the body of an error response written to a net/http
+// client with the configured page
+type errorPageWriter struct {
+	http.ResponseWriter
+	pages    *ErrorPages
+	source   int
+	replaced bool // the body written is dropped for the page
+}
+
+// wrap returns w, replacing the bodies of error responses written to it when
+// the server has error pages
+func (e *ErrorPages) wrap(w http.ResponseWriter) http.ResponseWriter {
+	if e == nil {
+		return w
+	}
+	return &errorPageWriter{ResponseWriter: w, pages: e}
+}
+
+// setResponseSource tells the error page writer under w, if any, where the
+// response about to be written comes from
+func setResponseSource(w http.ResponseWriter, source int) {
+	if ew, ok := w.(*errorPageWriter); ok {
+		ew.source = source
+	}
+}
+
+func (w *errorPageWriter) WriteHeader(code int) {
+	page, ok := w.pages.page(code, w.source == responseFromUpstream)
+	if !ok || w.source == responseOwnPage || w.replaced {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	header := w.Header()
+	header.Del("Content-Encoding")
+	header.Del("X-Content-Type-Options")
+	header.Set("Content-Type", page.contentType)
+	header.Set("Content-Length", strconv.Itoa(len(page.body)))
+	w.ResponseWriter.WriteHeader(code)
+	w.ResponseWriter.Write(page.body)
+	w.replaced = true
+}
+
+func (w *errorPageWriter) Write(b []byte) (int, error) {
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the wrapped writer, for http.ResponseController
+func (w *errorPageWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// applyFastHTTP replaces the body of an error response to a gnet client with its
+// page, for a response of an upstream when fromUpstream is set
+func (e *ErrorPages) applyFastHTTP(resp *fasthttp.Response, fromUpstream bool) {
+	page, ok := e.page(resp.StatusCode(), fromUpstream)
+	if !ok {
+		return
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Set("Content-Type", page.contentType)
+	resp.SetBody(page.body)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/valyala/fasthttp"
+)
+
+// fallbackResponse is the static response of a route whose upstreams are all
+// unhealthy, such as a "we'll be right back" page or a cached JSON default
+type fallbackResponse struct {
+	status      int
+	contentType string
+	headers     [][2]string
+	body        []byte
+}
+
+// newFallbackResponse creates the fallback response of a route, or returns nil
+// when the route has none and answers a plain 503
+func newFallbackResponse(config FallbackConfig) *fallbackResponse {
+	if config.Status == 0 && config.Body == "" && config.BodyFile == "" && len(config.Headers) == 0 {
+		return nil
+	}
+	f := &fallbackResponse{
+		status:      config.Status,
+		contentType: config.ContentType,
+		body:        []byte(config.Body),
+	}
+	if config.BodyFile != "" {
+		f.body = []byte(config.page)
+	}
+	if f.status == 0 {
+		f.status = http.StatusServiceUnavailable
+	}
+	if f.contentType == "" {
+		f.contentType = defaultPageContentType
+	}
+	// Headers were checked by Config.Validate, so each has a name
+	for _, header := range config.Headers {
+		name, value, _ := parseHeaderEntry(header)
+		f.headers = append(f.headers, [2]string{name, value})
+	}
+	return f
+}
+
+// write answers a net/http request with the fallback response. The configured
+// headers replace the default Content-Type and Cache-Control.
+func (f *fallbackResponse) write(w http.ResponseWriter) {
+	setResponseSource(w, responseOwnPage)
+	header := w.Header()
+	header.Set("Content-Type", f.contentType)
+	header.Set("Cache-Control", "no-store")
+	for _, h := range f.headers {
+		header.Del(h[0])
+	}
+	for _, h := range f.headers {
+		header.Add(h[0], h[1])
+	}
+	header.Set("Content-Length", strconv.Itoa(len(f.body)))
+	w.WriteHeader(f.status)
+	w.Write(f.body)
+}
+
+// writeFastHTTP fills a fasthttp response with the fallback response
+func (f *fallbackResponse) writeFastHTTP(resp *fasthttp.Response) {
+	resp.SetStatusCode(f.status)
+	resp.Header.Set("Content-Type", f.contentType)
+	resp.Header.Set("Cache-Control", "no-store")
+	for _, h := range f.headers {
+		resp.Header.Del(h[0])
+	}
+	for _, h := range f.headers {
+		resp.Header.Add(h[0], h[1])
+	}
+	resp.SetBody(f.body)
+}
+
+// Fallback returns the response of the route when no upstream is healthy, nil
+// when it has none
+func (r *Route) Fallback() *fallbackResponse {
+	if r == nil {
+		return nil
+	}
+	return r.fallback
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+// RequestFilter lets a program embedding the proxy change or answer requests
+// before they are forwarded. Filters run after the access lists, maintenance,
+// rate limits and authentication, with the name of the route the request
+// matched. Changes to the method, URL, headers and body are what the upstream
+// receives. A filter returning a response answers the client with it, and the
+// request never reaches an upstream nor the filters after it.
+type RequestFilter interface {
+	FilterRequest(r *http.Request, route string) *http.Response
+}
+
+// RequestFilterFunc adapts a function to a RequestFilter
+type RequestFilterFunc func(r *http.Request, route string) *http.Response
+
+// FilterRequest calls f(r, route)
+func (f RequestFilterFunc) FilterRequest(r *http.Request, route string) *http.Response {
+	return f(r, route)
+}
+
+// ResponseFilter lets a program embedding the proxy change the response of an
+// upstream before it is cached and relayed to the client. r is the request as
+// it was forwarded, its body already sent. A filter reading resp.Body must
+// replace it; the proxy closes the body it is left with, and the upstream's.
+type ResponseFilter interface {
+	FilterResponse(r *http.Request, resp *http.Response)
+}
+
+// ResponseFilterFunc adapts a function to a ResponseFilter
+type ResponseFilterFunc func(r *http.Request, resp *http.Response)
+
+// FilterResponse calls f(r, resp)
+func (f ResponseFilterFunc) FilterResponse(r *http.Request, resp *http.Response) {
+	f(r, resp)
+}
+
+// filterChain holds the filters registered on a server, shared by its handlers
+type filterChain struct {
+	mu       sync.RWMutex
+	request  []RequestFilter
+	response []ResponseFilter
+}
+
+// addRequest appends a request filter, run after the ones already registered
+func (f *filterChain) addRequest(filter RequestFilter) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.request = append(f.request[:len(f.request):len(f.request)], filter)
+}
+
+// addResponse appends a response filter, run after the ones already registered
+func (f *filterChain) addResponse(filter ResponseFilter) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.response = append(f.response[:len(f.response):len(f.response)], filter)
+}
+
+// requestFilters returns the registered request filters
+func (f *filterChain) requestFilters() []RequestFilter {
+	if f == nil {
+		return nil
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.request
+}
+
+// responseFilters returns the registered response filters
+func (f *filterChain) responseFilters() []ResponseFilter {
+	if f == nil {
+		return nil
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.response
+}
+
+// filterRequest runs the request filters on a net/http request, returning the
+// response of the first one answering it, or nil when it goes on to an upstream
+func (f *filterChain) filterRequest(r *http.Request, route string) staticPage {
+	for _, filter := range f.requestFilters() {
+		if resp := filter.FilterRequest(r, route); resp != nil {
+			return filteredResponse{resp}
+		}
+	}
+	return nil
+}
+
+// filterResponse runs the response filters on the response of an upstream to a
+// net/http request. A replaced body has its Content-Length header set from
+// resp.ContentLength, and the upstream's is closed.
+func (f *filterChain) filterResponse(r *http.Request, resp *http.Response) {
+	filters := f.responseFilters()
+	if len(filters) == 0 {
+		return
+	}
+	body := resp.Body
+	for _, filter := range filters {
+		filter.FilterResponse(r, resp)
+	}
+	if resp.Body != body {
+		body.Close()
+		resp.Header.Del("Content-Length")
+		if resp.ContentLength >= 0 {
+			resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+		}
+	}
+}
+
+// filterFastHTTPRequest runs the request filters on a gnet request from
+// remoteAddr through a net/http copy of it, and applies their changes back. The
+// body of an upload still arriving is not available to the filters.
+func (f *filterChain) filterFastHTTPRequest(req *fasthttp.Request, remoteAddr, route string, upload bool) (staticPage, error) {
+	if len(f.requestFilters()) == 0 {
+		return nil, nil
+	}
+	r, err := standardRequest(req, remoteAddr, !upload)
+	if err != nil {
+		return nil, err
+	}
+	body := r.Body
+	if page := f.filterRequest(r, route); page != nil {
+		return page, nil
+	}
+	req.Header.SetMethod(r.Method)
+	req.SetRequestURI(r.URL.RequestURI())
+	req.Header.SetHost(r.Host)
+	replaceFastHTTPHeader(&req.Header, r.Header)
+	if upload || r.Body == body {
+		return nil, nil
+	}
+	defer r.Body.Close()
+	replaced, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBody(replaced)
+	return nil, nil
+}
+
+// filterFastHTTPResponse runs the response filters on the response of an upstream
+// to a gnet request from remoteAddr, and applies their changes back. A replaced
+// body is buffered in full.
+func (f *filterChain) filterFastHTTPResponse(req *fasthttp.Request, resp *fasthttp.Response, remoteAddr string) error {
+	filters := f.responseFilters()
+	if len(filters) == 0 {
+		return nil
+	}
+	r, err := standardRequest(req, remoteAddr, false)
+	if err != nil {
+		return err
+	}
+	var body io.Reader
+	if resp.IsBodyStream() {
+		body = resp.BodyStream()
+	} else {
+		body = bytes.NewReader(resp.Body())
+	}
+	original := io.NopCloser(body)
+	length := int64(resp.Header.ContentLength())
+	if length < 0 {
+		length = -1
+	}
+	std := &http.Response{
+		Status:        strconv.Itoa(resp.StatusCode()) + " " + http.StatusText(resp.StatusCode()),
+		StatusCode:    resp.StatusCode(),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          original,
+		ContentLength: length,
+		Request:       r,
+	}
+	resp.Header.VisitAll(func(key, value []byte) {
+		std.Header.Add(string(key), string(value))
+	})
+	for _, filter := range filters {
+		filter.FilterResponse(r, std)
+	}
+
+	resp.SetStatusCode(std.StatusCode)
+	replaceFastHTTPHeader(&resp.Header, std.Header)
+	if std.Body == original {
+		return nil
+	}
+	defer std.Body.Close()
+	replaced, err := io.ReadAll(std.Body)
+	if err != nil {
+		return err
+	}
+	resp.SetBody(replaced)
+	resp.Header.SetContentLength(len(replaced))
+	return nil
+}
+
+// standardRequest returns a net/http copy of a gnet request from remoteAddr,
+// with its body when withBody is set
+func standardRequest(req *fasthttp.Request, remoteAddr string, withBody bool) (*http.Request, error) {
+	body := io.Reader(http.NoBody)
+	if withBody {
+		body = bytes.NewReader(req.Body())
+	}
+	r, err := http.NewRequest(string(req.Header.Method()), string(req.RequestURI()), body)
+	if err != nil {
+		return nil, err
+	}
+	r.RequestURI = string(req.RequestURI())
+	r.Host = string(req.Header.Host())
+	r.RemoteAddr = remoteAddr
+	req.Header.VisitAll(func(key, value []byte) {
+		r.Header.Add(string(key), string(value))
+	})
+	r.Header.Del("Host")
+	return r, nil
+}
+
+// fastHTTPHeader is the part of fasthttp's request and response headers filters
+// change
+type fastHTTPHeader interface {
+	VisitAll(f func(key, value []byte))
+	Del(key string)
+	Add(key, value string)
+}
+
+// replaceFastHTTPHeader gives a fasthttp header the fields of h. Host and the
+// framing fields, Content-Length and Transfer-Encoding, stay fasthttp's own.
+func replaceFastHTTPHeader(dst fastHTTPHeader, h http.Header) {
+	var names []string
+	dst.VisitAll(func(key, _ []byte) {
+		names = append(names, string(key))
+	})
+	for _, name := range names {
+		if !filterKeepsHeader(name) {
+			dst.Del(name)
+		}
+	}
+	for name, values := range h {
+		if filterKeepsHeader(name) {
+			continue
+		}
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
+
+// filterKeepsHeader reports whether a header field is left to fasthttp when the
+// changes of filters are applied back
+func filterKeepsHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "Host", "Content-Length", "Transfer-Encoding":
+		return true
+	}
+	return false
+}
+
+// filteredResponse is the response a request filter answered a request with
+type filteredResponse struct {
+	resp *http.Response
+}
+
+// status returns the status code of the response, 200 when the filter left it unset
+func (f filteredResponse) status() int {
+	if f.resp.StatusCode == 0 {
+		return http.StatusOK
+	}
+	return f.resp.StatusCode
+}
+
+// write answers a net/http request with the filter's response
+func (f filteredResponse) write(w http.ResponseWriter) {
+	setResponseSource(w, responseOwnPage)
+	header := w.Header()
+	for name, values := range f.resp.Header {
+		header[name] = append(header[name], values...)
+	}
+	w.WriteHeader(f.status())
+	if f.resp.Body != nil {
+		defer f.resp.Body.Close()
+		io.Copy(w, f.resp.Body)
+	}
+}
+
+// writeFastHTTP fills a fasthttp response with the filter's response
+func (f filteredResponse) writeFastHTTP(resp *fasthttp.Response) {
+	resp.SetStatusCode(f.status())
+	for name, values := range f.resp.Header {
+		if filterKeepsHeader(name) {
+			continue
+		}
+		for _, value := range values {
+			resp.Header.Add(name, value)
+		}
+	}
+	if f.resp.Body != nil {
+		defer f.resp.Body.Close()
+		body, _ := io.ReadAll(f.resp.Body)
+		resp.SetBody(body)
+	}
+}
+
+// RegisterRequestFilter adds a filter run on the HTTP requests of the server,
+// after the ones already registered. WebSocket upgrades are not filtered.
+func (ps *ProxyServer) RegisterRequestFilter(filter RequestFilter) {
+	ps.filters.addRequest(filter)
+}
+
+// RegisterResponseFilter adds a filter run on the responses of the server's
+// upstreams, after the ones already registered. Responses served from the
+// cache were filtered before they were stored.
+func (ps *ProxyServer) RegisterResponseFilter(filter ResponseFilter) {
+	ps.filters.addResponse(filter)
+}
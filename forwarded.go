@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Headers telling upstreams how a request reached them, selected per server by
+// forwarded_headers
+const (
+	ForwardedXHeaders = "x_forwarded" // X-Forwarded-For, -Proto and -Host (the default)
+	ForwardedRFC7239  = "forwarded"   // the standard Forwarded header (RFC 7239)
+	ForwardedBoth     = "both"
+)
+
+// forwardedStyles are the accepted values of forwarded_headers
+var forwardedStyles = map[string]bool{
+	"":                true,
+	ForwardedXHeaders: true,
+	ForwardedRFC7239:  true,
+	ForwardedBoth:     true,
+}
+
+// viaPseudonym names the proxy in the Via header of requests and responses
+const viaPseudonym = "surikiti"
+
+func (p ProxyConfig) sendsXForwarded() bool {
+	return p.ForwardedHeaders != ForwardedRFC7239
+}
+
+func (p ProxyConfig) sendsForwarded() bool {
+	return p.ForwardedHeaders == ForwardedRFC7239 || p.ForwardedHeaders == ForwardedBoth
+}
+
+// viaEntry returns the proxy's Via entry for a message it received over proto,
+// such as "1.1 surikiti" for HTTP/1.1
+func viaEntry(proto string) string {
+	return strings.TrimPrefix(proto, "HTTP/") + " " + viaPseudonym
+}
+
+// forwardedElement returns the Forwarded element of a request received from
+// remoteAddr for host over the scheme proto
+func forwardedElement(remoteAddr, proto, host string) string {
+	node := clientIP(remoteAddr)
+	if _, err := netip.ParseAddr(node); err != nil {
+		// Peers on a Unix socket have no address
+		node = "unknown"
+	} else if strings.Contains(node, ":") {
+		// IPv6 addresses are bracketed, and the colons need quoting
+		node = `"[` + node + `]"`
+	}
+	element := "for=" + node + ";proto=" + proto
+	if host != "" {
+		element += ";host=" + forwardedValue(host)
+	}
+	return element
+}
+
+// forwardedValue quotes a Forwarded parameter value unless it is a token
+func forwardedValue(value string) string {
+	for _, r := range value {
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", r) && !('0' <= r && r <= '9') && !('a' <= r && r <= 'z') && !('A' <= r && r <= 'Z') {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+		}
+	}
+	return value
+}
+
+// forwardedFor returns the X-Forwarded-For chain to send upstream for a request
+// from remoteAddr that arrived with the chain xff, and the client's IP. A chain
+// is only kept when the request came from a trusted proxy; the client is then
+// the last address in it that is not one of the trusted proxies. Both are empty
+// for peers on a Unix socket, which have no address.
+func forwardedFor(trusted *IPSet, remoteAddr, xff string) (chain, client string) {
+	peer := clientIP(remoteAddr)
+	peerAddr, err := netip.ParseAddr(peer)
+	if err != nil {
+		return "", ""
+	}
+	if xff == "" || !trusted.Contains(peerAddr) {
+		return peer, peer
+	}
+
+	chain = xff + ", " + peer
+	client = peer
+	hops := strings.Split(xff, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		addr, err := netip.ParseAddr(hop)
+		if err != nil {
+			// What precedes an address that is not one cannot be trusted either
+			break
+		}
+		client = hop
+		if !trusted.Contains(addr) {
+			break
+		}
+	}
+	return chain, client
+}
+
+// trustedPeer reports whether a request from remoteAddr came through a trusted
+// proxy, whose forwarding headers are kept
+func trustedPeer(trusted *IPSet, remoteAddr string) bool {
+	addr, err := netip.ParseAddr(clientIP(remoteAddr))
+	return err == nil && trusted.Contains(addr)
+}
+
+// appendListHeader returns the comma-separated list header value with entry added
+func appendListHeader(value, entry string) string {
+	if value == "" {
+		return entry
+	}
+	return value + ", " + entry
+}
+
+// setForwardingHeaders describes the client's request r to the upstream on its
+// copy h: Via, and the forwarding headers forwarded_headers selects, which extend
+// those of trusted proxies and replace those of anyone else.
+// xForwardedProto is the X-Forwarded-Proto value.
+func setForwardingHeaders(h http.Header, r *http.Request, xForwardedProto string, rc *RuntimeConfig) {
+	h.Set("Via", appendListHeader(strings.Join(h.Values("Via"), ", "), viaEntry(r.Proto)))
+	if rc.Proxy.sendsXForwarded() {
+		chain, client := forwardedFor(rc.TrustedProxies, r.RemoteAddr, strings.Join(h.Values("X-Forwarded-For"), ", "))
+		if chain != "" {
+			h.Set("X-Forwarded-For", chain)
+			h.Set("X-Real-IP", client)
+		} else {
+			h.Del("X-Forwarded-For")
+			h.Del("X-Real-IP")
+		}
+		h.Set("X-Forwarded-Proto", xForwardedProto)
+		h.Set("X-Forwarded-Host", r.Host)
+	}
+	if rc.Proxy.sendsForwarded() {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		forwarded := ""
+		if trustedPeer(rc.TrustedProxies, r.RemoteAddr) {
+			forwarded = strings.Join(h.Values("Forwarded"), ", ")
+		}
+		h.Set("Forwarded", appendListHeader(forwarded, forwardedElement(r.RemoteAddr, scheme, r.Host)))
+	}
+}
+
+// addResponseVia adds the proxy's Via entry to an upstream response on its way
+// to a net/http client
+func addResponseVia(h http.Header, resp *http.Response) {
+	h.Set("Via", appendListHeader(strings.Join(h.Values("Via"), ", "), viaEntry(resp.Proto)))
+}
+
+// addFastHTTPResponseVia adds the proxy's Via entry to an upstream response on
+// its way to a gnet client
+func addFastHTTPResponseVia(h *fasthttp.ResponseHeader) {
+	// fasthttp only records whether a response it read was HTTP/1.1
+	proto := "HTTP/1.0"
+	if h.IsHTTP11() {
+		proto = string(h.Protocol())
+	}
+	h.Set("Via", appendListHeader(string(bytes.Join(h.PeekAll("Via"), []byte(", "))), viaEntry(proto)))
+}
+
+// setFastHTTPForwardingHeaders is setForwardingHeaders for a gnet request from
+// remoteAddr, before it is pointed at the upstream
+func setFastHTTPForwardingHeaders(h *fasthttp.RequestHeader, remoteAddr string, rc *RuntimeConfig) {
+	host := string(h.Host())
+	h.Set("Via", appendListHeader(peekList(h, "Via"), viaEntry(string(h.Protocol()))))
+	if rc.Proxy.sendsXForwarded() {
+		chain, client := forwardedFor(rc.TrustedProxies, remoteAddr, peekList(h, "X-Forwarded-For"))
+		if chain != "" {
+			h.Set("X-Forwarded-For", chain)
+			h.Set("X-Real-IP", client)
+		} else {
+			h.Del("X-Forwarded-For")
+			h.Del("X-Real-IP")
+		}
+		h.Set("X-Forwarded-Proto", "http")
+		h.Set("X-Forwarded-Host", host)
+	}
+	if rc.Proxy.sendsForwarded() {
+		forwarded := ""
+		if trustedPeer(rc.TrustedProxies, remoteAddr) {
+			forwarded = peekList(h, "Forwarded")
+		}
+		h.Set("Forwarded", appendListHeader(forwarded, forwardedElement(remoteAddr, "http", host)))
+	}
+}
+
+// peekList returns the values of a list header of a gnet request as one value
+func peekList(h *fasthttp.RequestHeader, key string) string {
+	return string(bytes.Join(h.PeekAll(key), []byte(", ")))
+}
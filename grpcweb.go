@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Content types of gRPC and gRPC-Web; the -text variant carries base64 bodies
+const (
+	grpcContentType        = "application/grpc"
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+)
+
+// grpcWebTrailerFlag marks the frame of a gRPC-Web body that holds the trailers
+const grpcWebTrailerFlag = 0x80
+
+// grpcWebCall is a browser gRPC-Web request translated to native gRPC for the
+// upstream, and answered in the content type the browser used
+type grpcWebCall struct {
+	contentType string // as sent by the client
+	subtype     string // message format such as "+proto", or "" for the default
+	text        bool   // bodies are base64-encoded
+}
+
+// grpcWebCallFor returns the gRPC-Web call of a request to a route that translates
+// gRPC-Web, or nil when the route does not or the request is not gRPC-Web
+func (r *Route) grpcWebCallFor(contentType string) *grpcWebCall {
+	if r == nil || !r.config.GRPCWeb {
+		return nil
+	}
+	media, _, _ := strings.Cut(contentType, ";")
+	media = strings.ToLower(strings.TrimSpace(media))
+
+	call := &grpcWebCall{contentType: contentType}
+	switch {
+	case strings.HasPrefix(media, grpcWebTextContentType):
+		call.subtype, call.text = media[len(grpcWebTextContentType):], true
+	case strings.HasPrefix(media, grpcWebContentType):
+		call.subtype = media[len(grpcWebContentType):]
+	default:
+		return nil
+	}
+	if call.subtype != "" && !strings.HasPrefix(call.subtype, "+") {
+		return nil
+	}
+	return call
+}
+
+// translateRequest turns the gRPC-Web request into a gRPC one, in place
+func (c grpcWebCall) translateRequest(req *http.Request) {
+	req.Header.Set("Content-Type", grpcContentType+c.subtype)
+	req.Header.Set("Te", "trailers")
+	req.Header.Del("Content-Length")
+	if c.text {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{base64.NewDecoder(base64.StdEncoding, req.Body), req.Body}
+		req.ContentLength = -1
+	}
+}
+
+// translateResponseHeader turns the headers of the upstream's gRPC response into
+// gRPC-Web ones, in place. Trailers travel in the body instead.
+func (c grpcWebCall) translateResponseHeader(header http.Header) {
+	header.Set("Content-Type", c.contentType)
+	header.Del("Trailer")
+	header.Del("Content-Length")
+}
+
+// copyBody writes the upstream's gRPC response body as gRPC-Web: the message
+// frames as they are, then the trailers as a final frame
+func (c grpcWebCall) copyBody(dst io.Writer, resp *http.Response) error {
+	out, encoder := dst, io.WriteCloser(nil)
+	if c.text {
+		encoder = base64.NewEncoder(base64.StdEncoding, dst)
+		out = encoder
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		return err
+	}
+	// Trailers are known once the body is read. A trailers-only response already
+	// carries the status in its headers.
+	if frame := grpcWebTrailerFrame(resp.Trailer); frame != nil {
+		if _, err := out.Write(frame); err != nil {
+			return err
+		}
+	}
+	if encoder != nil {
+		return encoder.Close()
+	}
+	return nil
+}
+
+// grpcWebTrailerFrame encodes trailers as a gRPC-Web trailer frame, or returns nil
+// when there are none
+func grpcWebTrailerFrame(trailer http.Header) []byte {
+	names := make([]string, 0, len(trailer))
+	for name, values := range trailer {
+		if len(values) > 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+
+	var block bytes.Buffer
+	for _, name := range names {
+		for _, value := range trailer[name] {
+			fmt.Fprintf(&block, "%s: %s\r\n", strings.ToLower(name), value)
+		}
+	}
+	frame := make([]byte, 5, 5+block.Len())
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(block.Len()))
+	return append(frame, block.Bytes()...)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// parseHeaderEntry splits a "Name: value" header entry of the configuration
+func parseHeaderEntry(entry string) (name, value string, ok bool) {
+	name, value, ok = strings.Cut(entry, ":")
+	name = strings.TrimSpace(name)
+	return name, strings.TrimSpace(value), ok && name != ""
+}
+
+// headerRules changes the headers of requests on their way to an upstream, as
+// set by a request_headers section
+type headerRules struct {
+	remove   []string    // names removed
+	prefixes []string    // lower-case prefixes of the names removed by "Prefix-*"
+	set      [][2]string // name and value of the headers replaced
+	add      [][2]string // name and value of the headers added
+}
+
+// newHeaderRules compiles a request_headers section, or returns nil when it has no rules
+func newHeaderRules(config HeaderRulesConfig) *headerRules {
+	if len(config.Add) == 0 && len(config.Set) == 0 && len(config.Remove) == 0 {
+		return nil
+	}
+	// Entries were checked by Config.Validate, so each has a name
+	rules := &headerRules{}
+	for _, name := range config.Remove {
+		if prefix, ok := strings.CutSuffix(name, "*"); ok {
+			rules.prefixes = append(rules.prefixes, strings.ToLower(prefix))
+		} else {
+			rules.remove = append(rules.remove, name)
+		}
+	}
+	for _, header := range config.Set {
+		name, value, _ := parseHeaderEntry(header)
+		rules.set = append(rules.set, [2]string{name, value})
+	}
+	for _, header := range config.Add {
+		name, value, _ := parseHeaderEntry(header)
+		rules.add = append(rules.add, [2]string{name, value})
+	}
+	return rules
+}
+
+// removedByPrefix reports whether a header name is removed by a "Prefix-*" rule
+func (r *headerRules) removedByPrefix(name string) bool {
+	name = strings.ToLower(name)
+	for _, prefix := range r.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply changes the headers of a net/http request
+func (r *headerRules) apply(h http.Header) {
+	if r == nil {
+		return
+	}
+	for _, name := range r.remove {
+		h.Del(name)
+	}
+	if len(r.prefixes) > 0 {
+		for name := range h {
+			if r.removedByPrefix(name) {
+				delete(h, name)
+			}
+		}
+	}
+	for _, header := range r.set {
+		h.Set(header[0], header[1])
+	}
+	for _, header := range r.add {
+		h.Add(header[0], header[1])
+	}
+}
+
+// applyFastHTTP changes the headers of a gnet request
+func (r *headerRules) applyFastHTTP(h *fasthttp.RequestHeader) {
+	if r == nil {
+		return
+	}
+	for _, name := range r.remove {
+		h.Del(name)
+	}
+	if len(r.prefixes) > 0 {
+		var removed []string
+		h.VisitAll(func(key, _ []byte) {
+			if r.removedByPrefix(string(key)) {
+				removed = append(removed, string(key))
+			}
+		})
+		for _, name := range removed {
+			h.Del(name)
+		}
+	}
+	for _, header := range r.set {
+		h.Set(header[0], header[1])
+	}
+	for _, header := range r.add {
+		h.Add(header[0], header[1])
+	}
+}
+
+// rewriteRequestHeaders applies the server's request header rules, then the
+// route's, to a net/http request
+func (rc *RuntimeConfig) rewriteRequestHeaders(route *Route, h http.Header) {
+	rc.RequestHeaders.apply(h)
+	route.RequestHeaders().apply(h)
+}
+
+// rewriteFastHTTPRequestHeaders is rewriteRequestHeaders for a gnet request
+func (rc *RuntimeConfig) rewriteFastHTTPRequestHeaders(route *Route, h *fasthttp.RequestHeader) {
+	rc.RequestHeaders.applyFastHTTP(h)
+	route.RequestHeaders().applyFastHTTP(h)
+}
+
+// RequestHeaders returns the request header rules of the route, nil when it has none
+func (r *Route) RequestHeaders() *headerRules {
+	if r == nil {
+		return nil
+	}
+	return r.requestHeaders
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Hop-by-hop headers (RFC 7230 section 6.1) describe a single connection, so the
+// proxy drops them between client and upstream, in both directions, along with
+// the headers the Connection header of the message names.
+
+// hopHeaders are hop-by-hop whether or not Connection names them
+var hopHeaders = [][]byte{
+	[]byte("Connection"),
+	[]byte("Proxy-Connection"), // non-standard, still sent by some clients
+	[]byte("Keep-Alive"),
+	[]byte("Proxy-Authenticate"),
+	[]byte("Proxy-Authorization"),
+	[]byte("Te"),
+	[]byte("Transfer-Encoding"),
+	[]byte("Upgrade"),
+}
+
+// isHopHeader reports whether the header key is hop-by-hop in a message whose
+// Connection header is connection
+func isHopHeader(key, connection []byte) bool {
+	for _, name := range hopHeaders {
+		if bytes.EqualFold(key, name) {
+			return true
+		}
+	}
+	for len(connection) > 0 {
+		var token []byte
+		token, connection, _ = bytes.Cut(connection, []byte(","))
+		if bytes.EqualFold(bytes.TrimSpace(token), key) {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsTrailers reports whether a TE header asks for trailers, which gRPC
+// upstreams require and which is the one TE value passed on
+func wantsTrailers(te string) bool {
+	for _, token := range strings.Split(te, ",") {
+		if value, _, _ := strings.Cut(token, ";"); strings.EqualFold(strings.TrimSpace(value), "trailers") {
+			return true
+		}
+	}
+	return false
+}
+
+// removeHopHeaders deletes the hop-by-hop headers of a net/http message
+func removeHopHeaders(h http.Header) {
+	trailers := wantsTrailers(strings.Join(h.Values("Te"), ","))
+	connection := []byte(strings.Join(h.Values("Connection"), ","))
+	for name := range h {
+		if isHopHeader([]byte(name), connection) {
+			delete(h, name)
+		}
+	}
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+}
+
+// removeRequestHopHeaders deletes the hop-by-hop headers of a gnet request. The
+// body keeps its framing, which fasthttp sets again when writing the request.
+func removeRequestHopHeaders(h *fasthttp.RequestHeader) {
+	trailers := wantsTrailers(string(h.Peek("Te")))
+	connection := append([]byte(nil), h.Peek("Connection")...)
+	var hop [][]byte
+	h.VisitAll(func(key, _ []byte) {
+		if isHopHeader(key, connection) {
+			hop = append(hop, append([]byte(nil), key...))
+		}
+	})
+	for _, key := range hop {
+		h.DelBytes(key)
+	}
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+}
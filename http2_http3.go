@@ -7,10 +7,13 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"go.uber.org/zap"
 
 
@@ -18,18 +21,29 @@ import (
 
 type HTTP2HTTP3Server struct {
 	loadBalancer *LoadBalancer
+	clients      *UpstreamClients
 	logger       *zap.Logger
+	metrics      *ServerMetrics
+	runtime      *RuntimeConfigStore
 	config       ProxyConfig
+	filters      *filterChain
 	http2Server  *http.Server
 	http3Server  *http3.Server
 	tlsConfig    *tls.Config
 }
 
-func NewHTTP2HTTP3Server(lb *LoadBalancer, logger *zap.Logger, cfg ProxyConfig) *HTTP2HTTP3Server {
+// http2Address is where the HTTP/2 server of a gnet server listens
+const http2Address = "0.0.0.0:8443"
+
+func NewHTTP2HTTP3Server(lb *LoadBalancer, clients *UpstreamClients, logger *zap.Logger, metrics *ServerMetrics, runtime *RuntimeConfigStore, cfg ProxyConfig, filters *filterChain) *HTTP2HTTP3Server {
 	server := &HTTP2HTTP3Server{
 		loadBalancer: lb,
+		clients:      clients,
 		logger:       logger,
+		metrics:      metrics,
+		runtime:      runtime,
 		config:       cfg,
+		filters:      filters,
 	}
 
 	// Setup TLS config if certificates are provided
@@ -55,7 +69,7 @@ func NewHTTP2HTTP3Server(lb *LoadBalancer, logger *zap.Logger, cfg ProxyConfig)
 }
 
 func (h *HTTP2HTTP3Server) StartHTTP2Server(addr string) error {
-	if !h.config.EnableHTTP2 || h.tlsConfig == nil {
+	if !h.config.EnableHTTP2 || (h.tlsConfig == nil && !h.config.EnableH2C) {
 		return fmt.Errorf("HTTP/2 not enabled or TLS not configured")
 	}
 
@@ -63,25 +77,43 @@ func (h *HTTP2HTTP3Server) StartHTTP2Server(addr string) error {
 	mux.HandleFunc("/", h.handleHTTP2Request)
 
 	h.http2Server = &http.Server{
-		Addr:      addr,
-		Handler:   mux,
-		TLSConfig: h.tlsConfig,
+		Addr:         addr,
+		Handler:      recoverPanics(mux, h.logger, h.metrics),
+		TLSConfig:    h.tlsConfig,
 		ReadTimeout:  h.config.RequestTimeout,
 		WriteTimeout: h.config.ResponseTimeout,
 		IdleTimeout:  h.config.KeepAliveTimeout,
 	}
-
-	// Configure HTTP/2
-	if err := http2.ConfigureServer(h.http2Server, &http2.Server{
+	h2 := &http2.Server{
 		MaxConcurrentStreams: uint32(h.config.MaxConnections),
 		MaxReadFrameSize:     uint32(h.config.BufferSize),
 		IdleTimeout:          h.config.KeepAliveTimeout,
-	}); err != nil {
+	}
+
+	// Cleartext HTTP/2 for meshes that terminate TLS elsewhere: clients either
+	// start with the HTTP/2 preface (prior knowledge) or upgrade with Upgrade: h2c
+	if h.config.EnableH2C {
+		h.http2Server.Handler = h2c.NewHandler(mux, h2)
+		h.http2Server.TLSConfig = nil
+		h.logger.Info("Starting HTTP/2 server without TLS (h2c)", zap.String("addr", addr))
+		ln, err := listenTCP(addr, h.config)
+		if err != nil {
+			return err
+		}
+		return h.http2Server.Serve(ln)
+	}
+
+	// Configure HTTP/2
+	if err := http2.ConfigureServer(h.http2Server, h2); err != nil {
 		return fmt.Errorf("failed to configure HTTP/2: %w", err)
 	}
 
 	h.logger.Info("Starting HTTP/2 server", zap.String("addr", addr))
-	return h.http2Server.ListenAndServeTLS("", "")
+	ln, err := listenTCP(addr, h.config)
+	if err != nil {
+		return err
+	}
+	return h.http2Server.ServeTLS(ln, "", "")
 }
 
 func (h *HTTP2HTTP3Server) StartHTTP3Server() error {
@@ -95,17 +127,63 @@ func (h *HTTP2HTTP3Server) StartHTTP3Server() error {
 	addr := fmt.Sprintf(":%d", h.config.HTTP3Port)
 
 	h.http3Server = &http3.Server{
-		Addr:      addr,
-		Handler:   mux,
-		TLSConfig: h.tlsConfig,
-		QUICConfig: &quic.Config{
-			MaxIdleTimeout:  h.config.KeepAliveTimeout,
-			KeepAlivePeriod: h.config.KeepAliveTimeout / 2,
-		},
+		Addr:            addr,
+		Handler:         recoverPanics(mux, h.logger, h.metrics),
+		TLSConfig:       h.tlsConfig,
+		QUICConfig:      quicConfig(h.config),
+		EnableDatagrams: h.config.QUICDatagrams,
 	}
 
 	h.logger.Info("Starting HTTP/3 server", zap.String("addr", addr))
-	return h.http3Server.ListenAndServe()
+	conn, err := listenPacketHandover("udp", addr, func() (net.PacketConn, error) {
+		return net.ListenPacket("udp", addr)
+	})
+	if err != nil {
+		return err
+	}
+	return h.http3Server.Serve(conn)
+}
+
+// Initial receive windows of quic-go, which grow from there up to the maximums
+const (
+	quicInitialStreamWindow     = 512 << 10
+	quicInitialConnectionWindow = 768 << 10
+)
+
+// quicConfig returns the QUIC transport settings of the HTTP/3 server
+func quicConfig(p ProxyConfig) *quic.Config {
+	idle := p.QUICMaxIdleTimeout
+	if idle == 0 {
+		idle = p.KeepAliveTimeout
+	}
+	cfg := &quic.Config{
+		MaxIdleTimeout:             idle,
+		KeepAlivePeriod:            idle / 2,
+		MaxIncomingStreams:         int64(p.QUICMaxStreams),
+		MaxIncomingUniStreams:      int64(p.QUICMaxUniStreams),
+		MaxStreamReceiveWindow:     uint64(p.QUICStreamReceiveWindow),
+		MaxConnectionReceiveWindow: uint64(p.QUICConnectionReceiveWindow),
+		EnableDatagrams:            p.QUICDatagrams,
+		Allow0RTT:                  p.QUIC0RTT,
+	}
+	// A maximum below the initial window also lowers where the window starts
+	if cfg.MaxStreamReceiveWindow > 0 && cfg.MaxStreamReceiveWindow < quicInitialStreamWindow {
+		cfg.InitialStreamReceiveWindow = cfg.MaxStreamReceiveWindow
+	}
+	if cfg.MaxConnectionReceiveWindow > 0 && cfg.MaxConnectionReceiveWindow < quicInitialConnectionWindow {
+		cfg.InitialConnectionReceiveWindow = cfg.MaxConnectionReceiveWindow
+	}
+	return cfg
+}
+
+// earlyDataAllowed reports whether requests with method are served from 0-RTT data
+func (h *HTTP2HTTP3Server) earlyDataAllowed(method string) bool {
+	for _, allowed := range h.config.QUIC0RTTMethods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
 }
 
 func (h *HTTP2HTTP3Server) Shutdown(ctx context.Context) error {
@@ -136,7 +214,12 @@ func (h *HTTP2HTTP3Server) handleHTTP2Request(w http.ResponseWriter, r *http.Req
 		zap.String("path", r.URL.Path),
 		zap.String("proto", r.Proto))
 
-	h.proxyRequest(w, r, "HTTP/2")
+	// The listener also answers HTTP/1.x clients that did not negotiate HTTP/2
+	protocol := "HTTP/2"
+	if r.ProtoMajor < 2 {
+		protocol = r.Proto
+	}
+	h.serveRequest(w, r, protocol)
 }
 
 func (h *HTTP2HTTP3Server) handleHTTP3Request(w http.ResponseWriter, r *http.Request) {
@@ -145,102 +228,259 @@ func (h *HTTP2HTTP3Server) handleHTTP3Request(w http.ResponseWriter, r *http.Req
 		zap.String("path", r.URL.Path),
 		zap.String("proto", r.Proto))
 
-	h.proxyRequest(w, r, "HTTP/3")
+	h.serveRequest(w, r, "HTTP/3")
 }
 
-func (h *HTTP2HTTP3Server) proxyRequest(w http.ResponseWriter, r *http.Request, protocol string) {
+// serveRequest proxies a request and records it in the server metrics
+func (h *HTTP2HTTP3Server) serveRequest(w http.ResponseWriter, r *http.Request, protocol string) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	body := &countingBody{ReadCloser: r.Body}
+	r.Body = body
+	entry := &AccessEntry{
+		Protocol: protocol,
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Remote:   r.RemoteAddr,
+	}
+
+	h.proxyRequest(rec, r, protocol, entry)
+
+	entry.Status = rec.status
+	entry.BytesIn = body.bytes
+	entry.BytesOut = rec.bytes
+	entry.Duration = time.Since(start)
+	h.metrics.ObserveRequest(entry)
+}
+
+func (h *HTTP2HTTP3Server) proxyRequest(w http.ResponseWriter, r *http.Request, protocol string, entry *AccessEntry) {
+	rc := h.runtime.Load()
+	w = rc.ErrorPages.wrap(w)
+
+	// An overloaded proxy turns part of the requests away before doing any work on them
+	if admitted, retryAfter := rc.LoadShedding.Admit(); !admitted {
+		h.metrics.IncShedRequests()
+		writeOverloaded(w, retryAfter)
+		return
+	}
+	defer rc.LoadShedding.Done()
+
+	if !normalizeRequestURL(r, rc.Proxy.PathNormalization) {
+		h.logger.Debug("Request path rejected", zap.String("uri", r.RequestURI))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	entry.Path = r.URL.Path
+	route := rc.Router.Match(r.URL.Path)
+	entry.Route = route.RouteName()
+
+	// Requests in 0-RTT early data can be replayed, so only idempotent ones are
+	// served before the handshake completes; the client retries the rest after it
+	if r.TLS != nil && !r.TLS.HandshakeComplete {
+		if !h.earlyDataAllowed(r.Method) {
+			h.logger.Debug("Early data request deferred", zap.String("remote", r.RemoteAddr), zap.String("method", r.Method), zap.String("protocol", protocol))
+			http.Error(w, "Too Early", http.StatusTooEarly)
+			return
+		}
+		// Tells the upstream the request may be a replay (RFC 8470)
+		r.Header.Set("Early-Data", "1")
+	}
+
+	// Client IP allow/deny lists come before anything else
+	if !rc.AllowClient(route, clientIP(r.RemoteAddr)) {
+		h.logger.Debug("Client IP rejected by access list", zap.String("remote", r.RemoteAddr), zap.String("protocol", protocol))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	// During maintenance only the allow-listed clients reach the upstreams
+	if maintenance := rc.MaintenanceFor(route, clientIP(r.RemoteAddr)); maintenance != nil {
+		maintenance.write(w)
+		return
+	}
+	if !rc.UserAgents.Allowed(r.UserAgent()) {
+		h.logger.Debug("User agent rejected", zap.String("remote", r.RemoteAddr), zap.String("user_agent", r.UserAgent()), zap.String("protocol", protocol))
+		status, body := rc.UserAgents.Rejection()
+		http.Error(w, body, status)
+		return
+	}
+
+	// Server and route rate limits
+	if allowed, retryAfter := rc.AllowRequest(route, clientIP(r.RemoteAddr)); !allowed {
+		h.logger.Debug("Rate limit exceeded", zap.String("remote", r.RemoteAddr), zap.String("protocol", protocol))
+		writeTooManyRequests(w, retryAfter)
+		return
+	}
+
+	// Preflights delegated to the upstream carry no credentials, so they skip authentication
+	delegatedPreflight := route.DelegatesCORS() && isPreflight(r.Method, r.Header.Get("Origin"), r.Header.Get("Access-Control-Request-Method"))
+	if !delegatedPreflight && !rc.authenticate(w, r, route) {
+		return
+	}
+
+	// Filters of the embedding program may change the request or answer it themselves
+	if page := h.filters.filterRequest(r, entry.Route); page != nil {
+		page.write(w)
+		return
+	}
+
+	// Requests beyond the route's concurrency limit wait for a slot, or are turned away
+	limiter := route.Concurrency()
+	if !limiter.Acquire(r.Context().Done()) {
+		h.logger.Debug("Route concurrency limit reached", zap.String("route", entry.Route), zap.String("remote", r.RemoteAddr))
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer limiter.Release()
+
 	// Get upstream server
-	upstream := h.loadBalancer.GetUpstream()
+	upstream, splitCookie := h.loadBalancer.GetUpstreamForRoute(route, h.loadBalancer.affinityKey(r), clientIP(r.RemoteAddr), standardFields{r})
+	if splitCookie != "" {
+		w.Header().Add("Set-Cookie", splitCookie)
+	}
 	if upstream == nil {
 		h.logger.Error("No healthy upstream available", zap.String("protocol", protocol))
+		if fallback := route.Fallback(); fallback != nil {
+			fallback.write(w)
+			return
+		}
 		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
 		return
 	}
 
+	entry.Upstream = upstream.Name
+
+	// gRPC-Web is translated to native gRPC, which only runs over HTTP/2
+	grpcWeb := route.grpcWebCallFor(r.Header.Get("Content-Type"))
+	if grpcWeb != nil && !upstream.Overrides().http2() {
+		h.logger.Error("gRPC-Web route needs an h2 or h2c upstream", zap.String("upstream", upstream.Name))
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	// Header rules change the request before it is mirrored and forwarded
+	rc.rewriteRequestHeaders(route, r.Header)
+
 	// Increment connection count
 	h.loadBalancer.IncreaseConnections(upstream)
 	defer h.loadBalancer.DecreaseConnections(upstream)
 
-	// Create HTTP client with appropriate configuration
-	client := &http.Client{
-		Timeout: h.config.RequestTimeout,
-		Transport: &http.Transport{
-			MaxIdleConns:        h.config.MaxIdleConns,
-			MaxIdleConnsPerHost: h.config.MaxIdleConnsPerHost,
-			MaxConnsPerHost:     h.config.MaxConnsPerHost,
-			IdleConnTimeout:     h.config.IdleConnTimeout,
-			DialContext: (&net.Dialer{
-				Timeout:   h.config.RequestTimeout,
-				KeepAlive: h.config.KeepAliveTimeout,
-			}).DialContext,
-			TLSHandshakeTimeout: h.config.RequestTimeout,
-		},
-	}
-
-	// Configure HTTP/2 support for upstream if enabled
-	if h.config.EnableHTTP2 {
-		if err := http2.ConfigureTransport(client.Transport.(*http.Transport)); err != nil {
-			h.logger.Warn("Failed to configure HTTP/2 transport", zap.Error(err))
-		}
-	}
+	// A copy goes to the route's shadow upstream, if any
+	mirrorStandard(route, r, protocol, rc, h.metrics, h.logger)
+
+	// Use the reusable HTTP client of this upstream, with its own connection pool
+	client := h.clients.Standard(upstream)
+	requestTimeout := upstream.Overrides().requestTimeout(rc.Proxy)
 
-	// Create upstream request
-	upstreamURL := upstream.URL.String() + r.URL.Path
+	// Create upstream request, keeping escapes such as %2F the client sent
+	upstreamURL := upstream.URL.String() + route.UpstreamPath(r.URL.EscapedPath())
 	if r.URL.RawQuery != "" {
 		upstreamURL += "?" + r.URL.RawQuery
 	}
 
-	upstreamReq, err := http.NewRequestWithContext(r.Context(), r.Method, upstreamURL, r.Body)
-	if err != nil {
-		h.logger.Error("Failed to create upstream request", zap.Error(err))
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
+	// Build the upstream request of an attempt
+	newUpstreamRequest := func(ctx context.Context) (*http.Request, error) {
+		upstreamReq, err := http.NewRequestWithContext(ctx, r.Method, upstreamURL, r.Body)
+		if err != nil {
+			return nil, err
+		}
 
-	// Copy headers
-	for name, values := range r.Header {
-		for _, value := range values {
-			upstreamReq.Header.Add(name, value)
+		// Copy headers
+		for name, values := range r.Header {
+			for _, value := range values {
+				upstreamReq.Header.Add(name, value)
+			}
 		}
+		removeHopHeaders(upstreamReq.Header)
+		setStandardUpstreamAcceptEncoding(upstreamReq.Header, rc.Proxy.UpstreamEncoding)
+
+		// Add forwarding headers
+		setForwardingHeaders(upstreamReq.Header, r, protocol, rc)
+		setDeadlineHeader(ctx, upstreamReq.Header, rc.Proxy.DeadlineHeader)
+		if grpcWeb != nil {
+			grpcWeb.translateRequest(upstreamReq)
+		}
+		return upstreamReq, nil
 	}
 
-	// Add forwarding headers
-	upstreamReq.Header.Set("X-Forwarded-For", r.RemoteAddr)
-	upstreamReq.Header.Set("X-Forwarded-Proto", protocol)
-	upstreamReq.Header.Set("X-Forwarded-Host", r.Host)
+	// Synthetic latency for staging parity
+	applySyntheticDelay(route)
 
-	// Make request to upstream
-	ctx, cancel := context.WithTimeout(r.Context(), h.config.RequestTimeout)
+	// Make request to upstream, sending it again as the retry policy allows; the
+	// body is read from the client as it is sent, so only requests without one
+	ctx, cancel := context.WithTimeout(withInterimRelay(r.Context(), w, r), requestTimeout)
 	defer cancel()
-	upstreamReq = upstreamReq.WithContext(ctx)
 
-	resp, err := client.Do(upstreamReq)
+	policy := route.RetryPolicy(h.loadBalancer.RetryPolicy())
+	attempts := policy.Attempts(r.Method, r.ContentLength == 0)
+	resp, release, err := policy.do(ctx, client, attempts, newUpstreamRequest, func(attempt int, resp *http.Response, err error) {
+		fields := []zap.Field{
+			zap.String("upstream", upstream.URL.String()),
+			zap.String("protocol", protocol),
+			zap.Int("attempt", attempt),
+		}
+		if err != nil {
+			fields = append(fields, zap.Error(err))
+		} else {
+			fields = append(fields, zap.Int("status", resp.StatusCode))
+		}
+		h.logger.Warn("Retrying request to upstream", fields...)
+	})
 	if err != nil {
 		h.logger.Error("Failed to proxy request to upstream", 
 			zap.Error(err),
 			zap.String("upstream", upstream.URL.String()),
 			zap.String("protocol", protocol))
+		h.metrics.IncUpstreamErrors()
 		http.Error(w, "Bad Gateway", http.StatusBadGateway)
 		return
 	}
-	defer resp.Body.Close()
+	defer release()
+	// Filters may replace the body, so the one the response ends up with is closed
+	defer func() { resp.Body.Close() }()
 
 	// Copy response headers
+	removeHopHeaders(resp.Header)
+	setResponseSource(w, responseFromUpstream)
+	decodeStandardUpstreamResponse(resp.Header, rc.Proxy.UpstreamEncoding)
+	route.rewriteStandardCookies(resp.Header)
+	h.filters.filterResponse(resp.Request, resp)
 	for name, values := range resp.Header {
 		for _, value := range values {
 			w.Header().Add(name, value)
 		}
 	}
+	addResponseVia(w.Header(), resp)
+	h.loadBalancer.rewriteStandardLocation(w.Header(), standardOrigin(r, rc), route, rc)
 
 	// Add server header
 	w.Header().Set("Server", "Surikiti-Proxy/1.0")
 	w.Header().Set("X-Proxy-Protocol", protocol)
+	rc.SecurityHeadersFor(route).apply(w.Header())
+	if grpcWeb != nil {
+		grpcWeb.translateResponseHeader(w.Header())
+	}
+
+	// Add CORS headers for the request origin if enabled
+	applyCORS(w.Header(), rc.CORS, r.Header.Get("Origin"), route.DelegatesCORS())
+
+	// Compress the body for the client when enabled; gRPC-Web carries its own framing
+	body := io.Writer(w)
+	if rc.Proxy.EnableCompression && grpcWeb == nil {
+		var closeBody func()
+		body, closeBody = compressResponse(w, r, route.CompressionConfig(rc.Proxy), resp.StatusCode, resp.ContentLength)
+		defer closeBody()
+	}
 
 	// Write status code
 	w.WriteHeader(resp.StatusCode)
 
-	// Copy response body
-	if _, err := io.Copy(w, resp.Body); err != nil {
+	// Copy response body; gRPC-Web bodies end with the upstream's trailers
+	if grpcWeb != nil {
+		err = grpcWeb.copyBody(w, resp)
+	} else {
+		_, err = io.Copy(body, resp.Body)
+	}
+	if err != nil {
 		h.logger.Error("Failed to copy response body", 
 			zap.Error(err),
 			zap.String("protocol", protocol))
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -14,153 +15,283 @@ import (
 	"github.com/panjf2000/gnet/v2"
 	"github.com/valyala/fasthttp"
 	"go.uber.org/zap"
-	"golang.org/x/exp/slices"
 )
 
 // HTTPHandler handles HTTP proxy requests
 type HTTPHandler struct {
 	loadBalancer *LoadBalancer
-	client       *fasthttp.Client
-	httpClient   *http.Client
+	clients      *UpstreamClients
 	logger       *zap.Logger
-	proxyConfig  ProxyConfig
-	corsConfig   CORSConfig
+	metrics      *ServerMetrics
+	runtime      *RuntimeConfigStore
+	filters      *filterChain
+}
+
+// statusRecorder captures the status code and body size written to a ResponseWriter
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// countingBody counts the request body bytes read by the proxy
+type countingBody struct {
+	io.ReadCloser
+	bytes int
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += n
+	return n, err
 }
 
 // NewHTTPHandler creates a new HTTP handler
-func NewHTTPHandler(lb *LoadBalancer, client *fasthttp.Client, httpClient *http.Client, logger *zap.Logger, proxyConfig ProxyConfig, corsConfig CORSConfig) *HTTPHandler {
+func NewHTTPHandler(lb *LoadBalancer, clients *UpstreamClients, logger *zap.Logger, metrics *ServerMetrics, runtime *RuntimeConfigStore, filters *filterChain) *HTTPHandler {
 	return &HTTPHandler{
 		loadBalancer: lb,
-		client:       client,
-		httpClient:   httpClient,
+		clients:      clients,
 		logger:       logger,
-		proxyConfig:  proxyConfig,
-		corsConfig:   corsConfig,
+		metrics:      metrics,
+		runtime:      runtime,
+		filters:      filters,
 	}
 }
 
 // HandleHTTPProxy handles regular HTTP proxy requests using standard HTTP server
 func (h *HTTPHandler) HandleHTTPProxy(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	body := &countingBody{ReadCloser: r.Body}
+	r.Body = body
+	entry := &AccessEntry{
+		Protocol: "HTTP/1.1",
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Remote:   r.RemoteAddr,
+	}
+
+	h.proxyHTTP(rec, r, entry)
+
+	entry.Status = rec.status
+	entry.BytesIn = body.bytes
+	entry.BytesOut = rec.bytes
+	entry.Duration = time.Since(start)
+	h.metrics.ObserveRequest(entry)
+}
+
+// proxyHTTP forwards a single request from the standard HTTP server to an upstream
+func (h *HTTPHandler) proxyHTTP(w http.ResponseWriter, r *http.Request, entry *AccessEntry) {
+	rc := h.runtime.Load()
+	w = rc.ErrorPages.wrap(w)
+
+	// An overloaded proxy turns part of the requests away before doing any work on them
+	if admitted, retryAfter := rc.LoadShedding.Admit(); !admitted {
+		h.metrics.IncShedRequests()
+		writeOverloaded(w, retryAfter)
+		return
+	}
+	defer rc.LoadShedding.Done()
+
+	if !normalizeRequestURL(r, rc.Proxy.PathNormalization) {
+		h.logger.Debug("Request path rejected", zap.String("uri", r.RequestURI))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	entry.Path = r.URL.Path
+	route := rc.Router.Match(r.URL.Path)
+	entry.Route = route.RouteName()
+
+	// Client IP allow/deny lists come before anything else
+	if !rc.AllowClient(route, clientIP(r.RemoteAddr)) {
+		h.logger.Debug("Client IP rejected by access list", zap.String("remote", r.RemoteAddr))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	// During maintenance only the allow-listed clients reach the upstreams
+	if maintenance := rc.MaintenanceFor(route, clientIP(r.RemoteAddr)); maintenance != nil {
+		maintenance.write(w)
+		return
+	}
+	if !rc.UserAgents.Allowed(r.UserAgent()) {
+		h.logger.Debug("User agent rejected", zap.String("remote", r.RemoteAddr), zap.String("user_agent", r.UserAgent()))
+		status, body := rc.UserAgents.Rejection()
+		http.Error(w, body, status)
+		return
+	}
+
+	// Server and route rate limits
+	if allowed, retryAfter := rc.AllowRequest(route, clientIP(r.RemoteAddr)); !allowed {
+		h.logger.Debug("Rate limit exceeded", zap.String("remote", r.RemoteAddr))
+		writeTooManyRequests(w, retryAfter)
+		return
+	}
+
+	// Preflights delegated to the upstream carry no credentials, so they skip authentication
+	delegatedPreflight := route.DelegatesCORS() && isPreflight(r.Method, r.Header.Get("Origin"), r.Header.Get("Access-Control-Request-Method"))
+	if !delegatedPreflight && !rc.authenticate(w, r, route) {
+		return
+	}
+
+	// Filters of the embedding program may change the request or answer it themselves
+	if page := h.filters.filterRequest(r, entry.Route); page != nil {
+		page.write(w)
+		return
+	}
+
+	// Requests beyond the route's concurrency limit wait for a slot, or are turned away
+	limiter := route.Concurrency()
+	if !limiter.Acquire(r.Context().Done()) {
+		h.logger.Debug("Route concurrency limit reached", zap.String("route", entry.Route), zap.String("remote", r.RemoteAddr))
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer limiter.Release()
+
 	// Get upstream server
-	upstream := h.loadBalancer.GetUpstream()
+	upstream, splitCookie := h.loadBalancer.GetUpstreamForRoute(route, h.loadBalancer.affinityKey(r), clientIP(r.RemoteAddr), standardFields{r})
+	if splitCookie != "" {
+		w.Header().Add("Set-Cookie", splitCookie)
+	}
 	if upstream == nil {
 		h.logger.Error("No healthy upstream available")
+		if fallback := route.Fallback(); fallback != nil {
+			fallback.write(w)
+			return
+		}
 		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
 		return
 	}
 
+	entry.Upstream = upstream.Name
+	trackedConnFromContext(r.Context()).SetTarget(entry.Route, upstream.Name)
+
+	// Header rules change the request before it is mirrored and forwarded
+	rc.rewriteRequestHeaders(route, r.Header)
+
 	// Increment connection count
 	h.loadBalancer.IncreaseConnections(upstream)
 	defer h.loadBalancer.DecreaseConnections(upstream)
 
-	// Use the reusable HTTP client
-	client := h.httpClient
+	// A copy goes to the route's shadow upstream, if any
+	mirrorStandard(route, r, "http", rc, h.metrics, h.logger)
+
+	// Use the reusable HTTP client of this upstream
+	client := h.clients.Standard(upstream)
 
-	// Create upstream request
-	upstreamURL := upstream.URL.String() + r.URL.Path
+	// Create upstream request, keeping escapes such as %2F the client sent
+	upstreamURL := upstream.URL.String() + route.UpstreamPath(r.URL.EscapedPath())
 	if r.URL.RawQuery != "" {
 		upstreamURL += "?" + r.URL.RawQuery
 	}
 
-	upstreamReq, err := http.NewRequestWithContext(r.Context(), r.Method, upstreamURL, r.Body)
-	if err != nil {
-		h.logger.Error("Failed to create upstream request", zap.Error(err))
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
+	// Build the upstream request of an attempt
+	newUpstreamRequest := func(ctx context.Context) (*http.Request, error) {
+		upstreamReq, err := http.NewRequestWithContext(ctx, r.Method, upstreamURL, r.Body)
+		if err != nil {
+			return nil, err
+		}
 
-	// Copy headers
-	for name, values := range r.Header {
-		for _, value := range values {
-			upstreamReq.Header.Add(name, value)
+		// Copy headers
+		for name, values := range r.Header {
+			for _, value := range values {
+				upstreamReq.Header.Add(name, value)
+			}
 		}
-	}
+		removeHopHeaders(upstreamReq.Header)
+		setStandardUpstreamAcceptEncoding(upstreamReq.Header, rc.Proxy.UpstreamEncoding)
 
-	// Add forwarding headers
-	upstreamReq.Header.Set("X-Forwarded-For", r.RemoteAddr)
-	upstreamReq.Header.Set("X-Forwarded-Proto", "http")
-	upstreamReq.Header.Set("X-Forwarded-Host", r.Host)
+		// Add forwarding headers
+		setForwardingHeaders(upstreamReq.Header, r, "http", rc)
+		setDeadlineHeader(ctx, upstreamReq.Header, rc.Proxy.DeadlineHeader)
+		return upstreamReq, nil
+	}
 
 	// Make request to upstream with retry logic
-	ctx, cancel := context.WithTimeout(r.Context(), h.proxyConfig.RequestTimeout*2)
+	requestTimeout := upstream.Overrides().requestTimeout(rc.Proxy)
+	ctx, cancel := context.WithTimeout(withInterimRelay(r.Context(), w, r), requestTimeout*2)
 	defer cancel()
-	upstreamReq = upstreamReq.WithContext(ctx)
 
-	var resp *http.Response
-	maxRetries := 3
+	// Synthetic latency for staging parity
+	applySyntheticDelay(route)
 
-	for attempt := 0; attempt <= maxRetries; attempt++ {
-		resp, err = client.Do(upstreamReq)
-		if err == nil {
-			break
+	// The body is read from the client as it is sent, so only requests without
+	// one can be sent again
+	policy := route.RetryPolicy(h.loadBalancer.RetryPolicy())
+	attempts := policy.Attempts(r.Method, r.ContentLength == 0)
+	resp, release, err := policy.do(ctx, client, attempts, newUpstreamRequest, func(attempt int, resp *http.Response, err error) {
+		fields := []zap.Field{
+			zap.String("upstream", upstream.URL.String()),
+			zap.String("method", r.Method),
+			zap.Int("attempt", attempt),
+			zap.Int("max_retries", attempts-1),
 		}
-
-		// Log retry attempt
-		if attempt < maxRetries {
-			h.logger.Warn("Retrying request to upstream",
-				zap.Error(err),
-				zap.String("upstream", upstream.URL.String()),
-				zap.Int("attempt", attempt+1),
-				zap.Int("max_retries", maxRetries))
-
-			// Brief delay before retry
-			time.Sleep(time.Millisecond * 100 * time.Duration(attempt+1))
-
-			// Create new request for retry (body might be consumed)
-			if r.Body != nil {
-				r.Body.Close()
-			}
-			upstreamReq, _ = http.NewRequestWithContext(ctx, r.Method, upstreamURL, r.Body)
-			// Copy headers again
-			for name, values := range r.Header {
-				for _, value := range values {
-					upstreamReq.Header.Add(name, value)
-				}
-			}
-			// Add forwarding headers again
-			upstreamReq.Header.Set("X-Forwarded-For", r.RemoteAddr)
-			upstreamReq.Header.Set("X-Forwarded-Proto", "http")
-			upstreamReq.Header.Set("X-Forwarded-Host", r.Host)
+		if err != nil {
+			fields = append(fields, zap.Error(err))
+		} else {
+			fields = append(fields, zap.Int("status", resp.StatusCode))
 		}
-	}
-
+		h.logger.Warn("Retrying request to upstream", fields...)
+	})
 	if err != nil {
 		h.logger.Error("Failed to proxy request to upstream after retries",
 			zap.Error(err),
 			zap.String("upstream", upstream.URL.String()),
-			zap.Int("attempts", maxRetries+1))
+			zap.Int("attempts", attempts))
+		h.metrics.IncUpstreamErrors()
 		http.Error(w, "Bad Gateway", http.StatusBadGateway)
 		return
 	}
-	defer resp.Body.Close()
-
-	// Add CORS headers if enabled
-	if h.corsConfig.Enabled {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		if len(h.corsConfig.ExposedHeaders) > 0 {
-			w.Header().Set("Access-Control-Expose-Headers", strings.Join(h.corsConfig.ExposedHeaders, ", "))
-		}
-		if h.corsConfig.AllowCredentials {
-			w.Header().Set("Access-Control-Allow-Credentials", "true")
-		}
-	}
+	defer release()
+	// Filters may replace the body, so the one the response ends up with is closed
+	defer func() { resp.Body.Close() }()
 
 	// Copy response headers
+	removeHopHeaders(resp.Header)
+	setResponseSource(w, responseFromUpstream)
+	decodeStandardUpstreamResponse(resp.Header, rc.Proxy.UpstreamEncoding)
+	route.rewriteStandardCookies(resp.Header)
+	h.filters.filterResponse(resp.Request, resp)
 	for name, values := range resp.Header {
 		for _, value := range values {
 			w.Header().Add(name, value)
 		}
 	}
+	addResponseVia(w.Header(), resp)
+	h.loadBalancer.rewriteStandardLocation(w.Header(), standardOrigin(r, rc), route, rc)
+
+	// Add CORS headers for the request origin if enabled
+	applyCORS(w.Header(), rc.CORS, r.Header.Get("Origin"), route.DelegatesCORS())
 
 	// Add server header
 	w.Header().Set("Server", "Surikiti-Proxy/1.0")
 	w.Header().Set("X-Proxy-Protocol", "HTTP/1.1")
+	rc.SecurityHeadersFor(route).apply(w.Header())
+
+	// Compress the body for the client when enabled
+	body := io.Writer(w)
+	if rc.Proxy.EnableCompression {
+		var closeBody func()
+		body, closeBody = compressResponse(w, r, route.CompressionConfig(rc.Proxy), resp.StatusCode, resp.ContentLength)
+		defer closeBody()
+	}
 
 	// Write status code
 	w.WriteHeader(resp.StatusCode)
 
 	// Copy response body
-	if _, err := io.Copy(w, resp.Body); err != nil {
+	if _, err := io.Copy(body, resp.Body); err != nil {
 		h.logger.Error("Failed to copy response body", zap.Error(err))
 	}
 
@@ -171,16 +302,82 @@ func (h *HTTPHandler) HandleHTTPProxy(w http.ResponseWriter, r *http.Request) {
 
 // HandleTraffic handles gnet traffic for HTTP requests
 func (h *HTTPHandler) HandleTraffic(c gnet.Conn, reqData []byte) gnet.Action {
+	start := time.Now()
+	entry := &AccessEntry{
+		Protocol: "HTTP/1.1",
+		Remote:   remoteAddr(c),
+		BytesIn:  len(reqData),
+	}
+	observe := func() {
+		entry.Duration = time.Since(start)
+		h.metrics.ObserveRequest(entry)
+	}
+
+	// Until the request is parsed, responses follow HTTP/1.1 defaults
+	if cc, ok := c.Context().(*connContext); ok {
+		cc.reply = replyMode{}
+	}
+
+	// A request let through before its body arrived has the body streamed upstream
+	var upload *uploadBody
+	if headerLen, bodyLen, requestLen := requestProgress(reqData); requestLen < 0 {
+		upload = newUploadBody(reqData[headerLen:], bodyLen, h.runtime.Load().Proxy)
+	}
+
+	action := h.serveTraffic(c, reqData, upload, entry)
+
+	// Streamed exchanges finish outside the event loop and are recorded there
+	if cc, ok := c.Context().(*connContext); ok && cc.stream != nil {
+		h.runStream(c, cc, observe)
+		return action
+	}
+	// The rest of a rejected upload would be read as the next request
+	if upload != nil || h.clientReply(c).close {
+		action = gnet.Close
+	}
+
+	// Connections dropped before any response was written are not counted as requests
+	if entry.Status != 0 {
+		observe()
+	}
+	return action
+}
+
+// serveTraffic parses and proxies a single request read from a gnet connection.
+// When upload is set, reqData holds only the start of the body and the rest is
+// streamed to the upstream as it arrives.
+func (h *HTTPHandler) serveTraffic(c gnet.Conn, reqData []byte, upload *uploadBody, entry *AccessEntry) gnet.Action {
+	rc := h.runtime.Load()
+
 	// Check for empty request data
 	if len(reqData) == 0 {
 		h.logger.Debug("Received empty request data")
 		return gnet.Close
 	}
 
+	// An overloaded proxy turns part of the requests away before doing any work on them
+	if admitted, retryAfter := rc.LoadShedding.Admit(); !admitted {
+		h.metrics.IncShedRequests()
+		h.sendTrafficErrorHeader(c, entry, fasthttp.StatusServiceUnavailable, "Service Unavailable", "Retry-After", retryAfterSeconds(retryAfter))
+		return gnet.None
+	}
+	defer func() {
+		// A streamed exchange stays pending until its stream has finished
+		if cc, ok := c.Context().(*connContext); ok && cc.stream != nil {
+			run := cc.stream.run
+			cc.stream.run = func(w *clientWriter) bool {
+				defer rc.LoadShedding.Done()
+				return run(w)
+			}
+			return
+		}
+		rc.LoadShedding.Done()
+	}()
+
 	// Check max body size first
-	if int64(len(reqData)) > h.proxyConfig.MaxBodySize {
-		h.logger.Warn("Request too large", zap.Int("size", len(reqData)), zap.Int64("max", h.proxyConfig.MaxBodySize))
-		h.sendErrorResponse(c, fasthttp.StatusRequestEntityTooLarge, "Request Entity Too Large")
+	if int64(len(reqData)) > rc.Proxy.MaxBodySize {
+		h.logger.Warn("Request too large", zap.Int("size", len(reqData)), zap.Int64("max", rc.Proxy.MaxBodySize))
+		h.sendTrafficError(c, entry, fasthttp.StatusRequestEntityTooLarge, "Request Entity Too Large")
 		return gnet.None
 	}
 
@@ -189,55 +386,388 @@ func (h *HTTPHandler) HandleTraffic(c gnet.Conn, reqData []byte) gnet.Action {
 	defer fasthttp.ReleaseRequest(req)
 
 	bufReader := bufio.NewReader(bytes.NewReader(reqData))
-	if readErr := req.Read(bufReader); readErr != nil {
+	readRequest := req.Read
+	if upload != nil {
+		readRequest = req.Header.Read
+	}
+	readErr := readRequest(bufReader)
+	if readErr == nil && upload == nil && req.MayContinue() {
+		// The body followed the expectation and is already buffered
+		readErr = req.ContinueReadBody(bufReader, 0)
+	}
+	if readErr != nil {
 		h.logger.Debug("Failed to parse HTTP request", zap.Error(readErr))
-		h.sendErrorResponse(c, fasthttp.StatusBadRequest, "Bad Request")
+		h.sendTrafficError(c, entry, fasthttp.StatusBadRequest, "Bad Request")
 		return gnet.None
 	}
 
+	// Responses are written in the client's HTTP version, and the connection
+	// closed after them when the client asked to
+	reply := replyModeOf(req)
+	if cc, ok := c.Context().(*connContext); ok {
+		cc.reply = reply
+	}
+	if reply.http10 {
+		entry.Protocol = "HTTP/1.0"
+	}
+
 	// Validate HTTP method
 	method := string(req.Header.Method())
 	if method == "" {
 		h.logger.Debug("Missing HTTP method in request")
-		h.sendErrorResponse(c, fasthttp.StatusBadRequest, "Bad Request")
+		h.sendTrafficError(c, entry, fasthttp.StatusBadRequest, "Bad Request")
+		return gnet.None
+	}
+
+	entry.Method = method
+	if !normalizeFastHTTPTarget(req, rc.Proxy.PathNormalization) {
+		h.logger.Debug("Request path rejected", zap.ByteString("uri", req.Header.RequestURI()))
+		h.sendTrafficError(c, entry, fasthttp.StatusBadRequest, "Bad Request")
+		return gnet.None
+	}
+	entry.Path = string(req.URI().Path())
+	entry.BytesIn = len(req.Body())
+	route := rc.Router.Match(entry.Path)
+	entry.Route = route.RouteName()
+	reply.route = route
+	if cc, ok := c.Context().(*connContext); ok {
+		cc.reply.route = route
+	}
+
+	// Client IP allow/deny lists come before anything else
+	if !rc.AllowClient(route, clientIP(entry.Remote)) {
+		h.logger.Debug("Client IP rejected by access list", zap.String("remote", entry.Remote))
+		h.sendTrafficError(c, entry, fasthttp.StatusForbidden, "Forbidden")
+		return gnet.None
+	}
+	// During maintenance only the allow-listed clients reach the upstreams
+	if maintenance := rc.MaintenanceFor(route, clientIP(entry.Remote)); maintenance != nil {
+		h.sendPage(c, entry, maintenance)
+		return gnet.None
+	}
+	if userAgent := string(req.Header.UserAgent()); !rc.UserAgents.Allowed(userAgent) {
+		h.logger.Debug("User agent rejected", zap.String("remote", entry.Remote), zap.String("user_agent", userAgent))
+		status, body := rc.UserAgents.Rejection()
+		h.sendTrafficError(c, entry, status, body)
+		return gnet.None
+	}
+
+	// Server and route rate limits, preflight requests included
+	if allowed, retryAfter := rc.AllowRequest(route, clientIP(entry.Remote)); !allowed {
+		h.logger.Debug("Rate limit exceeded", zap.String("remote", entry.Remote))
+		h.sendTooManyRequests(c, entry, retryAfter)
+		return gnet.None
+	}
+
+	// Handle CORS preflight requests, unless the route leaves CORS to its upstream
+	if !route.DelegatesCORS() && h.handleCORS(req, c, rc.CORS) {
+		entry.Status = fasthttp.StatusOK
+		return gnet.None
+	}
+
+	// Preflight requests carry no credentials, so authentication is checked after CORS,
+	// and skipped for preflights delegated to the upstream
+	delegatedPreflight := route.DelegatesCORS() && isPreflight(string(req.Header.Method()),
+		string(req.Header.Peek("Origin")), string(req.Header.Peek("Access-Control-Request-Method")))
+	if !delegatedPreflight && !h.authenticateTraffic(c, entry, rc, route, req) {
+		return gnet.None
+	}
+
+	// Filters of the embedding program may change the request or answer it themselves
+	page, err := h.filters.filterFastHTTPRequest(req, entry.Remote, entry.Route, upload != nil)
+	if err != nil {
+		h.logger.Error("Request filter failed", zap.Error(err))
+		h.sendTrafficError(c, entry, fasthttp.StatusInternalServerError, "Internal Server Error")
 		return gnet.None
 	}
+	if page != nil {
+		h.sendPage(c, entry, page)
+		return gnet.None
+	}
+
+	// CORS headers of the response depend on the origin, redirects on the host the client used
+	origin := string(req.Header.Peek("Origin"))
+	external := fastHTTPOrigin(req, entry.Remote, rc)
+	decorate := func(resp *fasthttp.Response) {
+		rc.ErrorPages.applyFastHTTP(resp, true)
+		addFastHTTPResponseVia(&resp.Header)
+		h.loadBalancer.rewriteFastHTTPLocation(&resp.Header, external, route, rc)
+		route.rewriteFastHTTPCookies(&resp.Header)
+		rc.SecurityHeadersFor(route).applyFastHTTP(&resp.Header)
+		applyCORSFastHTTP(&resp.Header, rc.CORS, origin, route.DelegatesCORS())
+	}
 
-	// Handle CORS preflight requests
-	if h.handleCORS(req, c) {
+	// Cached responses are answered without reaching an upstream
+	var cacheKey CacheKey
+	cacheable := false
+	if upload == nil {
+		cacheKey, cacheable = rc.Cache.Key(req, entry.Path, route)
+	}
+	if cacheable && h.serveCached(c, rc.Cache, cacheKey, req, entry, decorate) {
 		return gnet.None
 	}
+	// A stale cached response is revalidated rather than downloaded again
+	var stale *cacheEntry
+	if cacheable {
+		stale = rc.Cache.Revalidate(cacheKey, req)
+	}
+	if rc.Cache != nil {
+		switch {
+		case stale != nil:
+			h.metrics.ObserveCache(cacheStale)
+		case cacheable && !requestCacheControl(req).noCache:
+			h.metrics.ObserveCache(cacheMiss)
+		default:
+			h.metrics.ObserveCache(cacheBypass)
+		}
+	}
+
+	x := &trafficExchange{
+		rc:        rc,
+		req:       req,
+		method:    string(req.Header.Method()),
+		upload:    upload,
+		entry:     entry,
+		reply:     reply,
+		route:     route,
+		decorate:  decorate,
+		cacheKey:  cacheKey,
+		cacheable: cacheable,
+		stale:     stale,
+	}
+	// A request waiting for a slot leaves the queue when its client goes away
+	var closed <-chan struct{}
+	if cc, ok := c.Context().(*connContext); ok {
+		x.tracked = cc.tracked
+		closed = cc.closed
+	}
+
+	// Requests beyond the route's concurrency limit wait for a slot, and synthetic
+	// latency for staging parity is waited out, in a goroutine, the connection
+	// reading no further request meanwhile
+	limiter := route.Concurrency()
+	acquired := limiter.TryAcquire()
+	if x.delay = route.SyntheticDelay(); !acquired || x.delay > 0 {
+		x.req = fasthttp.AcquireRequest()
+		req.CopyTo(x.req)
+		h.setStream(c, upload, nil, func(w *clientWriter) bool {
+			defer fasthttp.ReleaseRequest(x.req)
+			if !acquired && !limiter.Acquire(closed) {
+				h.logger.Debug("Route concurrency limit reached", zap.String("route", entry.Route), zap.String("remote", entry.Remote))
+				h.sendTrafficError(w, entry, fasthttp.StatusServiceUnavailable, "Service Unavailable")
+				return upload == nil && !reply.close
+			}
+			defer limiter.Release()
+			return h.forwardTraffic(c, w, x)
+		})
+		return gnet.None
+	}
+	defer limiter.Release()
+
+	if !h.forwardTraffic(c, nil, x) {
+		return gnet.Close
+	}
+	return gnet.None
+}
+
+// trafficExchange is a gnet request that passed the proxy's checks, on its way to
+// an upstream
+type trafficExchange struct {
+	rc        *RuntimeConfig
+	req       *fasthttp.Request
+	method    string      // as the request filters left it
+	upload    *uploadBody // the request body still arriving, if any
+	entry     *AccessEntry
+	reply     replyMode
+	route     *Route
+	tracked   *TrackedConn
+	decorate  func(*fasthttp.Response)
+	cacheKey  CacheKey
+	cacheable bool
+	stale     *cacheEntry   // cached response to revalidate
+	delay     time.Duration // synthetic latency, only when forwarded outside the event loop
+}
+
+// forwardTraffic sends an exchange to an upstream of its route and answers the
+// client, on the event loop when stream is nil, or from the goroutine of a
+// stream. It reports whether the connection can carry another request.
+func (h *HTTPHandler) forwardTraffic(c gnet.Conn, stream *clientWriter, x *trafficExchange) bool {
+	var w io.Writer = c
+	if stream != nil {
+		w = stream
+	}
+	rc, req, entry, route := x.rc, x.req, x.entry, x.route
+	// The rest of a rejected upload would be read as the next request
+	open := x.upload == nil && !x.reply.close
 
 	// Get upstream server
-	upstream := h.loadBalancer.GetUpstream()
+	decorate := x.decorate
+	upstream, splitCookie := h.loadBalancer.GetUpstreamForRoute(route, h.loadBalancer.affinityKeyFastHTTP(req, clientIP(entry.Remote)), clientIP(entry.Remote), fastHTTPFields{req})
+	if splitCookie != "" {
+		// Responses from the upstream carry the client's traffic split group
+		setHeaders := decorate
+		decorate = func(resp *fasthttp.Response) {
+			setHeaders(resp)
+			resp.Header.Add("Set-Cookie", splitCookie)
+		}
+	}
 	if upstream == nil {
-		h.sendErrorResponse(c, fasthttp.StatusServiceUnavailable, "Service Unavailable")
-		return gnet.None
+		if fallback := route.Fallback(); fallback != nil {
+			h.sendPage(w, entry, fallback)
+			return open
+		}
+		h.sendTrafficError(w, entry, fasthttp.StatusServiceUnavailable, "Service Unavailable")
+		return open
 	}
 
+	entry.Upstream = upstream.Name
+	x.tracked.SetTarget(entry.Route, upstream.Name)
+
+	// gRPC-Web is translated to native gRPC, which only runs over HTTP/2
+	grpcWeb := route.grpcWebCallFor(string(req.Header.ContentType()))
+	if grpcWeb != nil && !upstream.Overrides().http2() {
+		h.logger.Error("gRPC-Web route needs an h2 or h2c upstream", zap.String("upstream", upstream.Name))
+		h.sendTrafficError(w, entry, fasthttp.StatusBadGateway, "Bad Gateway")
+		return open
+	}
+
+	// Header rules and path rewrites change the request before it is mirrored and forwarded
+	rc.rewriteFastHTTPRequestHeaders(route, &req.Header)
+	rewriteFastHTTPTarget(route, req)
+
 	// Increment connection count
 	h.loadBalancer.IncreaseConnections(upstream)
 	defer h.loadBalancer.DecreaseConnections(upstream)
 
-	// Forward request to upstream
-	resp, err := h.forwardRequest(req, upstream)
+	// Synthetic latency for staging parity
+	time.Sleep(x.delay)
+
+	// A streamed upload is forwarded outside the event loop while its body arrives,
+	// too late to be mirrored
+	if x.upload != nil {
+		if route.Mirror() != nil {
+			h.metrics.ObserveMirror(mirrorSkipped)
+		}
+		if stream != nil {
+			return h.forwardUpload(stream, req, x.reply, x.upload, upstream, grpcWeb, entry, decorate)
+		}
+		streamReq := fasthttp.AcquireRequest()
+		req.CopyTo(streamReq)
+		h.setStream(c, x.upload, upstream, func(w *clientWriter) bool {
+			defer fasthttp.ReleaseRequest(streamReq)
+			return h.forwardUpload(w, streamReq, x.reply, x.upload, upstream, grpcWeb, entry, decorate)
+		})
+		return true
+	}
+
+	// A copy goes to the route's shadow upstream, if any
+	mirrorFastHTTP(route, req, entry.Remote, rc, h.metrics, h.logger)
+
+	// Forward request to upstream, relaying its interim responses as they come.
+	// The body is buffered, so the retry policy alone decides whether a failed
+	// request is sent again.
+	policy := route.RetryPolicy(h.loadBalancer.RetryPolicy())
+	attempts := policy.Attempts(x.method, true)
+	resp, next, err := h.forwardRequest(req, upstream, grpcWeb, entry.Remote, interimTo(w, x.reply), policy, 1, attempts, stream == nil)
+	if errors.Is(err, errRetryBackoff) {
+		// The backoff before a retry is waited out in a goroutine, with the
+		// attempts left
+		retryReq := fasthttp.AcquireRequest()
+		req.CopyTo(retryReq)
+		h.setStream(c, nil, upstream, func(w *clientWriter) bool {
+			defer fasthttp.ReleaseRequest(retryReq)
+			resp, _, err := h.forwardRequest(retryReq, upstream, grpcWeb, entry.Remote, interimTo(w, x.reply), policy, next, attempts, false)
+			return h.answerTraffic(c, w, x, retryReq, upstream, decorate, resp, err)
+		})
+		return true
+	}
+	return h.answerTraffic(c, stream, x, req, upstream, decorate, resp, err)
+}
+
+// interimTo relays the interim responses of an upstream to w, a gnet connection
+// or its clientWriter
+func interimTo(w io.Writer, reply replyMode) func(*fasthttp.ResponseHeader) {
+	return interimRelay(reply, func(buf []byte) error {
+		_, err := w.Write(buf)
+		return err
+	})
+}
+
+// answerTraffic answers the client of an exchange with the upstream's response
+// to req, or with the error forwarding it, on the event loop when stream is nil.
+// It reports whether the connection can carry another request.
+func (h *HTTPHandler) answerTraffic(c gnet.Conn, stream *clientWriter, x *trafficExchange, req *fasthttp.Request, upstream *Upstream, decorate func(*fasthttp.Response), resp *fasthttp.Response, err error) bool {
+	var w io.Writer = c
+	if stream != nil {
+		w = stream
+	}
+	rc, entry := x.rc, x.entry
+	open := !x.reply.close
+
 	if err != nil {
-		h.sendErrorResponse(c, fasthttp.StatusBadGateway, "Bad Gateway")
-		return gnet.None
+		h.metrics.IncUpstreamErrors()
+		h.sendTrafficError(w, entry, fasthttp.StatusBadGateway, "Bad Gateway")
+		return open
+	}
+	if !h.streamsBody(resp) {
+		decodeUpstreamResponse(resp, rc.Proxy.UpstreamEncoding)
+	}
+	// Filters of the embedding program see the response before it is cached
+	if err := h.filters.filterFastHTTPResponse(req, resp, entry.Remote); err != nil {
+		fasthttp.ReleaseResponse(resp)
+		h.logger.Error("Response filter failed", zap.Error(err))
+		h.sendTrafficError(w, entry, fasthttp.StatusInternalServerError, "Internal Server Error")
+		return open
+	}
+
+	if x.stale != nil && resp.StatusCode() == fasthttp.StatusNotModified {
+		rc.Cache.Refresh(x.cacheKey, x.stale, resp)
+	} else if x.cacheable && !h.streamsBody(resp) {
+		rc.Cache.Store(x.cacheKey, resp)
+	}
+	entry.Status = resp.StatusCode()
+	rc.Cache.MarkResponse(resp, false)
+	decorate(resp)
+
+	// A chunked or large body is relayed outside the event loop as it arrives
+	if stream != nil {
+		defer fasthttp.ReleaseResponse(resp)
+		return h.relayResponse(stream, resp, entry, x.reply)
+	}
+	if h.streamsBody(resp) && h.setStream(c, nil, upstream, func(w *clientWriter) bool {
+		defer fasthttp.ReleaseResponse(resp)
+		return h.relayResponse(w, resp, entry, x.reply)
+	}) {
+		return true
 	}
 	defer fasthttp.ReleaseResponse(resp)
+	entry.BytesOut = len(resp.Body())
 
 	// Send response back to client using fasthttp response writer
-	if err := h.sendResponse(c, resp); err != nil {
-		return gnet.Close
+	return h.writeResponse(c, resp) == nil
+}
+
+// serveCached answers req from the response stored under key, reporting false
+// when there is none it accepts
+func (h *HTTPHandler) serveCached(c gnet.Conn, cache *ResponseCache, key CacheKey, req *fasthttp.Request, entry *AccessEntry, decorate func(*fasthttp.Response)) bool {
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	if !cache.Get(key, req, resp) {
+		return false
 	}
 
-	return gnet.None
+	h.metrics.ObserveCache(cacheHit)
+	entry.Status = resp.StatusCode()
+	entry.BytesOut = len(resp.Body())
+	cache.MarkResponse(resp, true)
+	decorate(resp)
+	h.writeResponse(c, resp)
+	return true
 }
 
 // handleCORS adds CORS headers to the response if CORS is enabled
-func (h *HTTPHandler) handleCORS(req *fasthttp.Request, c gnet.Conn) bool {
-	if !h.corsConfig.Enabled {
+func (h *HTTPHandler) handleCORS(req *fasthttp.Request, c gnet.Conn, corsConfig CORSConfig) bool {
+	if !corsConfig.Enabled {
 		return false
 	}
 
@@ -245,16 +775,9 @@ func (h *HTTPHandler) handleCORS(req *fasthttp.Request, c gnet.Conn) bool {
 	method := string(req.Header.Method())
 
 	// Check if origin is allowed
-	allowedOrigin := "*"
-	if len(h.corsConfig.AllowedOrigins) > 0 && h.corsConfig.AllowedOrigins[0] != "*" {
-		originAllowed := false
-		if slices.Contains(h.corsConfig.AllowedOrigins, origin) {
-			allowedOrigin = origin
-			originAllowed = true
-		}
-		if !originAllowed {
-			return false
-		}
+	allowedOrigin := corsConfig.allowedOrigin(origin)
+	if allowedOrigin == "" {
+		return false
 	}
 
 	// Handle preflight request using fasthttp response
@@ -264,12 +787,18 @@ func (h *HTTPHandler) handleCORS(req *fasthttp.Request, c gnet.Conn) bool {
 
 		resp.SetStatusCode(fasthttp.StatusOK)
 		resp.Header.Set("Access-Control-Allow-Origin", allowedOrigin)
-		resp.Header.Set("Access-Control-Allow-Methods", strings.Join(h.corsConfig.AllowedMethods, ", "))
-		resp.Header.Set("Access-Control-Allow-Headers", strings.Join(h.corsConfig.AllowedHeaders, ", "))
-		if h.corsConfig.AllowCredentials {
+		resp.Header.Set("Vary", "Origin")
+		resp.Header.Set("Access-Control-Allow-Methods", strings.Join(corsConfig.AllowedMethods, ", "))
+		resp.Header.Set("Access-Control-Allow-Headers", strings.Join(corsConfig.AllowedHeaders, ", "))
+		if corsConfig.AllowCredentials {
 			resp.Header.Set("Access-Control-Allow-Credentials", "true")
 		}
-		resp.Header.Set("Access-Control-Max-Age", strconv.Itoa(h.corsConfig.MaxAge))
+		resp.Header.Set("Access-Control-Max-Age", strconv.Itoa(corsConfig.MaxAge))
+		// Chrome asks before letting public sites reach private networks
+		if bytes.EqualFold(req.Header.Peek("Access-Control-Request-Private-Network"), []byte("true")) &&
+			corsConfig.allowPrivateNetwork(origin) {
+			resp.Header.Set("Access-Control-Allow-Private-Network", "true")
+		}
 		resp.Header.Set("Content-Length", "0")
 
 		// Write response using fasthttp
@@ -280,77 +809,302 @@ func (h *HTTPHandler) handleCORS(req *fasthttp.Request, c gnet.Conn) bool {
 	return false
 }
 
-func (h *HTTPHandler) forwardRequest(req *fasthttp.Request, upstream *Upstream) (*fasthttp.Response, error) {
+// errRetryBackoff stops the attempts of a request on the event loop before the
+// backoff of a retry, which is waited out elsewhere
+var errRetryBackoff = errors.New("retry backoff left to wait outside the event loop")
+
+// forwardRequest sends a request to the upstream, attempts first to last while it
+// fails or answers with a status the policy retries. The response of the last
+// attempt is returned whatever its status. The request is pointed at the upstream
+// before the first attempt. With onLoop set, nothing is waited: a retry with a
+// backoff returns errRetryBackoff and the attempt to resume from instead.
+func (h *HTTPHandler) forwardRequest(req *fasthttp.Request, upstream *Upstream, grpcWeb *grpcWebCall, remoteAddr string, interim func(*fasthttp.ResponseHeader), policy RetryPolicy, first, attempts int, onLoop bool) (*fasthttp.Response, int, error) {
 	// Create fasthttp response
 	fastResp := fasthttp.AcquireResponse()
+	if first == 1 {
+		h.prepareUpstreamRequest(req, upstream, remoteAddr)
+	}
+
+	do := h.upstreamDo(upstream, grpcWeb, interim, policy.TryTimeout)
+	var err error
+	for i := first; i <= attempts; i++ {
+		if i > 1 {
+			delay := policy.Delay(i - 1)
+			if onLoop && delay > 0 {
+				fasthttp.ReleaseResponse(fastResp)
+				return nil, i, errRetryBackoff
+			}
+			time.Sleep(delay)
+		}
+
+		err = do(req, fastResp)
+		if err == nil && (i == attempts || !policy.RetriesStatus(fastResp.StatusCode())) {
+			return fastResp, 0, nil
+		}
+
+		// Mark upstream as unhealthy on persistent errors
+		if i == attempts {
+			h.loadBalancer.MarkUnhealthy(upstream)
+			break
+		}
+
+		if err == nil {
+			h.logger.Debug("Retrying request on upstream status",
+				zap.String("upstream", upstream.Name),
+				zap.Int("status", fastResp.StatusCode()),
+				zap.Int("attempt", i))
+			fastResp.Reset()
+		}
+	}
+
+	fasthttp.ReleaseResponse(fastResp)
+	return nil, 0, fmt.Errorf("failed to execute request after %d attempts: %w", attempts, err)
+}
+
+// prepareUpstreamRequest points a request from remoteAddr at the upstream and
+// adds the proxy headers
+func (h *HTTPHandler) prepareUpstreamRequest(req *fasthttp.Request, upstream *Upstream, remoteAddr string) {
+	removeRequestHopHeaders(&req.Header)
+
+	// Add proxy headers
+	setFastHTTPForwardingHeaders(&req.Header, remoteAddr, h.runtime.Load())
 
 	// Build target URL
 	originalURI := req.RequestURI()
 	targetURI := upstream.URL.String() + string(originalURI)
 	req.SetRequestURI(targetURI)
 
-	// Add proxy headers
-	req.Header.Set("X-Forwarded-Proto", "http")
-	req.Header.Set("X-Forwarded-Host", string(req.Header.Host()))
-	req.Header.Set("X-Real-IP", "127.0.0.1")
-
 	// Keep connection alive for better performance
 	req.Header.Set("Connection", "keep-alive")
 
-	// Execute request with minimal retry logic for performance
-	maxRetries := 2
-	var err error
-	for i := 0; i < maxRetries; i++ {
-		err = h.client.Do(req, fastResp)
-		if err == nil {
-			return fastResp, nil
-		}
+	// The proxy answers Expect: 100-continue itself, and sends the body along
+	// with the request
+	req.Header.Del("Expect")
 
-		// Mark upstream as unhealthy on persistent errors
-		if i == maxRetries-1 {
-			h.loadBalancer.MarkUnhealthy(upstream)
-		}
+	setUpstreamAcceptEncoding(&req.Header, h.runtime.Load().Proxy.UpstreamEncoding)
 
-		// Minimal delay before retry
-		time.Sleep(time.Millisecond * 10)
+	// The upstream learns how long it has to answer
+	proxyConfig := h.runtime.Load().Proxy
+	setFastHTTPDeadlineHeader(&req.Header, proxyConfig.DeadlineHeader, upstream.Overrides().requestTimeout(proxyConfig))
+}
+
+// upstreamDo returns the function that sends a request to the upstream: through
+// its HTTP/2 client, or its fasthttp client, which leaves bodies of unknown length
+// in the upstream connection, and large ones too when stream_bodies is on.
+// Interim responses of the upstream are passed to interim, when set, before the
+// function returns.
+func (h *HTTPHandler) upstreamDo(upstream *Upstream, grpcWeb *grpcWebCall, interim func(*fasthttp.ResponseHeader), tryTimeout time.Duration) func(*fasthttp.Request, *fasthttp.Response) error {
+	if upstream.Overrides().http2() {
+		return func(req *fasthttp.Request, resp *fasthttp.Response) error {
+			return h.doHTTP2(req, resp, upstream, grpcWeb, interim, tryTimeout)
+		}
 	}
+	client := h.clients.Fast(upstream)
+	if h.runtime.Load().Proxy.StreamBodies {
+		client = h.clients.Stream(upstream)
+	}
+	return func(req *fasthttp.Request, resp *fasthttp.Response) error {
+		defer watchInterim(req, interim)()
+		if tryTimeout > 0 {
+			req.SetTimeout(tryTimeout)
+		}
+		return client.Do(req, resp)
+	}
+}
 
-	fasthttp.ReleaseResponse(fastResp)
-	return nil, fmt.Errorf("failed to execute request after %d retries: %w", maxRetries, err)
+// http2ConnectionHeaders are connection-specific or set by the client itself, and
+// are not copied into HTTP/2 requests
+var http2ConnectionHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+	"Te":                true,
+	"Host":              true,
+	"Content-Length":    true,
 }
 
-func (h *HTTPHandler) sendResponse(c gnet.Conn, resp *fasthttp.Response) error {
-	// Add CORS headers if enabled
-	if h.corsConfig.Enabled {
-		resp.Header.Set("Access-Control-Allow-Origin", "*")
-		if len(h.corsConfig.ExposedHeaders) > 0 {
-			resp.Header.Set("Access-Control-Expose-Headers", strings.Join(h.corsConfig.ExposedHeaders, ", "))
+// doHTTP2 sends a gnet request to an h2 or h2c upstream through the upstream's
+// net/http client, which multiplexes requests over a few HTTP/2 connections, and
+// copies the answer into resp. gRPC-Web calls, when grpcWeb is set, are
+// translated to gRPC and back. With tryTimeout set, the request is given up when
+// the upstream does not answer within it.
+func (h *HTTPHandler) doHTTP2(req *fasthttp.Request, resp *fasthttp.Response, upstream *Upstream, grpcWeb *grpcWebCall, interim func(*fasthttp.ResponseHeader), tryTimeout time.Duration) error {
+	ctx, cancelRequest := context.WithTimeout(withInterimListener(context.Background(), interim), upstream.Overrides().requestTimeout(h.runtime.Load().Proxy))
+	ctx, cancelTry, arrived := RetryPolicy{TryTimeout: tryTimeout}.tryContext(ctx)
+	cancel := func() {
+		cancelTry()
+		cancelRequest()
+	}
+	streaming := false
+	defer func() {
+		if !streaming {
+			cancel()
 		}
-		if h.corsConfig.AllowCredentials {
-			resp.Header.Set("Access-Control-Allow-Credentials", "true")
+	}()
+
+	// A streamed upload is passed on as it arrives
+	reqBody := io.Reader(bytes.NewReader(req.Body()))
+	if req.IsBodyStream() {
+		reqBody = req.BodyStream()
+	}
+	stdReq, err := http.NewRequestWithContext(ctx, string(req.Header.Method()), req.URI().String(), reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.VisitAll(func(key, value []byte) {
+		if name := http.CanonicalHeaderKey(string(key)); !http2ConnectionHeaders[name] {
+			stdReq.Header.Add(name, string(value))
+		}
+	})
+	if grpcWeb != nil {
+		grpcWeb.translateRequest(stdReq)
+	}
+
+	stdResp, err := h.clients.Standard(upstream).Do(stdReq)
+	arrived()
+	if err != nil {
+		return err
+	}
+	resp.Reset()
+	resp.SetStatusCode(stdResp.StatusCode)
+	resp.Header.SetProtocol([]byte(stdResp.Proto))
+	copyResponseHeader := func() {
+		for name, values := range stdResp.Header {
+			if http2ConnectionHeaders[name] {
+				continue
+			}
+			for _, value := range values {
+				resp.Header.Add(name, value)
+			}
+		}
+	}
+
+	// A body of unknown length is relayed as it arrives, like a chunked HTTP/1.1
+	// one, and so is large partial content; releasing the response closes the
+	// stream
+	threshold := h.runtime.Load().Proxy.StreamThreshold
+	if grpcWeb == nil && (stdResp.ContentLength < 0 || streamsPartial(stdResp.StatusCode, stdResp.ContentLength, threshold)) {
+		streaming = true
+		copyResponseHeader()
+		resp.SetBodyStream(&streamBody{ReadCloser: stdResp.Body, cancel: cancel}, int(stdResp.ContentLength))
+		return nil
+	}
+
+	defer stdResp.Body.Close()
+	var body []byte
+	if grpcWeb != nil {
+		var buf bytes.Buffer
+		if err := grpcWeb.copyBody(&buf, stdResp); err != nil {
+			return err
 		}
+		body = buf.Bytes()
+		grpcWeb.translateResponseHeader(stdResp.Header)
+	} else if body, err = io.ReadAll(stdResp.Body); err != nil {
+		return err
 	}
 
-	return h.writeResponse(c, resp)
+	copyResponseHeader()
+	resp.SetBody(body)
+	return nil
+}
+
+// streamBody is the body of an HTTP/2 upstream response relayed as it arrives.
+// Closing it also ends the request's context.
+type streamBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
 }
 
-// writeResponse efficiently writes fasthttp response to gnet connection
-func (h *HTTPHandler) writeResponse(c gnet.Conn, resp *fasthttp.Response) error {
+func (b *streamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// writeResponse efficiently writes fasthttp response to gnet connection, or to
+// its clientWriter
+func (h *HTTPHandler) writeResponse(c io.Writer, resp *fasthttp.Response) error {
+	reply := h.clientReply(c)
+	h.compressReply(resp, reply)
+
 	// Pre-allocate buffer with larger estimated size for better performance
 	body := resp.Body()
 	estimatedSize := 1024 + len(body) // Larger header estimate + body
-	buf := make([]byte, 0, estimatedSize)
+	buf := appendResponseHead(make([]byte, 0, estimatedSize), resp, len(body), reply)
 
-	// Status line
-	buf = append(buf, fmt.Sprintf("HTTP/1.1 %d %s\r\n", resp.StatusCode(), fasthttp.StatusMessage(resp.StatusCode()))...)
+	// Body
+	buf = append(buf, body...)
 
-	// Keep connection alive for better performance
-	buf = append(buf, "Connection: keep-alive\r\n"...)
+	_, err := c.Write(buf)
+	return err
+}
 
-	// Headers
+// replyMode is how a gnet client expects its response: in the HTTP version of
+// its request, on a connection closed afterwards when it sent Connection: close,
+// or spoke HTTP/1.0 without asking for keep-alive, and compressed in a content
+// coding it accepts, at the levels of the route it matched
+type replyMode struct {
+	http10         bool
+	close          bool
+	acceptEncoding string
+	route          *Route // nil before the request is routed
+}
+
+// replyModeOf returns the reply mode a parsed request asks for
+func replyModeOf(req *fasthttp.Request) replyMode {
+	return replyMode{
+		http10:         !req.Header.IsHTTP11(),
+		close:          req.Header.ConnectionClose(),
+		acceptEncoding: string(req.Header.Peek("Accept-Encoding")),
+	}
+}
+
+// compressReply compresses a buffered response for the client when the server
+// has compression enabled
+func (h *HTTPHandler) compressReply(resp *fasthttp.Response, reply replyMode) {
+	if proxy := h.runtime.Load().Proxy; proxy.EnableCompression {
+		compressFastHTTP(resp, reply.route.CompressionConfig(proxy), []byte(reply.acceptEncoding))
+	}
+}
+
+// clientReply returns the reply mode of the request being answered on c, a gnet
+// connection or its clientWriter
+func (h *HTTPHandler) clientReply(c io.Writer) replyMode {
+	if w, ok := c.(*clientWriter); ok {
+		c = w.c
+	}
+	if conn, ok := c.(gnet.Conn); ok {
+		if cc, ok := conn.Context().(*connContext); ok {
+			return cc.reply
+		}
+	}
+	return replyMode{}
+}
+
+// appendResponseHead appends the status line and headers of resp to buf. A body
+// without Content-Length is framed as bodyLen bytes, or when bodyLen is negative
+// chunked, or for an HTTP/1.0 client by closing the connection.
+func appendResponseHead(buf []byte, resp *fasthttp.Response, bodyLen int, reply replyMode) []byte {
+	// Status line, in the client's HTTP version
+	proto := "HTTP/1.1"
+	if reply.http10 {
+		proto = "HTTP/1.0"
+	}
+	buf = append(buf, fmt.Sprintf("%s %d %s\r\n", proto, resp.StatusCode(), fasthttp.StatusMessage(resp.StatusCode()))...)
+
+	if reply.close {
+		buf = append(buf, "Connection: close\r\n"...)
+	} else {
+		buf = append(buf, "Connection: keep-alive\r\n"...)
+	}
+
+	// Headers, without the upstream's hop-by-hop ones, which include the framing
+	// set below
+	connection := resp.Header.Peek("Connection")
 	resp.Header.VisitAll(func(key, value []byte) {
-		// Skip connection header to avoid conflicts
-		if !bytes.EqualFold(key, []byte("connection")) {
+		if !isHopHeader(key, connection) {
 			buf = append(buf, key...)
 			buf = append(buf, ": "...)
 			buf = append(buf, value...)
@@ -360,26 +1114,72 @@ func (h *HTTPHandler) writeResponse(c gnet.Conn, resp *fasthttp.Response) error
 
 	// Content-Length if not present
 	if len(resp.Header.Peek("Content-Length")) == 0 {
-		buf = append(buf, fmt.Sprintf("Content-Length: %d\r\n", len(body))...)
+		switch {
+		case bodyLen >= 0:
+			buf = append(buf, fmt.Sprintf("Content-Length: %d\r\n", bodyLen)...)
+		case !reply.http10:
+			buf = append(buf, "Transfer-Encoding: chunked\r\n"...)
+		}
 	}
 
 	// End of headers
-	buf = append(buf, "\r\n"...)
-
-	// Body
-	buf = append(buf, body...)
-
-	_, err := c.Write(buf)
-	return err
+	return append(buf, "\r\n"...)
 }
 
 func (h *HTTPHandler) sendErrorResponse(c gnet.Conn, statusCode int, message string) {
 	resp := fasthttp.AcquireResponse()
 	defer fasthttp.ReleaseResponse(resp)
 
+	h.errorResponse(resp, statusCode, message)
+	h.writeResponse(c, resp)
+}
+
+// errorResponse fills resp with an error the proxy answers itself: the server's
+// error page for the status, or message as plain text
+func (h *HTTPHandler) errorResponse(resp *fasthttp.Response, statusCode int, message string) {
 	resp.SetStatusCode(statusCode)
 	resp.Header.Set("Content-Type", "text/plain")
 	resp.SetBodyString(message)
+	h.runtime.Load().ErrorPages.applyFastHTTP(resp, false)
+}
 
+// sendTrafficError writes an error response on a gnet connection and records it in the access entry
+func (h *HTTPHandler) sendTrafficError(c io.Writer, entry *AccessEntry, statusCode int, message string) {
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	h.errorResponse(resp, statusCode, message)
+	entry.Status = statusCode
+	entry.BytesOut = len(resp.Body())
 	h.writeResponse(c, resp)
-}
\ No newline at end of file
+}
+
+// sendTooManyRequests rejects a rate-limited request on a gnet connection with a Retry-After hint
+func (h *HTTPHandler) sendTooManyRequests(c gnet.Conn, entry *AccessEntry, retryAfter time.Duration) {
+	h.sendTrafficErrorHeader(c, entry, fasthttp.StatusTooManyRequests, "Too Many Requests", "Retry-After", retryAfterSeconds(retryAfter))
+}
+
+// sendPage answers a request on a gnet connection with a static page and records
+// it in the access entry
+func (h *HTTPHandler) sendPage(c io.Writer, entry *AccessEntry, page staticPage) {
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	page.writeFastHTTP(resp)
+	entry.Status = resp.StatusCode()
+	entry.BytesOut = len(resp.Body())
+	h.writeResponse(c, resp)
+}
+
+// sendTrafficErrorHeader is sendTrafficError with one extra response header
+func (h *HTTPHandler) sendTrafficErrorHeader(c gnet.Conn, entry *AccessEntry, statusCode int, message, header, value string) {
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	h.errorResponse(resp, statusCode, message)
+	resp.Header.Set(header, value)
+
+	entry.Status = statusCode
+	entry.BytesOut = len(resp.Body())
+	h.writeResponse(c, resp)
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Interim (1xx) responses, such as 103 Early Hints, come ahead of an upstream's
+// final response and are relayed to the client as they arrive. 100 Continue is
+// the exception: the proxy answers Expect: 100-continue itself. HTTP/1.0 clients
+// get none, since they cannot tell an interim response from the final one.
+
+// interimListeners maps the fasthttp requests being sent to the listeners of their
+// interim responses
+var interimListeners sync.Map
+
+// watchInterim passes the interim responses to req to listen until the returned
+// function is called
+func watchInterim(req *fasthttp.Request, listen func(*fasthttp.ResponseHeader)) func() {
+	if listen == nil {
+		return func() {}
+	}
+	interimListeners.Store(req, listen)
+	return func() { interimListeners.Delete(req) }
+}
+
+// interimRelay returns the listener relaying interim responses to a gnet client
+// through write, or nil when the client gets none
+func interimRelay(reply replyMode, write func([]byte) error) func(*fasthttp.ResponseHeader) {
+	if reply.http10 {
+		return nil
+	}
+	return func(h *fasthttp.ResponseHeader) {
+		if h.StatusCode() != fasthttp.StatusContinue {
+			// A failed write fails the final response's too
+			write(appendInterimResponse(nil, h))
+		}
+	}
+}
+
+// appendInterimResponse appends an interim response as sent to a gnet client.
+// It has no body, so none of the content headers fasthttp fills in either.
+func appendInterimResponse(buf []byte, h *fasthttp.ResponseHeader) []byte {
+	buf = fmt.Appendf(buf, "HTTP/1.1 %d %s\r\n", h.StatusCode(), fasthttp.StatusMessage(h.StatusCode()))
+	connection := h.Peek("Connection")
+	h.VisitAll(func(key, value []byte) {
+		if !isHopHeader(key, connection) && !bytes.EqualFold(key, []byte("Content-Type")) && !bytes.EqualFold(key, []byte("Content-Length")) {
+			buf = append(append(append(append(buf, key...), ": "...), value...), "\r\n"...)
+		}
+	})
+	return append(buf, "\r\n"...)
+}
+
+// withInterimListener returns ctx for a net/http upstream request whose interim
+// responses go to listen
+func withInterimListener(ctx context.Context, listen func(*fasthttp.ResponseHeader)) context.Context {
+	if listen == nil {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			listen(interimHeader(code, header))
+			return nil
+		},
+	})
+}
+
+// interimHeader converts an interim response received by a net/http client
+func interimHeader(code int, header textproto.MIMEHeader) *fasthttp.ResponseHeader {
+	h := &fasthttp.ResponseHeader{}
+	h.SetNoDefaultContentType(true)
+	h.SetStatusCode(code)
+	for name, values := range header {
+		if http2ConnectionHeaders[name] {
+			continue
+		}
+		for _, value := range values {
+			h.Add(name, value)
+		}
+	}
+	return h
+}
+
+// withInterimRelay returns ctx for the upstream request of r, relaying the
+// upstream's interim responses to the net/http client through w
+func withInterimRelay(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	if !r.ProtoAtLeast(1, 1) {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusContinue {
+				return nil
+			}
+			// WriteHeader sends the headers set so far along with a 1xx status, so
+			// those of the final response are put aside meanwhile
+			h := w.Header()
+			final := h.Clone()
+			clear(h)
+			for name, values := range header {
+				h[name] = values
+			}
+			removeHopHeaders(h)
+			w.WriteHeader(code)
+			clear(h)
+			for name, values := range final {
+				h[name] = values
+			}
+			return nil
+		},
+	})
+}
+
+// upstreamTransport is the fasthttp transport of the gnet path's upstream
+// clients. It is fasthttp's own exchange, except that interim responses before
+// the final one go to the request's listener instead of being taken for the
+// final response, that large partial content is always streamed, and that the
+// pool's connections are counted in gauges.
+type upstreamTransport struct {
+	streamThreshold int64
+	gauges          *poolGauges
+}
+
+func (t upstreamTransport) RoundTrip(hc *fasthttp.HostClient, req *fasthttp.Request, resp *fasthttp.Response) (bool, error) {
+	t.gauges.waiting.Add(1)
+	cc, err := hc.AcquireConn(0, req.ConnectionClose())
+	t.gauges.waiting.Add(-1)
+	if err != nil {
+		return false, err
+	}
+	t.gauges.inUse.Add(1)
+	release := func(reuse bool) {
+		t.gauges.inUse.Add(-1)
+		if reuse {
+			hc.ReleaseConn(cc)
+		} else {
+			hc.CloseConn(cc)
+		}
+	}
+	conn := cc.Conn()
+	resp.ParseNetConn(conn)
+
+	// Connections are renewed once older than MaxConnDuration
+	closeConn := req.ConnectionClose()
+	resetConnection := hc.MaxConnDuration > 0 && time.Since(cc.CreatedTime()) > hc.MaxConnDuration && !closeConn
+	if resetConnection {
+		req.SetConnectionClose()
+		closeConn = true
+	}
+
+	if err := conn.SetWriteDeadline(ioDeadline(hc.WriteTimeout)); err != nil {
+		release(false)
+		return true, err
+	}
+	bw := hc.AcquireWriter(conn)
+	err = req.Write(bw)
+	if resetConnection {
+		req.Header.ResetConnectionClose()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	hc.ReleaseWriter(bw)
+	if err != nil {
+		release(false)
+		return true, timeoutError(err)
+	}
+
+	if err := conn.SetReadDeadline(ioDeadline(hc.ReadTimeout)); err != nil {
+		release(false)
+		return true, err
+	}
+	skipBody := resp.SkipBody
+	if req.Header.IsHead() {
+		resp.SkipBody = true
+	}
+	if hc.DisableHeaderNamesNormalizing {
+		resp.Header.DisableNormalizing()
+	}
+	br := hc.AcquireReader(conn)
+	body, err := t.readResponse(br, req, resp, hc.MaxResponseBodySize)
+	resp.SkipBody = skipBody
+	if err != nil {
+		hc.ReleaseReader(br)
+		release(false)
+		return !errors.Is(err, fasthttp.ErrBodyTooLarge), err
+	}
+
+	closeConn = closeConn || resp.ConnectionClose()
+	if body != nil {
+		// The body stays in the connection until relayed, which may take any time
+		// while it makes progress
+		body.conn, body.timeout = conn, hc.ReadTimeout
+		body.release = func(reuse bool) {
+			hc.ReleaseReader(br)
+			release(reuse && !closeConn)
+		}
+		return false, nil
+	}
+	hc.ReleaseReader(br)
+	release(!closeConn)
+	return false, nil
+}
+
+// readResponse reads the response to req, passing interim responses to its
+// listener. A body the response streams is returned, left in br: one of unknown
+// length, longer than maxBodySize, or large partial content.
+func (t upstreamTransport) readResponse(br *bufio.Reader, req *fasthttp.Request, resp *fasthttp.Response, maxBodySize int) (*upstreamBody, error) {
+	resp.ResetBody()
+	for {
+		if err := resp.Header.Read(br); err != nil {
+			return nil, err
+		}
+		status := resp.Header.StatusCode()
+		if status < 100 || status >= 200 || status == fasthttp.StatusSwitchingProtocols {
+			break
+		}
+		if listen, ok := interimListeners.Load(req); ok {
+			listen.(func(*fasthttp.ResponseHeader))(&resp.Header)
+		}
+	}
+
+	status := resp.Header.StatusCode()
+	if resp.SkipBody || status < 200 || status == fasthttp.StatusNoContent || status == fasthttp.StatusNotModified {
+		return nil, nil
+	}
+
+	length := resp.Header.ContentLength()
+	streamed := length < 0 || (maxBodySize > 0 && length > maxBodySize) || streamsPartial(status, int64(length), t.streamThreshold)
+	if resp.StreamBody && streamed {
+		body := &upstreamBody{br: br, header: &resp.Header}
+		switch {
+		case length == -1:
+			body.chunked = true
+		case length < 0:
+			body.left = -1
+		default:
+			body.left = int64(length)
+		}
+		resp.SetBodyStream(body, length)
+		return body, nil
+	}
+	if err := resp.ReadBody(br, maxBodySize); err != nil {
+		return nil, err
+	}
+	if length == -1 {
+		if err := resp.Header.ReadTrailer(br); err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// upstreamBody is a response body read from the upstream connection as it is
+// relayed. The connection goes back to the pool once the body was read in full.
+type upstreamBody struct {
+	br      *bufio.Reader
+	header  *fasthttp.ResponseHeader // receives the trailers of a chunked body
+	chunked bool
+	left    int64 // bytes left in the body or the current chunk, -1 until the connection ends
+	err     error // io.EOF once the body was read in full
+	release func(reuse bool)
+
+	conn    net.Conn
+	timeout time.Duration // bounds each read
+}
+
+func (b *upstreamBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.timeout > 0 {
+		b.conn.SetReadDeadline(time.Now().Add(b.timeout))
+	}
+	if b.chunked && b.left == 0 {
+		if b.err = b.nextChunk(); b.err != nil {
+			return 0, b.err
+		}
+	}
+	if b.left >= 0 && int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+
+	n, err := b.br.Read(p)
+	if b.left < 0 {
+		// The body ends with the connection, which cannot be reused
+		b.err = err
+		return n, err
+	}
+	b.left -= int64(n)
+	switch {
+	case err == io.EOF:
+		err = io.ErrUnexpectedEOF
+	case err == nil && b.left == 0 && b.chunked:
+		err = b.endChunk()
+	case err == nil && b.left == 0:
+		err = io.EOF
+	}
+	b.err = err
+	return n, err
+}
+
+// nextChunk reads the size line of the next chunk, and the trailers after the last one
+func (b *upstreamBody) nextChunk() error {
+	line, err := b.br.ReadSlice('\n')
+	if err != nil {
+		return errChunk(err)
+	}
+	size, _, _ := bytes.Cut(bytes.TrimRight(line, "\r\n"), []byte(";"))
+	b.left, err = strconv.ParseInt(string(bytes.TrimSpace(size)), 16, 64)
+	if err != nil || b.left < 0 {
+		return errors.New("invalid chunk size")
+	}
+	if b.left == 0 {
+		if err := b.header.ReadTrailer(b.br); err != nil && err != io.EOF {
+			return err
+		}
+		return io.EOF
+	}
+	return nil
+}
+
+// endChunk reads the CRLF after the data of a chunk
+func (b *upstreamBody) endChunk() error {
+	crlf := make([]byte, 2)
+	if _, err := io.ReadFull(b.br, crlf); err != nil {
+		return errChunk(err)
+	}
+	if string(crlf) != "\r\n" {
+		return errors.New("missing CRLF after chunk")
+	}
+	return nil
+}
+
+// CloseWithError releases the upstream connection, which is only reused when the
+// body was read in full
+func (b *upstreamBody) CloseWithError(err error) error {
+	if b.release != nil {
+		b.release(err == nil && b.err == io.EOF && b.left >= 0)
+		b.release = nil
+	}
+	return nil
+}
+
+// errChunk reports a chunked body cut short
+func errChunk(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ioDeadline returns the deadline of an I/O operation bounded by timeout
+func ioDeadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// timeoutError reports any timeout as fasthttp.ErrTimeout, as fasthttp does
+func timeoutError(err error) error {
+	if t, ok := err.(interface{ Timeout() bool }); ok && t.Timeout() {
+		return fasthttp.ErrTimeout
+	}
+	return err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// IPSet is a set of IP networks stored in binary radix trees, one per address
+// family. A lookup walks at most one node per address bit, independent of the
+// number of networks.
+type IPSet struct {
+	v4 *ipTrieNode
+	v6 *ipTrieNode
+}
+
+// ipTrieNode is a node of the radix tree; terminal nodes end a network prefix
+type ipTrieNode struct {
+	children [2]*ipTrieNode
+	terminal bool
+}
+
+// NewIPSet builds a set from IP addresses and CIDR networks, or returns nil when
+// entries is empty
+func NewIPSet(entries []string) (*IPSet, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	set := &IPSet{v4: &ipTrieNode{}, v6: &ipTrieNode{}}
+	for _, entry := range entries {
+		prefix, err := parseIPPrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		set.insert(prefix)
+	}
+	return set, nil
+}
+
+// parseIPPrefix parses "10.0.0.0/8", "2001:db8::/32" or a single address
+func parseIPPrefix(entry string) (netip.Prefix, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", entry)
+		}
+		if prefix.Addr().Is4In6() {
+			// Addresses are matched unmapped, so a mapped prefix must cover IPv4
+			// addresses only
+			if prefix.Bits() < 96 {
+				return netip.Prefix{}, fmt.Errorf("CIDR %q too wide for an IPv4-mapped prefix", entry)
+			}
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address %q", entry)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func (s *IPSet) insert(prefix netip.Prefix) {
+	node := s.root(prefix.Addr())
+	addr := prefix.Addr().AsSlice()
+	for i := 0; i < prefix.Bits(); i++ {
+		if node.terminal {
+			// A shorter network already covers this one
+			return
+		}
+		bit := addressBit(addr, i)
+		if node.children[bit] == nil {
+			node.children[bit] = &ipTrieNode{}
+		}
+		node = node.children[bit]
+	}
+	node.terminal = true
+	node.children = [2]*ipTrieNode{}
+}
+
+// Contains reports whether the address falls in any network of the set
+func (s *IPSet) Contains(addr netip.Addr) bool {
+	if s == nil || !addr.IsValid() {
+		return false
+	}
+
+	addr = addr.Unmap()
+	node := s.root(addr)
+	bytes := addr.AsSlice()
+	for i := 0; i < addr.BitLen(); i++ {
+		if node.terminal {
+			return true
+		}
+		node = node.children[addressBit(bytes, i)]
+		if node == nil {
+			return false
+		}
+	}
+	return node.terminal
+}
+
+func (s *IPSet) root(addr netip.Addr) *ipTrieNode {
+	if addr.Is4() {
+		return s.v4
+	}
+	return s.v6
+}
+
+// addressBit returns bit i of an address, counting from the most significant bit
+func addressBit(addr []byte, i int) int {
+	return int(addr[i/8]>>(7-uint(i%8))) & 1
+}
+
+// IPFilter admits or rejects client IPs by allow and deny lists.
+// The deny list wins; a non-empty allow list admits only the IPs it contains.
+type IPFilter struct {
+	allow *IPSet
+	deny  *IPSet
+}
+
+// NewIPFilter builds a filter, or returns nil when neither list has entries.
+// A nil filter admits every client.
+func NewIPFilter(cfg AccessConfig) (*IPFilter, error) {
+	allow, err := NewIPSet(cfg.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	deny, err := NewIPSet(cfg.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	if allow == nil && deny == nil {
+		return nil, nil
+	}
+	return &IPFilter{allow: allow, deny: deny}, nil
+}
+
+// Allowed reports whether the client IP may use the server or route.
+// Unparseable addresses are rejected whenever a list is configured.
+func (f *IPFilter) Allowed(ip string) bool {
+	if f == nil {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	if f.deny.Contains(addr) {
+		return false
+	}
+	return f.allow == nil || f.allow.Contains(addr)
+}
+
+// AllowClient reports whether the server's and the route's access lists admit the client IP
+func (rc *RuntimeConfig) AllowClient(route *Route, ip string) bool {
+	return rc.Access.Allowed(ip) && route.AllowClient(ip)
+}
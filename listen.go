@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A server listens on its host and port, on a Unix socket (unix_socket), or on a
+// socket systemd opened for it and passed on start (systemd_socket), as described
+// in sd_listen_fds(3). The gnet engine binds its own sockets, so a server on a
+// systemd socket is served by the net/http engine, as WebSocket servers are.
+
+// listenFDsStart is the first file descriptor passed by systemd
+const listenFDsStart = 3
+
+var (
+	systemdOnce    sync.Once
+	systemdSockets map[string]net.Listener
+)
+
+// systemdListener returns the listening socket systemd passed under name, which
+// is the FileDescriptorName= of its socket unit, by default the unit's name
+func systemdListener(name string) (net.Listener, error) {
+	systemdOnce.Do(func() {
+		systemdSockets = inheritSystemdSockets()
+	})
+	ln, ok := systemdSockets[name]
+	if !ok {
+		return nil, fmt.Errorf("no socket named %q was passed by systemd", name)
+	}
+	return ln, nil
+}
+
+// inheritSystemdSockets takes over the listening sockets passed to the process.
+// The environment describing them is cleared, so that child processes do not take
+// them for theirs.
+func inheritSystemdSockets() map[string]net.Listener {
+	sockets := make(map[string]net.Listener)
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return sockets
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return sockets
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := range count {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		// Datagram sockets and further sockets of the same name are not served
+		if err != nil || sockets[name] != nil {
+			if ln != nil {
+				ln.Close()
+			}
+			continue
+		}
+		sockets[name] = ln
+	}
+	return sockets
+}
+
+// removeStaleSocket removes the socket file a previous run left at path, which
+// would fail the bind. Files other than sockets are left for the bind to report.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil || info.Mode()&fs.ModeSocket == 0 {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// listenServer opens the listener of a server served by the net/http engine
+func listenServer(server ServerConfig, p ProxyConfig) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	switch {
+	case server.SystemdSocket != "":
+		ln, err = listenHandover("systemd", server.SystemdSocket, func() (net.Listener, error) {
+			return systemdListener(server.SystemdSocket)
+		})
+	case server.UnixSocket != "":
+		ln, err = listenHandover("unix", server.UnixSocket, func() (net.Listener, error) {
+			if err := removeStaleSocket(server.UnixSocket); err != nil {
+				return nil, err
+			}
+			return net.Listen("unix", server.UnixSocket)
+		})
+	default:
+		addr := fmt.Sprintf("%s:%d", server.Host, server.Port)
+		ln, err = listenHandover("tcp", addr, func() (net.Listener, error) {
+			return net.Listen("tcp", addr)
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return withProxyProtocol(ln, p), nil
+}
+
+// Address returns where the server listens, as shown in logs and the admin API
+func (s ServerConfig) Address() string {
+	switch {
+	case s.SystemdSocket != "":
+		return "systemd:" + s.SystemdSocket
+	case s.UnixSocket != "":
+		return "unix:" + s.UnixSocket
+	}
+	return fmt.Sprintf("%s:%d", s.Host, s.Port)
+}
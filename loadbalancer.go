@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"sync"
@@ -16,17 +17,85 @@ type Upstream struct {
 	HealthCheck string
 	Healthy     int64 // atomic boolean (0 = unhealthy, 1 = healthy)
 	Connections int64 // atomic counter for active connections
+	State       int32 // atomic administrative state (UpstreamEnabled, UpstreamDisabled, UpstreamDraining)
+
+	MaxConnections int // concurrent connections accepted, 0 for no limit
+
+	overrides atomic.Pointer[UpstreamOverrides]
+	pool      poolGauges // connections of its pools on the gnet path
+}
+
+// Overrides returns the connection settings this upstream overrides
+func (u *Upstream) Overrides() UpstreamOverrides {
+	if o := u.overrides.Load(); o != nil {
+		return *o
+	}
+	return UpstreamOverrides{}
+}
+
+// SetOverrides replaces the connection settings this upstream overrides
+func (u *Upstream) SetOverrides(o UpstreamOverrides) {
+	u.overrides.Store(&o)
+}
+
+// Administrative upstream states set through the admin API
+const (
+	UpstreamEnabled  int32 = iota // receives traffic when healthy
+	UpstreamDisabled              // removed from rotation immediately, its client connections closed
+	UpstreamDraining              // receives no new traffic, existing connections finish
+)
+
+// upstreamStateNames maps administrative states to their API names
+var upstreamStateNames = map[int32]string{
+	UpstreamEnabled:  "enabled",
+	UpstreamDisabled: "disabled",
+	UpstreamDraining: "draining",
+}
+
+// UpstreamStatus is a point-in-time view of an upstream used for inspection
+type UpstreamStatus struct {
+	Name           string    `json:"name"`
+	URL            string    `json:"url"`
+	Weight         int       `json:"weight"`
+	Healthy        bool      `json:"healthy"`
+	State          string    `json:"state"`
+	Connections    int64     `json:"active_connections"`
+	MaxConnections int       `json:"max_connections,omitempty"`
+	Pool           PoolStats `json:"pool"`
+}
+
+// Available reports whether the upstream may receive new requests
+func (u *Upstream) Available() bool {
+	return atomic.LoadInt64(&u.Healthy) == 1 && atomic.LoadInt32(&u.State) == UpstreamEnabled
 }
 
 type LoadBalancer struct {
-	upstreams []*Upstream
-	method    string
-	current   uint64 // for round robin
-	mu        sync.RWMutex
-	timeout   time.Duration
-	retries   int
+	upstreams    []*Upstream
+	method       string
+	current      uint64 // for round robin
+	mu           sync.RWMutex
+	timeout      time.Duration
+	retry        RetryPolicy
 	healthTicker *time.Ticker
 	shutdownChan chan struct{}
+	checked      chan struct{} // closed once the first round of health checks is done
+
+	// Session affinity, shared with the server's other balancer
+	affinity     *AffinityStore
+	pool         string
+	affinityMode string
+	affinityName string
+	affinityTTL  time.Duration
+}
+
+// validateUpstreamConfigs checks that every upstream URL can be parsed
+func validateUpstreamConfigs(upstreamConfigs []UpstreamConfig) error {
+	for _, uc := range upstreamConfigs {
+		if _, err := url.Parse(uc.URL); err != nil {
+			return fmt.Errorf("invalid upstream URL %s: %w", uc.URL, err)
+		}
+	}
+	return nil
 }
 
 func NewLoadBalancer(upstreamConfigs []UpstreamConfig, lbConfig LoadBalancerConfig) (*LoadBalancer, error) {
@@ -39,12 +108,14 @@ func NewLoadBalancer(upstreamConfigs []UpstreamConfig, lbConfig LoadBalancerConf
 		}
 
 		upstream := &Upstream{
-			Name:        uc.Name,
-			URL:         parsedURL,
-			Weight:      uc.Weight,
-			HealthCheck: uc.HealthCheck,
-			Healthy:     1, // assume healthy initially
+			Name:           uc.Name,
+			URL:            parsedURL,
+			Weight:         uc.Weight,
+			HealthCheck:    uc.HealthCheck,
+			Healthy:        1, // assume healthy initially
+			MaxConnections: uc.MaxConnections,
 		}
+		upstream.SetOverrides(uc.Overrides())
 		upstreams = append(upstreams, upstream)
 	}
 
@@ -52,7 +123,11 @@ func NewLoadBalancer(upstreamConfigs []UpstreamConfig, lbConfig LoadBalancerConf
 		upstreams: upstreams,
 		method:    lbConfig.Method,
 		timeout:   lbConfig.Timeout,
-		retries:   lbConfig.MaxRetries,
+		retry:     retryPolicyOf(lbConfig),
+
+		affinityMode: lbConfig.Affinity,
+		affinityName: lbConfig.AffinityKey,
+		affinityTTL:  lbConfig.AffinityTTL,
 	}, nil
 }
 
@@ -67,12 +142,14 @@ func NewWebSocketLoadBalancer(wsUpstreamConfigs []UpstreamConfig, lbConfig LoadB
 		}
 
 		upstream := &Upstream{
-			Name:        uc.Name,
-			URL:         parsedURL,
-			Weight:      uc.Weight,
-			HealthCheck: uc.HealthCheck,
-			Healthy:     1, // assume healthy initially
+			Name:           uc.Name,
+			URL:            parsedURL,
+			Weight:         uc.Weight,
+			HealthCheck:    uc.HealthCheck,
+			Healthy:        1, // assume healthy initially
+			MaxConnections: uc.MaxConnections,
 		}
+		upstream.SetOverrides(uc.Overrides())
 		upstreams = append(upstreams, upstream)
 	}
 
@@ -80,17 +157,38 @@ func NewWebSocketLoadBalancer(wsUpstreamConfigs []UpstreamConfig, lbConfig LoadB
 		upstreams: upstreams,
 		method:    lbConfig.Method,
 		timeout:   lbConfig.Timeout,
-		retries:   lbConfig.MaxRetries,
+		retry:     retryPolicyOf(lbConfig),
+
+		affinityMode: lbConfig.Affinity,
+		affinityName: lbConfig.AffinityKey,
+		affinityTTL:  lbConfig.AffinityTTL,
 	}, nil
 }
 
+// RetryPolicy returns the retry policy of requests to the balancer's upstreams
+func (lb *LoadBalancer) RetryPolicy() RetryPolicy {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.retry
+}
+
 func (lb *LoadBalancer) GetUpstream() *Upstream {
+	return lb.getUpstreamAmong(nil)
+}
+
+// getUpstreamAmong balances between the available upstreams named in group, or
+// all of them when group is nil
+func (lb *LoadBalancer) getUpstreamAmong(group map[string]bool) *Upstream {
 	lb.mu.RLock()
 	defer lb.mu.RUnlock()
 
 	healthyUpstreams := make([]*Upstream, 0)
 	for _, upstream := range lb.upstreams {
-		if atomic.LoadInt64(&upstream.Healthy) == 1 {
+		if group != nil && !group[upstream.Name] {
+			continue
+		}
+		// Upstreams at their connection limit are skipped like unavailable ones
+		if upstream.Available() && upstream.hasCapacity() {
 			healthyUpstreams = append(healthyUpstreams, upstream)
 		}
 	}
@@ -113,19 +211,110 @@ func (lb *LoadBalancer) GetUpstream() *Upstream {
 	}
 }
 
-// GetUpstreamByName returns a specific upstream by name if it's healthy
+// GetUpstreamByName returns a specific upstream by name if it's healthy and below its connection limit
 func (lb *LoadBalancer) GetUpstreamByName(name string) *Upstream {
 	lb.mu.RLock()
 	defer lb.mu.RUnlock()
 
 	for _, upstream := range lb.upstreams {
-		if upstream.Name == name && atomic.LoadInt64(&upstream.Healthy) == 1 {
+		if upstream.Name == name && upstream.Available() && upstream.hasCapacity() {
 			return upstream
 		}
 	}
 	return nil
 }
 
+// Method returns the balancing algorithm used by this load balancer
+func (lb *LoadBalancer) Method() string {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.method
+}
+
+// Snapshot returns the current state of every upstream in the pool
+func (lb *LoadBalancer) Snapshot() []UpstreamStatus {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	statuses := make([]UpstreamStatus, 0, len(lb.upstreams))
+	for _, upstream := range lb.upstreams {
+		statuses = append(statuses, UpstreamStatus{
+			Name:           upstream.Name,
+			URL:            upstream.URL.String(),
+			Weight:         upstream.Weight,
+			Healthy:        atomic.LoadInt64(&upstream.Healthy) == 1,
+			State:          upstreamStateNames[atomic.LoadInt32(&upstream.State)],
+			Connections:    atomic.LoadInt64(&upstream.Connections),
+			MaxConnections: upstream.MaxConnections,
+			Pool:           upstream.pool.stats(),
+		})
+	}
+	return statuses
+}
+
+// SetUpstreamState changes the administrative state of the named upstream and
+// returns its previous state. found is false if the pool has no upstream with that name.
+func (lb *LoadBalancer) SetUpstreamState(name string, state int32) (previous int32, found bool) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	for _, upstream := range lb.upstreams {
+		if upstream.Name == name {
+			previous = atomic.SwapInt32(&upstream.State, state)
+			found = true
+		}
+	}
+	return previous, found
+}
+
+// Reconfigure atomically replaces the upstream pool and balancing settings.
+// Upstreams whose name and URL are unchanged keep their health, state and connection counters.
+func (lb *LoadBalancer) Reconfigure(upstreamConfigs []UpstreamConfig, lbConfig LoadBalancerConfig) error {
+	if err := validateUpstreamConfigs(upstreamConfigs); err != nil {
+		return err
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	existing := make(map[string]*Upstream, len(lb.upstreams))
+	for _, upstream := range lb.upstreams {
+		existing[upstream.Name+"|"+upstream.URL.String()] = upstream
+	}
+
+	upstreams := make([]*Upstream, 0, len(upstreamConfigs))
+	for _, uc := range upstreamConfigs {
+		parsedURL, _ := url.Parse(uc.URL)
+		if upstream, ok := existing[uc.Name+"|"+parsedURL.String()]; ok {
+			upstream.Weight = uc.Weight
+			upstream.HealthCheck = uc.HealthCheck
+			upstream.MaxConnections = uc.MaxConnections
+			upstream.SetOverrides(uc.Overrides())
+			upstreams = append(upstreams, upstream)
+			continue
+		}
+		upstream := &Upstream{
+			Name:           uc.Name,
+			URL:            parsedURL,
+			Weight:         uc.Weight,
+			HealthCheck:    uc.HealthCheck,
+			Healthy:        1, // assume healthy initially
+			MaxConnections: uc.MaxConnections,
+		}
+		upstream.SetOverrides(uc.Overrides())
+		upstreams = append(upstreams, upstream)
+	}
+
+	lb.upstreams = upstreams
+	lb.method = lbConfig.Method
+	lb.timeout = lbConfig.Timeout
+	lb.retry = retryPolicyOf(lbConfig)
+	lb.affinityMode = lbConfig.Affinity
+	lb.affinityName = lbConfig.AffinityKey
+	lb.affinityTTL = lbConfig.AffinityTTL
+	return nil
+}
+
 func (lb *LoadBalancer) roundRobin(upstreams []*Upstream) *Upstream {
 	index := atomic.AddUint64(&lb.current, 1) % uint64(len(upstreams))
 	return upstreams[index]
@@ -185,6 +374,28 @@ func (lb *LoadBalancer) DecreaseConnections(upstream *Upstream) {
 	atomic.AddInt64(&upstream.Connections, -1)
 }
 
+// AcquireConnection counts a new connection to the upstream unless it is at its
+// limit. Unlike IncreaseConnections it never lets concurrent callers overshoot.
+func (lb *LoadBalancer) AcquireConnection(upstream *Upstream) bool {
+	lb.mu.RLock()
+	limit := int64(upstream.MaxConnections)
+	lb.mu.RUnlock()
+	for {
+		current := atomic.LoadInt64(&upstream.Connections)
+		if limit > 0 && current >= limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&upstream.Connections, current, current+1) {
+			return true
+		}
+	}
+}
+
+// hasCapacity reports whether the upstream is below its connection limit
+func (u *Upstream) hasCapacity() bool {
+	return u.MaxConnections == 0 || atomic.LoadInt64(&u.Connections) < int64(u.MaxConnections)
+}
+
 func (lb *LoadBalancer) MarkUnhealthy(upstream *Upstream) {
 	atomic.StoreInt64(&upstream.Healthy, 0)
 }
@@ -193,14 +404,22 @@ func (lb *LoadBalancer) MarkHealthy(upstream *Upstream) {
 	atomic.StoreInt64(&upstream.Healthy, 1)
 }
 
-func (lb *LoadBalancer) StartHealthCheck() {
+// StartHealthCheck checks the upstreams periodically, resolving their host names
+// through resolver
+func (lb *LoadBalancer) StartHealthCheck(resolver *upstreamResolver) {
+	client := newHealthCheckClient(resolver)
 	lb.healthTicker = time.NewTicker(30 * time.Second)
 	lb.shutdownChan = make(chan struct{})
+	lb.checked = make(chan struct{})
 	go func() {
+		// The first round runs right away, so the server is not ready before
+		// the health of its upstreams is known
+		lb.performHealthCheck(client)
+		close(lb.checked)
 		for {
 			select {
 			case <-lb.healthTicker.C:
-				lb.performHealthCheck()
+				lb.performHealthCheck(client)
 			case <-lb.shutdownChan:
 				return
 			}
@@ -208,6 +427,12 @@ func (lb *LoadBalancer) StartHealthCheck() {
 	}()
 }
 
+// HealthChecked returns a channel closed once the first round of health checks
+// started by StartHealthCheck is done
+func (lb *LoadBalancer) HealthChecked() <-chan struct{} {
+	return lb.checked
+}
+
 func (lb *LoadBalancer) StopHealthCheck() {
 	if lb.healthTicker != nil {
 		lb.healthTicker.Stop()
@@ -217,13 +442,22 @@ func (lb *LoadBalancer) StopHealthCheck() {
 	}
 }
 
-func (lb *LoadBalancer) performHealthCheck() {
-	client := &http.Client{
-		Timeout: 5 * time.Second,
+func (lb *LoadBalancer) performHealthCheck(client *http.Client) {
+	// Health check paths are copied under the lock, as a reload rewrites them
+	lb.mu.RLock()
+	upstreams := make([]*Upstream, len(lb.upstreams))
+	copy(upstreams, lb.upstreams)
+	paths := make([]string, len(upstreams))
+	for i, upstream := range upstreams {
+		paths[i] = upstream.HealthCheck
 	}
+	lb.mu.RUnlock()
 
-	for _, upstream := range lb.upstreams {
-		go func(u *Upstream) {
+	var wg sync.WaitGroup
+	for i, upstream := range upstreams {
+		wg.Add(1)
+		go func(u *Upstream, path string) {
+			defer wg.Done()
 			// Skip health check for WebSocket upstreams or assume they're healthy
 			if u.URL.Scheme == "ws" || u.URL.Scheme == "wss" {
 				// For WebSocket upstreams, we assume they're healthy
@@ -233,16 +467,37 @@ func (lb *LoadBalancer) performHealthCheck() {
 				return
 			}
 			
-			healthURL := u.URL.String() + u.HealthCheck
-			resp, err := client.Get(healthURL)
-			if err != nil || resp.StatusCode != http.StatusOK {
+			if err := checkHealth(client, u, path); err != nil {
 				lb.MarkUnhealthy(u)
 			} else {
 				lb.MarkHealthy(u)
 			}
-			if resp != nil {
-				resp.Body.Close()
-			}
-		}(upstream)
+		}(upstream, paths[i])
+	}
+	wg.Wait()
+}
+
+// newHealthCheckClient returns the client health checks are sent with, resolving
+// host names through resolver
+func newHealthCheckClient(resolver *upstreamResolver) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = resolver.dialContext(&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second})
+	return &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: transport,
 	}
-}
\ No newline at end of file
+}
+
+// checkHealth requests the health check path of an HTTP upstream, which is
+// healthy when it answers 200
+func checkHealth(client *http.Client, u *Upstream, path string) error {
+	resp, err := client.Get(u.URL.String() + path)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check answered %s", resp.Status)
+	}
+	return nil
+}
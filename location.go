@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// clientOrigin is the scheme and host clients address the proxy with
+type clientOrigin struct {
+	scheme string
+	host   string
+}
+
+// externalOrigin returns the origin of a request from remoteAddr made with scheme
+// and host, or the one a trusted proxy in front reports in X-Forwarded-Proto and
+// X-Forwarded-Host
+func externalOrigin(trusted *IPSet, remoteAddr, scheme, host, forwardedProto, forwardedHost string) clientOrigin {
+	if trustedPeer(trusted, remoteAddr) {
+		if proto, _, _ := strings.Cut(forwardedProto, ","); strings.TrimSpace(proto) != "" {
+			scheme = strings.TrimSpace(proto)
+		}
+		if forwarded, _, _ := strings.Cut(forwardedHost, ","); strings.TrimSpace(forwarded) != "" {
+			host = strings.TrimSpace(forwarded)
+		}
+	}
+	return clientOrigin{scheme: strings.ToLower(scheme), host: host}
+}
+
+// standardOrigin returns the external origin of a net/http request
+func standardOrigin(r *http.Request, rc *RuntimeConfig) clientOrigin {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return externalOrigin(rc.TrustedProxies, r.RemoteAddr, scheme, r.Host,
+		r.Header.Get("X-Forwarded-Proto"), r.Header.Get("X-Forwarded-Host"))
+}
+
+// fastHTTPOrigin returns the external origin of a gnet request from remoteAddr
+func fastHTTPOrigin(req *fasthttp.Request, remoteAddr string, rc *RuntimeConfig) clientOrigin {
+	return externalOrigin(rc.TrustedProxies, remoteAddr, "http", string(req.Header.Host()),
+		string(req.Header.Peek("X-Forwarded-Proto")), string(req.Header.Peek("X-Forwarded-Host")))
+}
+
+// hostPort returns the host and port of an absolute URL, the port filled in
+// from the scheme when the URL leaves it out
+func hostPort(u *url.URL) (string, string) {
+	port := u.Port()
+	if port == "" {
+		switch strings.ToLower(u.Scheme) {
+		case "https", "wss":
+			port = "443"
+		default:
+			port = "80"
+		}
+	}
+	return strings.ToLower(u.Hostname()), port
+}
+
+// ownsURL reports whether an absolute URL points at one of the balancer's upstreams
+func (lb *LoadBalancer) ownsURL(u *url.URL) bool {
+	host, port := hostPort(u)
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	for _, upstream := range lb.upstreams {
+		if upstreamHost, upstreamPort := hostPort(upstream.URL); upstreamHost == host && upstreamPort == port {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteLocation points a Location value naming one of the balancer's upstreams
+// back at the proxy, as clients reach it. On routes with strip_prefix, the
+// route's prefix is put back in front of the path, relative ones included. It
+// reports false when the value is left alone.
+func (lb *LoadBalancer) rewriteLocation(location string, origin clientOrigin, route *Route) (string, bool) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", false
+	}
+	stripped := route.RewritesPath() && route.config.StripPrefix
+	if u.IsAbs() {
+		if origin.host == "" || !lb.ownsURL(u) {
+			return "", false
+		}
+		u.Scheme, u.Host = origin.scheme, origin.host
+	} else if !stripped || u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		return "", false
+	}
+	if stripped {
+		prefix := strings.TrimSuffix(route.config.PathPrefix, "/")
+		u.Path = prefix + u.Path
+		if u.RawPath != "" {
+			u.RawPath = prefix + u.RawPath
+		}
+	}
+	return u.String(), true
+}
+
+// rewriteStandardLocation rewrites the Location header of a response to a
+// net/http client when rewrite_location is on
+func (lb *LoadBalancer) rewriteStandardLocation(h http.Header, origin clientOrigin, route *Route, rc *RuntimeConfig) {
+	if !rc.Proxy.RewriteLocation {
+		return
+	}
+	if location := h.Get("Location"); location != "" {
+		if rewritten, ok := lb.rewriteLocation(location, origin, route); ok {
+			h.Set("Location", rewritten)
+		}
+	}
+}
+
+// rewriteFastHTTPLocation is rewriteStandardLocation for a response to a gnet client
+func (lb *LoadBalancer) rewriteFastHTTPLocation(h *fasthttp.ResponseHeader, origin clientOrigin, route *Route, rc *RuntimeConfig) {
+	if !rc.Proxy.RewriteLocation {
+		return
+	}
+	if location := h.Peek("Location"); len(location) > 0 {
+		if rewritten, ok := lb.rewriteLocation(string(location), origin, route); ok {
+			h.Set("Location", rewritten)
+		}
+	}
+}
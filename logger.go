@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -11,6 +12,12 @@ import (
 
 // SetupLogger creates a logger with the specified configuration
 func SetupLogger(loggingConfig LoggingConfig, serverName string) (*zap.Logger, error) {
+	logger, _, err := NewLeveledLogger(loggingConfig, serverName)
+	return logger, err
+}
+
+// NewLeveledLogger creates a logger whose level can be changed at runtime through the returned AtomicLevel
+func NewLeveledLogger(loggingConfig LoggingConfig, serverName string) (*zap.Logger, zap.AtomicLevel, error) {
 	// Create log file name
 	logFile := fmt.Sprintf("logs/%s.log", serverName)
 	if loggingConfig.File != "" {
@@ -19,11 +26,11 @@ func SetupLogger(loggingConfig LoggingConfig, serverName string) (*zap.Logger, e
 
 	// Create logs directory if it doesn't exist
 	if err := os.MkdirAll("logs", 0755); err != nil {
-		return nil, fmt.Errorf("failed to create logs directory: %w", err)
+		return nil, zap.AtomicLevel{}, fmt.Errorf("failed to create logs directory: %w", err)
 	}
 
 	// Configure log level
-	level := parseLogLevel(loggingConfig.Level)
+	level := zap.NewAtomicLevelAt(parseLogLevel(loggingConfig.Level))
 
 	// Configure log rotation
 	lumberjackLogger := &lumberjack.Logger{
@@ -51,9 +58,32 @@ func SetupLogger(loggingConfig LoggingConfig, serverName string) (*zap.Logger, e
 	)
 
 	core := zapcore.NewTee(fileCore, consoleCore)
-	logger := zap.New(core, zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel))
+	logger := zap.New(core, zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel)).
+		With(zap.String("server", serverName))
+
+	return logger, level, nil
+}
 
-	return logger, nil
+// NewAuditLogger creates a JSON file logger for admin audit records
+func NewAuditLogger(file string) (*zap.Logger, error) {
+	if file == "" {
+		file = "logs/admin-audit.log"
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+
+	core := zapcore.NewCore(
+		zapcore.NewJSONEncoder(createEncoderConfig()),
+		zapcore.AddSync(&lumberjack.Logger{
+			Filename:   file,
+			MaxSize:    100, // MB
+			MaxBackups: 10,
+			MaxAge:     365, // days
+		}),
+		zapcore.InfoLevel,
+	)
+	return zap.New(core), nil
 }
 
 // parseLogLevel converts string log level to zapcore.Level
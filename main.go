@@ -5,16 +5,21 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/fatih/color"
 	"github.com/spf13/cobra"
+	"go.uber.org/zap"
 )
 
 var (
-	configsDir string
-	configFile string
+	configsDir      string
+	configFile      string
+	configOverrides []string
+	remoteConfig    string
+	remotePoll      time.Duration
 )
 
 // printStartupBanner displays a colorful startup banner
@@ -84,7 +89,7 @@ func printServerStatus(instances []*ServerInstance) {
 	green.Println("  📡 Active Server Instances:")
 	for _, instance := range instances {
 		white.Printf("     • %s: ", instance.config.Name)
-		cyan.Printf("%s:%d\n", instance.config.Host, instance.config.Port)
+		cyan.Println(instance.config.Address())
 	}
 	fmt.Println()
 
@@ -112,28 +117,71 @@ func Execute() {
 }
 
 func init() {
-	// Add flags
-	rootCmd.Flags().StringVar(&configsDir, "configs", ".", "Path to configuration directory containing TOML files")
-	rootCmd.Flags().StringVar(&configFile, "config", "", "Path to single configuration file (legacy mode)")
+	// Add flags (persistent so subcommands share the same config location)
+	rootCmd.PersistentFlags().StringVar(&configsDir, "configs", ".", "Path to configuration directory containing TOML files")
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "Path to single configuration file (legacy mode)")
+	rootCmd.PersistentFlags().StringArrayVar(&configOverrides, "set", nil, "Override a configuration key, e.g. --set proxy.max_body_size=1048576 (repeatable)")
+	rootCmd.PersistentFlags().StringVar(&remoteConfig, "remote-config", "", "Load and watch configuration from consul://host:port/prefix or etcd://host:port/prefix, falling back to local files")
+	rootCmd.PersistentFlags().DurationVar(&remotePoll, "remote-poll", 10*time.Second, "Poll interval for remote backends without blocking queries (etcd)")
 }
 
-func runServer(cmd *cobra.Command, args []string) error {
-	// Load configuration
-	var cfg *Config
-	var err error
+// loadConfiguration loads the configuration from the remote backend (--remote-config)
+// or the local files (--config/--configs) and applies the --set overrides
+func loadConfiguration() (*Config, error) {
+	overrides, err := ParseConfigOverrides(configOverrides)
+	if err != nil {
+		return nil, err
+	}
 
-	if configFile != "" {
-		// Legacy mode: single config file
-		cfg, err = LoadConfig(configFile)
+	if remoteConfig != "" {
+		source, err := NewRemoteConfigSource(remoteConfig)
 		if err != nil {
-			return fmt.Errorf("failed to load config: %w", err)
+			return nil, err
+		}
+		// Only an unreachable backend falls back to local files; invalid remote configuration is an error
+		files, fetchErr := fetchRemoteFiles(source)
+		if fetchErr == nil {
+			cfg, err := loadRemoteFiles(files, overrides)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load remote config: %w", err)
+			}
+			return cfg, nil
 		}
-	} else {
-		// New mode: multiple config files from directory
-		cfg, err = LoadMultiFileConfig(configsDir)
+		cfg, err := loadLocalConfiguration(overrides)
 		if err != nil {
-			return fmt.Errorf("failed to load multi-file config: %w", err)
+			return nil, fmt.Errorf("%v; local fallback failed: %w", fetchErr, err)
 		}
+		cfg.Warnings = append(cfg.Warnings, fmt.Sprintf("remote configuration unavailable, using local files: %v", fetchErr))
+		return cfg, nil
+	}
+
+	return loadLocalConfiguration(overrides)
+}
+
+// loadLocalConfiguration loads the configuration files selected by the --config/--configs flags
+func loadLocalConfiguration(overrides ConfigOverrides) (*Config, error) {
+	if configFile != "" {
+		// Legacy mode: single config file
+		cfg, err := LoadConfig(configFile, overrides)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load config: %w", err)
+		}
+		return cfg, nil
+	}
+
+	// New mode: multiple config files from directory
+	cfg, err := LoadMultiFileConfig(configsDir, overrides)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load multi-file config: %w", err)
+	}
+	return cfg, nil
+}
+
+func runServer(cmd *cobra.Command, args []string) error {
+	// Load configuration
+	cfg, err := loadConfiguration()
+	if err != nil {
+		return err
 	}
 
 	// Setup global logger (fallback)
@@ -160,7 +208,22 @@ func runServer(cmd *cobra.Command, args []string) error {
 		configMode = "multi_file"
 		configPath = configsDir
 	}
-	printStartupBanner("1.0.0", configMode, configPath, len(enabledServers))
+	buildInfo := currentBuildInfo()
+	printStartupBanner(buildInfo.Version, configMode, configPath, len(enabledServers))
+	globalLogger.Info("Starting surikiti",
+		zap.String("version", buildInfo.Version),
+		zap.String("commit", buildInfo.Commit),
+		zap.String("build_date", buildInfo.BuildDate))
+
+	// Surface configuration warnings on the console as well as in the log
+	logConfigWarnings(cfg, globalLogger)
+	if len(cfg.Warnings) > 0 {
+		yellow := color.New(color.FgYellow, color.Bold)
+		for _, warning := range cfg.Warnings {
+			yellow.Printf("  ⚠️  %s\n", warning)
+		}
+		fmt.Println()
+	}
 
 	// Create multi-server manager
 	multiManager := NewMultiServerManager()
@@ -180,26 +243,151 @@ func runServer(cmd *cobra.Command, args []string) error {
 	// Start all server instances
 	errorChan, wg := multiManager.StartAllServers()
 
+	// Keep systemd's watchdog fed, and tell it once the servers are ready
+	stopWatchdog := startSDWatchdog(globalLogger)
+	defer stopWatchdog()
+	readyChan := multiManager.Ready()
+
+	// Start admin API if enabled
+	var adminServer *AdminServer
+	if cfg.Admin.Enabled {
+		adminServer = NewAdminServer(cfg.Admin, multiManager, globalLogger)
+		if err := adminServer.Start(errorChan); err != nil {
+			return fmt.Errorf("failed to start admin API: %w", err)
+		}
+	}
+
 	instances := multiManager.GetServerInstances()
 	// Display server status with colors instead of logs
 	printServerStatus(instances)
 
+	// Reload configuration on SIGHUP
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+
+	// Hand the listening sockets over to a new binary on SIGUSR2
+	upgradeSignal := make(chan os.Signal, 1)
+	signal.Notify(upgradeSignal, syscall.SIGUSR2)
+	var upgradeChan <-chan error
+	var upgradeProcess *os.Process
+	upgraded := false
+
+	// Keep in sync with the remote configuration backend
+	var remoteChan <-chan struct{}
+	if remoteConfig != "" {
+		source, err := NewRemoteConfigSource(remoteConfig)
+		if err != nil {
+			return err
+		}
+		remoteWatcher := NewRemoteConfigWatcher(source, remotePoll, globalLogger)
+		defer remoteWatcher.Close()
+		remoteChan = remoteWatcher.Changes()
+	}
+
+	// Optionally reload when configuration files change
+	var watchChan <-chan struct{}
+	if cfg.Reload.Watch {
+		watcher, err := NewConfigWatcher(configsDir, configFile, cfg.Reload.Debounce, globalLogger)
+		if err != nil {
+			return fmt.Errorf("failed to watch configuration: %w", err)
+		}
+		defer watcher.Close()
+		watchChan = watcher.Changes()
+	}
+
+	reload := func(reason string) {
+		yellow := color.New(color.FgYellow, color.Bold)
+		yellow.Printf("  🔄 %s, reloading configuration...\n", reason)
+		changes, err := reloadFromDisk(multiManager, globalLogger)
+		if err != nil {
+			red := color.New(color.FgRed, color.Bold)
+			red.Printf("  ❌ Reload failed, keeping current configuration: %v\n", err)
+			return
+		}
+		green := color.New(color.FgGreen, color.Bold)
+		green.Printf("  ✅ Configuration reloaded (%d changes)\n", len(changes))
+		for _, change := range changes {
+			fmt.Printf("     • %s %s\n", change.Kind(), change.Path)
+		}
+	}
+
 	// Wait for shutdown signal or server error
-	select {
-	case <-sigChan:
-		red := color.New(color.FgRed, color.Bold)
-		red.Println("\n  🛑 Shutdown signal received, stopping all servers...")
-	case err := <-errorChan:
-		red := color.New(color.FgRed, color.Bold)
-		red.Printf("\n  ❌ Server error occurred: %v\n", err)
-		red.Println("  🛑 Shutting down all servers...")
-		cancel()
+waitLoop:
+	for {
+		select {
+		case <-readyChan:
+			readyChan = nil
+			globalLogger.Info("All servers ready")
+			upgradeReady()
+			if err := sdNotify("READY=1\nSTATUS=Serving " + strconv.Itoa(len(instances)) + " servers"); err != nil {
+				globalLogger.Warn("Failed to notify systemd of readiness", zap.Error(err))
+			}
+		case <-upgradeSignal:
+			if upgradeChan != nil {
+				globalLogger.Warn("Binary upgrade already in progress, ignoring SIGUSR2")
+				continue
+			}
+			yellow := color.New(color.FgYellow, color.Bold)
+			yellow.Println("  🔄 SIGUSR2 received, starting the new binary...")
+			process, done, err := startUpgrade(instances, globalLogger)
+			if err != nil {
+				red := color.New(color.FgRed, color.Bold)
+				red.Printf("  ❌ Upgrade failed, keeping current process: %v\n", err)
+				continue
+			}
+			upgradeProcess, upgradeChan = process, done
+		case err := <-upgradeChan:
+			upgradeChan = nil
+			if err != nil {
+				red := color.New(color.FgRed, color.Bold)
+				red.Printf("  ❌ Upgrade failed, keeping current process: %v\n", err)
+				continue
+			}
+			upgraded = true
+			// The new process is the service's main process from now on
+			if err := sdNotify("MAINPID=" + strconv.Itoa(upgradeProcess.Pid)); err != nil {
+				globalLogger.Warn("Failed to notify systemd of the new main process", zap.Error(err))
+			}
+			green := color.New(color.FgGreen, color.Bold)
+			green.Printf("\n  ✅ New process %d is ready, draining this one...\n", upgradeProcess.Pid)
+			break waitLoop
+		case <-reloadChan:
+			reload("SIGHUP received")
+		case <-watchChan:
+			reload("Configuration change detected")
+		case <-remoteChan:
+			reload("Remote configuration changed")
+		case <-sigChan:
+			red := color.New(color.FgRed, color.Bold)
+			red.Println("\n  🛑 Shutdown signal received, stopping all servers...")
+			break waitLoop
+		case err := <-errorChan:
+			red := color.New(color.FgRed, color.Bold)
+			red.Printf("\n  ❌ Server error occurred: %v\n", err)
+			red.Println("  🛑 Shutting down all servers...")
+			cancel()
+			break waitLoop
+		}
+	}
+
+	// After an upgrade, the service goes on in the new process
+	if !upgraded {
+		if err := sdNotify("STOPPING=1"); err != nil {
+			globalLogger.Warn("Failed to notify systemd of shutdown", zap.Error(err))
+		}
 	}
 
 	// Graceful shutdown with timeout
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer shutdownCancel()
 
+	// Stop admin API before the servers it inspects
+	if adminServer != nil {
+		if err := adminServer.Shutdown(shutdownCtx); err != nil {
+			globalLogger.Error("Error shutting down admin API", zap.Error(err))
+		}
+	}
+
 	// Shutdown all server instances
 	multiManager.Shutdown(shutdownCtx, globalLogger)
 
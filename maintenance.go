@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+// defaultMaintenancePage is served when maintenance mode sets neither body nor body_file
+const defaultMaintenancePage = "<!DOCTYPE html>\n<html><head><title>Down for maintenance</title></head>" +
+	"<body><h1>Down for maintenance</h1><p>We'll be back shortly.</p></body></html>\n"
+
+// maintenanceMode holds the public off a server or route with a static 503 page
+// while the clients on its allow list still reach the upstreams. It is switched
+// by the configuration and, at runtime, by the admin API.
+type maintenanceMode struct {
+	config  MaintenanceConfig
+	allow   *IPSet
+	page    []byte
+	enabled atomic.Bool
+}
+
+// newMaintenanceMode creates the maintenance mode of a server or route. It is
+// never nil, so maintenance can be switched on at runtime for any of them.
+func newMaintenanceMode(config MaintenanceConfig) *maintenanceMode {
+	// The allow list was checked by Config.Validate, so parsing cannot fail here
+	allow, _ := NewIPSet(config.Allow)
+	page := config.Body
+	if config.BodyFile != "" {
+		page = config.page
+	}
+	if page == "" {
+		page = defaultMaintenancePage
+	}
+	m := &maintenanceMode{config: config, allow: allow, page: []byte(page)}
+	m.enabled.Store(config.Enabled)
+	return m
+}
+
+// Enabled reports whether maintenance mode is on
+func (m *maintenanceMode) Enabled() bool {
+	return m != nil && m.enabled.Load()
+}
+
+// SetEnabled switches maintenance mode on or off until the next reload that
+// changes its configuration
+func (m *maintenanceMode) SetEnabled(enabled bool) {
+	m.enabled.Store(enabled)
+}
+
+// holds reports whether a request from the client IP gets the maintenance page
+func (m *maintenanceMode) holds(ip string) bool {
+	if !m.Enabled() {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
+	return err != nil || !m.allow.Contains(addr)
+}
+
+// contentType returns the Content-Type of the maintenance page
+func (m *maintenanceMode) contentType() string {
+	if m.config.ContentType != "" {
+		return m.config.ContentType
+	}
+	return defaultPageContentType
+}
+
+// write answers a net/http request with the maintenance page
+func (m *maintenanceMode) write(w http.ResponseWriter) {
+	setResponseSource(w, responseOwnPage)
+	header := w.Header()
+	header.Set("Content-Type", m.contentType())
+	header.Set("Cache-Control", "no-store")
+	if m.config.RetryAfter > 0 {
+		header.Set("Retry-After", retryAfterSeconds(m.config.RetryAfter))
+	}
+	header.Set("Content-Length", strconv.Itoa(len(m.page)))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(m.page)
+}
+
+// writeFastHTTP fills a fasthttp response with the maintenance page
+func (m *maintenanceMode) writeFastHTTP(resp *fasthttp.Response) {
+	resp.SetStatusCode(fasthttp.StatusServiceUnavailable)
+	resp.Header.Set("Content-Type", m.contentType())
+	resp.Header.Set("Cache-Control", "no-store")
+	if m.config.RetryAfter > 0 {
+		resp.Header.Set("Retry-After", retryAfterSeconds(m.config.RetryAfter))
+	}
+	resp.SetBody(m.page)
+}
+
+// Maintenance returns the maintenance mode of the route
+func (r *Route) Maintenance() *maintenanceMode {
+	if r == nil {
+		return nil
+	}
+	return r.maintenance
+}
+
+// MaintenanceFor returns the maintenance mode holding a request from the client
+// IP on route, the server's before the route's, or nil when the request goes
+// through to the upstreams
+func (rc *RuntimeConfig) MaintenanceFor(route *Route, ip string) *maintenanceMode {
+	if rc.Maintenance.holds(ip) {
+		return rc.Maintenance
+	}
+	if m := route.Maintenance(); m.holds(ip) {
+		return m
+	}
+	return nil
+}
+
+// merge returns the route's maintenance settings with the ones it leaves unset
+// taken from the server's; whether maintenance is on stays the route's own
+func (m MaintenanceConfig) merge(route MaintenanceConfig) MaintenanceConfig {
+	merged := route
+	if len(merged.Allow) == 0 {
+		merged.Allow = m.Allow
+	}
+	if merged.Body == "" && merged.BodyFile == "" {
+		merged.Body, merged.BodyFile, merged.page = m.Body, m.BodyFile, m.page
+	}
+	if merged.ContentType == "" {
+		merged.ContentType = m.ContentType
+	}
+	if merged.RetryAfter == 0 {
+		merged.RetryAfter = m.RetryAfter
+	}
+	return merged
+}
+
+// inheritMaintenance keeps the server's and routes' maintenance modes whose
+// configuration did not change, so a reload does not undo what was switched
+// through the admin API
+func (rc *RuntimeConfig) inheritMaintenance(previous *RuntimeConfig) {
+	if reflect.DeepEqual(rc.Maintenance.config, previous.Maintenance.config) {
+		rc.Maintenance = previous.Maintenance
+	}
+	if rc.Router == nil || previous.Router == nil {
+		return
+	}
+	for _, route := range rc.Router.routes {
+		for _, old := range previous.Router.routes {
+			if old.Name == route.Name && reflect.DeepEqual(old.maintenance.config, route.maintenance.config) {
+				route.maintenance = old.maintenance
+				break
+			}
+		}
+	}
+}
@@ -22,12 +22,17 @@ type ServerInstance struct {
 	websocketServer *http.Server
 	gnetStarted     chan struct{}
 	logger          *zap.Logger
+	logLevel        zap.AtomicLevel
+	metrics         *ServerMetrics
+	connections     *ConnectionTracker
 }
 
 // MultiServerManager manages multiple server instances
 type MultiServerManager struct {
 	serverInstances []*ServerInstance
 	shutdownChan    chan struct{}
+	metrics         *MetricsRegistry
+	config          *Config // configuration the instances were created or last reloaded from
 	mu              sync.RWMutex
 }
 
@@ -35,6 +40,7 @@ type MultiServerManager struct {
 func NewMultiServerManager() *MultiServerManager {
 	return &MultiServerManager{
 		shutdownChan: make(chan struct{}),
+		metrics:      NewMetricsRegistry(),
 	}
 }
 
@@ -46,8 +52,6 @@ func (msm *MultiServerManager) CreateServerInstance(serverCfg ServerConfig, cfg
 
 	// Get per-server configurations (fallback to global if not set)
 	lbConfig := cfg.GetLoadBalancerConfig(serverCfg.Name)
-	proxyConfig := cfg.GetProxyConfig(serverCfg.Name)
-	corsConfig := cfg.GetCORSConfig(serverCfg.Name)
 
 	// Create HTTP load balancer for this server
 	lb, err := NewLoadBalancer(upstreams, lbConfig)
@@ -61,15 +65,31 @@ func (msm *MultiServerManager) CreateServerInstance(serverCfg ServerConfig, cfg
 		return nil, fmt.Errorf("failed to create WebSocket load balancer for server %s: %w", serverCfg.Name, err)
 	}
 
+	// Both balancers pin clients through one store, so reconnecting WebSocket
+	// clients reach the same upstream as before
+	affinity := NewAffinityStore()
+	lb.SetAffinity(affinity, "http")
+	wsLB.SetAffinity(affinity, "websocket")
+
 	// Setup per-server logger
 	loggingConfig := cfg.GetLoggingConfig(serverCfg.Name)
-	serverLogger, err := SetupLogger(loggingConfig, serverCfg.Name)
+	serverLogger, logLevel, err := NewLeveledLogger(loggingConfig, serverCfg.Name)
 	if err != nil {
 		return nil, fmt.Errorf("failed to setup logger for server %s: %w", serverCfg.Name, err)
 	}
 
+	// Metrics and access logs are labeled with the server instance name
+	metrics := msm.metrics.ForServer(serverCfg.Name)
+	if loggingConfig.AccessLog {
+		metrics.SetAccessLogger(serverLogger.Named("access"))
+	}
+
+	// Track client connections for the admin API
+	connections := NewConnectionTracker(serverCfg.Name)
+
 	// Create proxy server
-	proxyServer := NewProxyServer(lb, wsLB, serverLogger, proxyConfig, corsConfig)
+	proxyServer := NewProxyServer(lb, wsLB, serverLogger, metrics, connections, NewRuntimeConfig(cfg, serverCfg))
+	metrics.SetUpstreams(lb.Snapshot)
 
 	instance := &ServerInstance{
 		name:           serverCfg.Name,
@@ -79,10 +99,14 @@ func (msm *MultiServerManager) CreateServerInstance(serverCfg ServerConfig, cfg
 		proxyServer:    proxyServer,
 		gnetStarted:    make(chan struct{}),
 		logger:         serverLogger,
+		logLevel:       logLevel,
+		metrics:        metrics,
+		connections:    connections,
 	}
 
 	msm.mu.Lock()
 	msm.serverInstances = append(msm.serverInstances, instance)
+	msm.config = cfg
 	msm.mu.Unlock()
 
 	return instance, nil
@@ -92,14 +116,14 @@ func (msm *MultiServerManager) CreateServerInstance(serverCfg ServerConfig, cfg
 func (msm *MultiServerManager) StartServerInstance(instance *ServerInstance, wg *sync.WaitGroup, errorChan chan<- error) {
 	instance.logger.Info("Starting server instance",
 		zap.String("name", instance.name),
-		zap.String("address", fmt.Sprintf("%s:%d", instance.config.Host, instance.config.Port)))
+		zap.String("address", instance.config.Address()))
 
 	// Add to wait group before starting goroutine
 	wg.Add(1)
 
 	// Check if this is a WebSocket-only server
 	instance.logger.Info("Checking server type", zap.String("name", instance.name), zap.Bool("is_websocket", strings.Contains(strings.ToLower(instance.name), "websocket")))
-	if strings.Contains(strings.ToLower(instance.name), "websocket") {
+	if instance.config.servedByNetHTTP() {
 		msm.startWebSocketServer(instance, wg, errorChan)
 	} else {
 		msm.startGnetServer(instance, wg, errorChan)
@@ -109,11 +133,18 @@ func (msm *MultiServerManager) StartServerInstance(instance *ServerInstance, wg
 	close(instance.gnetStarted)
 }
 
+// servedByNetHTTP reports whether the server runs on net/http rather than gnet:
+// WebSocket-only servers, and those on a systemd socket, which the gnet engine
+// cannot take over
+func (s ServerConfig) servedByNetHTTP() bool {
+	return strings.Contains(strings.ToLower(s.Name), "websocket") || s.SystemdSocket != ""
+}
+
 // startWebSocketServer starts a WebSocket server using standard HTTP server
 func (msm *MultiServerManager) startWebSocketServer(instance *ServerInstance, wg *sync.WaitGroup, errorChan chan<- error) {
 	go func() {
 		defer wg.Done()
-		addr := fmt.Sprintf("%s:%d", instance.config.Host, instance.config.Port)
+		addr := instance.config.Address()
 		instance.logger.Info("WebSocket server started successfully",
 			zap.String("server", instance.name),
 			zap.String("address", fmt.Sprintf("http://%s", addr)))
@@ -129,16 +160,25 @@ func (msm *MultiServerManager) startWebSocketServer(instance *ServerInstance, wg
 		})
 
 		server := &http.Server{
-			Addr:    addr,
-			Handler: mux,
+			Addr:        addr,
+			Handler:     recoverPanics(mux, instance.logger, instance.proxyServer.metrics),
+			ConnContext: instance.connections.ConnContext,
+			ConnState:   instance.connections.ConnState,
 		}
 
 		// Store server reference for shutdown
 		instance.httpServer = server
 
 		// Start server in a separate goroutine
+		served := make(chan struct{})
 		go func() {
-			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			defer close(served)
+			ln, err := listenServer(instance.config, instance.proxyServer.proxyConfig)
+			if err == nil {
+				instance.proxyServer.markListening()
+				err = server.Serve(ln)
+			}
+			if err != nil && err != http.ErrServerClosed {
 				errorChan <- fmt.Errorf("HTTP server error for %s: %w", instance.name, err)
 			}
 		}()
@@ -146,6 +186,9 @@ func (msm *MultiServerManager) startWebSocketServer(instance *ServerInstance, wg
 		// Wait for shutdown signal
 		<-msm.shutdownChan
 		instance.logger.Info("WebSocket server shutdown signal received", zap.String("server", instance.name))
+
+		// The server is only shut down once its WebSocket sessions are drained
+		<-served
 	}()
 }
 
@@ -154,11 +197,19 @@ func (msm *MultiServerManager) startGnetServer(instance *ServerInstance, wg *syn
 	go func() {
 		defer wg.Done()
 		addr := fmt.Sprintf("tcp://%s:%d", instance.config.Host, instance.config.Port)
+		if path := instance.config.UnixSocket; path != "" {
+			if err := removeStaleSocket(path); err != nil {
+				errorChan <- fmt.Errorf("gnet server error for %s: %w", instance.name, err)
+				return
+			}
+			addr = "unix://" + path
+		}
 		instance.logger.Info("Reverse proxy server started successfully",
 			zap.String("server", instance.name),
 			zap.String("address", addr))
 
-		if err := gnet.Run(instance.proxyServer, addr, gnet.WithMulticore(true)); err != nil {
+		// SO_REUSEPORT lets the process started by a binary upgrade bind alongside
+		if err := gnet.Run(instance.proxyServer, addr, gnet.WithMulticore(true), gnet.WithReusePort(true)); err != nil {
 			select {
 			case <-msm.shutdownChan:
 				// Shutdown was requested, this is expected
@@ -185,6 +236,25 @@ func (msm *MultiServerManager) StartAllServers() (chan error, *sync.WaitGroup) {
 	return errorChan, &wg
 }
 
+// Ready returns a channel closed once every server instance listens and has run
+// its first round of upstream health checks. A server failing to start reports
+// on the error channel of StartAllServers and is never ready.
+func (msm *MultiServerManager) Ready() <-chan struct{} {
+	msm.mu.RLock()
+	instances := append([]*ServerInstance(nil), msm.serverInstances...)
+	msm.mu.RUnlock()
+
+	ready := make(chan struct{})
+	go func() {
+		for _, instance := range instances {
+			<-instance.proxyServer.Listening()
+			<-instance.loadBalancer.HealthChecked()
+		}
+		close(ready)
+	}()
+	return ready
+}
+
 // Shutdown gracefully shuts down all server instances
 func (msm *MultiServerManager) Shutdown(ctx context.Context, mainLogger *zap.Logger) {
 	mainLogger.Info("Starting graceful shutdown of all server instances...")
@@ -204,6 +274,12 @@ func (msm *MultiServerManager) Shutdown(ctx context.Context, mainLogger *zap.Log
 func (msm *MultiServerManager) shutdownServerInstance(instance *ServerInstance, ctx context.Context, mainLogger *zap.Logger) {
 	mainLogger.Info("Shutting down server instance", zap.String("name", instance.name))
 
+	// WebSocket sessions outlive http.Server.Shutdown and the gnet engine's stop,
+	// so they are closed properly first
+	if instance.proxyServer != nil {
+		instance.proxyServer.DrainWebSockets(ctx)
+	}
+
 	// Shutdown HTTP server if it exists (for WebSocket servers)
 	if instance.httpServer != nil {
 		mainLogger.Info("Shutting down HTTP server", zap.String("server", instance.name))
@@ -261,3 +337,83 @@ func (msm *MultiServerManager) GetServerInstances() []*ServerInstance {
 	copy(instances, msm.serverInstances)
 	return instances
 }
+
+// Config returns the configuration currently in effect
+func (msm *MultiServerManager) Config() *Config {
+	msm.mu.RLock()
+	defer msm.mu.RUnlock()
+	return msm.config
+}
+
+// Metrics returns the metrics registry shared by all server instances
+func (msm *MultiServerManager) Metrics() *MetricsRegistry {
+	return msm.metrics
+}
+
+// serverReload holds the validated settings to apply to one server instance
+type serverReload struct {
+	instance           *ServerInstance
+	upstreams          []UpstreamConfig
+	websocketUpstreams []UpstreamConfig
+	lbConfig           LoadBalancerConfig
+	runtime            *RuntimeConfig
+	logLevel           string
+}
+
+// Reload applies routes, upstreams, limits and log levels from a freshly loaded configuration.
+// Everything is validated before the first instance is touched, so an invalid
+// configuration leaves all running instances unchanged. Adding or removing server
+// instances and changing listen addresses still requires a restart.
+func (msm *MultiServerManager) Reload(cfg *Config, mainLogger *zap.Logger) error {
+	msm.mu.Lock()
+	defer msm.mu.Unlock()
+
+	running := make(map[string]bool, len(msm.serverInstances))
+	var reloads []serverReload
+	for _, instance := range msm.serverInstances {
+		running[instance.name] = true
+
+		serverCfg, ok := cfg.GetServer(instance.name)
+		if !ok || !serverCfg.Enabled {
+			mainLogger.Warn("Server instance no longer in configuration, restart required to stop it",
+				zap.String("name", instance.name))
+			continue
+		}
+
+		reload := serverReload{
+			instance:           instance,
+			upstreams:          cfg.GetUpstreamsByNames(serverCfg.Upstreams),
+			websocketUpstreams: cfg.GetWebSocketUpstreamsByNames(serverCfg.Upstreams),
+			lbConfig:           cfg.GetLoadBalancerConfig(serverCfg.Name),
+			runtime:            NewRuntimeConfig(cfg, serverCfg),
+			logLevel:           cfg.GetLoggingConfig(serverCfg.Name).Level,
+		}
+		if err := validateUpstreamConfigs(reload.upstreams); err != nil {
+			return fmt.Errorf("server %s: %w", instance.name, err)
+		}
+		if err := validateUpstreamConfigs(reload.websocketUpstreams); err != nil {
+			return fmt.Errorf("server %s: %w", instance.name, err)
+		}
+		reloads = append(reloads, reload)
+	}
+
+	for _, serverCfg := range cfg.GetEnabledServers() {
+		if !running[serverCfg.Name] {
+			mainLogger.Warn("New server instance in configuration, restart required to start it",
+				zap.String("name", serverCfg.Name))
+		}
+	}
+
+	for _, reload := range reloads {
+		instance := reload.instance
+		// Upstream configs were validated above, so reconfiguring cannot fail here
+		instance.loadBalancer.Reconfigure(reload.upstreams, reload.lbConfig)
+		instance.wsLoadBalancer.Reconfigure(reload.websocketUpstreams, reload.lbConfig)
+		instance.proxyServer.Reload(reload.runtime)
+		instance.logLevel.SetLevel(parseLogLevel(reload.logLevel))
+	}
+
+	msm.config = cfg
+	mainLogger.Info("Configuration reloaded", zap.Int("instances", len(reloads)))
+	return nil
+}
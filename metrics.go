@@ -0,0 +1,578 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// latencyBuckets are the upper bounds (in seconds) used for request duration histograms
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// sizeBuckets are the upper bounds (in bytes) used for body size histograms
+var sizeBuckets = []float64{256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216}
+
+// sessionBuckets are the upper bounds (in seconds) used for WebSocket session duration histograms
+var sessionBuckets = []float64{1, 10, 60, 300, 900, 1800, 3600, 14400, 43200, 86400}
+
+// Histogram is a simple cumulative histogram compatible with the Prometheus text format
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64 // one counter per bound plus the +Inf bucket
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram creates a histogram with the given upper bounds
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// Observe records a single value
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	idx := sort.SearchFloat64s(h.bounds, v)
+	h.counts[idx]++
+	h.sum += v
+	h.count++
+}
+
+// write renders the histogram as Prometheus text using the given metric name and labels
+func (h *Histogram) write(w io.Writer, name, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound, cumulative)
+	}
+	cumulative += h.counts[len(h.bounds)]
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, cumulative)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+// ServerMetrics holds traffic counters for a single server instance
+type ServerMetrics struct {
+	server            string
+	requests          int64
+	responses         [6]int64 // indexed by status class (1xx..5xx), index 0 is unused
+	upstreamErrors    int64
+	activeConnections int64
+	bytesReceived     int64
+	bytesSent         int64
+	duration          *Histogram
+	cache             [4]int64                // cache lookups, indexed by cacheResult
+	mirror            [3]int64                // mirrored requests, indexed by mirrorResult
+	shed              int64                   // requests rejected by the load shedder
+	panics            int64                   // requests whose handler panicked
+	accessLog         *zap.Logger             // nil when access logging is disabled
+	upstreams         func() []UpstreamStatus // the server's HTTP upstreams, nil until set
+
+	sizesMu sync.RWMutex
+	sizes   map[sizeKey]*bodySizes
+
+	websocketsMu sync.RWMutex
+	websockets   map[string]*WebSocketMetrics // by upstream
+}
+
+// sizeKey identifies the route and upstream a body size was observed for
+type sizeKey struct {
+	route    string
+	upstream string
+}
+
+// bodySizes holds the request and response body size distributions of a route/upstream pair
+type bodySizes struct {
+	request  *Histogram
+	response *Histogram
+}
+
+// AccessEntry describes a single handled request for metrics and access logging
+type AccessEntry struct {
+	Protocol string
+	Method   string
+	Path     string
+	Route    string
+	Remote   string
+	Upstream string
+	Status   int
+	BytesIn  int // request body bytes
+	BytesOut int // response body bytes
+	Duration time.Duration
+}
+
+// NewServerMetrics creates an empty metrics set for the named server instance
+func NewServerMetrics(server string) *ServerMetrics {
+	return &ServerMetrics{
+		server:   server,
+		duration: NewHistogram(latencyBuckets),
+		sizes:    make(map[sizeKey]*bodySizes),
+
+		websockets: make(map[string]*WebSocketMetrics),
+	}
+}
+
+// SetAccessLogger enables access logging through the given logger
+func (m *ServerMetrics) SetAccessLogger(logger *zap.Logger) {
+	m.accessLog = logger
+}
+
+// SetUpstreams sets where the connection pools of the server's HTTP upstreams
+// are read from
+func (m *ServerMetrics) SetUpstreams(snapshot func() []UpstreamStatus) {
+	m.upstreams = snapshot
+}
+
+// ObserveRequest records a completed request and writes its access log entry
+func (m *ServerMetrics) ObserveRequest(e *AccessEntry) {
+	atomic.AddInt64(&m.requests, 1)
+	if class := e.Status / 100; class >= 1 && class <= 5 {
+		atomic.AddInt64(&m.responses[class], 1)
+	}
+	atomic.AddInt64(&m.bytesReceived, int64(e.BytesIn))
+	atomic.AddInt64(&m.bytesSent, int64(e.BytesOut))
+	m.duration.Observe(e.Duration.Seconds())
+
+	sizes := m.bodySizesFor(e.Route, e.Upstream)
+	sizes.request.Observe(float64(e.BytesIn))
+	sizes.response.Observe(float64(e.BytesOut))
+
+	if m.accessLog != nil {
+		m.accessLog.Info("access",
+			zap.String("protocol", e.Protocol),
+			zap.String("method", e.Method),
+			zap.String("path", e.Path),
+			zap.String("route", e.Route),
+			zap.String("remote", e.Remote),
+			zap.String("upstream", e.Upstream),
+			zap.Int("status", e.Status),
+			zap.Int("bytes_in", e.BytesIn),
+			zap.Int("bytes_out", e.BytesOut),
+			zap.Duration("duration", e.Duration))
+	}
+}
+
+// bodySizesFor returns the size histograms of a route/upstream pair, creating them if needed
+func (m *ServerMetrics) bodySizesFor(route, upstream string) *bodySizes {
+	if route == "" {
+		route = "default"
+	}
+	if upstream == "" {
+		upstream = "none"
+	}
+	key := sizeKey{route: route, upstream: upstream}
+
+	m.sizesMu.RLock()
+	sizes, ok := m.sizes[key]
+	m.sizesMu.RUnlock()
+	if ok {
+		return sizes
+	}
+
+	m.sizesMu.Lock()
+	defer m.sizesMu.Unlock()
+	if sizes, ok := m.sizes[key]; ok {
+		return sizes
+	}
+	sizes = &bodySizes{
+		request:  NewHistogram(sizeBuckets),
+		response: NewHistogram(sizeBuckets),
+	}
+	m.sizes[key] = sizes
+	return sizes
+}
+
+// sortedSizeKeys returns the observed route/upstream pairs in a stable order
+func (m *ServerMetrics) sortedSizeKeys() []sizeKey {
+	m.sizesMu.RLock()
+	defer m.sizesMu.RUnlock()
+
+	keys := make([]sizeKey, 0, len(m.sizes))
+	for key := range m.sizes {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].upstream < keys[j].upstream
+	})
+	return keys
+}
+
+// Results of looking a request up in the response cache
+const (
+	cacheHit    = iota // answered from the cache
+	cacheMiss          // nothing cached, sent upstream
+	cacheStale         // a stale response cached, revalidated with the upstream
+	cacheBypass        // not cacheable, or the client asked for a fresh answer
+)
+
+// cacheResultNames are the result label values of cache metrics
+var cacheResultNames = [4]string{"hit", "miss", "stale", "bypass"}
+
+// ObserveCache records the result of a response cache lookup
+func (m *ServerMetrics) ObserveCache(result int) {
+	atomic.AddInt64(&m.cache[result], 1)
+}
+
+// cacheHitRatio returns the share of cache lookups answered from the cache, bypasses
+// left out, or 0 before any
+func (m *ServerMetrics) cacheHitRatio() float64 {
+	hits := atomic.LoadInt64(&m.cache[cacheHit])
+	lookups := hits + atomic.LoadInt64(&m.cache[cacheMiss]) + atomic.LoadInt64(&m.cache[cacheStale])
+	if lookups == 0 {
+		return 0
+	}
+	return float64(hits) / float64(lookups)
+}
+
+// Outcomes of a request mirrored to a shadow upstream
+const (
+	mirrorSent    = iota // the shadow upstream answered
+	mirrorFailed         // the shadow upstream could not be reached in time
+	mirrorSkipped        // not mirrored: too many pending, or a body the proxy does not hold
+)
+
+// mirrorResultNames are the result label values of mirror metrics
+var mirrorResultNames = [3]string{"sent", "failed", "skipped"}
+
+// ObserveMirror records the outcome of a mirrored request
+func (m *ServerMetrics) ObserveMirror(result int) {
+	atomic.AddInt64(&m.mirror[result], 1)
+}
+
+// IncShedRequests records a request rejected because the proxy was overloaded
+func (m *ServerMetrics) IncShedRequests() {
+	atomic.AddInt64(&m.shed, 1)
+}
+
+// IncUpstreamErrors records a failed upstream exchange
+func (m *ServerMetrics) IncUpstreamErrors() {
+	atomic.AddInt64(&m.upstreamErrors, 1)
+}
+
+// IncPanics records a request whose handling panicked and was answered with a 500
+func (m *ServerMetrics) IncPanics() {
+	atomic.AddInt64(&m.panics, 1)
+}
+
+// ConnectionOpened records a new client connection
+func (m *ServerMetrics) ConnectionOpened() {
+	atomic.AddInt64(&m.activeConnections, 1)
+}
+
+// ConnectionClosed records a closed client connection
+func (m *ServerMetrics) ConnectionClosed() {
+	atomic.AddInt64(&m.activeConnections, -1)
+}
+
+// WebSocket traffic directions
+const (
+	wsClientToUpstream = iota
+	wsUpstreamToClient
+)
+
+// wsDirectionNames are the direction label values of WebSocket traffic metrics
+var wsDirectionNames = [2]string{"client_to_upstream", "upstream_to_client"}
+
+// WebSocketMetrics holds the WebSocket session counters of one upstream
+type WebSocketMetrics struct {
+	active            int64
+	sessions          int64
+	handshakeFailures int64
+	messages          [2]int64 // indexed by direction
+	bytes             [2]int64 // indexed by direction
+	duration          *Histogram
+}
+
+// WebSocketFor returns the WebSocket metrics of an upstream, creating them if needed
+func (m *ServerMetrics) WebSocketFor(upstream string) *WebSocketMetrics {
+	m.websocketsMu.RLock()
+	ws, ok := m.websockets[upstream]
+	m.websocketsMu.RUnlock()
+	if ok {
+		return ws
+	}
+
+	m.websocketsMu.Lock()
+	defer m.websocketsMu.Unlock()
+	if ws, ok := m.websockets[upstream]; ok {
+		return ws
+	}
+	ws = &WebSocketMetrics{duration: NewHistogram(sessionBuckets)}
+	m.websockets[upstream] = ws
+	return ws
+}
+
+// sortedWebSocketUpstreams returns the upstreams with WebSocket metrics in a stable order
+func (m *ServerMetrics) sortedWebSocketUpstreams() []string {
+	m.websocketsMu.RLock()
+	defer m.websocketsMu.RUnlock()
+
+	upstreams := make([]string, 0, len(m.websockets))
+	for upstream := range m.websockets {
+		upstreams = append(upstreams, upstream)
+	}
+	sort.Strings(upstreams)
+	return upstreams
+}
+
+// SessionOpened records an established WebSocket session
+func (ws *WebSocketMetrics) SessionOpened() {
+	atomic.AddInt64(&ws.active, 1)
+	atomic.AddInt64(&ws.sessions, 1)
+}
+
+// SessionClosed records the end of a session opened with SessionOpened
+func (ws *WebSocketMetrics) SessionClosed(duration time.Duration) {
+	atomic.AddInt64(&ws.active, -1)
+	ws.duration.Observe(duration.Seconds())
+}
+
+// HandshakeFailed records an upgrade the upstream could not be reached for or did not accept
+func (ws *WebSocketMetrics) HandshakeFailed() {
+	atomic.AddInt64(&ws.handshakeFailures, 1)
+}
+
+// Traffic records messages and bytes relayed in one direction
+func (ws *WebSocketMetrics) Traffic(direction, messages, bytes int) {
+	if messages > 0 {
+		atomic.AddInt64(&ws.messages[direction], int64(messages))
+	}
+	atomic.AddInt64(&ws.bytes[direction], int64(bytes))
+}
+
+// MetricsRegistry keeps the metrics of all server instances, keyed by server name
+type MetricsRegistry struct {
+	mu      sync.RWMutex
+	servers map[string]*ServerMetrics
+}
+
+// NewMetricsRegistry creates an empty metrics registry
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{
+		servers: make(map[string]*ServerMetrics),
+	}
+}
+
+// ForServer returns the metrics of the named server instance, creating them if needed
+func (r *MetricsRegistry) ForServer(name string) *ServerMetrics {
+	r.mu.RLock()
+	m, ok := r.servers[name]
+	r.mu.RUnlock()
+	if ok {
+		return m
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m, ok := r.servers[name]; ok {
+		return m
+	}
+	m = NewServerMetrics(name)
+	r.servers[name] = m
+	return m
+}
+
+// WritePrometheus renders the metrics of every server instance in Prometheus text format
+func (r *MetricsRegistry) WritePrometheus(w io.Writer) {
+	servers := r.snapshot()
+
+	counter := func(name, help string, value func(m *ServerMetrics) int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, m := range servers {
+			fmt.Fprintf(w, "%s{server=%q} %d\n", name, m.server, value(m))
+		}
+	}
+
+	counter("surikiti_requests_total", "Total number of proxied requests.", func(m *ServerMetrics) int64 {
+		return atomic.LoadInt64(&m.requests)
+	})
+
+	fmt.Fprintln(w, "# HELP surikiti_responses_total Responses sent to clients by status class.")
+	fmt.Fprintln(w, "# TYPE surikiti_responses_total counter")
+	for _, m := range servers {
+		for class := 1; class <= 5; class++ {
+			fmt.Fprintf(w, "surikiti_responses_total{server=%q,code=\"%dxx\"} %d\n", m.server, class, atomic.LoadInt64(&m.responses[class]))
+		}
+	}
+
+	counter("surikiti_upstream_errors_total", "Failed exchanges with upstream servers.", func(m *ServerMetrics) int64 {
+		return atomic.LoadInt64(&m.upstreamErrors)
+	})
+	counter("surikiti_panics_total", "Requests whose handling panicked and was answered with a 500.", func(m *ServerMetrics) int64 {
+		return atomic.LoadInt64(&m.panics)
+	})
+	counter("surikiti_bytes_received_total", "Request bytes received from clients.", func(m *ServerMetrics) int64 {
+		return atomic.LoadInt64(&m.bytesReceived)
+	})
+	counter("surikiti_bytes_sent_total", "Response bytes sent to clients.", func(m *ServerMetrics) int64 {
+		return atomic.LoadInt64(&m.bytesSent)
+	})
+
+	fmt.Fprintln(w, "# HELP surikiti_active_connections Currently open client connections.")
+	fmt.Fprintln(w, "# TYPE surikiti_active_connections gauge")
+	for _, m := range servers {
+		fmt.Fprintf(w, "surikiti_active_connections{server=%q} %d\n", m.server, atomic.LoadInt64(&m.activeConnections))
+	}
+
+	fmt.Fprintln(w, "# HELP surikiti_request_duration_seconds Time spent handling requests.")
+	fmt.Fprintln(w, "# TYPE surikiti_request_duration_seconds histogram")
+	for _, m := range servers {
+		m.duration.write(w, "surikiti_request_duration_seconds", fmt.Sprintf("server=%q", m.server))
+	}
+
+	fmt.Fprintln(w, "# HELP surikiti_request_body_bytes Request body sizes by route and upstream.")
+	fmt.Fprintln(w, "# TYPE surikiti_request_body_bytes histogram")
+	for _, m := range servers {
+		for _, key := range m.sortedSizeKeys() {
+			labels := fmt.Sprintf("server=%q,route=%q,upstream=%q", m.server, key.route, key.upstream)
+			m.bodySizesFor(key.route, key.upstream).request.write(w, "surikiti_request_body_bytes", labels)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP surikiti_response_body_bytes Response body sizes by route and upstream.")
+	fmt.Fprintln(w, "# TYPE surikiti_response_body_bytes histogram")
+	for _, m := range servers {
+		for _, key := range m.sortedSizeKeys() {
+			labels := fmt.Sprintf("server=%q,route=%q,upstream=%q", m.server, key.route, key.upstream)
+			m.bodySizesFor(key.route, key.upstream).response.write(w, "surikiti_response_body_bytes", labels)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP surikiti_cache_requests_total Response cache lookups by result.")
+	fmt.Fprintln(w, "# TYPE surikiti_cache_requests_total counter")
+	for _, m := range servers {
+		for result, label := range cacheResultNames {
+			fmt.Fprintf(w, "surikiti_cache_requests_total{server=%q,result=%q} %d\n", m.server, label, atomic.LoadInt64(&m.cache[result]))
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP surikiti_cache_hit_ratio Share of cacheable requests answered from the response cache.")
+	fmt.Fprintln(w, "# TYPE surikiti_cache_hit_ratio gauge")
+	for _, m := range servers {
+		fmt.Fprintf(w, "surikiti_cache_hit_ratio{server=%q} %g\n", m.server, m.cacheHitRatio())
+	}
+
+	fmt.Fprintln(w, "# HELP surikiti_mirror_requests_total Requests mirrored to shadow upstreams by result.")
+	fmt.Fprintln(w, "# TYPE surikiti_mirror_requests_total counter")
+	for _, m := range servers {
+		for result, label := range mirrorResultNames {
+			fmt.Fprintf(w, "surikiti_mirror_requests_total{server=%q,result=%q} %d\n", m.server, label, atomic.LoadInt64(&m.mirror[result]))
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP surikiti_shed_requests_total Requests rejected with 503 while the proxy was overloaded.")
+	fmt.Fprintln(w, "# TYPE surikiti_shed_requests_total counter")
+	for _, m := range servers {
+		fmt.Fprintf(w, "surikiti_shed_requests_total{server=%q} %d\n", m.server, atomic.LoadInt64(&m.shed))
+	}
+
+	writePoolMetrics(w, servers)
+	r.writeWebSocketMetrics(w, servers)
+}
+
+// writePoolMetrics renders the upstream connection pools of every server instance
+func writePoolMetrics(w io.Writer, servers []*ServerMetrics) {
+	pools := make([][]UpstreamStatus, len(servers))
+	for i, m := range servers {
+		if m.upstreams != nil {
+			pools[i] = m.upstreams()
+		}
+	}
+	gauge := func(name, help string, value func(p PoolStats) int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for i, m := range servers {
+			for _, upstream := range pools[i] {
+				fmt.Fprintf(w, "%s{server=%q,upstream=%q} %d\n", name, m.server, upstream.Name, value(upstream.Pool))
+			}
+		}
+	}
+
+	gauge("surikiti_upstream_pool_open_connections", "Open connections to the upstream on the gnet listener, idle or in use.", func(p PoolStats) int64 {
+		return p.Open
+	})
+	gauge("surikiti_upstream_pool_idle_connections", "Open connections to the upstream waiting for a request.", func(p PoolStats) int64 {
+		return p.Idle
+	})
+	gauge("surikiti_upstream_pool_waiters", "Requests waiting for a connection to the upstream, dialing included.", func(p PoolStats) int64 {
+		return p.Waiters
+	})
+}
+
+// writeWebSocketMetrics renders the per-upstream WebSocket metrics of every server instance
+func (r *MetricsRegistry) writeWebSocketMetrics(w io.Writer, servers []*ServerMetrics) {
+	perUpstream := func(name, help, kind string, value func(ws *WebSocketMetrics) int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, m := range servers {
+			for _, upstream := range m.sortedWebSocketUpstreams() {
+				fmt.Fprintf(w, "%s{server=%q,upstream=%q} %d\n", name, m.server, upstream, value(m.WebSocketFor(upstream)))
+			}
+		}
+	}
+	perDirection := func(name, help string, values func(ws *WebSocketMetrics) *[2]int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, m := range servers {
+			for _, upstream := range m.sortedWebSocketUpstreams() {
+				counts := values(m.WebSocketFor(upstream))
+				for direction, label := range wsDirectionNames {
+					fmt.Fprintf(w, "%s{server=%q,upstream=%q,direction=%q} %d\n", name, m.server, upstream, label, atomic.LoadInt64(&counts[direction]))
+				}
+			}
+		}
+	}
+
+	perUpstream("surikiti_websocket_sessions_active", "Currently open WebSocket sessions.", "gauge", func(ws *WebSocketMetrics) int64 {
+		return atomic.LoadInt64(&ws.active)
+	})
+	perUpstream("surikiti_websocket_sessions_total", "WebSocket sessions established.", "counter", func(ws *WebSocketMetrics) int64 {
+		return atomic.LoadInt64(&ws.sessions)
+	})
+	perUpstream("surikiti_websocket_handshake_failures_total", "WebSocket upgrades the upstream could not be reached for or did not accept.", "counter", func(ws *WebSocketMetrics) int64 {
+		return atomic.LoadInt64(&ws.handshakeFailures)
+	})
+	perDirection("surikiti_websocket_messages_total", "WebSocket messages relayed.", func(ws *WebSocketMetrics) *[2]int64 {
+		return &ws.messages
+	})
+	perDirection("surikiti_websocket_bytes_total", "WebSocket bytes relayed, frame overhead included on the gnet listener.", func(ws *WebSocketMetrics) *[2]int64 {
+		return &ws.bytes
+	})
+
+	fmt.Fprintln(w, "# HELP surikiti_websocket_session_duration_seconds Lifetime of closed WebSocket sessions.")
+	fmt.Fprintln(w, "# TYPE surikiti_websocket_session_duration_seconds histogram")
+	for _, m := range servers {
+		for _, upstream := range m.sortedWebSocketUpstreams() {
+			labels := fmt.Sprintf("server=%q,upstream=%q", m.server, upstream)
+			m.WebSocketFor(upstream).duration.write(w, "surikiti_websocket_session_duration_seconds", labels)
+		}
+	}
+}
+
+// snapshot returns the registered server metrics sorted by server name
+func (r *MetricsRegistry) snapshot() []*ServerMetrics {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	servers := make([]*ServerMetrics, 0, len(r.servers))
+	for _, m := range r.servers {
+		servers = append(servers, m)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].server < servers[j].server
+	})
+	return servers
+}
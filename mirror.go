@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+// defaultMirrorMaxInFlight bounds the mirrored requests of a route pending at once
+// when max_in_flight is not set
+const defaultMirrorMaxInFlight = 100
+
+// trafficMirror sends copies of a route's requests to a shadow upstream and
+// discards its answers, so that a new version of a service can be tried on
+// production traffic without clients noticing. Mirrored requests are sent in the
+// background and never delay or change the client's response. Method and path
+// filters and a sample rate keep the shadow's share of the traffic manageable.
+type trafficMirror struct {
+	config   RouteMirrorConfig
+	upstream UpstreamConfig
+	client   *http.Client
+	timeout  time.Duration
+	slots    chan struct{} // one per pending mirrored request
+}
+
+// newTrafficMirror creates the mirror of a route toward the shadow upstream, or
+// returns nil when the route mirrors nothing
+func newTrafficMirror(config RouteMirrorConfig, upstream UpstreamConfig, p ProxyConfig) *trafficMirror {
+	if config.Upstream == "" {
+		return nil
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = upstream.Overrides().requestTimeout(p)
+	}
+	maxInFlight := config.MaxInFlight
+	if maxInFlight <= 0 {
+		maxInFlight = defaultMirrorMaxInFlight
+	}
+	return &trafficMirror{
+		config:   config,
+		upstream: upstream,
+		client:   newStandardClient(p, upstream.Overrides()),
+		timeout:  timeout,
+		slots:    make(chan struct{}, maxInFlight),
+	}
+}
+
+// Mirror returns the traffic mirror of the route, nil when it has none
+func (r *Route) Mirror() *trafficMirror {
+	if r == nil {
+		return nil
+	}
+	return r.mirror
+}
+
+// InheritMirrors keeps the mirrors, with their connections and pending requests,
+// of routes whose name, mirror and shadow upstream did not change
+func (rt *Router) InheritMirrors(previous *Router) {
+	if rt == nil || previous == nil {
+		return
+	}
+	for _, route := range rt.routes {
+		for _, old := range previous.routes {
+			if old.Name == route.Name && old.mirror != nil && route.mirror != nil &&
+				reflect.DeepEqual(old.mirror.config, route.mirror.config) && old.mirror.upstream == route.mirror.upstream {
+				route.mirror = old.mirror
+				break
+			}
+		}
+	}
+}
+
+// selects reports whether a request is mirrored: its method and path pass the
+// filters and it falls within the sample
+func (m *trafficMirror) selects(method, path string) bool {
+	if len(m.config.Methods) > 0 && !slices.ContainsFunc(m.config.Methods, func(allowed string) bool {
+		return strings.EqualFold(allowed, method)
+	}) {
+		return false
+	}
+	if len(m.config.Paths) > 0 && !slices.ContainsFunc(m.config.Paths, func(prefix string) bool {
+		return strings.HasPrefix(path, prefix)
+	}) {
+		return false
+	}
+	rate := m.config.SampleRate
+	return rate <= 0 || rate >= 1 || rand.Float64() < rate
+}
+
+// send mirrors a request in the background, with the header it has on its way to
+// the upstream. It reports false, sending nothing, when max_in_flight mirrored
+// requests are still pending, so a slow shadow upstream costs the proxy no more
+// than that. done is called with the outcome once the shadow answered.
+func (m *trafficMirror) send(method, requestURI string, header http.Header, body []byte, done func(error)) bool {
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		return false
+	}
+
+	go func() {
+		defer func() { <-m.slots }()
+		ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(m.upstream.URL, "/")+requestURI, bytes.NewReader(body))
+		if err != nil {
+			done(err)
+			return
+		}
+		req.Header = header
+		resp, err := m.client.Do(req)
+		if err != nil {
+			done(err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		done(nil)
+	}()
+	return true
+}
+
+// mirrorStandard sends a copy of a request of the net/http servers to the route's
+// shadow upstream. The body is read first and put back for the upstream, so only
+// requests whose body has a known length within max_body_size are mirrored.
+// xForwardedProto is the X-Forwarded-Proto value.
+func mirrorStandard(route *Route, r *http.Request, xForwardedProto string, rc *RuntimeConfig, metrics *ServerMetrics, logger *zap.Logger) {
+	mirror := route.Mirror()
+	if mirror == nil || !mirror.selects(r.Method, r.URL.Path) {
+		return
+	}
+	body, ok := bufferRequestBody(r, rc.Proxy.MaxBodySize)
+	if !ok {
+		metrics.ObserveMirror(mirrorSkipped)
+		return
+	}
+
+	header := r.Header.Clone()
+	removeHopHeaders(header)
+	setForwardingHeaders(header, r, xForwardedProto, rc)
+	mirror.dispatch(route, r.Method, route.upstreamRequestURI(r.URL.RequestURI()), header, body, metrics, logger)
+}
+
+// mirrorFastHTTP sends a copy of a request read from a gnet connection, with its
+// buffered body, to the route's shadow upstream
+func mirrorFastHTTP(route *Route, req *fasthttp.Request, remoteAddr string, rc *RuntimeConfig, metrics *ServerMetrics, logger *zap.Logger) {
+	mirror := route.Mirror()
+	if mirror == nil || !mirror.selects(string(req.Header.Method()), string(req.URI().Path())) {
+		return
+	}
+
+	shadow := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(shadow)
+	req.CopyTo(shadow)
+	removeRequestHopHeaders(&shadow.Header)
+	setFastHTTPForwardingHeaders(&shadow.Header, remoteAddr, rc)
+	shadow.Header.Del("Expect")
+
+	header := make(http.Header)
+	shadow.Header.VisitAll(func(key, value []byte) {
+		header.Add(string(key), string(value))
+	})
+	body := append([]byte(nil), shadow.Body()...)
+	mirror.dispatch(route, string(shadow.Header.Method()), string(shadow.RequestURI()), header, body, metrics, logger)
+}
+
+// dispatch sends a mirrored request of route and records its outcome
+func (m *trafficMirror) dispatch(route *Route, method, requestURI string, header http.Header, body []byte, metrics *ServerMetrics, logger *zap.Logger) {
+	sent := m.send(method, requestURI, header, body, func(err error) {
+		if err != nil {
+			logger.Debug("Mirrored request failed",
+				zap.String("route", route.RouteName()),
+				zap.String("upstream", m.upstream.Name),
+				zap.Error(err))
+			metrics.ObserveMirror(mirrorFailed)
+			return
+		}
+		metrics.ObserveMirror(mirrorSent)
+	})
+	if !sent {
+		metrics.ObserveMirror(mirrorSkipped)
+	}
+}
+
+// bufferRequestBody reads the body of a net/http request so that it can be sent
+// twice, leaving a copy in r.Body. It reports false, leaving the body to stream,
+// when its length is unknown or above limit, or reading it failed.
+func bufferRequestBody(r *http.Request, limit int64) ([]byte, bool) {
+	if r.ContentLength == 0 || r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength < 0 || r.ContentLength > limit {
+		return nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, r.ContentLength))
+	if err != nil {
+		// What was read still goes to the upstream, followed by whatever remains
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false
+	}
+	r.Body = readCloser{bytes.NewReader(body), r.Body}
+	return body, true
+}
+
+// readCloser reads from Reader and closes Closer
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// OAuth2 defaults
+const (
+	defaultOAuth2CacheTTL      = time.Minute
+	defaultOAuth2Timeout       = 5 * time.Second
+	defaultOAuth2SubjectHeader = "X-Auth-Subject"
+	defaultOAuth2ScopesHeader  = "X-Auth-Scopes"
+)
+
+// oauth2CacheSize bounds the introspection results kept in memory
+const oauth2CacheSize = 10000
+
+// TokenInfo is the part of an introspection response passed on to upstreams
+type TokenInfo struct {
+	Active    bool
+	Subject   string
+	Scopes    []string
+	ExpiresAt time.Time // zero when the token has no expiry
+}
+
+// OAuth2Introspector validates opaque bearer tokens against an OAuth2 token
+// introspection endpoint (RFC 7662) and caches the answers
+type OAuth2Introspector struct {
+	config OAuth2Config
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]cachedToken
+}
+
+// cachedToken is an introspection result and when it must be asked again
+type cachedToken struct {
+	info    TokenInfo
+	expires time.Time
+}
+
+// NewOAuth2Introspector creates the introspector of a server, or returns nil when OAuth2 is disabled
+func NewOAuth2Introspector(cfg OAuth2Config) *OAuth2Introspector {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &OAuth2Introspector{
+		config: cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		cache:  make(map[[sha256.Size]byte]cachedToken),
+	}
+}
+
+// Config returns the settings the introspector was created with
+func (o *OAuth2Introspector) Config() OAuth2Config {
+	if o == nil {
+		return OAuth2Config{}
+	}
+	return o.config
+}
+
+// Authenticate validates the bearer token of an Authorization header. It returns
+// the token on success, or the status and WWW-Authenticate challenge to reject
+// the request with: 401 for a missing or inactive token, 403 for missing scopes
+// and 503 when the introspection endpoint cannot be reached.
+func (o *OAuth2Introspector) Authenticate(ctx context.Context, authorization string) (*TokenInfo, int, string) {
+	if o == nil {
+		return nil, 0, ""
+	}
+
+	scheme, token, ok := strings.Cut(authorization, " ")
+	token = strings.TrimSpace(token)
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, http.StatusUnauthorized, `Bearer`
+	}
+
+	info, err := o.introspect(ctx, token)
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, ""
+	}
+	if !info.Active {
+		return nil, http.StatusUnauthorized, `Bearer error="invalid_token"`
+	}
+	if missing := missingScopes(info.Scopes, o.config.RequiredScopes); len(missing) > 0 {
+		return nil, http.StatusForbidden,
+			fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, strings.Join(o.config.RequiredScopes, " "))
+	}
+	return info, 0, ""
+}
+
+// introspect returns the cached answer for a token or asks the endpoint
+func (o *OAuth2Introspector) introspect(ctx context.Context, token string) (*TokenInfo, error) {
+	digest := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	o.mu.Lock()
+	cached, ok := o.cache[digest]
+	o.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return &cached.info, nil
+	}
+
+	info, err := o.request(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	// Active tokens are never cached past their expiry
+	expires := now.Add(o.config.CacheTTL)
+	if info.Active && !info.ExpiresAt.IsZero() && info.ExpiresAt.Before(expires) {
+		expires = info.ExpiresAt
+	}
+
+	o.mu.Lock()
+	if len(o.cache) >= oauth2CacheSize {
+		for key, entry := range o.cache {
+			if !now.Before(entry.expires) {
+				delete(o.cache, key)
+			}
+		}
+		if len(o.cache) >= oauth2CacheSize {
+			o.cache = make(map[[sha256.Size]byte]cachedToken)
+		}
+	}
+	o.cache[digest] = cachedToken{info: *info, expires: expires}
+	o.mu.Unlock()
+
+	return info, nil
+}
+
+// request calls the introspection endpoint
+func (o *OAuth2Introspector) request(ctx context.Context, token string) (*TokenInfo, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.config.IntrospectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.config.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(o.config.ClientID), url.QueryEscape(o.config.ClientSecret))
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection endpoint returned %s", resp.Status)
+	}
+
+	var body struct {
+		Active bool   `json:"active"`
+		Sub    string `json:"sub"`
+		Scope  string `json:"scope"`
+		Exp    int64  `json:"exp"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode introspection response: %w", err)
+	}
+
+	info := &TokenInfo{Active: body.Active, Subject: body.Sub, Scopes: strings.Fields(body.Scope)}
+	if body.Exp > 0 {
+		info.ExpiresAt = time.Unix(body.Exp, 0)
+	}
+	return info, nil
+}
+
+// missingScopes returns the required scopes the token was not granted
+func missingScopes(granted, required []string) []string {
+	var missing []string
+	for _, scope := range required {
+		found := false
+		for _, g := range granted {
+			if g == scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
+
+// upstreamHeaders returns the headers describing the token to the upstream.
+// Headers with the same names sent by the client are always replaced or removed.
+func (o *OAuth2Introspector) upstreamHeaders(info *TokenInfo) [2][2]string {
+	return [2][2]string{
+		{o.config.SubjectHeader, info.Subject},
+		{o.config.ScopesHeader, strings.Join(info.Scopes, " ")},
+	}
+}
+
+// setTokenHeadersFastHTTP replaces the token headers of a gnet request
+func (o *OAuth2Introspector) setTokenHeadersFastHTTP(req *fasthttp.Request, info *TokenInfo) {
+	if o == nil {
+		return
+	}
+	for _, header := range o.upstreamHeaders(info) {
+		req.Header.Del(header[0])
+		if header[1] != "" {
+			req.Header.Set(header[0], header[1])
+		}
+	}
+}
+
+// setTokenHeaders replaces the token headers of a net/http request
+func (o *OAuth2Introspector) setTokenHeaders(h http.Header, info *TokenInfo) {
+	if o == nil {
+		return
+	}
+	for _, header := range o.upstreamHeaders(info) {
+		h.Del(header[0])
+		if header[1] != "" {
+			h.Set(header[0], header[1])
+		}
+	}
+}
+
+// writeOAuth2Error rejects a net/http request with the status returned by Authenticate
+func writeOAuth2Error(w http.ResponseWriter, status int, challenge string) {
+	if challenge != "" {
+		w.Header().Set("WWW-Authenticate", challenge)
+	}
+	http.Error(w, http.StatusText(status), status)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	rtmetrics "runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// overloadSampleInterval is how often the process-wide overload signals are sampled
+const overloadSampleInterval = 100 * time.Millisecond
+
+// heapObjectsMetric is the runtime metric of live heap memory
+const heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+
+// overloadSignals are the load figures of the whole process, sampled in the
+// background once a server enables load shedding
+var overloadSignals struct {
+	once   sync.Once
+	lag    atomic.Int64  // how late the last sample timer fired, in nanoseconds
+	memory atomic.Uint64 // bytes of live heap objects
+}
+
+// startOverloadSampler starts sampling the overload signals, once per process
+func startOverloadSampler() {
+	overloadSignals.once.Do(func() {
+		go sampleOverloadSignals()
+	})
+}
+
+// sampleOverloadSignals measures how late a timer fires, which grows when the
+// event loops and goroutines of the proxy compete for too little CPU, and the
+// live heap
+func sampleOverloadSignals() {
+	samples := []rtmetrics.Sample{{Name: heapObjectsMetric}}
+	for {
+		start := time.Now()
+		time.Sleep(overloadSampleInterval)
+		overloadSignals.lag.Store(int64(time.Since(start) - overloadSampleInterval))
+
+		rtmetrics.Read(samples)
+		if samples[0].Value.Kind() == rtmetrics.KindUint64 {
+			overloadSignals.memory.Store(samples[0].Value.Uint64())
+		}
+	}
+}
+
+// LoadShedder turns away a share of a server's requests while the proxy is
+// overloaded: its timers fire late, too many requests are pending or the heap is
+// too large. Rejecting part of the traffic early, before any work is done on it,
+// keeps the rest served instead of letting every request time out.
+type LoadShedder struct {
+	config  LoadSheddingConfig
+	pending *atomic.Int64 // requests of the server being handled
+}
+
+// NewLoadShedder creates the load shedder of a server, or returns nil when load
+// shedding is disabled
+func NewLoadShedder(config LoadSheddingConfig) *LoadShedder {
+	if !config.Enabled {
+		return nil
+	}
+	startOverloadSampler()
+	return &LoadShedder{config: config, pending: new(atomic.Int64)}
+}
+
+// Overloaded reports whether any threshold of the shedder is exceeded
+func (l *LoadShedder) Overloaded() bool {
+	if l == nil {
+		return false
+	}
+	c := l.config
+	return (c.MaxEventLoopLag > 0 && time.Duration(overloadSignals.lag.Load()) > c.MaxEventLoopLag) ||
+		(c.MaxPendingRequests > 0 && l.pending.Load() > int64(c.MaxPendingRequests)) ||
+		(c.MaxMemory > 0 && overloadSignals.memory.Load() > uint64(c.MaxMemory))
+}
+
+// Admit decides whether a request is handled. An admitted request counts as
+// pending until Done is called; a rejected one should get 503 with the returned
+// Retry-After. A nil shedder admits every request.
+func (l *LoadShedder) Admit() (admitted bool, retryAfter time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	if l.Overloaded() && rand.Float64() < l.config.ShedFraction {
+		return false, l.config.RetryAfter
+	}
+	l.pending.Add(1)
+	return true, 0
+}
+
+// Done stops counting a request admitted by Admit as pending
+func (l *LoadShedder) Done() {
+	if l == nil {
+		return
+	}
+	l.pending.Add(-1)
+}
+
+// inherit keeps counting the requests pending under the previous shedder, which
+// finish after a reload
+func (l *LoadShedder) inherit(previous *LoadShedder) {
+	if l == nil || previous == nil {
+		return
+	}
+	l.pending = previous.pending
+}
+
+// writeOverloaded rejects a net/http request shed by the load shedder with 503 and
+// a Retry-After hint
+func writeOverloaded(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+	http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/valyala/fasthttp"
+)
+
+// defaultPageContentType is the Content-Type of a page when content_type is not set
+const defaultPageContentType = "text/html; charset=utf-8"
+
+// staticPage is a response the proxy answers itself instead of an upstream
+type staticPage interface {
+	// write answers a net/http request with the page
+	write(w http.ResponseWriter)
+	// writeFastHTTP fills a fasthttp response with the page
+	writeFastHTTP(resp *fasthttp.Response)
+}
+
+// readPageFile reads the page of a body_file setting
+func readPageFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// resolvePage reads the body_file of a page section into page
+func resolvePage(prefix, body, file string, page *string) error {
+	if file == "" {
+		return nil
+	}
+	if body != "" {
+		return fmt.Errorf("%s: body and body_file are mutually exclusive", prefix)
+	}
+	contents, err := readPageFile(file)
+	if err != nil {
+		return fmt.Errorf("%s: failed to read body_file: %w", prefix, err)
+	}
+	*page = contents
+	return nil
+}
+
+// resolvePage reads the page of a maintenance section from its body_file
+func (m *MaintenanceConfig) resolvePage(prefix string) error {
+	return resolvePage(prefix, m.Body, m.BodyFile, &m.page)
+}
+
+// resolvePage reads the page of a fallback section from its body_file
+func (f *FallbackConfig) resolvePage(prefix string) error {
+	return resolvePage(prefix, f.Body, f.BodyFile, &f.page)
+}
+
+// resolvePages reads the error pages of an error_pages section from their body_file
+func (e *ErrorPagesConfig) resolvePages(prefix string) error {
+	for i := range e.Pages {
+		page := &e.Pages[i]
+		if err := resolvePage(fmt.Sprintf("%s: status %d", prefix, page.Status), page.Body, page.BodyFile, &page.page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolvePages reads the maintenance, fallback and error pages referenced by the
+// configuration. It runs on every load, so an edited page is picked up by a reload.
+func (c *Config) resolvePages() error {
+	if err := c.Maintenance.resolvePage("maintenance"); err != nil {
+		return err
+	}
+	if err := c.ErrorPages.resolvePages("error_pages"); err != nil {
+		return err
+	}
+	for i := range c.Servers {
+		server := &c.Servers[i]
+		if server.Maintenance != nil {
+			if err := server.Maintenance.resolvePage(fmt.Sprintf("server %q: maintenance", server.Name)); err != nil {
+				return err
+			}
+		}
+		if server.ErrorPages != nil {
+			if err := server.ErrorPages.resolvePages(fmt.Sprintf("server %q: error_pages", server.Name)); err != nil {
+				return err
+			}
+		}
+		for j := range server.Routes {
+			route := &server.Routes[j]
+			prefix := fmt.Sprintf("server %q: route %q", server.Name, route.PathPrefix)
+			if err := route.Maintenance.resolvePage(prefix + ": maintenance"); err != nil {
+				return err
+			}
+			if err := route.Fallback.resolvePage(prefix + ": fallback"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// How request paths are checked before routing and forwarding, selected per
+// server by path_normalization. Upstreams that decode and resolve paths on their
+// own could otherwise be reached through a path the proxy's routes never saw,
+// such as /public/%2e%2e/admin.
+const (
+	PathsUnchecked  = "off"       // passed on unchecked (the default)
+	PathsNormalized = "normalize" // rewritten to their normal form
+	PathsStrict     = "reject"    // refused unless already in normal form
+)
+
+// pathNormalizations are the accepted values of path_normalization
+var pathNormalizations = map[string]bool{
+	"":              true,
+	PathsUnchecked:  true,
+	PathsNormalized: true,
+	PathsStrict:     true,
+}
+
+var (
+	errInvalidPath   = errors.New("invalid request path")
+	errPathNotNormal = errors.New("request path is not in normal form")
+)
+
+// normalizeTarget applies the path normalization mode to a request target and
+// returns the target to route and forward. Only origin-form targets, those
+// starting with "/", are checked; their query is kept as is unless unsafe.
+func normalizeTarget(target, mode string) (string, error) {
+	if mode == "" || mode == PathsUnchecked || !strings.HasPrefix(target, "/") {
+		return target, nil
+	}
+	path, query, hasQuery := strings.Cut(target, "?")
+	if unsafeQuery(query) {
+		return "", errInvalidPath
+	}
+	normal, err := normalizePath(path)
+	if err != nil {
+		return "", err
+	}
+	if mode == PathsStrict && normal != path {
+		return "", errPathNotNormal
+	}
+	if hasQuery {
+		normal += "?" + query
+	}
+	return normal, nil
+}
+
+// normalizePath returns the normal form of an escaped path (RFC 3986 section 6):
+// escaped unreserved characters, %2e among them, are decoded and dot segments
+// removed. Control characters, raw or escaped, and dot segments hidden behind an
+// escaped slash or a backslash are refused.
+func normalizePath(path string) (string, error) {
+	var decoded strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c < 0x20 || c == 0x7f {
+			return "", errInvalidPath
+		}
+		if c != '%' {
+			decoded.WriteByte(c)
+			continue
+		}
+		if i+2 >= len(path) || !isHex(path[i+1]) || !isHex(path[i+2]) {
+			return "", errInvalidPath
+		}
+		b := unhex(path[i+1])<<4 | unhex(path[i+2])
+		switch {
+		case b < 0x20 || b == 0x7f:
+			return "", errInvalidPath
+		case isUnreserved(b):
+			decoded.WriteByte(b)
+		default:
+			decoded.WriteString(path[i : i+3])
+		}
+		i += 2
+	}
+
+	segments := strings.Split(decoded.String()[1:], "/")
+	out := make([]string, 0, len(segments))
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		switch segment {
+		case ".":
+		case "..":
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		default:
+			if hidesDotSegment(segment) {
+				return "", errInvalidPath
+			}
+			out = append(out, segment)
+			continue
+		}
+		// A path ending in a dot segment names a directory
+		if last {
+			out = append(out, "")
+		}
+	}
+	return "/" + strings.Join(out, "/"), nil
+}
+
+// hidesDotSegment reports whether a segment holds a dot segment for upstreams
+// that decode %2F or take a backslash for a slash, such as ..%2F..%2Fetc
+func hidesDotSegment(segment string) bool {
+	if !strings.ContainsAny(segment, `%\`) {
+		return false
+	}
+	separators := strings.NewReplacer("%2F", "/", "%2f", "/", "%5C", "/", "%5c", "/", `\`, "/")
+	for _, part := range strings.Split(separators.Replace(segment), "/") {
+		if part == "." || part == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// unsafeQuery reports whether a query holds a raw control character or an
+// escaped NUL. Other escaped control characters are ordinary form data, such as
+// the line breaks of a text area.
+func unsafeQuery(query string) bool {
+	for i := 0; i < len(query); i++ {
+		if c := query[i]; c < 0x20 || c == 0x7f {
+			return true
+		}
+	}
+	return strings.Contains(query, "%00")
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c <= 'F':
+		return c - 'A' + 10
+	}
+	return c - 'a' + 10
+}
+
+// normalizeFastHTTPTarget applies the path normalization mode to a gnet
+// request, reporting false when it must be refused
+func normalizeFastHTTPTarget(req *fasthttp.Request, mode string) bool {
+	target := string(req.Header.RequestURI())
+	normal, err := normalizeTarget(target, mode)
+	if err != nil {
+		return false
+	}
+	if normal != target {
+		req.SetRequestURI(normal)
+	}
+	return true
+}
+
+// normalizeRequestURL applies the path normalization mode to a net/http
+// request, reporting false when it must be refused
+func normalizeRequestURL(r *http.Request, mode string) bool {
+	target := r.RequestURI
+	if !strings.HasPrefix(target, "/") {
+		target = r.URL.RequestURI()
+	}
+	normal, err := normalizeTarget(target, mode)
+	if err != nil {
+		return false
+	}
+	if normal != target {
+		u, err := url.ParseRequestURI(normal)
+		if err != nil {
+			return false
+		}
+		r.URL.Path, r.URL.RawPath, r.URL.RawQuery = u.Path, u.RawPath, u.RawQuery
+		r.RequestURI = normal
+	}
+	return true
+}
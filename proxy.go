@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"net"
 	"net/http"
 	"strings"
 	"sync"
@@ -19,84 +18,63 @@ type ProxyServer struct {
 	mu               sync.RWMutex
 	loadBalancer     *LoadBalancer
 	logger           *zap.Logger
-	client           *fasthttp.Client
-	httpClient       *http.Client
+	metrics          *ServerMetrics
+	runtime          *RuntimeConfigStore
+	connections      *ConnectionTracker
+	connLimits       *ConnLimiter
+	clients          *UpstreamClients
 	proxyConfig      ProxyConfig
 	corsConfig       CORSConfig
 	websocketHandler *WebSocketHandler
 	httpHandler      *HTTPHandler
 	http2http3Server *HTTP2HTTP3Server
+	filters          *filterChain
 	engine           gnet.Engine
 	engineSet        bool
+	listening        chan struct{} // closed once the server's listener is bound
+	listeningOnce    sync.Once
 }
 
-func NewProxyServer(lb *LoadBalancer, wsLB *LoadBalancer, logger *zap.Logger, proxyConfig ProxyConfig, corsConfig CORSConfig) *ProxyServer {
-	// Create fasthttp client optimized for stability
-	client := &fasthttp.Client{
-		ReadTimeout:                   proxyConfig.RequestTimeout,
-		WriteTimeout:                  proxyConfig.RequestTimeout,
-		MaxIdleConnDuration:           time.Second * 30,
-		MaxConnDuration:               time.Minute * 1,
-		MaxConnsPerHost:               proxyConfig.MaxConnsPerHost,
-		MaxConnWaitTimeout:            time.Second * 5,
-		ReadBufferSize:                proxyConfig.BufferSize,
-		WriteBufferSize:               proxyConfig.BufferSize,
-		DisableHeaderNamesNormalizing: false,
-		DisablePathNormalizing:        false,
-		RetryIf: func(request *fasthttp.Request) bool {
-			// Disable retries for stability
-			return false
-		},
-		Dial: (&fasthttp.TCPDialer{
-			Concurrency:      1000,
-			DNSCacheDuration: time.Minute * 10,
-		}).Dial,
-	}
-
-	// Create reusable HTTP client for standard HTTP proxy
-	httpClient := &http.Client{
-		Timeout: proxyConfig.RequestTimeout * 2, // Give more time for the overall request
-		Transport: &http.Transport{
-			MaxIdleConns:        proxyConfig.MaxIdleConns,
-			MaxIdleConnsPerHost: proxyConfig.MaxIdleConnsPerHost,
-			MaxConnsPerHost:     proxyConfig.MaxConnsPerHost,
-			IdleConnTimeout:     proxyConfig.IdleConnTimeout,
-			DialContext: (&net.Dialer{
-				Timeout:   proxyConfig.RequestTimeout,
-				KeepAlive: proxyConfig.KeepAliveTimeout,
-			}).DialContext,
-			TLSHandshakeTimeout: proxyConfig.RequestTimeout,
-			DisableKeepAlives:   false, // Enable keep-alives for better performance
-			ForceAttemptHTTP2:   false, // Disable HTTP/2 for upstream connections
-		},
-	}
+func NewProxyServer(lb *LoadBalancer, wsLB *LoadBalancer, logger *zap.Logger, metrics *ServerMetrics, connections *ConnectionTracker, rc *RuntimeConfig) *ProxyServer {
+	proxyConfig := rc.Proxy
+	corsConfig := rc.CORS
+
+	// Create reusable upstream clients (fasthttp for gnet, net/http for the standard server)
+	clients := NewUpstreamClients(proxyConfig)
+
+	runtime := NewRuntimeConfigStore(rc)
 
 	ps := &ProxyServer{
 		loadBalancer: lb,
 		logger:       logger,
-		client:       client,
-		httpClient:   httpClient,
+		metrics:      metrics,
+		runtime:      runtime,
+		connections:  connections,
+		connLimits:   NewConnLimiter(),
+		clients:      clients,
 		proxyConfig:  proxyConfig,
 		corsConfig:   corsConfig,
+		filters:      &filterChain{},
+		listening:    make(chan struct{}),
 	}
 
 	// Initialize WebSocket handler if enabled
 	if proxyConfig.EnableWebSocket {
-		ps.websocketHandler = NewWebSocketHandler(wsLB, logger, proxyConfig)
+		ps.websocketHandler = NewWebSocketHandler(wsLB, logger, metrics, connections, proxyConfig)
 		logger.Info("WebSocket handler enabled")
 	}
 
 	// Initialize HTTP handler
-	ps.httpHandler = NewHTTPHandler(lb, client, httpClient, logger, proxyConfig, corsConfig)
+	ps.httpHandler = NewHTTPHandler(lb, clients, logger, metrics, runtime, ps.filters)
 
 	// Initialize HTTP/2 and HTTP/3 server if enabled
 	if proxyConfig.EnableHTTP2 || proxyConfig.EnableHTTP3 {
-		ps.http2http3Server = NewHTTP2HTTP3Server(lb, logger, proxyConfig)
+		ps.http2http3Server = NewHTTP2HTTP3Server(lb, clients, logger, metrics, runtime, proxyConfig, ps.filters)
 		logger.Info("HTTP/2 and HTTP/3 support enabled")
 	}
 
 	// Start health check
-	lb.StartHealthCheck()
+	lb.StartHealthCheck(newUpstreamResolver(proxyConfig))
 
 	return ps
 }
@@ -106,19 +84,19 @@ func (ps *ProxyServer) OnBoot(eng gnet.Engine) gnet.Action {
 	ps.engine = eng
 	ps.engineSet = true
 	ps.mu.Unlock()
+	ps.markListening()
 	
 	ps.logger.Info("Proxy server started")
 	
 	// Start HTTP/2 server if enabled
 	if ps.http2http3Server != nil && ps.proxyConfig.EnableHTTP2 {
 		go func() {
-			if ps.proxyConfig.TLSCertFile != "" && ps.proxyConfig.TLSKeyFile != "" {
-				addr := "0.0.0.0:8443"
-				if err := ps.http2http3Server.StartHTTP2Server(addr); err != nil {
+			if (ps.proxyConfig.TLSCertFile != "" && ps.proxyConfig.TLSKeyFile != "") || ps.proxyConfig.EnableH2C {
+				if err := ps.http2http3Server.StartHTTP2Server(http2Address); err != nil {
 					ps.logger.Error("Failed to start HTTP/2 server", zap.Error(err))
 				}
 			} else {
-				ps.logger.Warn("HTTP/2 enabled but TLS certificates not configured")
+				ps.logger.Warn("HTTP/2 enabled but TLS certificates not configured; set enable_h2c for cleartext HTTP/2")
 			}
 		}()
 	}
@@ -141,10 +119,82 @@ func (ps *ProxyServer) OnBoot(eng gnet.Engine) gnet.Action {
 
 func (ps *ProxyServer) OnOpen(c gnet.Conn) ([]byte, gnet.Action) {
 	ps.logger.Debug("New connection opened", zap.String("remote", c.RemoteAddr().String()))
+	ps.metrics.ConnectionOpened()
+	proxyConfig := ps.runtime.Load().Proxy
+
+	// A new connection has to send its first request headers in time
+	cc := &connContext{
+		tracked:  ps.connections.Track(c.RemoteAddr().String(), "HTTP/1.1", c.Close),
+		deadline: newReadDeadline(time.Now().Add(proxyConfig.HeaderReadTimeout), c.Close),
+		remote:   c.RemoteAddr().String(),
+		closed:   make(chan struct{}),
+	}
+	c.SetContext(cc)
+
+	// Behind a PROXY protocol balancer, the client is only known from the header
+	if ps.proxyConfig.ProxyProtocol {
+		cc.proxyHeader = true
+		return nil, gnet.None
+	}
+	if !ps.admitClient(cc) {
+		return nil, gnet.Close
+	}
 	return nil, gnet.None
 }
 
+// admitClient counts the connection against the per-IP limit of its client;
+// connections beyond it are closed right away
+func (ps *ProxyServer) admitClient(cc *connContext) bool {
+	ip := clientIP(cc.remote)
+	if !ps.connLimits.Acquire(ip, ps.runtime.Load().Proxy.MaxConnectionsPerIP) {
+		ps.logger.Debug("Connection limit per IP reached", zap.String("remote", cc.remote))
+		return false
+	}
+	cc.clientIP = ip
+	return true
+}
+
+// readProxyHeader reads the PROXY protocol header a connection starts with and
+// admits the client it names. It reports whether request bytes follow.
+func (ps *ProxyServer) readProxyHeader(c gnet.Conn, cc *connContext) (gnet.Action, bool) {
+	data, _ := c.Peek(-1)
+	remote, n, err := parseProxyHeader(data)
+	if err != nil {
+		ps.logger.Debug("Invalid PROXY protocol header", zap.String("remote", c.RemoteAddr().String()))
+		return gnet.Close, false
+	}
+	if n == 0 {
+		return gnet.None, false
+	}
+	c.Discard(n)
+	cc.proxyHeader = false
+
+	if remote.IsValid() {
+		cc.remote = remote.String()
+		cc.tracked.SetRemote(cc.remote)
+	}
+	if !ps.admitClient(cc) {
+		return gnet.Close, false
+	}
+	return gnet.None, c.InboundBuffered() > 0
+}
+
 func (ps *ProxyServer) OnClose(c gnet.Conn, err error) gnet.Action {
+	ps.metrics.ConnectionClosed()
+	if cc, ok := c.Context().(*connContext); ok {
+		ps.connections.Untrack(cc.tracked)
+		cc.deadline.Stop()
+		if cc.clientIP != "" {
+			ps.connLimits.Release(cc.clientIP)
+		}
+		if cc.tunnel != nil {
+			cc.tunnel.Close()
+		}
+		if cc.stream != nil && cc.stream.upload != nil {
+			cc.stream.upload.abort(errUploadAborted)
+		}
+		close(cc.closed)
+	}
 	if err != nil {
 		// These errors are normal when client closes connection
 		errorMsg := err.Error()
@@ -170,6 +220,26 @@ func (ps *ProxyServer) OnShutdown(eng gnet.Engine) {
 	ps.logger.Info("Proxy server shutting down")
 }
 
+// DrainWebSockets asks open WebSocket sessions to close and waits for them, up
+// to the drain timeout, before the listeners are shut down
+func (ps *ProxyServer) DrainWebSockets(ctx context.Context) {
+	if ps.websocketHandler == nil || ps.websocketHandler.websocketProxy == nil {
+		return
+	}
+	ps.websocketHandler.websocketProxy.Drain(ctx, ps.runtime.Load().Proxy.WebSocketDrainTimeout)
+}
+
+// markListening records that the server's listener is bound, by the gnet engine
+// or the net/http server
+func (ps *ProxyServer) markListening() {
+	ps.listeningOnce.Do(func() { close(ps.listening) })
+}
+
+// Listening returns a channel closed once the server's listener is bound
+func (ps *ProxyServer) Listening() <-chan struct{} {
+	return ps.listening
+}
+
 func (ps *ProxyServer) Shutdown(ctx context.Context) error {
 	ps.logger.Info("Starting proxy server shutdown")
 	
@@ -205,20 +275,41 @@ func (ps *ProxyServer) Shutdown(ctx context.Context) error {
 		}
 	}
 	
-	// Close fasthttp client connections
-	if ps.client != nil {
-		ps.client.CloseIdleConnections()
-	}
-	
-	// Close HTTP client connections
-	if ps.httpClient != nil {
-		ps.httpClient.CloseIdleConnections()
+	// Close upstream client connections
+	if ps.clients != nil {
+		ps.clients.CloseIdleConnections()
 	}
 	
 	ps.logger.Info("Proxy server shutdown completed")
 	return nil
 }
 
+// Cache returns the response cache of the server, nil when it caches nothing
+func (ps *ProxyServer) Cache() *ResponseCache {
+	return ps.runtime.Load().Cache
+}
+
+// Maintenance returns the server's maintenance mode
+func (ps *ProxyServer) Maintenance() *maintenanceMode {
+	return ps.runtime.Load().Maintenance
+}
+
+// Router returns the routes of the server
+func (ps *ProxyServer) Router() *Router {
+	return ps.runtime.Load().Router
+}
+
+// Reload atomically replaces the routes and request limits used for new requests.
+// Listener, TLS and connection pool settings keep their startup values until restart.
+// Unchanged rate limits keep their limiters, so clients don't get a fresh burst,
+// and unchanged traffic splits and maintenance modes keep what was set through
+// the admin API.
+func (ps *ProxyServer) Reload(rc *RuntimeConfig) {
+	rc.inheritState(ps.runtime.Load())
+	ps.runtime.Store(rc)
+	ps.logger.Info("Proxy configuration reloaded")
+}
+
 func (ps *ProxyServer) OnTick() (delay time.Duration, action gnet.Action) {
 	return time.Second, gnet.None
 }
@@ -238,7 +329,44 @@ func (ps *ProxyServer) HandleWebSocketHTTP(w http.ResponseWriter, r *http.Reques
 		http.Error(w, "WebSocket proxy not initialized", http.StatusInternalServerError)
 		return
 	}
-	
+
+	rc := ps.runtime.Load()
+	if !normalizeRequestURL(r, rc.Proxy.PathNormalization) {
+		ps.logger.Debug("Request path rejected", zap.String("uri", r.RequestURI))
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	route := rc.Router.Match(r.URL.Path)
+	ip := clientIP(r.RemoteAddr)
+	if !rc.AllowClient(route, ip) {
+		ps.logger.Debug("Client IP rejected by access list", zap.String("remote", r.RemoteAddr))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if maintenance := rc.MaintenanceFor(route, ip); maintenance != nil {
+		maintenance.write(w)
+		return
+	}
+	if !rc.UserAgents.Allowed(r.UserAgent()) {
+		ps.logger.Debug("User agent rejected", zap.String("remote", r.RemoteAddr), zap.String("user_agent", r.UserAgent()))
+		status, body := rc.UserAgents.Rejection()
+		http.Error(w, body, status)
+		return
+	}
+
+	// WebSocket upgrades have their own rate limits
+	if allowed, retryAfter := rc.RateLimit.AllowWebSocket(ip); !allowed {
+		ps.logger.Debug("WebSocket rate limit exceeded", zap.String("remote", r.RemoteAddr))
+		writeTooManyRequests(w, retryAfter)
+		return
+	}
+
+	// The same checks as other requests; browsers cannot set headers on WebSocket
+	// handshakes, so API keys usually come in the query
+	if !rc.authenticate(w, r, route) {
+		return
+	}
+
 	ps.websocketHandler.HandleWebSocketHTTP(w, r)
 }
 
@@ -252,16 +380,73 @@ func (ps *ProxyServer) HandleHTTPProxy(w http.ResponseWriter, r *http.Request) {
 	ps.httpHandler.HandleHTTPProxy(w, r)
 }
 
-func (ps *ProxyServer) OnTraffic(c gnet.Conn) gnet.Action {
+func (ps *ProxyServer) OnTraffic(c gnet.Conn) (action gnet.Action) {
+	defer ps.recoverTraffic(c, &action)
+	cc, _ := c.Context().(*connContext)
+
+	if cc != nil && cc.proxyHeader {
+		if action, more := ps.readProxyHeader(c, cc); !more {
+			return action
+		}
+	}
+
+	// Upgraded WebSocket connections only relay bytes to their upstream
+	if cc != nil && cc.tunnel != nil {
+		return cc.tunnel.relay(c)
+	}
+
+	// While an exchange is streamed, the client's bytes are the upload's body or
+	// wait in the buffer as the next request
+	if cc != nil && cc.stream != nil {
+		if cc.stream.upload != nil {
+			cc.stream.upload.feed(c)
+		}
+		return gnet.None
+	}
+
+	// Requests pipelined behind this one are answered in order, each once it has
+	// arrived in full
+	for {
+		// Wait until the whole request has arrived, within the read deadlines, and
+		// read no further: what follows is the next request
+		requestLen := -1
+		if cc != nil {
+			action, n, ready := ps.awaitRequest(c, cc)
+			if !ready {
+				return action
+			}
+			requestLen = n
+		}
+		action := ps.serveRequest(c, cc, requestLen)
+		if action != gnet.None || cc == nil || cc.tunnel != nil || cc.stream != nil || c.InboundBuffered() == 0 {
+			return action
+		}
+	}
+}
+
+// serveRequest reads the request of length requestLen from c and answers it
+func (ps *ProxyServer) serveRequest(c gnet.Conn, cc *connContext, requestLen int) gnet.Action {
+	if cc != nil {
+		// Slow upstreams are bounded by their own timeouts, not the client's
+		cc.deadline.Clear()
+		defer func() {
+			// Upgraded connections stay open as long as the WebSocket does, and
+			// streamed exchanges restore the deadline once they are done
+			if cc.tunnel == nil && cc.stream == nil {
+				cc.deadline.Set(time.Now().Add(ps.runtime.Load().Proxy.KeepAliveTimeout))
+			}
+		}()
+	}
+
 	// Read the HTTP request
-	reqData, err := c.Next(-1)
+	reqData, err := c.Next(requestLen)
 	if err != nil {
 		ps.logger.Debug("Failed to read request data", zap.Error(err))
 		return gnet.Close
 	}
 
 	// Check for WebSocket upgrade request
-	if ps.websocketHandler != nil && ps.proxyConfig.EnableWebSocket {
+	if ps.websocketHandler != nil && ps.proxyConfig.EnableWebSocket && cc != nil {
 		// Parse headers to check for WebSocket upgrade
 		headers := make(map[string]string)
 		// Simple header parsing for WebSocket detection
@@ -275,13 +460,9 @@ func (ps *ProxyServer) OnTraffic(c gnet.Conn) gnet.Action {
 			}
 		}
 		
-		if ps.websocketHandler.IsWebSocketRequestFromHeaders(headers) {
+		if ps.websocketHandler.IsWebSocketRequestFromHeaders(headers) && ps.httpHandler != nil {
 			ps.logger.Debug("WebSocket upgrade request detected")
-			// Note: WebSocket handling would require a different approach
-			// as gnet doesn't directly support HTTP upgrade protocol
-			// This is a limitation that would need to be addressed
-			ps.sendErrorResponse(c, fasthttp.StatusNotImplemented, "WebSocket upgrade not supported in gnet mode")
-			return gnet.None
+			return ps.httpHandler.HandleWebSocketTraffic(c, cc, reqData, ps.websocketHandler.websocketProxy)
 		}
 	}
 
@@ -303,6 +484,88 @@ func (ps *ProxyServer) OnTraffic(c gnet.Conn) gnet.Action {
 
 
 
+// awaitRequest checks whether the buffered data holds a complete request, and
+// returns its length, or -1 when its body is streamed and the request is read
+// up to what has arrived. While the request is incomplete, the connection gets
+// header_read_timeout to finish the headers and then body_read_timeout for the
+// body, both capped by request_read_timeout from the first byte, so clients
+// trickling a request byte by byte are cut off.
+func (ps *ProxyServer) awaitRequest(c gnet.Conn, cc *connContext) (gnet.Action, int, bool) {
+	data, err := c.Peek(-1)
+	if err != nil {
+		ps.logger.Debug("Failed to read request data", zap.Error(err))
+		return gnet.Close, 0, false
+	}
+	headerLen, bodyLen, requestLen := requestProgress(data)
+	if requestLen >= 0 {
+		cc.readStart = time.Time{}
+		cc.headersRead = time.Time{}
+		cc.continued = false
+		return gnet.None, requestLen, true
+	}
+
+	proxyConfig := ps.runtime.Load().Proxy
+	now := time.Now()
+	if cc.readStart.IsZero() {
+		cc.readStart = now
+	}
+
+	var deadline time.Time
+	if headerLen < 0 {
+		maxHeaderSize := proxyConfig.MaxHeaderSize
+		if maxHeaderSize <= 0 {
+			maxHeaderSize = defaultMaxPendingHeaderSize
+		}
+		if len(data) > maxHeaderSize {
+			cc.reply = replyMode{close: true}
+			ps.sendErrorResponse(c, fasthttp.StatusRequestHeaderFieldsTooLarge, "Request Header Fields Too Large")
+			return gnet.Close, 0, false
+		}
+		deadline = cc.readStart.Add(proxyConfig.HeaderReadTimeout)
+	} else {
+		if bodyLen > proxyConfig.MaxBodySize || int64(len(data)-headerLen) > proxyConfig.MaxBodySize {
+			cc.reply = replyMode{close: true}
+			ps.sendErrorResponse(c, fasthttp.StatusRequestEntityTooLarge, "Request Entity Too Large")
+			return gnet.Close, 0, false
+		}
+		// Chunked and large bodies are streamed to the upstream as they arrive
+		if ps.streamsUpload(proxyConfig, data[:headerLen], bodyLen) {
+			cc.readStart = time.Time{}
+			cc.headersRead = time.Time{}
+			cc.continued = false
+			return gnet.None, -1, true
+		}
+		if cc.headersRead.IsZero() {
+			cc.headersRead = now
+		}
+		// A client waiting on Expect: 100-continue is asked for the body it fits in
+		// max_body_size; a streamed upload is asked once its request is accepted
+		if !cc.continued && len(data) == headerLen && expectsContinue(data[:headerLen]) {
+			if _, err := c.Write(continueResponse); err != nil {
+				return gnet.Close, 0, false
+			}
+			cc.continued = true
+		}
+		deadline = cc.headersRead.Add(proxyConfig.BodyReadTimeout)
+	}
+	if total := cc.readStart.Add(proxyConfig.RequestReadTimeout); total.Before(deadline) {
+		deadline = total
+	}
+	cc.deadline.Set(deadline)
+	return gnet.None, 0, false
+}
+
+// streamsUpload reports whether a request body is forwarded while it arrives: it
+// is chunked, or longer than stream_threshold when stream_bodies is on, and its
+// route does not verify signatures, which cover the whole body
+func (ps *ProxyServer) streamsUpload(p ProxyConfig, head []byte, bodyLen int64) bool {
+	if bodyLen >= 0 && (!p.StreamBodies || bodyLen <= p.StreamThreshold) {
+		return false
+	}
+	rc := ps.runtime.Load()
+	return !rc.Signatures.Required(rc.Router.Match(requestPath(head)))
+}
+
 func (ps *ProxyServer) sendErrorResponse(c gnet.Conn, statusCode int, message string) {
 	if ps.httpHandler != nil {
 		ps.httpHandler.sendErrorResponse(c, statusCode, message)
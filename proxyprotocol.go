@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An L4 balancer such as AWS NLB or HAProxy in TCP mode hides the client's
+// address from the proxy unless it starts each connection with a PROXY
+// protocol header (https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt)
+// carrying it. Listeners with proxy_protocol enabled require one, in either the
+// text (v1) or the binary (v2) form.
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyV1MaxLen is the longest v1 header, CRLF included
+const proxyV1MaxLen = 107
+
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+// parseProxyHeader parses the PROXY protocol header at the start of data. It
+// returns the client address the header carries, the zero AddrPort when the
+// balancer opened the connection on its own behalf (such as for a health
+// check), and the header's length, 0 while data holds only part of it.
+func parseProxyHeader(data []byte) (netip.AddrPort, int, error) {
+	switch {
+	case bytes.HasPrefix(data, proxyV2Signature):
+		return parseProxyV2(data)
+	case bytes.HasPrefix(data, proxyV1Prefix):
+		return parseProxyV1(data)
+	case bytes.HasPrefix(proxyV2Signature, data), bytes.HasPrefix(proxyV1Prefix, data):
+		// Too short to tell yet
+		return netip.AddrPort{}, 0, nil
+	}
+	return netip.AddrPort{}, 0, errProxyHeader
+}
+
+// parseProxyV1 parses a text header: "PROXY TCP4 src dst sport dport\r\n"
+func parseProxyV1(data []byte) (netip.AddrPort, int, error) {
+	end := bytes.Index(data, []byte("\r\n"))
+	if end < 0 {
+		if len(data) >= proxyV1MaxLen {
+			return netip.AddrPort{}, 0, errProxyHeader
+		}
+		return netip.AddrPort{}, 0, nil
+	}
+	n := end + 2
+	if n > proxyV1MaxLen {
+		return netip.AddrPort{}, 0, errProxyHeader
+	}
+
+	fields := strings.Split(string(data[:end]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return netip.AddrPort{}, n, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return netip.AddrPort{}, 0, errProxyHeader
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil || addr.Is4() != (fields[1] == "TCP4") {
+		return netip.AddrPort{}, 0, errProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, 0, errProxyHeader
+	}
+	return netip.AddrPortFrom(addr, uint16(port)), n, nil
+}
+
+// parseProxyV2 parses a binary header: the signature, version and command,
+// address family, the length of the rest, then the addresses and TLVs, which
+// are skipped
+func parseProxyV2(data []byte) (netip.AddrPort, int, error) {
+	if len(data) < 16 {
+		return netip.AddrPort{}, 0, nil
+	}
+	if data[12]>>4 != 2 {
+		return netip.AddrPort{}, 0, errProxyHeader
+	}
+	n := 16 + int(binary.BigEndian.Uint16(data[14:16]))
+	if len(data) < n {
+		return netip.AddrPort{}, 0, nil
+	}
+
+	switch data[12] & 0x0f {
+	case 0x0: // LOCAL
+		return netip.AddrPort{}, n, nil
+	case 0x1: // PROXY
+	default:
+		return netip.AddrPort{}, 0, errProxyHeader
+	}
+
+	addrs := data[16:n]
+	switch data[13] >> 4 {
+	case 0x1: // AF_INET
+		if len(addrs) < 12 {
+			return netip.AddrPort{}, 0, errProxyHeader
+		}
+		addr := netip.AddrFrom4([4]byte(addrs[0:4]))
+		return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(addrs[8:10])), n, nil
+	case 0x2: // AF_INET6
+		if len(addrs) < 36 {
+			return netip.AddrPort{}, 0, errProxyHeader
+		}
+		addr := netip.AddrFrom16([16]byte(addrs[0:16])).Unmap()
+		return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(addrs[32:34])), n, nil
+	}
+	// Unix sockets and unspecified families carry no client IP
+	return netip.AddrPort{}, n, nil
+}
+
+// readProxyHeader reads the PROXY protocol header from the start of a
+// connection, leaving what follows it in br
+func readProxyHeader(br *bufio.Reader) (netip.AddrPort, error) {
+	size := 1
+	for {
+		data, err := br.Peek(size)
+		remote, n, perr := parseProxyHeader(data)
+		if perr != nil {
+			return netip.AddrPort{}, perr
+		}
+		if n > 0 {
+			_, err = br.Discard(n)
+			return remote, err
+		}
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		size = max(len(data)+1, br.Buffered())
+	}
+}
+
+// proxyProtocolListener accepts the connections of a net/http server once their
+// PROXY protocol header has been read, which happens on a goroutine of its own
+// per connection so that a slow client cannot hold up the others
+type proxyProtocolListener struct {
+	net.Listener
+	timeout time.Duration
+
+	ready chan net.Conn
+	done  chan struct{} // closed once the listener fails or is closed
+	err   error         // why, set before done is closed
+}
+
+// listenTCP opens the listener of a net/http server for the proxy settings p
+func listenTCP(addr string, p ProxyConfig) (net.Listener, error) {
+	ln, err := listenHandover("tcp", addr, func() (net.Listener, error) {
+		return net.Listen("tcp", addr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return withProxyProtocol(ln, p), nil
+}
+
+// withProxyProtocol returns ln, reading the PROXY protocol header of each
+// connection first when p requires one
+func withProxyProtocol(ln net.Listener, p ProxyConfig) net.Listener {
+	if !p.ProxyProtocol {
+		return ln
+	}
+	l := &proxyProtocolListener{
+		Listener: ln,
+		timeout:  p.HeaderReadTimeout,
+		ready:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.ready:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *proxyProtocolListener) acceptLoop() {
+	defer close(l.done)
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				l.err = err
+				return
+			}
+			// Transient failures, such as running out of file descriptors
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		go l.handshake(conn)
+	}
+}
+
+// handshake reads the header of a new connection and hands it to Accept
+func (l *proxyProtocolListener) handshake(conn net.Conn) {
+	if l.timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(l.timeout))
+	}
+	br := bufio.NewReader(conn)
+	remote, err := readProxyHeader(br)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	pc := &proxiedConn{Conn: conn, reader: br}
+	if remote.IsValid() {
+		pc.remote = net.TCPAddrFromAddrPort(remote)
+	}
+	select {
+	case l.ready <- pc:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// proxiedConn is a connection whose PROXY protocol header has been read
+type proxiedConn struct {
+	net.Conn
+	reader *bufio.Reader // holds whatever arrived after the header
+	remote net.Addr      // the client's address, nil when the header had none
+}
+
+func (c *proxiedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
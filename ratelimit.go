@@ -0,0 +1,198 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitSweepInterval is how often idle client buckets are dropped
+const rateLimitSweepInterval = time.Minute
+
+// globalBucketKey is the single bucket key of limits shared by all clients
+const globalBucketKey = ""
+
+// RateLimiter enforces the rate_limit section of a server: limits on HTTP requests
+// and separate limits on WebSocket upgrades
+type RateLimiter struct {
+	config    RateLimitConfig
+	requests  *ruleLimiter
+	websocket *ruleLimiter
+}
+
+// NewRateLimiter creates a limiter, or returns nil when rate limiting is disabled.
+// A nil limiter allows every request.
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &RateLimiter{
+		config:    cfg,
+		requests:  newRuleLimiter(cfg.RateLimitRule),
+		websocket: newRuleLimiter(cfg.WebSocket),
+	}
+}
+
+// Config returns the settings the limiter was created with
+func (rl *RateLimiter) Config() RateLimitConfig {
+	if rl == nil {
+		return RateLimitConfig{}
+	}
+	return rl.config
+}
+
+// Allow takes a token for an HTTP request of the client IP. When a bucket is
+// empty it reports false and how long the client should wait before retrying.
+func (rl *RateLimiter) Allow(ip string) (bool, time.Duration) {
+	if rl == nil {
+		return true, 0
+	}
+	return rl.requests.Allow(ip)
+}
+
+// AllowWebSocket takes a token for a WebSocket upgrade of the client IP
+func (rl *RateLimiter) AllowWebSocket(ip string) (bool, time.Duration) {
+	if rl == nil {
+		return true, 0
+	}
+	return rl.websocket.Allow(ip)
+}
+
+// AllowRequest applies the server's and then the route's rate limits to a client IP
+func (rc *RuntimeConfig) AllowRequest(route *Route, ip string) (bool, time.Duration) {
+	if allowed, retryAfter := rc.RateLimit.Allow(ip); !allowed {
+		return false, retryAfter
+	}
+	return route.AllowRequest(ip)
+}
+
+// ruleLimiter enforces a RateLimitRule: a bucket per client IP and one shared bucket
+type ruleLimiter struct {
+	perClient *tokenBuckets
+	global    *tokenBuckets
+}
+
+// newRuleLimiter returns nil when the rule sets no limit
+func newRuleLimiter(rule RateLimitRule) *ruleLimiter {
+	if rule.IsZero() {
+		return nil
+	}
+	return &ruleLimiter{
+		perClient: newTokenBuckets(rule.RequestsPerSecond, rule.Burst),
+		global:    newTokenBuckets(rule.GlobalRequestsPerSecond, rule.GlobalBurst),
+	}
+}
+
+// Allow checks the client's bucket first, so a single client cannot drain the shared one
+func (l *ruleLimiter) Allow(ip string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	if allowed, retryAfter := l.perClient.Take(ip); !allowed {
+		return false, retryAfter
+	}
+	return l.global.Take(globalBucketKey)
+}
+
+// tokenBuckets is a set of token buckets with the same rate and capacity
+type tokenBuckets struct {
+	rate  float64 // tokens added per second
+	burst float64 // bucket capacity
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// tokenBucket is the state of one key
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBuckets returns nil for a zero rate; burst defaults to the rate
+func newTokenBuckets(requestsPerSecond float64, burst int) *tokenBuckets {
+	if requestsPerSecond <= 0 {
+		return nil
+	}
+	capacity := float64(burst)
+	if capacity < 1 {
+		capacity = math.Max(1, math.Ceil(requestsPerSecond))
+	}
+	return &tokenBuckets{
+		rate:      requestsPerSecond,
+		burst:     capacity,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Take takes a token from the key's bucket, or reports how long until one is available
+func (tb *tokenBuckets) Take(key string) (bool, time.Duration) {
+	if tb == nil {
+		return true, 0
+	}
+
+	now := time.Now()
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.sweep(now)
+
+	bucket, ok := tb.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: tb.burst, last: now}
+		tb.buckets[key] = bucket
+	} else {
+		bucket.tokens = math.Min(tb.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*tb.rate)
+		bucket.last = now
+	}
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / tb.rate * float64(time.Second))
+}
+
+// sweep drops buckets that have refilled completely, they behave exactly like new ones
+func (tb *tokenBuckets) sweep(now time.Time) {
+	if now.Sub(tb.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	tb.lastSweep = now
+
+	refill := time.Duration(tb.burst / tb.rate * float64(time.Second))
+	for key, bucket := range tb.buckets {
+		if now.Sub(bucket.last) >= refill {
+			delete(tb.buckets, key)
+		}
+	}
+}
+
+// clientIP returns the IP part of a remote address
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// retryAfterSeconds formats a wait time as a Retry-After value in whole seconds (at least 1)
+func retryAfterSeconds(wait time.Duration) string {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.Itoa(seconds)
+}
+
+// writeTooManyRequests rejects a net/http request with 429 and a Retry-After hint
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+}
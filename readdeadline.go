@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// defaultMaxPendingHeaderSize bounds the headers buffered while waiting for the
+// end of the header block when max_header_size is not set
+const defaultMaxPendingHeaderSize = 64 << 10
+
+// readDeadline closes a gnet connection that doesn't make progress in time. The
+// event loop moves the deadline as a request arrives; a timer closes the
+// connection once it passes. The timer runs outside the event loop, so the
+// deadline is kept in an atomic and checked again when the timer fires.
+type readDeadline struct {
+	deadline atomic.Int64 // unix nanoseconds, 0 while a request is being served
+	timer    *time.Timer
+}
+
+// newReadDeadline starts a deadline that calls closeFn when it expires
+func newReadDeadline(at time.Time, closeFn func() error) *readDeadline {
+	d := &readDeadline{}
+	d.deadline.Store(at.UnixNano())
+	d.timer = time.AfterFunc(time.Until(at), func() {
+		deadline := d.deadline.Load()
+		if deadline == 0 {
+			return
+		}
+		if remaining := time.Until(time.Unix(0, deadline)); remaining > 0 {
+			d.timer.Reset(remaining)
+			return
+		}
+		closeFn()
+	})
+	return d
+}
+
+// Set moves the deadline
+func (d *readDeadline) Set(at time.Time) {
+	d.deadline.Store(at.UnixNano())
+	d.timer.Reset(time.Until(at))
+}
+
+// Clear suspends the deadline while the proxy itself is busy with the request
+func (d *readDeadline) Clear() {
+	d.deadline.Store(0)
+}
+
+// Stop releases the timer once the connection is closed
+func (d *readDeadline) Stop() {
+	d.timer.Stop()
+}
+
+// requestPath returns the path in the request line of an HTTP/1.x request
+func requestPath(data []byte) string {
+	line, _, _ := bytes.Cut(data, []byte("\r\n"))
+	_, target, _ := bytes.Cut(line, []byte(" "))
+	target, _, _ = bytes.Cut(target, []byte(" "))
+	path, _, _ := bytes.Cut(target, []byte("?"))
+	return string(path)
+}
+
+// continueResponse is the interim response that asks a client waiting on
+// Expect: 100-continue to send its body
+var continueResponse = []byte("HTTP/1.1 100 Continue\r\n\r\n")
+
+// expectsContinue reports whether the header block of an HTTP/1.1 request asks
+// for 100 Continue before the body is sent. HTTP/1.0 clients never wait for it.
+func expectsContinue(head []byte) bool {
+	lines := bytes.Split(bytes.TrimSuffix(head, []byte("\r\n\r\n")), []byte("\r\n"))
+	if !bytes.HasSuffix(lines[0], []byte(" HTTP/1.1")) {
+		return false
+	}
+	for _, line := range lines[1:] {
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if ok && bytes.EqualFold(name, []byte("Expect")) {
+			return bytes.EqualFold(bytes.TrimSpace(value), []byte("100-continue"))
+		}
+	}
+	return false
+}
+
+// requestProgress reports how much of an HTTP/1.x request has been received:
+// the length of the header block (-1 while incomplete), the declared body
+// length (-1 for chunked bodies) and the length of the whole request (-1 while
+// incomplete). Bytes past it belong to the next request. Malformed framing is
+// reported as a request taking all of data, so the parser rejects it.
+func requestProgress(data []byte) (headerLen int, bodyLen int64, requestLen int) {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		return -1, 0, -1
+	}
+	headerLen = end + 4
+
+	for _, line := range bytes.Split(data[:end], []byte("\r\n"))[1:] {
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok {
+			continue
+		}
+		value = bytes.TrimSpace(value)
+		switch {
+		case bytes.EqualFold(name, []byte("Transfer-Encoding")):
+			if bytes.Contains(bytes.ToLower(value), []byte("chunked")) {
+				bodyLen = -1
+			}
+		case bytes.EqualFold(name, []byte("Content-Length")) && bodyLen == 0:
+			n, err := strconv.ParseInt(string(value), 10, 64)
+			if err != nil || n < 0 {
+				return headerLen, 0, len(data)
+			}
+			bodyLen = n
+		}
+	}
+
+	if bodyLen < 0 {
+		switch n := chunkedLength(data[headerLen:]); {
+		case n == chunkedMalformed:
+			return headerLen, bodyLen, len(data)
+		case n < 0:
+			return headerLen, bodyLen, -1
+		default:
+			return headerLen, bodyLen, headerLen + n
+		}
+	}
+	if int64(len(data)-headerLen) < bodyLen {
+		return headerLen, bodyLen, -1
+	}
+	return headerLen, bodyLen, headerLen + int(bodyLen)
+}
+
+// chunkedMalformed is returned by chunkedLength for a body with broken chunk framing
+const chunkedMalformed = -2
+
+// chunkedLength returns the length of the chunked body at the start of data, up
+// to the empty line after its trailers, or -1 while it is incomplete
+func chunkedLength(data []byte) int {
+	crlf := []byte("\r\n")
+	pos := 0
+	for {
+		line := bytes.Index(data[pos:], crlf)
+		if line < 0 {
+			return -1
+		}
+		sizeField, _, _ := bytes.Cut(data[pos:pos+line], []byte(";"))
+		size, err := strconv.ParseInt(string(bytes.TrimSpace(sizeField)), 16, 64)
+		if err != nil || size < 0 {
+			return chunkedMalformed
+		}
+		pos += line + 2
+		if size == 0 {
+			break
+		}
+		// Chunk data is followed by CRLF
+		if int64(len(data)-pos-2) < size {
+			return -1
+		}
+		pos += int(size)
+		if !bytes.HasPrefix(data[pos:], crlf) {
+			return chunkedMalformed
+		}
+		pos += 2
+	}
+	// Trailer fields, then an empty line
+	for {
+		line := bytes.Index(data[pos:], crlf)
+		if line < 0 {
+			return -1
+		}
+		pos += line + 2
+		if line == 0 {
+			return pos
+		}
+	}
+}
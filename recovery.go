@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+
+	"github.com/panjf2000/gnet/v2"
+	"go.uber.org/zap"
+)
+
+// requestIDHeader carries the ID a request is logged under when its handling panics
+const requestIDHeader = "X-Request-Id"
+
+// panicResponseBody is the body of the 500 answering a request whose handling panicked
+const panicResponseBody = "Internal Server Error"
+
+// requestID returns the ID a client gave its request, or a new one when it gave none
+func requestID(id string) string {
+	if id == "" {
+		return rand.Text()
+	}
+	return id
+}
+
+// panicWriter records whether a handler started its response, which can no
+// longer be replaced by a 500 once it did
+type panicWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (w *panicWriter) WriteHeader(statusCode int) {
+	// Interim responses leave the final one to be written
+	if statusCode >= 200 {
+		w.wrote = true
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *panicWriter) Write(p []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap returns the wrapped writer, for http.ResponseController
+func (w *panicWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack hands the connection to a WebSocket upgrade, which asserts http.Hijacker
+func (w *panicWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.wrote = true
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// recoverPanics wraps a net/http handler so that a panic answers its request with
+// a 500, is logged with its stack and the request's ID, and is counted in metrics
+// when they are given. A panic after the response started aborts the connection.
+func recoverPanics(next http.Handler, logger *zap.Logger, metrics *ServerMetrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pw := &panicWriter{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			id := requestID(r.Header.Get(requestIDHeader))
+			logger.Error("Panic while handling request",
+				zap.String("request_id", id),
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path),
+				zap.String("remote", r.RemoteAddr),
+				zap.Any("panic", v),
+				zap.ByteString("stack", debug.Stack()))
+			if metrics != nil {
+				metrics.IncPanics()
+			}
+			if pw.wrote {
+				panic(http.ErrAbortHandler)
+			}
+			header := w.Header()
+			clear(header)
+			header.Set(requestIDHeader, id)
+			header.Set("Content-Type", "text/plain; charset=utf-8")
+			header.Set("Content-Length", strconv.Itoa(len(panicResponseBody)))
+			if r.ProtoMajor == 1 {
+				header.Set("Connection", "close")
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(panicResponseBody))
+		}()
+		next.ServeHTTP(pw, r)
+	})
+}
+
+// recoverTraffic is deferred by OnTraffic so that a panic while answering a gnet
+// request does not take the event loop down. The connection, whose state can no
+// longer be trusted, is answered with a 500 and closed.
+func (ps *ProxyServer) recoverTraffic(c gnet.Conn, action *gnet.Action) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	// The request is not parsed at this point, so it gets an ID of its own
+	id := requestID("")
+	ps.logger.Error("Panic while handling request",
+		zap.String("request_id", id),
+		zap.String("remote", c.RemoteAddr().String()),
+		zap.Any("panic", v),
+		zap.ByteString("stack", debug.Stack()))
+	ps.metrics.IncPanics()
+
+	c.Write(panicResponse(id))
+	*action = gnet.Close
+}
+
+// recoverStream is deferred by the goroutine of a streamed exchange, which
+// recoverTraffic does not cover. The client is answered with a 500 when nothing
+// was written to it yet, and the connection is closed once done is called.
+func (h *HTTPHandler) recoverStream(c gnet.Conn, w *clientWriter, done func()) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	id := requestID("")
+	h.logger.Error("Panic while streaming request",
+		zap.String("request_id", id),
+		zap.String("remote", c.RemoteAddr().String()),
+		zap.Any("panic", v),
+		zap.ByteString("stack", debug.Stack()))
+	h.metrics.IncPanics()
+
+	if !w.wrote {
+		w.Write(panicResponse(id))
+	}
+	done()
+	c.Close()
+}
+
+// panicResponse is the raw 500 a gnet connection is answered with before it is
+// closed after a panic
+func panicResponse(id string) []byte {
+	return []byte("HTTP/1.1 500 Internal Server Error\r\n" +
+		requestIDHeader + ": " + id + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Length: " + strconv.Itoa(len(panicResponseBody)) + "\r\n" +
+		"Connection: close\r\n\r\n" + panicResponseBody)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// RuntimeConfig is the part of a server's configuration that can change without a restart
+type RuntimeConfig struct {
+	Router *Router
+	Proxy  ProxyConfig
+	CORS   CORSConfig
+	// SecurityHeaders is nil when the server adds no security headers
+	SecurityHeaders *SecurityHeaders
+	// RateLimit is nil when rate limiting is disabled
+	RateLimit *RateLimiter
+	// Access is nil when the server has no client IP lists
+	Access *IPFilter
+	// UserAgents is nil when the server has no user agent rules
+	UserAgents *UserAgentFilter
+	// APIKeys is nil when the server doesn't require API keys
+	APIKeys *APIKeyAuth
+	// Signatures is nil when the server doesn't verify request signatures
+	Signatures *SignatureVerifier
+	// OAuth2 is nil when the server doesn't require bearer tokens
+	OAuth2 *OAuth2Introspector
+	// TrustedProxies is nil when no proxy in front of the server is trusted
+	TrustedProxies *IPSet
+	// Cache is nil when the server doesn't cache responses
+	Cache *ResponseCache
+	// LoadShedding is nil when the server never sheds load
+	LoadShedding *LoadShedder
+	// Maintenance is never nil, so the admin API can switch it on
+	Maintenance *maintenanceMode
+	// RequestHeaders is nil when the server has no request header rules
+	RequestHeaders *headerRules
+	// ErrorPages is nil when the server answers its errors in plain text
+	ErrorPages *ErrorPages
+}
+
+// NewRuntimeConfig builds the reloadable settings of a server from a validated configuration
+func NewRuntimeConfig(cfg *Config, serverCfg ServerConfig) *RuntimeConfig {
+	// Access lists, user agent patterns, API keys, signature consumers and trusted proxies were checked by Config.Validate,
+	// so parsing cannot fail here
+	access, _ := NewIPFilter(cfg.GetAccessConfig(serverCfg.Name))
+	userAgents, _ := NewUserAgentFilter(cfg.GetUserAgentConfig(serverCfg.Name))
+	apiKeys, _ := NewAPIKeyAuth(cfg.GetAPIKeyConfig(serverCfg.Name))
+	signatures, _ := NewSignatureVerifier(cfg.GetSignatureConfig(serverCfg.Name))
+	proxy := cfg.GetProxyConfig(serverCfg.Name)
+	trustedProxies, _ := NewIPSet(proxy.TrustedProxies)
+
+	// Routes inherit the server's security headers and maintenance page and override them one by one
+	router := NewRouter(serverCfg.Routes)
+	securityHeaders := cfg.GetSecurityHeadersConfig(serverCfg.Name)
+	maintenance := cfg.GetMaintenanceConfig(serverCfg.Name)
+	for _, route := range router.routes {
+		route.securityHeaders = NewSecurityHeaders(securityHeaders.merge(route.config.SecurityHeaders))
+		route.maintenance = newMaintenanceMode(maintenance.merge(route.config.Maintenance))
+	}
+	// Shadow upstreams are looked up among all upstreams, not only the server's
+	for _, route := range router.routes {
+		if name := route.config.Mirror.Upstream; name != "" {
+			upstreams := cfg.GetUpstreamsByNames([]string{name})
+			route.mirror = newTrafficMirror(route.config.Mirror, upstreams[0], proxy)
+		}
+	}
+
+	return &RuntimeConfig{
+		Router:          router,
+		Proxy:           proxy,
+		CORS:            cfg.GetCORSConfig(serverCfg.Name),
+		SecurityHeaders: NewSecurityHeaders(securityHeaders),
+		RateLimit:       NewRateLimiter(cfg.GetRateLimitConfig(serverCfg.Name)),
+		Access:          access,
+		UserAgents:      userAgents,
+		APIKeys:         apiKeys,
+		Signatures:      signatures,
+		OAuth2:          NewOAuth2Introspector(cfg.GetOAuth2Config(serverCfg.Name)),
+		TrustedProxies:  trustedProxies,
+		Cache:           NewResponseCache(cfg.GetCacheConfig(serverCfg.Name), serverCfg.Routes),
+		LoadShedding:    NewLoadShedder(cfg.GetLoadSheddingConfig(serverCfg.Name)),
+		Maintenance:     newMaintenanceMode(maintenance),
+		RequestHeaders:  newHeaderRules(cfg.GetRequestHeadersConfig(serverCfg.Name)),
+		ErrorPages:      NewErrorPages(cfg.GetErrorPagesConfig(serverCfg.Name)),
+	}
+}
+
+// inheritState keeps the rate limit buckets, traffic split weights, traffic
+// mirrors, concurrency slots, maintenance switches, authentication caches and
+// cached responses of the previous configuration for settings that did not
+// change, so a reload does not hand every client a fresh burst, undo a canary
+// rollout or maintenance window, forget the requests in flight, send every token
+// back to the introspection endpoint or every request to the upstreams
+func (rc *RuntimeConfig) inheritState(previous *RuntimeConfig) {
+	if previous == nil {
+		return
+	}
+	rc.Router.InheritRateLimits(previous.Router)
+	rc.Router.InheritSplits(previous.Router)
+	rc.Router.InheritMirrors(previous.Router)
+	rc.Router.InheritConcurrency(previous.Router)
+	rc.LoadShedding.inherit(previous.LoadShedding)
+	rc.inheritMaintenance(previous)
+	if rc.RateLimit.Config() == previous.RateLimit.Config() {
+		rc.RateLimit = previous.RateLimit
+	}
+	if reflect.DeepEqual(rc.APIKeys.Config(), previous.APIKeys.Config()) {
+		rc.APIKeys = previous.APIKeys
+	}
+	if reflect.DeepEqual(rc.OAuth2.Config(), previous.OAuth2.Config()) {
+		rc.OAuth2 = previous.OAuth2
+	}
+	if reflect.DeepEqual(rc.Cache.Config(), previous.Cache.Config()) {
+		rc.Cache = previous.Cache
+	}
+}
+
+// RuntimeConfigStore publishes RuntimeConfig snapshots to request handlers.
+// Handlers load the snapshot once per request so a reload never mixes old and new settings.
+type RuntimeConfigStore struct {
+	current atomic.Pointer[RuntimeConfig]
+}
+
+// NewRuntimeConfigStore creates a store holding the initial configuration
+func NewRuntimeConfigStore(rc *RuntimeConfig) *RuntimeConfigStore {
+	store := &RuntimeConfigStore{}
+	store.current.Store(rc)
+	return store
+}
+
+// Load returns the current configuration snapshot
+func (s *RuntimeConfigStore) Load() *RuntimeConfig {
+	return s.current.Load()
+}
+
+// Store replaces the configuration snapshot
+func (s *RuntimeConfigStore) Store(rc *RuntimeConfig) {
+	s.current.Store(rc)
+}
+
+// reloadFromDisk re-reads the configuration selected on the command line, applies it
+// and logs what changed
+func reloadFromDisk(manager *MultiServerManager, logger *zap.Logger) ([]ConfigChange, error) {
+	cfg, err := loadConfiguration()
+	if err != nil {
+		logger.Error("Reload failed to load configuration", zap.Error(err))
+		return nil, err
+	}
+	logConfigWarnings(cfg, logger)
+
+	previous := manager.Config()
+	if err := manager.Reload(cfg, logger); err != nil {
+		logger.Error("Reload rejected configuration", zap.Error(err))
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	changes := DiffConfigs(previous, cfg)
+	for _, change := range changes {
+		logger.Info("Configuration changed",
+			zap.String("change", change.Kind()),
+			zap.String("path", change.Path),
+			zap.Any("old", change.Old),
+			zap.Any("new", change.New))
+	}
+	return changes, nil
+}
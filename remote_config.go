@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// remoteFetchTimeout bounds a single (non-blocking) fetch from the remote backend
+const remoteFetchTimeout = 10 * time.Second
+
+// consulWaitTime is how long a Consul blocking query waits for a change
+const consulWaitTime = 55 * time.Second
+
+// RemoteConfigSource reads configuration files stored under a KV prefix.
+// Every key below the prefix is a file, e.g. <prefix>/global.toml and <prefix>/api.toml.
+type RemoteConfigSource interface {
+	// Fetch returns the files keyed by their path relative to the prefix.
+	// waitIndex > 0 asks backends supporting it to block until the data changes past that index.
+	Fetch(ctx context.Context, waitIndex uint64) (files map[string][]byte, index uint64, err error)
+	// Blocking reports whether Fetch waits for changes itself
+	Blocking() bool
+	String() string
+}
+
+// NewRemoteConfigSource parses a consul://host:port/prefix or etcd://host:port/prefix URL
+func NewRemoteConfigSource(rawURL string) (RemoteConfigSource, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote config URL: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("remote config URL %q has no host", rawURL)
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if prefix == "" {
+		return nil, fmt.Errorf("remote config URL %q has no key prefix", rawURL)
+	}
+
+	client := &http.Client{Timeout: consulWaitTime + remoteFetchTimeout}
+	switch u.Scheme {
+	case "consul":
+		return &consulSource{
+			endpoint: "http://" + u.Host,
+			prefix:   prefix,
+			token:    os.Getenv("CONSUL_HTTP_TOKEN"),
+			client:   client,
+		}, nil
+	case "etcd":
+		return &etcdSource{endpoint: "http://" + u.Host, prefix: prefix, client: client}, nil
+	default:
+		return nil, fmt.Errorf("unsupported remote config backend %q (use consul:// or etcd://)", u.Scheme)
+	}
+}
+
+// consulSource reads the Consul KV store over its HTTP API
+type consulSource struct {
+	endpoint string
+	prefix   string
+	token    string
+	client   *http.Client
+}
+
+func (s *consulSource) String() string { return "consul " + s.endpoint + "/" + s.prefix }
+func (s *consulSource) Blocking() bool { return true }
+
+func (s *consulSource) Fetch(ctx context.Context, waitIndex uint64) (map[string][]byte, uint64, error) {
+	query := url.Values{"recurse": {"true"}}
+	if waitIndex > 0 {
+		query.Set("index", strconv.FormatUint(waitIndex, 10))
+		query.Set("wait", consulWaitTime.String())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		s.endpoint+"/v1/kv/"+s.prefix+"/?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if s.token != "" {
+		req.Header.Set("X-Consul-Token", s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if resp.StatusCode == http.StatusNotFound {
+		return map[string][]byte{}, index, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul returned %s", resp.Status)
+	}
+
+	var entries []struct {
+		Key   string
+		Value []byte // base64 in JSON, decoded by encoding/json
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode consul response: %w", err)
+	}
+
+	files := make(map[string][]byte, len(entries))
+	for _, entry := range entries {
+		files[strings.TrimPrefix(entry.Key, s.prefix+"/")] = entry.Value
+	}
+	return files, index, nil
+}
+
+// etcdSource reads etcd v3 through its JSON gRPC gateway
+type etcdSource struct {
+	endpoint string
+	prefix   string
+	client   *http.Client
+}
+
+func (s *etcdSource) String() string { return "etcd " + s.endpoint + "/" + s.prefix }
+func (s *etcdSource) Blocking() bool { return false }
+
+func (s *etcdSource) Fetch(ctx context.Context, _ uint64) (map[string][]byte, uint64, error) {
+	// Range over every key starting with "<prefix>/": range_end is the prefix with its last byte incremented
+	key := []byte(s.prefix + "/")
+	rangeEnd := append([]byte(nil), key...)
+	rangeEnd[len(rangeEnd)-1]++
+
+	body, _ := json.Marshal(map[string]string{
+		"key":       base64.StdEncoding.EncodeToString(key),
+		"range_end": base64.StdEncoding.EncodeToString(rangeEnd),
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint+"/v3/kv/range", bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("etcd returned %s", resp.Status)
+	}
+
+	var result struct {
+		Header struct {
+			Revision string `json:"revision"`
+		} `json:"header"`
+		Kvs []struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode etcd response: %w", err)
+	}
+
+	files := make(map[string][]byte, len(result.Kvs))
+	for _, kv := range result.Kvs {
+		files[strings.TrimPrefix(string(kv.Key), s.prefix+"/")] = kv.Value
+	}
+	revision, _ := strconv.ParseUint(result.Header.Revision, 10, 64)
+	return files, revision, nil
+}
+
+// fetchRemoteFiles reads the configuration files from the remote backend once
+func fetchRemoteFiles(source RemoteConfigSource) (map[string][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteFetchTimeout)
+	defer cancel()
+
+	files, _, err := source.Fetch(ctx, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch configuration from %s: %w", source, err)
+	}
+	if _, ok := files["global.toml"]; !ok {
+		return nil, fmt.Errorf("no global.toml under %s", source)
+	}
+	return files, nil
+}
+
+// loadRemoteFiles loads fetched files through the regular multi-file loader by
+// writing them to a temporary directory, so includes and server files behave
+// exactly as they do on disk
+func loadRemoteFiles(files map[string][]byte, overrides ConfigOverrides) (*Config, error) {
+	dir, err := os.MkdirTemp("", "surikiti-remote-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range files {
+		// Keys ending in "/" are folders; keep everything inside the temporary directory
+		if name == "" || strings.HasSuffix(name, "/") {
+			continue
+		}
+		clean := path.Clean("/" + name)[1:]
+		if clean == "" || clean != name {
+			return nil, fmt.Errorf("invalid remote configuration key %q", name)
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(clean))
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(target, content, 0o600); err != nil {
+			return nil, err
+		}
+	}
+
+	return LoadMultiFileConfig(dir, overrides)
+}
+
+// remoteFilesDigest fingerprints a set of files to detect changes
+func remoteFilesDigest(files map[string][]byte) [sha256.Size]byte {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(hash, "%s\x00%d\x00", name, len(files[name]))
+		hash.Write(files[name])
+	}
+	var digest [sha256.Size]byte
+	copy(digest[:], hash.Sum(nil))
+	return digest
+}
+
+// RemoteConfigWatcher signals when the configuration stored in the remote backend changes
+type RemoteConfigWatcher struct {
+	source   RemoteConfigSource
+	interval time.Duration
+	logger   *zap.Logger
+	changes  chan struct{}
+	cancel   context.CancelFunc
+}
+
+// NewRemoteConfigWatcher starts watching; blocking backends (Consul) are long-polled,
+// others are polled every interval
+func NewRemoteConfigWatcher(source RemoteConfigSource, interval time.Duration, logger *zap.Logger) *RemoteConfigWatcher {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	rw := &RemoteConfigWatcher{
+		source:   source,
+		interval: interval,
+		logger:   logger,
+		changes:  make(chan struct{}, 1),
+		cancel:   cancel,
+	}
+	go rw.run(ctx)
+	return rw
+}
+
+// Changes returns a channel receiving a value whenever the remote configuration changes
+func (rw *RemoteConfigWatcher) Changes() <-chan struct{} {
+	return rw.changes
+}
+
+// Close stops watching
+func (rw *RemoteConfigWatcher) Close() {
+	rw.cancel()
+}
+
+func (rw *RemoteConfigWatcher) run(ctx context.Context) {
+	var (
+		index  uint64
+		digest [sha256.Size]byte
+		primed bool
+	)
+
+	for {
+		files, next, err := rw.source.Fetch(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			rw.logger.Warn("Remote configuration watch failed", zap.String("source", rw.source.String()), zap.Error(err))
+			index = 0
+		} else {
+			current := remoteFilesDigest(files)
+			if primed && current != digest {
+				rw.logger.Info("Remote configuration changed", zap.String("source", rw.source.String()))
+				select {
+				case rw.changes <- struct{}{}:
+				default:
+					// A reload is already pending
+				}
+			}
+			digest, primed = current, true
+			// Consul resets its index on snapshot restore; start over when it goes backwards
+			if next < index {
+				next = 0
+			}
+			index = next
+		}
+
+		// Blocking backends wait inside Fetch; wait between polls otherwise or after an error
+		if err == nil && rw.source.Blocking() {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(rw.interval):
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamResolver resolves the host names of upstreams with the nameservers and
+// lookup timeout of a server's proxy settings
+type upstreamResolver struct {
+	resolver *net.Resolver
+	timeout  time.Duration // 0 for the dial's own
+}
+
+// newUpstreamResolver returns the resolver of the proxy settings p. The
+// nameservers, when set, are queried in turn; dns_servers is validated already.
+func newUpstreamResolver(p ProxyConfig) *upstreamResolver {
+	r := &upstreamResolver{resolver: net.DefaultResolver, timeout: p.DNSTimeout}
+	if len(p.DNSServers) == 0 {
+		return r
+	}
+	servers := make([]string, 0, len(p.DNSServers))
+	for _, server := range p.DNSServers {
+		if addr, err := nameserverAddr(server); err == nil {
+			servers = append(servers, addr)
+		}
+	}
+	var next atomic.Uint32
+	r.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			server := servers[int(next.Add(1)-1)%len(servers)]
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+	return r
+}
+
+// nameserverAddr returns the address of a nameserver given as IP or IP:port
+func nameserverAddr(server string) (string, error) {
+	if addr, err := netip.ParseAddr(server); err == nil {
+		return netip.AddrPortFrom(addr, 53).String(), nil
+	}
+	if addrPort, err := netip.ParseAddrPort(server); err == nil {
+		return addrPort.String(), nil
+	}
+	return "", fmt.Errorf("invalid nameserver %q (expected IP or IP:port)", server)
+}
+
+// LookupIPAddr implements fasthttp.Resolver
+func (r *upstreamResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	return r.resolver.LookupIPAddr(ctx, host)
+}
+
+// dialContext returns the DialContext of net/http transports and other dialers
+// of upstream connections, resolving host names through r before dialing with d
+func (r *upstreamResolver) dialContext(d *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if r.resolver == net.DefaultResolver && r.timeout == 0 {
+		return d.DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return d.DialContext(ctx, network, addr)
+		}
+		if d.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+			defer cancel()
+		}
+		ips, err := r.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+		// Addresses are tried in the order the nameserver returned them
+		for _, ip := range ips {
+			var conn net.Conn
+			conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		if err == nil {
+			err = &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}}
+		}
+		return nil, err
+	}
+}
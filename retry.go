@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// RetryPolicy decides whether a request that failed to reach its upstream is sent
+// again. A retry can repeat side effects the upstream already performed, so only
+// idempotent methods are retried unless NonIdempotent allows the others, and only
+// requests whose body the proxy still holds.
+type RetryPolicy struct {
+	MaxRetries    int           // Retries after the first attempt
+	NonIdempotent bool          // Retry POST, PATCH and other non-idempotent methods too
+	Backoff       time.Duration // Wait before the first retry, doubled before each next one
+	MaxBackoff    time.Duration // Longest wait before a retry
+	OnStatus      []int         // Upstream statuses retried like failures to connect
+	TryTimeout    time.Duration // Wait for the response of each attempt, 0 for no limit of its own
+}
+
+// retryPolicyOf returns the retry policy of load balancer settings
+func retryPolicyOf(lbConfig LoadBalancerConfig) RetryPolicy {
+	return RetryPolicy{
+		MaxRetries:    lbConfig.MaxRetries,
+		NonIdempotent: lbConfig.RetryNonIdempotent,
+		Backoff:       lbConfig.RetryBackoff,
+		MaxBackoff:    lbConfig.RetryMaxBackoff,
+		OnStatus:      lbConfig.RetryOnStatus,
+		TryTimeout:    lbConfig.TryTimeout,
+	}
+}
+
+// Attempts returns how many times a request may be sent to its upstream. A body
+// that is not replayable, such as one streamed from the client, was consumed by
+// the first attempt.
+func (p RetryPolicy) Attempts(method string, replayable bool) int {
+	if !replayable || (!idempotentMethods[method] && !p.NonIdempotent) {
+		return 1
+	}
+	return 1 + p.MaxRetries
+}
+
+// RetriesStatus reports whether an upstream response with status is retried
+func (p RetryPolicy) RetriesStatus(status int) bool {
+	return slices.Contains(p.OnStatus, status)
+}
+
+// Delay returns the wait before the retry-th retry: the backoff doubled for each
+// earlier retry, capped at the maximum, of which a random half is kept so that
+// clients failing together do not come back together
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	if p.Backoff <= 0 {
+		return 0
+	}
+	delay := p.Backoff
+	for i := 1; i < retry && (p.MaxBackoff <= 0 || delay < p.MaxBackoff); i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// tryContext returns the context of one attempt of a request under parent, and
+// the function to call once the upstream's response arrived. Until then, the
+// attempt is canceled after the try timeout.
+func (p RetryPolicy) tryContext(parent context.Context) (context.Context, context.CancelFunc, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	if p.TryTimeout <= 0 {
+		return ctx, cancel, func() {}
+	}
+	timer := time.AfterFunc(p.TryTimeout, cancel)
+	return ctx, cancel, func() { timer.Stop() }
+}
+
+// do sends the request newRequest builds up to attempts times through client,
+// while it fails or the upstream answers with a status the policy retries,
+// waiting the policy's delay between attempts. retrying is told of each failed
+// attempt followed by another. The response of the last attempt is returned
+// whatever its status, with the function releasing its context once its body
+// was read.
+func (p RetryPolicy) do(ctx context.Context, client *http.Client, attempts int, newRequest func(context.Context) (*http.Request, error), retrying func(attempt int, resp *http.Response, err error)) (*http.Response, context.CancelFunc, error) {
+	for attempt := 1; ; attempt++ {
+		tryCtx, cancel, arrived := p.tryContext(ctx)
+		req, err := newRequest(tryCtx)
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		resp, err := client.Do(req)
+		arrived()
+		if attempt >= attempts || (err == nil && !p.RetriesStatus(resp.StatusCode)) {
+			if err != nil {
+				cancel()
+				return nil, nil, err
+			}
+			return resp, cancel, nil
+		}
+		if retrying != nil {
+			retrying(attempt, resp, err)
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		cancel()
+
+		select {
+		case <-time.After(p.Delay(attempt)):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
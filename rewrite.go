@@ -0,0 +1,74 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// pathRewrite is a compiled rewrite rule of a route
+type pathRewrite struct {
+	match       *regexp.Regexp
+	replacement string
+}
+
+// newPathRewrites compiles the rewrite rules of a route
+func newPathRewrites(configs []PathRewriteConfig) []pathRewrite {
+	rewrites := make([]pathRewrite, 0, len(configs))
+	for _, config := range configs {
+		// Patterns were checked by Config.Validate, so compiling cannot fail here
+		rewrites = append(rewrites, pathRewrite{regexp.MustCompile(config.Match), config.Replacement})
+	}
+	return rewrites
+}
+
+// RewritesPath reports whether the route sends upstreams another path than the client's
+func (r *Route) RewritesPath() bool {
+	return r != nil && (r.config.StripPrefix || len(r.rewrites) > 0)
+}
+
+// UpstreamPath returns the path the upstream is asked for: the client's escaped
+// path without the route's prefix when strip_prefix is set, then changed by the
+// first rewrite rule that matches
+func (r *Route) UpstreamPath(path string) string {
+	if !r.RewritesPath() {
+		return path
+	}
+	if r.config.StripPrefix {
+		path = strings.TrimPrefix(path, strings.TrimSuffix(r.config.PathPrefix, "/"))
+	}
+	for _, rewrite := range r.rewrites {
+		if rewrite.match.MatchString(path) {
+			path = rewrite.match.ReplaceAllString(path, rewrite.replacement)
+			break
+		}
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// upstreamRequestURI returns the request URI the upstream is asked for, with the
+// route's rewrites applied to the path of the client's URI
+func (r *Route) upstreamRequestURI(requestURI string) string {
+	if !r.RewritesPath() {
+		return requestURI
+	}
+	path, query, hasQuery := strings.Cut(requestURI, "?")
+	path = r.UpstreamPath(path)
+	if hasQuery {
+		path += "?" + query
+	}
+	return path
+}
+
+// rewriteFastHTTPTarget applies the route's rewrites to a gnet request before it
+// is mirrored and forwarded
+func rewriteFastHTTPTarget(route *Route, req *fasthttp.Request) {
+	if !route.RewritesPath() {
+		return
+	}
+	req.SetRequestURI(route.upstreamRequestURI(string(req.Header.RequestURI())))
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route is a path prefix of a server with its own settings
+type Route struct {
+	Name   string
+	config RouteConfig
+
+	// jitterRand is seeded from the route config so delays are reproducible between runs
+	jitterMu   sync.Mutex
+	jitterRand *rand.Rand
+
+	// rateLimiter is nil when the route sets no rate limit
+	rateLimiter *ruleLimiter
+	// access is nil when the route has no client IP lists
+	access *IPFilter
+	// basicAuth is nil when the route doesn't require credentials
+	basicAuth *BasicAuth
+	// securityHeaders merges the server's and the route's, nil when there are none
+	securityHeaders *SecurityHeaders
+	// split is nil when the route sends its requests to the whole pool
+	split *trafficSplit
+	// mirror is nil when the route's requests are not mirrored
+	mirror *trafficMirror
+	// concurrency is nil when the route's requests in flight are not limited
+	concurrency *concurrencyLimiter
+	// maintenance merges the server's maintenance page settings with the route's
+	maintenance *maintenanceMode
+	// fallback is nil when the route answers a plain 503 without healthy upstreams
+	fallback *fallbackResponse
+	// requestHeaders is nil when the route has no request header rules
+	requestHeaders *headerRules
+	// rewrites are the compiled rewrite rules of the path sent to upstreams
+	rewrites []pathRewrite
+}
+
+// Router matches request paths against the routes of a server
+type Router struct {
+	routes []*Route // sorted by descending prefix length
+}
+
+// NewRouter creates a router from route configurations
+func NewRouter(configs []RouteConfig) *Router {
+	routes := make([]*Route, 0, len(configs))
+	for _, rc := range configs {
+		name := rc.Name
+		if name == "" {
+			name = rc.PathPrefix
+		}
+		// Access lists and users were checked by Config.Validate, so parsing cannot fail here
+		access, _ := NewIPFilter(rc.Access)
+		basicAuth, _ := NewBasicAuth(rc.BasicAuth)
+		routes = append(routes, &Route{
+			Name:           name,
+			config:         rc,
+			jitterRand:     rand.New(rand.NewSource(rc.JitterSeed)),
+			rateLimiter:    newRuleLimiter(rc.RateLimit),
+			access:         access,
+			basicAuth:      basicAuth,
+			split:          newTrafficSplit(rc.Split, rc.SplitSticky, rc.SplitCookie),
+			concurrency:    newConcurrencyLimiter(rc.Concurrency),
+			fallback:       newFallbackResponse(rc.Fallback),
+			requestHeaders: newHeaderRules(rc.RequestHeaders),
+			rewrites:       newPathRewrites(rc.Rewrite),
+		})
+	}
+
+	// Longest prefix wins
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].config.PathPrefix) > len(routes[j].config.PathPrefix)
+	})
+
+	return &Router{routes: routes}
+}
+
+// DelegatesCORS reports whether the route leaves CORS preflights to its upstream
+func (r *Route) DelegatesCORS() bool {
+	return r != nil && r.config.CORSPassthrough
+}
+
+// RetryPolicy returns the retry policy of the route's requests: the load
+// balancer's, with the settings the route overrides
+func (r *Route) RetryPolicy(balancer RetryPolicy) RetryPolicy {
+	if r == nil {
+		return balancer
+	}
+	if r.config.MaxRetries != nil {
+		balancer.MaxRetries = *r.config.MaxRetries
+	}
+	if r.config.RetryNonIdempotent != nil {
+		balancer.NonIdempotent = *r.config.RetryNonIdempotent
+	}
+	return balancer
+}
+
+// CompressionConfig returns the server's proxy settings with the compression
+// levels the route overrides
+func (r *Route) CompressionConfig(p ProxyConfig) ProxyConfig {
+	if r == nil {
+		return p
+	}
+	if level := r.config.Compression.GzipLevel; level > 0 {
+		p.GzipLevel = level
+	}
+	if quality := r.config.Compression.BrotliQuality; quality > 0 {
+		p.BrotliQuality = quality
+	}
+	if level := r.config.Compression.ZstdLevel; level > 0 {
+		p.ZstdLevel = level
+	}
+	return p
+}
+
+// CachePolicy returns how the route's responses are cached: as the server's
+// cache settings say, with the ones the route overrides
+func (r *Route) CachePolicy(server CacheConfig) cachePolicy {
+	policy := cachePolicy{
+		enabled:       server.Enabled,
+		ttl:           server.TTL,
+		maxObjectSize: server.MaxObjectSize,
+		ignoreVary:    server.Vary == CacheVaryIgnore,
+	}
+	if r == nil {
+		return policy
+	}
+	override := r.config.Cache
+	if override.Enabled != nil {
+		policy.enabled = *override.Enabled
+	}
+	if override.TTL > 0 {
+		policy.ttl = override.TTL
+	}
+	if override.MaxObjectSize > 0 {
+		policy.maxObjectSize = override.MaxObjectSize
+	}
+	if override.Vary != "" {
+		policy.ignoreVary = override.Vary == CacheVaryIgnore
+	}
+	return policy
+}
+
+// CacheKeyConfig returns the extra components of the route's cache keys
+func (r *Route) CacheKeyConfig() CacheKeyConfig {
+	if r == nil {
+		return CacheKeyConfig{}
+	}
+	return r.config.CacheKey
+}
+
+// Match returns the route with the longest prefix matching the path, or nil
+func (rt *Router) Match(path string) *Route {
+	if rt == nil {
+		return nil
+	}
+	for _, route := range rt.routes {
+		if strings.HasPrefix(path, route.config.PathPrefix) {
+			return route
+		}
+	}
+	return nil
+}
+
+// InheritRateLimits reuses the rate limiters of routes whose name and limits did not
+// change, so a reload does not hand every client a fresh burst
+func (rt *Router) InheritRateLimits(previous *Router) {
+	if rt == nil || previous == nil {
+		return
+	}
+	for _, route := range rt.routes {
+		for _, old := range previous.routes {
+			if old.Name == route.Name && old.config.RateLimit == route.config.RateLimit {
+				route.rateLimiter = old.rateLimiter
+				break
+			}
+		}
+	}
+}
+
+// RouteName returns the name of the route, or an empty string for unmatched requests
+func (r *Route) RouteName() string {
+	if r == nil {
+		return ""
+	}
+	return r.Name
+}
+
+// AllowClient reports whether the route's access lists admit the client IP
+func (r *Route) AllowClient(ip string) bool {
+	if r == nil {
+		return true
+	}
+	return r.access.Allowed(ip)
+}
+
+// Authorize checks the Authorization header against the route's basic auth users.
+// It returns the WWW-Authenticate challenge to send when the request is rejected.
+func (r *Route) Authorize(authorization string) (bool, string) {
+	if r == nil || r.basicAuth.Check(authorization) {
+		return true, ""
+	}
+	return false, r.basicAuth.Challenge()
+}
+
+// AllowRequest applies the route's rate limits to a client IP
+func (r *Route) AllowRequest(ip string) (bool, time.Duration) {
+	if r == nil {
+		return true, 0
+	}
+	return r.rateLimiter.Allow(ip)
+}
+
+// SyntheticDelay returns the artificial latency to add before forwarding to the upstream
+func (r *Route) SyntheticDelay() time.Duration {
+	if r == nil {
+		return 0
+	}
+
+	delay := r.config.Latency
+	if r.config.Jitter > 0 {
+		r.jitterMu.Lock()
+		delay += time.Duration(r.jitterRand.Int63n(int64(r.config.Jitter) + 1))
+		r.jitterMu.Unlock()
+	}
+	return delay
+}
+
+// applySyntheticDelay sleeps for the route's configured latency and jitter, if any
+func applySyntheticDelay(route *Route) {
+	if delay := route.SyntheticDelay(); delay > 0 {
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Under systemd, the proxy reports its state to the service manager as described
+// in sd_notify(3): READY=1 once every server listens and knows the health of its
+// upstreams, for units of Type=notify, WATCHDOG=1 keepalives for units with
+// WatchdogSec=, and STOPPING=1 when it shuts down. Outside systemd, NOTIFY_SOCKET
+// is unset and nothing is sent.
+
+// sdNotify sends state, newline-separated assignments such as "READY=1", to the
+// service manager
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Sockets in the abstract namespace are given with a leading @
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns how often to send watchdog keepalives, half the
+// WatchdogSec= of the unit, or 0 when the watchdog is not enabled for this process
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// startSDWatchdog sends watchdog keepalives until the returned function is called
+func startSDWatchdog(logger *zap.Logger) (stop func()) {
+	interval := sdWatchdogInterval()
+	if interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := sdNotify("WATCHDOG=1"); err != nil {
+					logger.Warn("Failed to send systemd watchdog keepalive", zap.Error(err))
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	logger.Info("Sending systemd watchdog keepalives", zap.Duration("interval", interval))
+	return func() { close(done) }
+}
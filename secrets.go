@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readSecretFile reads a secret mounted as a file, ignoring the trailing newline
+// most tools (and editors) leave at the end
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// resolveSecret replaces value with the contents of file when file is set
+func resolveSecret(name string, value *string, file string) error {
+	if file == "" {
+		return nil
+	}
+	if *value != "" {
+		return fmt.Errorf("%s and %s_file are mutually exclusive", name, name)
+	}
+	secret, err := readSecretFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read %s_file: %w", name, err)
+	}
+	if secret == "" {
+		return fmt.Errorf("%s_file %s is empty", name, file)
+	}
+	*value = secret
+	return nil
+}
+
+// resolveSecrets loads every *_file secret referenced by the configuration.
+// It runs on every load, so rotated secret files are picked up by a reload.
+func (c *Config) resolveSecrets() error {
+	if err := resolveSecret("admin.token", &c.Admin.Token, c.Admin.TokenFile); err != nil {
+		return err
+	}
+	for i := range c.Admin.Tokens {
+		named := &c.Admin.Tokens[i]
+		if err := resolveSecret(fmt.Sprintf("admin.tokens[%s].token", named.Name), &named.Token, named.TokenFile); err != nil {
+			return err
+		}
+	}
+	if err := c.APIKeys.resolveKeysFile(c); err != nil {
+		return fmt.Errorf("api_keys: %w", err)
+	}
+	if err := resolveSecret("oauth2.client_secret", &c.OAuth2.ClientSecret, c.OAuth2.ClientSecretFile); err != nil {
+		return err
+	}
+	if err := c.Signatures.resolveSecrets("signatures"); err != nil {
+		return err
+	}
+	for i := range c.Servers {
+		if oauth2 := c.Servers[i].OAuth2; oauth2 != nil {
+			name := fmt.Sprintf("servers[%s].oauth2.client_secret", c.Servers[i].Name)
+			if err := resolveSecret(name, &oauth2.ClientSecret, oauth2.ClientSecretFile); err != nil {
+				return err
+			}
+		}
+		if signatures := c.Servers[i].Signatures; signatures != nil {
+			if err := signatures.resolveSecrets(fmt.Sprintf("servers[%s].signatures", c.Servers[i].Name)); err != nil {
+				return err
+			}
+		}
+		if c.Servers[i].APIKeys != nil {
+			if err := c.Servers[i].APIKeys.resolveKeysFile(c); err != nil {
+				return fmt.Errorf("server %q: api_keys: %w", c.Servers[i].Name, err)
+			}
+		}
+		for j := range c.Servers[i].Routes {
+			route := &c.Servers[i].Routes[j]
+			if route.BasicAuth.HtpasswdFile == "" {
+				continue
+			}
+			entries, err := readHtpasswdFile(route.BasicAuth.HtpasswdFile)
+			if err != nil {
+				return fmt.Errorf("server %q: route %q: failed to read htpasswd_file: %w",
+					c.Servers[i].Name, route.PathPrefix, err)
+			}
+			route.BasicAuth.htpasswd = entries
+		}
+	}
+	return nil
+}
+
+// resolveKeysFile reads the keys file of an api_keys section, reporting unknown
+// settings as configuration warnings
+func (a *APIKeyConfig) resolveKeysFile(c *Config) error {
+	if a.KeysFile == "" {
+		return nil
+	}
+	keys, warnings, err := readAPIKeysFile(a.KeysFile)
+	if err != nil {
+		return fmt.Errorf("failed to read keys_file: %w", err)
+	}
+	a.fileKeys = keys
+	c.Warnings = append(c.Warnings, warnings...)
+	return nil
+}
+
+// resolveSecrets reads the secret files of the consumers of a signatures section
+func (s *SignatureConfig) resolveSecrets(prefix string) error {
+	for i := range s.Consumers {
+		consumer := &s.Consumers[i]
+		name := fmt.Sprintf("%s.consumers[%s].secret", prefix, consumer.Name)
+		if err := resolveSecret(name, &consumer.Secret, consumer.SecretFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/valyala/fasthttp"
+)
+
+// SecurityHeaders are the security headers added to proxied responses
+type SecurityHeaders struct {
+	headers  [][2]string
+	override bool
+}
+
+// NewSecurityHeaders returns nil when the configuration sets no header
+func NewSecurityHeaders(cfg SecurityHeadersConfig) *SecurityHeaders {
+	var headers [][2]string
+	for _, header := range [][2]string{
+		{"Strict-Transport-Security", cfg.HSTS},
+		{"X-Content-Type-Options", cfg.ContentTypeOptions},
+		{"X-Frame-Options", cfg.FrameOptions},
+		{"Content-Security-Policy", cfg.ContentSecurityPolicy},
+		{"Referrer-Policy", cfg.ReferrerPolicy},
+	} {
+		if header[1] != "" {
+			headers = append(headers, header)
+		}
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+	return &SecurityHeaders{headers: headers, override: cfg.Override}
+}
+
+// merge returns the server's headers with the ones set by a route taking precedence
+func (cfg SecurityHeadersConfig) merge(route SecurityHeadersConfig) SecurityHeadersConfig {
+	merged := cfg
+	for _, field := range []struct {
+		dst *string
+		src string
+	}{
+		{&merged.HSTS, route.HSTS},
+		{&merged.ContentTypeOptions, route.ContentTypeOptions},
+		{&merged.FrameOptions, route.FrameOptions},
+		{&merged.ContentSecurityPolicy, route.ContentSecurityPolicy},
+		{&merged.ReferrerPolicy, route.ReferrerPolicy},
+	} {
+		if field.src != "" {
+			*field.dst = field.src
+		}
+	}
+	merged.Override = cfg.Override || route.Override
+	return merged
+}
+
+// SecurityHeadersFor returns the security headers of a route's responses, or nil
+func (rc *RuntimeConfig) SecurityHeadersFor(route *Route) *SecurityHeaders {
+	if route != nil {
+		return route.securityHeaders
+	}
+	return rc.SecurityHeaders
+}
+
+// applyFastHTTP adds the headers to a gnet response. Headers set by the upstream are
+// kept unless override is enabled.
+func (s *SecurityHeaders) applyFastHTTP(h *fasthttp.ResponseHeader) {
+	if s == nil {
+		return
+	}
+	for _, header := range s.headers {
+		if s.override || len(h.Peek(header[0])) == 0 {
+			h.Set(header[0], header[1])
+		}
+	}
+}
+
+// apply adds the headers to a net/http response. Headers set by the upstream are
+// kept unless override is enabled.
+func (s *SecurityHeaders) apply(h http.Header) {
+	if s == nil {
+		return
+	}
+	for _, header := range s.headers {
+		if s.override || h.Get(header[0]) == "" {
+			h.Set(header[0], header[1])
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Signature verification defaults
+const (
+	defaultSignatureHeader         = "X-Signature"
+	defaultSignatureConsumerHeader = "X-Signature-Consumer"
+	defaultSignatureMaxSkew        = 5 * time.Minute
+)
+
+// errBodyTooLarge reports a body over max_body_size while buffering it for verification
+var errBodyTooLarge = errors.New("request body too large")
+
+// SignatureVerifier checks HMAC-SHA256 request signatures made with the shared
+// secret of one of the configured consumers. The signed message is
+//
+//	METHOD "\n" REQUEST-URI "\n" [TIMESTAMP "\n"] BODY
+//
+// where the timestamp line is present only when a timestamp header is configured.
+type SignatureVerifier struct {
+	config    SignatureConfig
+	consumers []signatureConsumer
+	routes    map[string]bool // nil requires signatures on every route
+}
+
+// signatureConsumer is a caller and the secret it signs with
+type signatureConsumer struct {
+	name   string
+	secret []byte
+}
+
+// NewSignatureVerifier creates the verifier of a server, or returns nil when signatures are disabled
+func NewSignatureVerifier(cfg SignatureConfig) (*SignatureVerifier, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	v := &SignatureVerifier{config: cfg}
+	names := make(map[string]bool, len(cfg.Consumers))
+	for _, consumer := range cfg.Consumers {
+		if consumer.Name == "" || consumer.Secret == "" {
+			return nil, errors.New("every consumer needs a name and a secret")
+		}
+		if names[consumer.Name] {
+			return nil, fmt.Errorf("duplicate consumer name %q", consumer.Name)
+		}
+		names[consumer.Name] = true
+		v.consumers = append(v.consumers, signatureConsumer{name: consumer.Name, secret: []byte(consumer.Secret)})
+	}
+	if len(v.consumers) == 0 {
+		return nil, errors.New("enabled without any consumer")
+	}
+	if cfg.MaxSkew < 0 {
+		return nil, errors.New("max_skew must not be negative")
+	}
+
+	if len(cfg.Routes) > 0 {
+		v.routes = make(map[string]bool, len(cfg.Routes))
+		for _, route := range cfg.Routes {
+			v.routes[route] = true
+		}
+	}
+	return v, nil
+}
+
+// Config returns the settings the verifier was created with
+func (v *SignatureVerifier) Config() SignatureConfig {
+	if v == nil {
+		return SignatureConfig{}
+	}
+	return v.config
+}
+
+// Required reports whether requests of the route must be signed
+func (v *SignatureVerifier) Required(route *Route) bool {
+	return v != nil && (v.routes == nil || v.routes[route.RouteName()])
+}
+
+// Verify checks a request signature and returns the name of the consumer whose
+// secret produced it. Every consumer is tried, in constant time per comparison.
+func (v *SignatureVerifier) Verify(method, requestURI, signature, timestamp string, body []byte) (string, bool) {
+	digest, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(signature), "sha256="))
+	if err != nil || len(digest) != sha256.Size {
+		return "", false
+	}
+
+	if v.config.TimestampHeader != "" {
+		seconds, err := strconv.ParseInt(strings.TrimSpace(timestamp), 10, 64)
+		if err != nil {
+			return "", false
+		}
+		if skew := time.Since(time.Unix(seconds, 0)); math.Abs(float64(skew)) > float64(v.config.MaxSkew) {
+			return "", false
+		}
+	}
+
+	for _, consumer := range v.consumers {
+		mac := hmac.New(sha256.New, consumer.secret)
+		io.WriteString(mac, method+"\n"+requestURI+"\n")
+		if v.config.TimestampHeader != "" {
+			io.WriteString(mac, strings.TrimSpace(timestamp)+"\n")
+		}
+		mac.Write(body)
+		if hmac.Equal(mac.Sum(nil), digest) {
+			return consumer.name, true
+		}
+	}
+	return "", false
+}
+
+// verifyFastHTTP verifies a gnet request and passes the consumer name to the upstream
+func (v *SignatureVerifier) verifyFastHTTP(route *Route, req *fasthttp.Request) bool {
+	if v == nil {
+		return true
+	}
+	// A consumer header sent by the client is never trusted
+	req.Header.Del(v.config.ConsumerHeader)
+	if !v.Required(route) {
+		return true
+	}
+	var timestamp string
+	if v.config.TimestampHeader != "" {
+		timestamp = string(req.Header.Peek(v.config.TimestampHeader))
+	}
+	consumer, ok := v.Verify(string(req.Header.Method()), string(req.RequestURI()),
+		string(req.Header.Peek(v.config.Header)), timestamp, req.Body())
+	if !ok {
+		return false
+	}
+	req.Header.Set(v.config.ConsumerHeader, consumer)
+	return true
+}
+
+// verify verifies a net/http request and passes the consumer name to the upstream.
+// The body is buffered (up to maxBodySize) to be verified and then forwarded.
+func (v *SignatureVerifier) verify(route *Route, r *http.Request, maxBodySize int64) (bool, error) {
+	if v == nil {
+		return true, nil
+	}
+	// A consumer header sent by the client is never trusted
+	r.Header.Del(v.config.ConsumerHeader)
+	if !v.Required(route) {
+		return true, nil
+	}
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+		if err != nil {
+			return false, err
+		}
+		if int64(len(body)) > maxBodySize {
+			return false, errBodyTooLarge
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	requestURI := r.RequestURI
+	if requestURI == "" {
+		requestURI = r.URL.RequestURI()
+	}
+	var timestamp string
+	if v.config.TimestampHeader != "" {
+		timestamp = r.Header.Get(v.config.TimestampHeader)
+	}
+	consumer, ok := v.Verify(r.Method, requestURI, r.Header.Get(v.config.Header), timestamp, body)
+	if !ok {
+		return false, nil
+	}
+	r.Header.Set(v.config.ConsumerHeader, consumer)
+	return true, nil
+}
+
+// writeSignatureError rejects a net/http request whose signature could not be verified
+func writeSignatureError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+	case err != nil:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+	default:
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/gorilla/websocket"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var (
+	soakDuration    time.Duration
+	soakInterval    time.Duration
+	soakConcurrency int
+	soakPath        string
+	soakReportFile  string
+)
+
+// soakCmd runs the proxy in-process and drives it with a long-running load test
+var soakCmd = &cobra.Command{
+	Use:   "soak",
+	Short: "Run a long-duration self-load test and write a leak/latency report",
+	Long: `Starts all enabled servers from the configuration in-process and continuously sends
+traffic through them while sampling heap usage, goroutines, open file descriptors and
+latency. The resulting report is written as JSON so growth between releases can be compared.
+
+HTTP servers receive plain GET requests; WebSocket servers get short-lived connections that
+send one message each, exercising the upgrade and splicing path.`,
+	RunE: runSoak,
+}
+
+func init() {
+	soakCmd.Flags().DurationVar(&soakDuration, "duration", 10*time.Minute, "Total duration of the soak test")
+	soakCmd.Flags().DurationVar(&soakInterval, "interval", 30*time.Second, "Interval between resource samples")
+	soakCmd.Flags().IntVar(&soakConcurrency, "concurrency", 10, "Concurrent clients per server instance")
+	soakCmd.Flags().StringVar(&soakPath, "path", "/", "Request path used for generated traffic")
+	soakCmd.Flags().StringVar(&soakReportFile, "report", "soak-report.json", "Path of the JSON report artifact")
+	rootCmd.AddCommand(soakCmd)
+}
+
+// SoakSample is a snapshot of process resources and latency for one sampling window
+type SoakSample struct {
+	Elapsed      string  `json:"elapsed"`
+	HeapAlloc    uint64  `json:"heap_alloc_bytes"`
+	HeapObjects  uint64  `json:"heap_objects"`
+	Goroutines   int     `json:"goroutines"`
+	OpenFDs      int     `json:"open_fds"`
+	Requests     int64   `json:"requests"`
+	Errors       int64   `json:"errors"`
+	LatencyP50Ms float64 `json:"latency_p50_ms"`
+	LatencyP99Ms float64 `json:"latency_p99_ms"`
+}
+
+// SoakSummary captures growth between the first and the last sample
+type SoakSummary struct {
+	TotalRequests   int64   `json:"total_requests"`
+	TotalErrors     int64   `json:"total_errors"`
+	HeapGrowthBytes int64   `json:"heap_growth_bytes"`
+	GoroutineGrowth int     `json:"goroutine_growth"`
+	FDGrowth        int     `json:"fd_growth"`
+	P99DriftMs      float64 `json:"p99_drift_ms"`
+}
+
+// SoakReport is the artifact written at the end of a soak run
+type SoakReport struct {
+	StartedAt  time.Time    `json:"started_at"`
+	FinishedAt time.Time    `json:"finished_at"`
+	Duration   string       `json:"duration"`
+	Targets    []string     `json:"targets"`
+	Samples    []SoakSample `json:"samples"`
+	Summary    SoakSummary  `json:"summary"`
+}
+
+// soakStats collects results from all load generating workers
+type soakStats struct {
+	requests int64
+	errors   int64
+	mu       sync.Mutex
+	window   []time.Duration
+}
+
+func (s *soakStats) record(elapsed time.Duration, err error) {
+	atomic.AddInt64(&s.requests, 1)
+	if err != nil {
+		atomic.AddInt64(&s.errors, 1)
+		return
+	}
+	s.mu.Lock()
+	s.window = append(s.window, elapsed)
+	s.mu.Unlock()
+}
+
+// drain returns the latencies of the current window and starts a new one
+func (s *soakStats) drain() []time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	window := s.window
+	s.window = nil
+	return window
+}
+
+func runSoak(cmd *cobra.Command, args []string) error {
+	cfg, err := loadConfiguration()
+	if err != nil {
+		return err
+	}
+
+	logger, err := SetupLogger(cfg.Logging, "soak")
+	if err != nil {
+		return fmt.Errorf("failed to setup logger: %w", err)
+	}
+	defer logger.Sync()
+	logConfigWarnings(cfg, logger)
+
+	enabledServers := cfg.GetEnabledServers()
+	if len(enabledServers) == 0 {
+		return fmt.Errorf("no enabled servers found in configuration")
+	}
+
+	multiManager := NewMultiServerManager()
+	for _, serverCfg := range enabledServers {
+		if _, err := multiManager.CreateServerInstance(serverCfg, cfg, logger); err != nil {
+			return fmt.Errorf("failed to create server instance %s: %w", serverCfg.Name, err)
+		}
+	}
+
+	errorChan, wg := multiManager.StartAllServers()
+
+	// Traffic starts once every listener is bound and the health of the upstreams is known
+	select {
+	case <-multiManager.Ready():
+	case err := <-errorChan:
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer shutdownCancel()
+		multiManager.Shutdown(shutdownCtx, logger)
+		wg.Wait()
+		return fmt.Errorf("server failed to start: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), soakDuration)
+	defer cancel()
+
+	stats := &soakStats{}
+	var workers sync.WaitGroup
+	var targets []string
+	workerCount := 0
+	for _, instance := range multiManager.GetServerInstances() {
+		// Workers dial a host and port
+		if instance.config.UnixSocket != "" || instance.config.SystemdSocket != "" {
+			continue
+		}
+		host := instance.config.Host
+		if host == "" || host == "0.0.0.0" {
+			host = "127.0.0.1"
+		}
+		addr := fmt.Sprintf("%s:%d", host, instance.config.Port)
+
+		var target string
+		var worker func(ctx context.Context, target string, stats *soakStats)
+		if strings.Contains(strings.ToLower(instance.name), "websocket") {
+			target = "ws://" + addr + soakPath
+			worker = soakWebSocketWorker
+		} else {
+			target = "http://" + addr + soakPath
+			worker = soakHTTPWorker
+		}
+		targets = append(targets, target)
+
+		for i := 0; i < soakConcurrency; i++ {
+			workerCount++
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				worker(ctx, target, stats)
+			}()
+		}
+	}
+
+	cyan := color.New(color.FgCyan, color.Bold)
+	cyan.Printf("  🔥 Soak test running for %s against %d target(s)\n", soakDuration, len(targets))
+
+	report := &SoakReport{
+		StartedAt: time.Now(),
+		Duration:  soakDuration.String(),
+		Targets:   targets,
+	}
+
+	var lastRequests, lastErrors int64
+	sample := func() {
+		requests := atomic.LoadInt64(&stats.requests)
+		errors := atomic.LoadInt64(&stats.errors)
+		s := takeSoakSample(time.Since(report.StartedAt), stats.drain())
+		s.Requests = requests - lastRequests
+		s.Errors = errors - lastErrors
+		lastRequests, lastErrors = requests, errors
+		report.Samples = append(report.Samples, s)
+		logger.Info("Soak sample",
+			zap.String("elapsed", s.Elapsed),
+			zap.Uint64("heap_alloc", s.HeapAlloc),
+			zap.Int("goroutines", s.Goroutines),
+			zap.Int("open_fds", s.OpenFDs),
+			zap.Float64("p99_ms", s.LatencyP99Ms))
+	}
+
+	// The load generator runs in the process it measures. Its workers, clients and
+	// connections are in place once each has sent a request, and stay the same
+	// from then on, so the baseline is taken then and growth after it is the proxy's.
+	for atomic.LoadInt64(&stats.requests) < int64(workerCount) && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	sample()
+
+	ticker := time.NewTicker(soakInterval)
+	defer ticker.Stop()
+
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			sample()
+		case err := <-errorChan:
+			logger.Error("Server error during soak test", zap.Error(err))
+			cancel()
+			break loop
+		case <-ctx.Done():
+			break loop
+		}
+	}
+
+	workers.Wait()
+	sample()
+	report.FinishedAt = time.Now()
+	report.Summary = summarizeSoak(report.Samples)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer shutdownCancel()
+	multiManager.Shutdown(shutdownCtx, logger)
+	wg.Wait()
+
+	if err := writeSoakReport(soakReportFile, report); err != nil {
+		return err
+	}
+
+	green := color.New(color.FgGreen, color.Bold)
+	green.Printf("  ✅ Soak report written to %s (%d requests, %d errors, heap growth %d bytes, goroutine growth %d)\n",
+		soakReportFile, report.Summary.TotalRequests, report.Summary.TotalErrors,
+		report.Summary.HeapGrowthBytes, report.Summary.GoroutineGrowth)
+	return nil
+}
+
+// soakHTTPWorker sends requests in a loop until the context is done
+func soakHTTPWorker(ctx context.Context, target string, stats *soakStats) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for ctx.Err() == nil {
+		start := time.Now()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			stats.record(0, err)
+			return
+		}
+		resp, err := client.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode >= http.StatusInternalServerError {
+				err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		stats.record(time.Since(start), err)
+	}
+}
+
+// soakWebSocketWorker opens short-lived WebSocket connections until the context is done
+func soakWebSocketWorker(ctx context.Context, target string, stats *soakStats) {
+	dialer := &websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	for ctx.Err() == nil {
+		start := time.Now()
+		conn, _, err := dialer.DialContext(ctx, target, nil)
+		if err == nil {
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			if err = conn.WriteMessage(websocket.TextMessage, []byte("surikiti-soak")); err == nil {
+				_, _, err = conn.ReadMessage()
+			}
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			conn.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		stats.record(time.Since(start), err)
+	}
+}
+
+// takeSoakSample captures process resources and latency percentiles of a window
+func takeSoakSample(elapsed time.Duration, window []time.Duration) SoakSample {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	sort.Slice(window, func(i, j int) bool { return window[i] < window[j] })
+
+	return SoakSample{
+		Elapsed:      elapsed.Round(time.Second).String(),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapObjects:  mem.HeapObjects,
+		Goroutines:   runtime.NumGoroutine(),
+		OpenFDs:      countOpenFDs(),
+		LatencyP50Ms: percentileMs(window, 0.50),
+		LatencyP99Ms: percentileMs(window, 0.99),
+	}
+}
+
+// summarizeSoak compares the first and last samples of a run
+func summarizeSoak(samples []SoakSample) SoakSummary {
+	var summary SoakSummary
+	for _, s := range samples {
+		summary.TotalRequests += s.Requests
+		summary.TotalErrors += s.Errors
+	}
+	if len(samples) < 2 {
+		return summary
+	}
+
+	first, last := samples[0], samples[len(samples)-1]
+	summary.HeapGrowthBytes = int64(last.HeapAlloc) - int64(first.HeapAlloc)
+	summary.GoroutineGrowth = last.Goroutines - first.Goroutines
+	summary.FDGrowth = last.OpenFDs - first.OpenFDs
+	summary.P99DriftMs = last.LatencyP99Ms - first.LatencyP99Ms
+	return summary
+}
+
+// percentileMs returns the given percentile of sorted durations in milliseconds
+func percentileMs(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(float64(len(sorted)-1) * p)
+	return float64(sorted[idx]) / float64(time.Millisecond)
+}
+
+// countOpenFDs returns the number of open file descriptors, or -1 if unavailable
+func countOpenFDs() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
+
+func writeSoakReport(path string, report *SoakReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode soak report: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write soak report: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+// trafficSplit divides the requests of a route between upstream groups by
+// weight, such as 95% to the stable release and 5% to a canary. Weights start
+// from the configuration and can be changed at runtime through the admin API.
+// Groups with a match rule take the requests carrying their header or cookie
+// first, for A/B tests and beta programs.
+type trafficSplit struct {
+	config []TrafficSplitConfig
+	sticky bool
+	cookie string            // cookie recording the group of each client, empty for none
+	groups []map[string]bool // upstream names of each group, in configuration order
+	all    map[string]bool   // upstream names of every group
+
+	mu      sync.RWMutex
+	weights []int
+}
+
+// SplitGroupStatus is a group of a traffic split as reported by the admin API
+type SplitGroupStatus struct {
+	Name        string   `json:"name"`
+	Upstreams   []string `json:"upstreams"`
+	Weight      int      `json:"weight"`
+	MatchHeader string   `json:"match_header,omitempty"`
+	MatchCookie string   `json:"match_cookie,omitempty"`
+	MatchValue  string   `json:"match_value,omitempty"`
+}
+
+// requestFields reads the headers and cookies of a request of either server kind
+type requestFields interface {
+	header(name string) string
+	cookie(name string) string
+}
+
+// fastHTTPFields are the fields of a request read from a gnet connection
+type fastHTTPFields struct{ req *fasthttp.Request }
+
+func (f fastHTTPFields) header(name string) string { return string(f.req.Header.Peek(name)) }
+func (f fastHTTPFields) cookie(name string) string { return string(f.req.Header.Cookie(name)) }
+
+// standardFields are the fields of a request of the net/http servers
+type standardFields struct{ r *http.Request }
+
+func (f standardFields) header(name string) string { return f.r.Header.Get(name) }
+func (f standardFields) cookie(name string) string {
+	if cookie, err := f.r.Cookie(name); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// matches reports whether a request carries the header or cookie of the group's
+// match rule, with match_value when set. Groups without a rule match nothing.
+func (group TrafficSplitConfig) matches(fields requestFields) bool {
+	var value string
+	switch {
+	case group.MatchHeader != "":
+		value = fields.header(group.MatchHeader)
+	case group.MatchCookie != "":
+		value = fields.cookie(group.MatchCookie)
+	default:
+		return false
+	}
+	if group.MatchValue == "" {
+		return value != ""
+	}
+	return value == group.MatchValue
+}
+
+// newTrafficSplit creates the traffic split of a route, or returns nil when the
+// route has none
+func newTrafficSplit(config []TrafficSplitConfig, sticky bool, cookie string) *trafficSplit {
+	if len(config) == 0 {
+		return nil
+	}
+	s := &trafficSplit{
+		config:  config,
+		sticky:  sticky,
+		cookie:  cookie,
+		groups:  make([]map[string]bool, len(config)),
+		all:     make(map[string]bool),
+		weights: make([]int, len(config)),
+	}
+	for i, group := range config {
+		s.groups[i] = make(map[string]bool, len(group.Upstreams))
+		for _, name := range group.Upstreams {
+			s.groups[i][name] = true
+			s.all[name] = true
+		}
+		s.weights[i] = group.Weight
+	}
+	return s
+}
+
+// assign returns the index of the group a request falls in, -1 when every weight
+// is zero, and whether the split cookie has to be set to record it. Match rules
+// come first, then the group a split cookie names if it still has a weight, and
+// then the weights: a sticky split buckets clients by their key, so that a client
+// stays in its group for as long as the weights stay the same, and others are
+// assigned at random.
+func (s *trafficSplit) assign(client string, fields requestFields) (group int, setCookie bool) {
+	for i, config := range s.config {
+		if config.matches(fields) {
+			return i, false
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.cookie != "" {
+		if name := fields.cookie(s.cookie); name != "" {
+			for i, config := range s.config {
+				if config.Name == name && s.weights[i] > 0 {
+					return i, false
+				}
+			}
+		}
+	}
+
+	total := 0
+	for _, weight := range s.weights {
+		total += weight
+	}
+	if total == 0 {
+		return -1, false
+	}
+
+	var bucket int
+	if s.sticky && client != "" {
+		h := fnv.New32a()
+		h.Write([]byte(client))
+		bucket = int(h.Sum32() % uint32(total))
+	} else {
+		bucket = rand.Intn(total)
+	}
+	for i, weight := range s.weights {
+		if bucket < weight {
+			return i, s.cookie != ""
+		}
+		bucket -= weight
+	}
+	return -1, false
+}
+
+// upstreams returns the upstream names of a group, or of every group for -1
+func (s *trafficSplit) upstreams(group int) map[string]bool {
+	if group < 0 {
+		return s.all
+	}
+	return s.groups[group]
+}
+
+// cookieFor returns the Set-Cookie value recording that a client is in group
+func (s *trafficSplit) cookieFor(group int) string {
+	cookie := http.Cookie{
+		Name:     s.cookie,
+		Value:    s.config[group].Name,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	return cookie.String()
+}
+
+// Status returns the groups of the split with their current weights
+func (s *trafficSplit) Status() []SplitGroupStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	groups := make([]SplitGroupStatus, len(s.config))
+	for i, group := range s.config {
+		groups[i] = SplitGroupStatus{
+			Name:        group.Name,
+			Upstreams:   group.Upstreams,
+			Weight:      s.weights[i],
+			MatchHeader: group.MatchHeader,
+			MatchCookie: group.MatchCookie,
+			MatchValue:  group.MatchValue,
+		}
+	}
+	return groups
+}
+
+// SetWeights changes the weights of the named groups, leaving the others as they
+// are. It fails without changing anything when a group is unknown, a weight
+// negative, or every weight would be zero.
+func (s *trafficSplit) SetWeights(weights map[string]int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	updated, err := s.apply(weights)
+	if err != nil {
+		return err
+	}
+	s.weights = updated
+	return nil
+}
+
+// CheckWeights reports the error SetWeights would return, without changing anything
+func (s *trafficSplit) CheckWeights(weights map[string]int) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, err := s.apply(weights)
+	return err
+}
+
+// apply returns the current weights with the named groups changed. The caller
+// holds the lock.
+func (s *trafficSplit) apply(weights map[string]int) ([]int, error) {
+	updated := append([]int(nil), s.weights...)
+	for name, weight := range weights {
+		index := -1
+		for i, group := range s.config {
+			if group.Name == name {
+				index = i
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("unknown group %q", name)
+		}
+		if weight < 0 {
+			return nil, fmt.Errorf("weight of group %q must not be negative", name)
+		}
+		updated[index] = weight
+	}
+	total := 0
+	for _, weight := range updated {
+		total += weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("at least one group needs a positive weight")
+	}
+	return updated, nil
+}
+
+// Split returns the traffic split of the route, nil when it has none
+func (r *Route) Split() *trafficSplit {
+	if r == nil {
+		return nil
+	}
+	return r.split
+}
+
+// InheritSplits keeps the weights set through the admin API on routes whose
+// name and split did not change, so that a reload does not undo a canary rollout
+func (rt *Router) InheritSplits(previous *Router) {
+	if rt == nil || previous == nil {
+		return
+	}
+	for _, route := range rt.routes {
+		for _, old := range previous.routes {
+			if old.Name == route.Name && old.split != nil && route.split != nil &&
+				old.split.sticky == route.split.sticky && old.split.cookie == route.split.cookie &&
+				reflect.DeepEqual(old.split.config, route.split.config) {
+				route.split = old.split
+				break
+			}
+		}
+	}
+}
+
+// GetUpstreamForRoute returns the upstream of a request on route, with the
+// client's affinity key and IP: one of the group the route's traffic split
+// assigns it to, falling back to the route's other groups when that one has no
+// upstream available, or one of the whole pool when the route has no split.
+// Sticky splits bucket clients by affinity key, or by IP without one. The
+// Set-Cookie value to add to the response, if any, records the assignment.
+func (lb *LoadBalancer) GetUpstreamForRoute(route *Route, key, ip string, fields requestFields) (*Upstream, string) {
+	split := route.Split()
+	if split == nil {
+		return lb.GetUpstreamFor(key), ""
+	}
+	client := key
+	if client == "" {
+		client = ip
+	}
+	group, setCookie := split.assign(client, fields)
+	var cookie string
+	if setCookie {
+		cookie = split.cookieFor(group)
+	}
+	if upstream := lb.getUpstreamIn(key, split.upstreams(group)); upstream != nil {
+		return upstream, cookie
+	}
+	return lb.getUpstreamIn(key, split.all), cookie
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+// Streamed bodies on the gnet listener. The event loop must not block, so an
+// exchange whose body is too large to hold in memory finishes in a goroutine:
+// an upload is fed to it as the client's bytes arrive, and the response is
+// written back with AsyncWrite, pausing while the client has not read what is
+// already queued for it.
+
+const (
+	streamMaxPending = 1 << 20               // response bytes queued for a slow client before the relay waits
+	streamPoll       = 10 * time.Millisecond // how often a waiting relay checks the client's queue
+)
+
+var (
+	errUploadTooLarge = errors.New("streamed request body exceeds max_body_size")
+	errUploadTimeout  = errors.New("client stopped sending the request body")
+	errUploadAborted  = errors.New("client connection closed")
+)
+
+// trafficStream is an exchange on a gnet connection that finishes outside the
+// event loop. The connection reads no further request until it is done.
+type trafficStream struct {
+	upload *uploadBody              // the request body still arriving, nil when only the response is streamed
+	run    func(*clientWriter) bool // relays the exchange and reports whether the connection stays open
+}
+
+// setStream hands the rest of an exchange to a goroutine started once the event
+// loop is done with the request. The upstream, when one is chosen already, counts
+// as busy until it is done.
+func (h *HTTPHandler) setStream(c gnet.Conn, upload *uploadBody, upstream *Upstream, run func(*clientWriter) bool) bool {
+	cc, ok := c.Context().(*connContext)
+	if !ok {
+		return false
+	}
+	if upstream != nil {
+		h.loadBalancer.IncreaseConnections(upstream)
+		relay := run
+		run = func(w *clientWriter) bool {
+			defer h.loadBalancer.DecreaseConnections(upstream)
+			return relay(w)
+		}
+	}
+	cc.stream = &trafficStream{upload: upload, run: run}
+	return true
+}
+
+// runStream runs the stream of a connection, calls done once it has finished,
+// and lets the connection read requests again
+func (h *HTTPHandler) runStream(c gnet.Conn, cc *connContext, done func()) {
+	stream := cc.stream
+	keepAlive := h.runtime.Load().Proxy.KeepAliveTimeout
+	go func() {
+		w := newClientWriter(c)
+		defer h.recoverStream(c, w, done)
+		open := stream.run(w)
+		done()
+		if !open {
+			c.Close()
+			return
+		}
+		// Back on the event loop, where the connection state may be touched
+		c.AsyncWrite(nil, func(c gnet.Conn, err error) error {
+			if err != nil {
+				return nil
+			}
+			cc.stream = nil
+			cc.deadline.Set(time.Now().Add(keepAlive))
+			// Pipelined requests that arrived meanwhile are waiting in the buffer
+			if c.InboundBuffered() > 0 {
+				return c.Wake(nil)
+			}
+			return nil
+		})
+	}()
+}
+
+// clientWriter writes to a gnet connection from outside its event loop. Each
+// write waits until the event loop has taken the bytes, and then while more than
+// streamMaxPending are queued for the client, so a slow reader holds back the
+// upstream instead of filling the proxy's memory.
+type clientWriter struct {
+	c       gnet.Conn
+	done    chan error
+	pending int  // bytes queued for the client after the last write
+	wrote   bool // whether anything was written yet
+}
+
+func newClientWriter(c gnet.Conn) *clientWriter {
+	return &clientWriter{c: c, done: make(chan error, 1)}
+}
+
+func (w *clientWriter) Write(p []byte) (int, error) {
+	w.wrote = true
+	// AsyncWrite queues the buffer, so it is copied before p is reused
+	if err := w.queue(append([]byte(nil), p...)); err != nil {
+		return 0, err
+	}
+	for w.pending > streamMaxPending {
+		time.Sleep(streamPoll)
+		if err := w.queue(nil); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// queue hands buf to the event loop and waits for it to be written or buffered
+func (w *clientWriter) queue(buf []byte) error {
+	err := w.c.AsyncWrite(buf, func(c gnet.Conn, err error) error {
+		if err == nil {
+			w.pending = c.OutboundBuffered()
+		}
+		w.done <- err
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return <-w.done
+}
+
+// uploadBody is the body of a request forwarded while it arrives. The event loop
+// appends the bytes it receives; the upstream client reads them.
+type uploadBody struct {
+	mu        sync.Mutex
+	chunks    [][]byte
+	err       error         // set once no more bytes will come
+	ready     chan struct{} // signalled when chunks or err change
+	remaining int64         // body bytes still expected, -1 for a chunked body
+	received  int64
+	max       int64
+	timeout   time.Duration // longest wait for the client's next bytes
+}
+
+// newUploadBody starts the body of a request with the body bytes that arrived
+// with its headers; bodyLen is -1 for a chunked body
+func newUploadBody(initial []byte, bodyLen int64, p ProxyConfig) *uploadBody {
+	u := &uploadBody{
+		ready:     make(chan struct{}, 1),
+		remaining: bodyLen,
+		max:       p.MaxBodySize,
+		timeout:   p.BodyReadTimeout,
+	}
+	u.push(append([]byte(nil), initial...))
+	return u
+}
+
+// feed takes the body bytes that have arrived on c. Bytes past the end of a body
+// of known length stay buffered for the next request.
+func (u *uploadBody) feed(c gnet.Conn) error {
+	n := c.InboundBuffered()
+	u.mu.Lock()
+	if u.remaining >= 0 && int64(n) > u.remaining {
+		n = int(u.remaining)
+	}
+	u.mu.Unlock()
+	if n == 0 {
+		return nil
+	}
+	data, err := c.Next(n)
+	if err != nil {
+		return err
+	}
+	// The event loop reuses the buffer returned by Next
+	return u.push(append([]byte(nil), data...))
+}
+
+func (u *uploadBody) push(data []byte) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.err != nil {
+		return u.err
+	}
+	u.received += int64(len(data))
+	if u.remaining >= 0 {
+		u.remaining -= int64(len(data))
+	}
+	if u.received > u.max {
+		u.fail(errUploadTooLarge)
+		return u.err
+	}
+	if len(data) > 0 {
+		u.chunks = append(u.chunks, data)
+		u.signal()
+	}
+	return nil
+}
+
+// abort ends the body early, failing the reader with err
+func (u *uploadBody) abort(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.err == nil {
+		u.fail(err)
+	}
+}
+
+func (u *uploadBody) fail(err error) {
+	u.err = err
+	u.chunks = nil
+	u.signal()
+}
+
+func (u *uploadBody) signal() {
+	select {
+	case u.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Read hands the received bytes to the upstream client, waiting up to
+// body_read_timeout for more
+func (u *uploadBody) Read(p []byte) (int, error) {
+	timer := time.NewTimer(u.timeout)
+	defer timer.Stop()
+	for {
+		u.mu.Lock()
+		if len(u.chunks) > 0 {
+			n := copy(p, u.chunks[0])
+			if u.chunks[0] = u.chunks[0][n:]; len(u.chunks[0]) == 0 {
+				u.chunks = u.chunks[1:]
+			}
+			u.mu.Unlock()
+			return n, nil
+		}
+		err := u.err
+		u.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+
+		select {
+		case <-u.ready:
+		case <-timer.C:
+			u.abort(errUploadTimeout)
+		}
+	}
+}
+
+// state returns the bytes received so far, whether a body of known length was
+// received in full, and the error that ended the body early, if any
+func (u *uploadBody) state() (received int64, complete bool, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.received, u.err == nil && u.remaining == 0, u.err
+}
+
+// forwardUpload forwards a request whose body is still arriving, then relays the
+// response. It reports whether the connection can carry another request, which
+// a chunked upload cannot: where its body ends is only known to the upstream client.
+func (h *HTTPHandler) forwardUpload(w *clientWriter, req *fasthttp.Request, reply replyMode, upload *uploadBody, upstream *Upstream, grpcWeb *grpcWebCall, entry *AccessEntry, decorate func(*fasthttp.Response)) bool {
+	proxyConfig := h.runtime.Load().Proxy
+	// A client waiting on Expect: 100-continue is asked for the body now that the
+	// request has passed the proxy's checks
+	if received, _, _ := upload.state(); received == 0 && req.MayContinue() && req.Header.IsHTTP11() {
+		if _, err := w.Write(continueResponse); err != nil {
+			return false
+		}
+	}
+	if err := req.ContinueReadBodyStream(bufio.NewReaderSize(upload, proxyConfig.BufferSize), 0, false); err != nil {
+		h.writeStreamError(w, entry, reply, fasthttp.StatusBadRequest)
+		return false
+	}
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	h.prepareUpstreamRequest(req, upstream, entry.Remote)
+	interim := interimRelay(reply, func(buf []byte) error {
+		_, err := w.Write(buf)
+		return err
+	})
+	tryTimeout := reply.route.RetryPolicy(h.loadBalancer.RetryPolicy()).TryTimeout
+	err := h.upstreamDo(upstream, grpcWeb, interim, tryTimeout)(req, resp)
+
+	received, complete, uploadErr := upload.state()
+	entry.BytesIn = int(received)
+	switch {
+	case errors.Is(uploadErr, errUploadTooLarge):
+		h.writeStreamError(w, entry, reply, fasthttp.StatusRequestEntityTooLarge)
+		return false
+	case errors.Is(uploadErr, errUploadTimeout):
+		h.writeStreamError(w, entry, reply, fasthttp.StatusRequestTimeout)
+		return false
+	case err != nil:
+		// The body was sent once and cannot be replayed, so there is no retry
+		h.metrics.IncUpstreamErrors()
+		h.loadBalancer.MarkUnhealthy(upstream)
+		h.writeStreamError(w, entry, reply, fasthttp.StatusBadGateway)
+		return false
+	}
+
+	if !h.streamsBody(resp) {
+		decodeUpstreamResponse(resp, proxyConfig.UpstreamEncoding)
+	}
+	if err := h.filters.filterFastHTTPResponse(req, resp, entry.Remote); err != nil {
+		h.logger.Error("Response filter failed", zap.Error(err))
+		h.writeStreamError(w, entry, reply, fasthttp.StatusInternalServerError)
+		return false
+	}
+	entry.Status = resp.StatusCode()
+	decorate(resp)
+	reply.close = reply.close || !complete
+	return h.relayResponse(w, resp, entry, reply)
+}
+
+// relayResponse writes a response from outside the event loop, streaming its body
+// when it is large, and reports whether it was written in full on a connection
+// that stays open
+func (h *HTTPHandler) relayResponse(w *clientWriter, resp *fasthttp.Response, entry *AccessEntry, reply replyMode) bool {
+	if !h.streamsBody(resp) {
+		h.compressReply(resp, reply)
+		body := resp.Body()
+		entry.BytesOut = len(body)
+		buf := appendResponseHead(make([]byte, 0, 1024+len(body)), resp, len(body), reply)
+		_, err := w.Write(append(buf, body...))
+		return err == nil && !reply.close
+	}
+
+	// A body of unknown length is sent to the client chunked, or to an HTTP/1.0
+	// client up to the end of the connection
+	length := resp.Header.ContentLength()
+	chunked := length < 0 && !reply.http10
+	if length < 0 && reply.http10 {
+		reply.close = true
+	}
+	if _, err := w.Write(appendResponseHead(nil, resp, length, reply)); err != nil {
+		resp.SetConnectionClose()
+		return false
+	}
+
+	bufferSize := h.runtime.Load().Proxy.BufferSize
+	buf, frame := make([]byte, bufferSize), make([]byte, 0, bufferSize+16)
+	for {
+		n, err := resp.BodyStream().Read(buf)
+		if n > 0 {
+			entry.BytesOut += n
+			data := buf[:n]
+			if chunked {
+				frame = strconv.AppendInt(frame[:0], int64(n), 16)
+				frame = append(append(append(frame, "\r\n"...), data...), "\r\n"...)
+				data = frame
+			}
+			if _, werr := w.Write(data); werr != nil {
+				err = werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// The upstream connection is left in the middle of the body, so it is
+			// closed rather than reused
+			resp.SetConnectionClose()
+			return false
+		}
+	}
+	if chunked {
+		if _, err := w.Write(appendLastChunk(frame[:0], &resp.Header)); err != nil {
+			return false
+		}
+	}
+	return !reply.close
+}
+
+// appendLastChunk appends the end of a chunked body, with the trailers the
+// upstream declared and sent after its own last chunk
+func appendLastChunk(buf []byte, header *fasthttp.ResponseHeader) []byte {
+	buf = append(buf, "0\r\n"...)
+	for name := range header.Trailers() {
+		if value := header.PeekBytes(name); len(value) > 0 {
+			buf = append(append(append(append(buf, name...), ": "...), value...), "\r\n"...)
+		}
+	}
+	return append(buf, "\r\n"...)
+}
+
+// streamsBody reports whether a response body is relayed as it arrives: it was
+// left in the upstream connection, and is longer than stream_threshold or of
+// unknown length
+func (h *HTTPHandler) streamsBody(resp *fasthttp.Response) bool {
+	length := resp.Header.ContentLength()
+	return resp.IsBodyStream() && (length < 0 || int64(length) > h.runtime.Load().Proxy.StreamThreshold)
+}
+
+// streamsPartial reports whether a 206 Partial Content body of length bytes is
+// left in the upstream connection whether or not stream_bodies is on: ranges of
+// large files, such as video seeks and resumed downloads, are relayed as they
+// arrive above threshold
+func streamsPartial(status int, length, threshold int64) bool {
+	return status == fasthttp.StatusPartialContent && length > threshold
+}
+
+// writeStreamError answers an exchange that failed outside the event loop, and
+// closes the connection after it
+func (h *HTTPHandler) writeStreamError(w *clientWriter, entry *AccessEntry, reply replyMode, statusCode int) {
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	h.errorResponse(resp, statusCode, fasthttp.StatusMessage(statusCode))
+	body := resp.Body()
+
+	entry.Status = statusCode
+	entry.BytesOut = len(body)
+	reply.close = true
+	w.Write(append(appendResponseHead(nil, resp, len(body), reply), body...))
+}
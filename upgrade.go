@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// A binary upgrade, started by SIGUSR2, replaces the running process with a new
+// one started from its executable, without refusing a connection. The listening
+// sockets of the net/http servers, the HTTP/2 and HTTP/3 listeners and the admin
+// API are passed to the new process, which serves them as they are: connections
+// waiting to be accepted are accepted by it. The gnet engine binds its own
+// sockets, so gnet servers bind their host and port with SO_REUSEPORT, the new
+// process alongside the old. Once the new process is ready, as systemd's READY=1
+// waits for, it tells the old one through a pipe, and the old process drains its
+// connections and exits as on SIGTERM. If the new process fails to start, the old
+// one keeps serving.
+
+// Environment of a process started by an upgrade
+const (
+	upgradeSocketsEnv = "SURIKITI_UPGRADE_SOCKETS" // JSON array naming the sockets passed from descriptor 3 on
+	upgradeReadyEnv   = "SURIKITI_UPGRADE_READY"   // descriptor of the pipe readiness is reported on
+)
+
+// upgradeReadyTimeout bounds the wait for a new process to be ready, after which
+// it is killed and the old process keeps serving
+const upgradeReadyTimeout = time.Minute
+
+// socketFile is a listener or packet socket whose descriptor can be passed on
+type socketFile interface {
+	File() (*os.File, error)
+}
+
+var (
+	handoverOnce     sync.Once
+	handoverMu       sync.Mutex
+	inheritedSockets map[string]*os.File   // passed by the upgraded process, until a server takes them
+	activeSockets    map[string]socketFile // listened on by this process, passed on by the next upgrade
+	upgradeReadyPipe *os.File              // set in a process started by an upgrade, until it is ready
+)
+
+// inheritUpgradeSockets takes over the sockets and the readiness pipe passed by
+// the process this one upgraded. The environment describing them is cleared, so
+// that child processes do not take them for theirs.
+func inheritUpgradeSockets() {
+	inheritedSockets = make(map[string]*os.File)
+	activeSockets = make(map[string]socketFile)
+	defer func() {
+		os.Unsetenv(upgradeSocketsEnv)
+		os.Unsetenv(upgradeReadyEnv)
+	}()
+	var names []string
+	if err := json.Unmarshal([]byte(os.Getenv(upgradeSocketsEnv)), &names); err != nil {
+		return
+	}
+	for i, name := range names {
+		inheritedSockets[name] = os.NewFile(uintptr(listenFDsStart+i), name)
+	}
+	if fd, err := strconv.Atoi(os.Getenv(upgradeReadyEnv)); err == nil {
+		upgradeReadyPipe = os.NewFile(uintptr(fd), "upgrade-ready")
+	}
+}
+
+// handoverSocket returns the socket named key passed by the process this one
+// upgraded, or opens it with listen, and keeps it to pass on at the next upgrade
+func handoverSocket[T any](key string, fromFile func(*os.File) (T, error), listen func() (T, error)) (T, error) {
+	handoverOnce.Do(inheritUpgradeSockets)
+	handoverMu.Lock()
+	f := inheritedSockets[key]
+	delete(inheritedSockets, key)
+	handoverMu.Unlock()
+
+	var sock T
+	var err error
+	if f != nil {
+		sock, err = fromFile(f)
+		f.Close()
+	} else {
+		sock, err = listen()
+	}
+	if err != nil {
+		return sock, err
+	}
+	if s, ok := any(sock).(socketFile); ok {
+		handoverMu.Lock()
+		activeSockets[key] = s
+		handoverMu.Unlock()
+	}
+	return sock, nil
+}
+
+// listenHandover is handoverSocket for the listener of network and address
+func listenHandover(network, address string, listen func() (net.Listener, error)) (net.Listener, error) {
+	return handoverSocket(network+" "+address, net.FileListener, listen)
+}
+
+// listenPacketHandover is handoverSocket for the packet socket of network and address
+func listenPacketHandover(network, address string, listen func() (net.PacketConn, error)) (net.PacketConn, error) {
+	return handoverSocket(network+" "+address, net.FilePacketConn, listen)
+}
+
+// upgradeReady tells the upgraded process, if any, that this one is ready to
+// take over, and closes the passed sockets no server took
+func upgradeReady() {
+	handoverOnce.Do(inheritUpgradeSockets)
+	handoverMu.Lock()
+	defer handoverMu.Unlock()
+	for key, f := range inheritedSockets {
+		f.Close()
+		delete(inheritedSockets, key)
+	}
+	if upgradeReadyPipe != nil {
+		upgradeReadyPipe.Write([]byte{1})
+		upgradeReadyPipe.Close()
+		upgradeReadyPipe = nil
+	}
+}
+
+// startUpgrade starts the executable of the process again with its listening
+// sockets, returning the new process and a channel receiving nil once it is
+// ready to take over, or why it is not
+func startUpgrade(instances []*ServerInstance, logger *zap.Logger) (*os.Process, <-chan error, error) {
+	for _, instance := range instances {
+		// The gnet engine removes its socket file when it stops, which would be the
+		// new process's
+		if instance.config.UnixSocket != "" && !instance.config.servedByNetHTTP() {
+			return nil, nil, fmt.Errorf("server %q serves a Unix socket with the gnet engine, which cannot be handed over", instance.name)
+		}
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	handoverOnce.Do(inheritUpgradeSockets)
+	handoverMu.Lock()
+	keys := make([]string, 0, len(activeSockets))
+	for key := range activeSockets {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, key := range keys {
+		f, err := activeSockets[key].File()
+		if err != nil {
+			handoverMu.Unlock()
+			return nil, nil, fmt.Errorf("failed to pass on %s: %w", key, err)
+		}
+		files = append(files, f)
+		// The socket file now belongs to the new process too
+		if ln, ok := activeSockets[key].(*net.UnixListener); ok {
+			ln.SetUnlinkOnClose(false)
+		}
+	}
+	handoverMu.Unlock()
+	names, _ := json.Marshal(keys)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	files = append(files, w)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(upgradeEnviron(),
+		upgradeSocketsEnv+"="+string(names),
+		upgradeReadyEnv+"="+strconv.Itoa(listenFDsStart+len(files)-1))
+	if err := cmd.Start(); err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	logger.Info("Started new process for binary upgrade",
+		zap.Int("pid", cmd.Process.Pid),
+		zap.String("executable", executable),
+		zap.Strings("sockets", keys))
+
+	done := make(chan error, 1)
+	go func() {
+		defer r.Close()
+		ready := make(chan error, 1)
+		go func() {
+			if _, err := r.Read(make([]byte, 1)); err != nil {
+				ready <- errors.New("new process exited before it was ready")
+				return
+			}
+			ready <- nil
+		}()
+		select {
+		case err := <-ready:
+			if err != nil {
+				cmd.Wait()
+			}
+			done <- err
+		case <-time.After(upgradeReadyTimeout):
+			cmd.Process.Kill()
+			cmd.Wait()
+			done <- fmt.Errorf("new process not ready after %s", upgradeReadyTimeout)
+		}
+	}()
+	return cmd.Process, done, nil
+}
+
+// upgradeEnviron returns the environment of the process without what describes
+// the sockets it was passed itself, by systemd or an upgrade, and the watchdog
+// settings meant for its own PID
+func upgradeEnviron() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		switch name {
+		case upgradeSocketsEnv, upgradeReadyEnv, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", "WATCHDOG_PID":
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// UpstreamOverrides are connection settings of a single upstream that replace the
+// server's proxy settings; zero values keep the server setting
+type UpstreamOverrides struct {
+	ConnectTimeout      time.Duration
+	TLSHandshakeTimeout time.Duration
+	FirstByteTimeout    time.Duration
+	RequestTimeout      time.Duration
+	MaxConnsPerHost     int
+	BufferSize          int
+	Protocol            string
+}
+
+// Protocols spoken to an upstream
+const (
+	UpstreamHTTP1 = "http1" // HTTP/1.1, pooled by fasthttp on the gnet path
+	UpstreamH2    = "h2"    // HTTP/2 over TLS
+	UpstreamH2C   = "h2c"   // HTTP/2 without TLS, with prior knowledge
+)
+
+// upstreamProtocols are the accepted values of an upstream's protocol
+var upstreamProtocols = map[string]bool{
+	"":            true,
+	UpstreamHTTP1: true,
+	UpstreamH2:    true,
+	UpstreamH2C:   true,
+}
+
+// IsZero reports whether the upstream uses the server's settings unchanged
+func (o UpstreamOverrides) IsZero() bool {
+	return o == UpstreamOverrides{}
+}
+
+// requestTimeout returns the request timeout toward the upstream
+func (o UpstreamOverrides) requestTimeout(p ProxyConfig) time.Duration {
+	if o.RequestTimeout > 0 {
+		return o.RequestTimeout
+	}
+	return p.RequestTimeout
+}
+
+// connectTimeout returns the dial timeout toward the upstream
+func (o UpstreamOverrides) connectTimeout(p ProxyConfig) time.Duration {
+	if o.ConnectTimeout > 0 {
+		return o.ConnectTimeout
+	}
+	return p.RequestTimeout
+}
+
+// tlsHandshakeTimeout returns the TLS handshake timeout toward the upstream, the
+// connect timeout unless it has one of its own
+func (o UpstreamOverrides) tlsHandshakeTimeout(p ProxyConfig) time.Duration {
+	if o.TLSHandshakeTimeout > 0 {
+		return o.TLSHandshakeTimeout
+	}
+	return o.connectTimeout(p)
+}
+
+// maxConnsPerHost returns the connection limit toward the upstream
+func (o UpstreamOverrides) maxConnsPerHost(p ProxyConfig) int {
+	if o.MaxConnsPerHost > 0 {
+		return o.MaxConnsPerHost
+	}
+	return p.MaxConnsPerHost
+}
+
+// http2 reports whether requests to the upstream are multiplexed over HTTP/2
+func (o UpstreamOverrides) http2() bool {
+	return o.Protocol == UpstreamH2 || o.Protocol == UpstreamH2C
+}
+
+// protocols returns the HTTP versions a net/http transport may use toward the
+// upstream, or nil to keep the transport's default
+func (o UpstreamOverrides) protocols() *http.Protocols {
+	var protocols http.Protocols
+	switch o.Protocol {
+	case UpstreamH2:
+		protocols.SetHTTP2(true)
+	case UpstreamH2C:
+		protocols.SetUnencryptedHTTP2(true)
+	default:
+		return nil
+	}
+	return &protocols
+}
+
+// bufferSize returns the read/write buffer size toward the upstream
+func (o UpstreamOverrides) bufferSize(p ProxyConfig) int {
+	if o.BufferSize > 0 {
+		return o.BufferSize
+	}
+	return p.BufferSize
+}
+
+// UpstreamClients hands out HTTP clients toward upstreams. Each upstream gets
+// clients of its own, with their own connection pools and dialers, so that a slow
+// upstream holding all of its connections does not hold up the others.
+type UpstreamClients struct {
+	proxyConfig ProxyConfig
+
+	mu      sync.Mutex
+	clients map[*Upstream]*upstreamClient
+}
+
+// upstreamClient holds the clients built for an upstream's overrides
+type upstreamClient struct {
+	overrides UpstreamOverrides
+	fast      *fasthttp.Client
+	stream    *fasthttp.Client
+	std       *http.Client
+}
+
+// NewUpstreamClients creates the upstream clients of a server
+func NewUpstreamClients(proxyConfig ProxyConfig) *UpstreamClients {
+	return &UpstreamClients{
+		proxyConfig: proxyConfig,
+		clients:     make(map[*Upstream]*upstreamClient),
+	}
+}
+
+// Fast returns the fasthttp client for an upstream
+func (uc *UpstreamClients) Fast(u *Upstream) *fasthttp.Client {
+	return uc.clientFor(u).fast
+}
+
+// Stream returns the fasthttp client for an upstream that streams large response
+// bodies, used when stream_bodies is on
+func (uc *UpstreamClients) Stream(u *Upstream) *fasthttp.Client {
+	return uc.clientFor(u).stream
+}
+
+// Standard returns the net/http client for an upstream
+func (uc *UpstreamClients) Standard(u *Upstream) *http.Client {
+	return uc.clientFor(u).std
+}
+
+// CloseIdleConnections closes idle connections of all clients
+func (uc *UpstreamClients) CloseIdleConnections() {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	for _, client := range uc.clients {
+		client.closeIdleConnections()
+	}
+}
+
+// clientFor returns the clients of an upstream, creating them on first use.
+// Clients are rebuilt when a reload changes the upstream's overrides.
+func (uc *UpstreamClients) clientFor(u *Upstream) *upstreamClient {
+	overrides := u.Overrides()
+
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	client, ok := uc.clients[u]
+	if ok && client.overrides == overrides {
+		return client
+	}
+	if ok {
+		client.closeIdleConnections()
+	}
+
+	client = &upstreamClient{
+		overrides: overrides,
+		fast:      newFastClient(uc.proxyConfig, overrides, u.URL.Scheme == "https", &u.pool),
+		stream:    newStreamClient(uc.proxyConfig, overrides, u.URL.Scheme == "https", &u.pool),
+		std:       newStandardClient(uc.proxyConfig, overrides),
+	}
+	uc.clients[u] = client
+	return client
+}
+
+func (c *upstreamClient) closeIdleConnections() {
+	c.fast.CloseIdleConnections()
+	c.stream.CloseIdleConnections()
+	c.std.CloseIdleConnections()
+}
+
+// poolGauges count the connections of an upstream's pools on the gnet path
+type poolGauges struct {
+	open    atomic.Int64 // dialed and not closed yet
+	inUse   atomic.Int64 // carrying an exchange or a body being relayed
+	waiting atomic.Int64 // requests waiting for a connection, dialing included
+}
+
+// PoolStats describes the connections of an upstream's pools on the gnet path
+type PoolStats struct {
+	Open    int64 `json:"open"`
+	Idle    int64 `json:"idle"`
+	Waiters int64 `json:"waiters"`
+}
+
+func (g *poolGauges) stats() PoolStats {
+	open, inUse := g.open.Load(), g.inUse.Load()
+	return PoolStats{Open: open, Idle: max(open-inUse, 0), Waiters: g.waiting.Load()}
+}
+
+// pooledConn is an upstream connection counted as open until closed
+type pooledConn struct {
+	net.Conn
+	gauges *poolGauges
+	closed atomic.Bool
+}
+
+func (c *pooledConn) Close() error {
+	if !c.closed.Swap(true) {
+		c.gauges.open.Add(-1)
+	}
+	return c.Conn.Close()
+}
+
+// newFastClient creates the fasthttp client used on the gnet path, whose
+// connections are counted in gauges
+func newFastClient(p ProxyConfig, o UpstreamOverrides, secure bool, gauges *poolGauges) *fasthttp.Client {
+	// Create fasthttp client optimized for stability
+	return &fasthttp.Client{
+		ReadTimeout:                   o.requestTimeout(p),
+		WriteTimeout:                  o.requestTimeout(p),
+		MaxIdleConnDuration:           time.Second * 30,
+		MaxConnDuration:               time.Minute * 1,
+		MaxConnsPerHost:               o.maxConnsPerHost(p),
+		MaxConnWaitTimeout:            time.Second * 5,
+		ReadBufferSize:                o.bufferSize(p),
+		WriteBufferSize:               o.bufferSize(p),
+		DisableHeaderNamesNormalizing: false,
+		DisablePathNormalizing:        false,
+		// Bodies of unknown length, such as chunked ones, are relayed as they arrive
+		StreamResponseBody: true,
+		RetryIf: func(request *fasthttp.Request) bool {
+			// Disable retries for stability
+			return false
+		},
+		Dial: upstreamDialer(p, o, secure, gauges, 0),
+		// Relays interim responses, which fasthttp would take for the final one
+		Transport: upstreamTransport{streamThreshold: p.StreamThreshold, gauges: gauges},
+	}
+}
+
+// newStreamClient creates the fasthttp client used on the gnet path when bodies
+// are streamed. Responses above stream_threshold, not only those of unknown
+// length, keep their body in the upstream connection until relayed. A transfer may take any time while it makes progress,
+// so request_timeout bounds each read and write instead of the whole exchange.
+func newStreamClient(p ProxyConfig, o UpstreamOverrides, secure bool, gauges *poolGauges) *fasthttp.Client {
+	client := newFastClient(p, o, secure, gauges)
+	client.StreamResponseBody = true
+	client.MaxResponseBodySize = int(p.StreamThreshold)
+	client.ReadTimeout = 0
+	client.WriteTimeout = 0
+	client.Dial = upstreamDialer(p, o, secure, gauges, o.requestTimeout(p))
+	return client
+}
+
+// upstreamDialer returns the dial function of the gnet path's clients. Each phase
+// of a new connection has its own timeout: connect_timeout for the TCP dial,
+// tls_handshake_timeout for the handshake with an https upstream, and
+// first_byte_timeout, when set, for the first byte of each response. With
+// progress set, a read or write making no progress within it fails.
+func upstreamDialer(p ProxyConfig, o UpstreamOverrides, secure bool, gauges *poolGauges, progress time.Duration) fasthttp.DialFunc {
+	dialer := &fasthttp.TCPDialer{
+		Concurrency:      1000,
+		DNSCacheDuration: p.DNSCacheTTL,
+		Resolver:         newUpstreamResolver(p),
+	}
+	return func(addr string) (net.Conn, error) {
+		var conn net.Conn
+		var err error
+		if o.ConnectTimeout > 0 {
+			conn, err = dialer.DialTimeout(addr, o.ConnectTimeout)
+		} else {
+			conn, err = dialer.Dial(addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		gauges.open.Add(1)
+		conn = &pooledConn{Conn: conn, gauges: gauges}
+		if secure {
+			host, _, _ := net.SplitHostPort(addr)
+			if conn, err = handshakeUpstreamTLS(conn, host, o.tlsHandshakeTimeout(p)); err != nil {
+				return nil, err
+			}
+		}
+		// The progress deadline is set through the first byte one, which keeps the sooner
+		if o.FirstByteTimeout > 0 {
+			conn = &firstByteConn{Conn: conn, timeout: o.FirstByteTimeout}
+		}
+		if progress > 0 {
+			conn = &progressConn{Conn: conn, timeout: progress}
+		}
+		if secure {
+			// fasthttp makes its own handshake on connections that cannot tell it was made
+			conn = handshakenConn{conn}
+		}
+		return conn, nil
+	}
+}
+
+// handshakeUpstreamTLS makes the TLS handshake with an upstream named serverName
+// over conn within timeout, closing conn when it fails
+func handshakeUpstreamTLS(conn net.Conn, serverName string, timeout time.Duration) (*tls.Conn, error) {
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName})
+	if timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+		defer tlsConn.SetDeadline(time.Time{})
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// handshakenConn is a TLS connection whose handshake was already made
+type handshakenConn struct {
+	net.Conn
+}
+
+// Handshake does nothing, the handshake was made when the connection was dialed
+func (c handshakenConn) Handshake() error {
+	return nil
+}
+
+// progressConn fails a read or write that makes no progress within timeout
+type progressConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *progressConn) Read(b []byte) (int, error) {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *progressConn) Write(b []byte) (int, error) {
+	if c.timeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Write(b)
+}
+
+// firstByteConn fails a read waiting for the first byte of a response longer
+// than timeout after the request was written. Deadlines the client sets still
+// apply when they come sooner.
+type firstByteConn struct {
+	net.Conn
+	timeout  time.Duration
+	waiting  bool      // a request was written and nothing of its response read yet
+	deadline time.Time // read deadline set by the client
+}
+
+func (c *firstByteConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *firstByteConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *firstByteConn) Write(b []byte) (int, error) {
+	c.waiting = true
+	return c.Conn.Write(b)
+}
+
+func (c *firstByteConn) Read(b []byte) (int, error) {
+	if !c.waiting {
+		return c.Conn.Read(b)
+	}
+	deadline := time.Now().Add(c.timeout)
+	if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+		deadline = c.deadline
+	}
+	c.Conn.SetReadDeadline(deadline)
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.waiting = false
+		c.Conn.SetReadDeadline(c.deadline)
+	}
+	return n, err
+}
+
+// newStandardClient creates the net/http client used by the standard HTTP server
+func newStandardClient(p ProxyConfig, o UpstreamOverrides) *http.Client {
+	transport := &http.Transport{
+		MaxIdleConns:        p.MaxIdleConns,
+		MaxIdleConnsPerHost: p.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     o.maxConnsPerHost(p),
+		IdleConnTimeout:     p.IdleConnTimeout,
+		DialContext: newUpstreamResolver(p).dialContext(&net.Dialer{
+			Timeout:   o.connectTimeout(p),
+			KeepAlive: p.KeepAliveTimeout,
+		}),
+		TLSHandshakeTimeout:   o.tlsHandshakeTimeout(p),
+		ResponseHeaderTimeout: o.FirstByteTimeout,
+		DisableKeepAlives:     false, // Enable keep-alives for better performance
+		ForceAttemptHTTP2:     false, // Disable HTTP/2 for upstream connections
+		// Upstreams set to h2 or h2c get HTTP/2 only, multiplexed over few connections
+		Protocols: o.protocols(),
+	}
+	if o.BufferSize > 0 {
+		transport.ReadBufferSize = o.BufferSize
+		transport.WriteBufferSize = o.BufferSize
+	}
+
+	return &http.Client{
+		Timeout:   o.requestTimeout(p) * 2, // Give more time for the overall request
+		Transport: transport,
+	}
+}
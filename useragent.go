@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// UserAgentFilter rejects scrapers and bad bots by their User-Agent header
+type UserAgentFilter struct {
+	deny       *regexp.Regexp // nil when there are no deny patterns
+	allow      *regexp.Regexp // nil when there are no allow patterns
+	blockEmpty bool
+	status     int
+	body       string
+}
+
+// NewUserAgentFilter creates the filter of a server, or returns nil when it has no rules
+func NewUserAgentFilter(cfg UserAgentConfig) (*UserAgentFilter, error) {
+	if cfg.Status != 0 && (cfg.Status < 400 || cfg.Status > 599) {
+		return nil, fmt.Errorf("status %d is not an error status", cfg.Status)
+	}
+
+	deny, err := compileUserAgentPatterns(cfg.Deny)
+	if err != nil {
+		return nil, err
+	}
+	allow, err := compileUserAgentPatterns(cfg.Allow)
+	if err != nil {
+		return nil, err
+	}
+	if deny == nil && !cfg.BlockEmpty {
+		return nil, nil
+	}
+
+	f := &UserAgentFilter{
+		deny:       deny,
+		allow:      allow,
+		blockEmpty: cfg.BlockEmpty,
+		status:     cfg.Status,
+		body:       cfg.Body,
+	}
+	if f.status == 0 {
+		f.status = http.StatusForbidden
+	}
+	if f.body == "" {
+		f.body = http.StatusText(f.status)
+	}
+	return f, nil
+}
+
+// compileUserAgentPatterns joins patterns into one case-insensitive expression,
+// compiling each on its own first so errors name the offending pattern
+func compileUserAgentPatterns(patterns []string) (*regexp.Regexp, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	groups := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		groups[i] = "(?:" + pattern + ")"
+	}
+	return regexp.Compile("(?i)" + strings.Join(groups, "|"))
+}
+
+// Allowed reports whether a request with the given User-Agent may proceed
+func (f *UserAgentFilter) Allowed(userAgent string) bool {
+	if f == nil {
+		return true
+	}
+	if userAgent == "" {
+		return !f.blockEmpty
+	}
+	if f.deny == nil || !f.deny.MatchString(userAgent) {
+		return true
+	}
+	return f.allow != nil && f.allow.MatchString(userAgent)
+}
+
+// Rejection returns the status and body rejected requests are answered with
+func (f *UserAgentFilter) Rejection() (int, string) {
+	return f.status, f.body
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// validateCmd checks the configuration without starting any server
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check the configuration and exit non-zero when it has errors",
+	Long: `Loads the configuration the way the server does, from --configs, --config or
+--remote-config with the --set overrides, and reports its problems: invalid values and
+servers or routes naming upstreams that do not exist, then, once it loads, enabled
+servers, their HTTP/2 and HTTP/3 listeners and the admin API listening on the same
+address.
+
+Nothing is started, so it can run in CI or before a reload.`,
+	SilenceUsage: true,
+	RunE:         runValidate,
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}
+
+func runValidate(cmd *cobra.Command, args []string) error {
+	green := color.New(color.FgGreen, color.Bold)
+	yellow := color.New(color.FgYellow, color.Bold)
+	red := color.New(color.FgRed, color.Bold)
+
+	cfg, err := loadConfiguration()
+	if err == nil {
+		err = errors.Join(cfg.listenerCollisions()...)
+	}
+	if cfg != nil {
+		for _, warning := range cfg.Warnings {
+			yellow.Printf("  ⚠️  %s\n", warning)
+		}
+	}
+	if err != nil {
+		red.Println("  ❌ Configuration is invalid:")
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Printf("     • %s\n", line)
+		}
+		return fmt.Errorf("invalid configuration")
+	}
+
+	green.Printf("  ✅ Configuration is valid (%d enabled servers, %d upstreams, %d websocket upstreams)\n",
+		len(cfg.GetEnabledServers()), len(cfg.Upstreams), len(cfg.WebSocketUpstreams))
+	return nil
+}
+
+// listener is an address the proxy binds, and who binds it
+type listener struct {
+	network string // "tcp", "udp" or "unix"
+	host    string
+	port    int
+	path    string // of a Unix socket
+	owner   string
+}
+
+// overlaps reports whether two listeners cannot both bind: the same socket path,
+// or the same port on the same host or a wildcard one
+func (l listener) overlaps(other listener) bool {
+	if l.network != other.network {
+		return false
+	}
+	if l.network == "unix" {
+		return l.path == other.path
+	}
+	return l.port == other.port && (l.host == other.host || wildcardHost(l.host) || wildcardHost(other.host))
+}
+
+// String returns the address of the listener as shown in errors
+func (l listener) String() string {
+	if l.network == "unix" {
+		return "unix:" + l.path
+	}
+	return l.network + " " + net.JoinHostPort(l.host, strconv.Itoa(l.port))
+}
+
+// wildcardHost reports whether a listen host binds every interface
+func wildcardHost(host string) bool {
+	switch strings.Trim(host, "[]") {
+	case "", "0.0.0.0", "::":
+		return true
+	}
+	return false
+}
+
+// listeners returns the addresses the enabled servers and the admin API bind.
+// Sockets handed over by systemd are bound by systemd itself.
+func (c *Config) listeners() []listener {
+	var listeners []listener
+	for _, server := range c.GetEnabledServers() {
+		owner := fmt.Sprintf("server %q", server.Name)
+		switch {
+		case server.SystemdSocket != "":
+		case server.UnixSocket != "":
+			listeners = append(listeners, listener{network: "unix", path: server.UnixSocket, owner: owner})
+		default:
+			listeners = append(listeners, listener{network: "tcp", host: server.Host, port: server.Port, owner: owner})
+		}
+		if server.servedByNetHTTP() {
+			continue
+		}
+
+		proxyConfig := c.GetProxyConfig(server.Name)
+		hasTLS := proxyConfig.TLSCertFile != "" && proxyConfig.TLSKeyFile != ""
+		if proxyConfig.EnableHTTP2 && (hasTLS || proxyConfig.EnableH2C) {
+			host, port, _ := net.SplitHostPort(http2Address)
+			n, _ := strconv.Atoi(port)
+			listeners = append(listeners, listener{network: "tcp", host: host, port: n, owner: owner + " HTTP/2"})
+		}
+		if proxyConfig.EnableHTTP3 && hasTLS {
+			listeners = append(listeners, listener{network: "udp", port: proxyConfig.HTTP3Port, owner: owner + " HTTP/3"})
+		}
+	}
+	if c.Admin.Enabled {
+		listeners = append(listeners, listener{network: "tcp", host: c.Admin.Host, port: c.Admin.Port, owner: "admin API"})
+	}
+	return listeners
+}
+
+// listenerCollisions reports every pair of listeners that cannot both bind
+func (c *Config) listenerCollisions() []error {
+	var errs []error
+	listeners := c.listeners()
+	for i, l := range listeners {
+		for _, other := range listeners[:i] {
+			if l.overlaps(other) {
+				errs = append(errs, fmt.Errorf("%s and %s both listen on %s", other.owner, l.owner, l))
+			}
+		}
+	}
+	return errs
+}
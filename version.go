@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Build metadata, set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// BuildInfo describes the running binary
+type BuildInfo struct {
+	Version   string
+	Commit    string
+	BuildDate string
+	Go        string
+	Gnet      string
+	QUICGo    string
+}
+
+// versionCmd prints the build metadata of the binary
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print the version, commit, build date and the versions of Go, gnet and quic-go",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Fprint(cmd.OutOrStdout(), currentBuildInfo().String())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(versionCmd)
+	// --version prints the same as the version command
+	info := currentBuildInfo()
+	rootCmd.Version = info.Version
+	rootCmd.SetVersionTemplate(info.String())
+}
+
+// currentBuildInfo returns the build metadata of the binary. What the ldflags left
+// unset is taken from the module and VCS information Go embeds, when it has any.
+func currentBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		Go:        runtime.Version(),
+		Gnet:      "unknown",
+		QUICGo:    "unknown",
+	}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info.withUnknowns()
+	}
+	if info.Version == "dev" && build.Main.Version != "" && build.Main.Version != "(devel)" {
+		info.Version = strings.TrimPrefix(build.Main.Version, "v")
+	}
+	for _, setting := range build.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && info.Commit == "":
+			info.Commit = setting.Value
+		case setting.Key == "vcs.time" && info.BuildDate == "":
+			info.BuildDate = setting.Value
+		}
+	}
+	for _, dep := range build.Deps {
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		switch dep.Path {
+		case "github.com/panjf2000/gnet/v2":
+			info.Gnet = dep.Version
+		case "github.com/quic-go/quic-go":
+			info.QUICGo = dep.Version
+		}
+	}
+	return info.withUnknowns()
+}
+
+// withUnknowns marks the metadata neither the ldflags nor Go provided
+func (b BuildInfo) withUnknowns() BuildInfo {
+	if b.Commit == "" {
+		b.Commit = "unknown"
+	}
+	if b.BuildDate == "" {
+		b.BuildDate = "unknown"
+	}
+	return b
+}
+
+// String returns the build metadata as printed by the version command
+func (b BuildInfo) String() string {
+	return fmt.Sprintf("surikiti %s\n  commit:     %s\n  built:      %s\n  go:         %s\n  gnet:       %s\n  quic-go:    %s\n",
+		b.Version, b.Commit, b.BuildDate, b.Go, b.Gnet, b.QUICGo)
+}
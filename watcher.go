@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// defaultReloadDebounce is the quiet period used when reload.debounce is not set
+const defaultReloadDebounce = time.Second
+
+// ConfigWatcher watches configuration files and signals when they have settled after a change
+type ConfigWatcher struct {
+	watcher  *fsnotify.Watcher
+	file     string // only this file is relevant in single file mode
+	debounce time.Duration
+	logger   *zap.Logger
+	changes  chan struct{}
+
+	mu    sync.Mutex
+	timer *time.Timer
+	done  chan struct{}
+}
+
+// NewConfigWatcher watches configDir recursively, or only configFile when it is set.
+// Directories are watched rather than files so editors that replace files on save are handled.
+func NewConfigWatcher(configDir, configFile string, debounce time.Duration, logger *zap.Logger) (*ConfigWatcher, error) {
+	if debounce <= 0 {
+		debounce = defaultReloadDebounce
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	cw := &ConfigWatcher{
+		watcher:  watcher,
+		debounce: debounce,
+		logger:   logger,
+		changes:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	if configFile != "" {
+		cw.file = filepath.Clean(configFile)
+		err = watcher.Add(filepath.Dir(cw.file))
+	} else {
+		err = cw.addTree(configDir)
+	}
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	go cw.run()
+	return cw, nil
+}
+
+// Changes returns a channel receiving a value once configuration files have stopped changing
+func (cw *ConfigWatcher) Changes() <-chan struct{} {
+	return cw.changes
+}
+
+// Close stops watching
+func (cw *ConfigWatcher) Close() error {
+	close(cw.done)
+	cw.mu.Lock()
+	if cw.timer != nil {
+		cw.timer.Stop()
+	}
+	cw.mu.Unlock()
+	return cw.watcher.Close()
+}
+
+// addTree watches a directory and all of its subdirectories
+func (cw *ConfigWatcher) addTree(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return cw.watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+func (cw *ConfigWatcher) run() {
+	for {
+		select {
+		case <-cw.done:
+			return
+		case event, ok := <-cw.watcher.Events:
+			if !ok {
+				return
+			}
+			cw.handleEvent(event)
+		case err, ok := <-cw.watcher.Errors:
+			if !ok {
+				return
+			}
+			cw.logger.Warn("Configuration watcher error", zap.Error(err))
+		}
+	}
+}
+
+func (cw *ConfigWatcher) handleEvent(event fsnotify.Event) {
+	// Pick up new subdirectories in multi-file mode
+	if cw.file == "" && event.Has(fsnotify.Create) {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			if err := cw.addTree(event.Name); err != nil {
+				cw.logger.Warn("Failed to watch configuration directory",
+					zap.String("path", event.Name), zap.Error(err))
+			}
+			return
+		}
+	}
+
+	if !cw.relevant(event.Name) || event.Op == fsnotify.Chmod {
+		return
+	}
+
+	cw.logger.Debug("Configuration file changed",
+		zap.String("path", event.Name),
+		zap.String("op", event.Op.String()))
+
+	// Restart the quiet period so a burst of writes results in a single reload
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.timer != nil {
+		cw.timer.Stop()
+	}
+	cw.timer = time.AfterFunc(cw.debounce, cw.notify)
+}
+
+// relevant reports whether a path is one of the loaded configuration files
+func (cw *ConfigWatcher) relevant(path string) bool {
+	if cw.file != "" {
+		return filepath.Clean(path) == cw.file
+	}
+	return strings.HasSuffix(strings.ToLower(path), ".toml")
+}
+
+func (cw *ConfigWatcher) notify() {
+	select {
+	case cw.changes <- struct{}{}:
+	default:
+		// A reload is already pending
+	}
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -17,16 +20,31 @@ type WebSocketProxy struct {
 	loadBalancer   *LoadBalancer
 	wsLoadBalancer *LoadBalancer
 	logger         *zap.Logger
+	metrics        *ServerMetrics
+	connections    *ConnectionTracker
 	config         ProxyConfig
+	trustedProxies *IPSet // proxies whose X-Forwarded-For is extended rather than replaced
 	upgrader       websocket.Upgrader
+	dialer         *websocket.Dialer
+	sessions       atomic.Int64 // open sessions on both the gnet and net/http listeners
+
+	// Sessions closed by a drain on shutdown
+	liveMu   sync.Mutex
+	live     map[*wsSession]struct{}
+	draining atomic.Bool
 }
 
-func NewWebSocketProxy(lb *LoadBalancer, wsLB *LoadBalancer, logger *zap.Logger, cfg ProxyConfig) *WebSocketProxy {
+func NewWebSocketProxy(lb *LoadBalancer, wsLB *LoadBalancer, logger *zap.Logger, metrics *ServerMetrics, connections *ConnectionTracker, cfg ProxyConfig) *WebSocketProxy {
+	// trusted_proxies was checked by Config.Validate, so parsing cannot fail here
+	trustedProxies, _ := NewIPSet(cfg.TrustedProxies)
 	return &WebSocketProxy{
 		loadBalancer:   lb,
 		wsLoadBalancer: wsLB,
 		logger:         logger,
+		metrics:        metrics,
+		connections:    connections,
 		config:         cfg,
+		trustedProxies: trustedProxies,
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  cfg.WebSocketBufferSize,
 			WriteBufferSize: cfg.WebSocketBufferSize,
@@ -34,8 +52,16 @@ func NewWebSocketProxy(lb *LoadBalancer, wsLB *LoadBalancer, logger *zap.Logger,
 				// Allow all origins for now - should be configurable
 				return true
 			},
-			HandshakeTimeout: cfg.WebSocketTimeout,
+			HandshakeTimeout:  cfg.WebSocketTimeout,
+			EnableCompression: cfg.WebSocketCompression,
+		},
+		dialer: &websocket.Dialer{
+			NetDialContext:    newUpstreamResolver(cfg).dialContext(&net.Dialer{}),
+			Proxy:             http.ProxyFromEnvironment,
+			HandshakeTimeout:  websocket.DefaultDialer.HandshakeTimeout,
+			EnableCompression: cfg.WebSocketCompression,
 		},
+		live: make(map[*wsSession]struct{}),
 	}
 }
 
@@ -46,18 +72,58 @@ func (ws *WebSocketProxy) IsWebSocketRequest(headers map[string]string) bool {
 	return strings.Contains(connection, "upgrade") && upgrade == "websocket"
 }
 
+// acquireSession reserves one of the server's WebSocket sessions, or reports
+// false when limit (0 for none) sessions are already open
+func (ws *WebSocketProxy) acquireSession(limit int) bool {
+	for {
+		current := ws.sessions.Load()
+		if limit > 0 && current >= int64(limit) {
+			return false
+		}
+		if ws.sessions.CompareAndSwap(current, current+1) {
+			return true
+		}
+	}
+}
+
+// releaseSession frees a session reserved by acquireSession
+func (ws *WebSocketProxy) releaseSession() {
+	ws.sessions.Add(-1)
+}
+
+// reserve reserves a server session and a connection to a WebSocket upstream,
+// returning the function that releases both, or nil when a limit is reached or
+// the proxy is draining
+func (ws *WebSocketProxy) reserve(limit int, affinityKey string) (*Upstream, func()) {
+	if ws.draining.Load() {
+		ws.logger.Debug("WebSocket upgrade refused while draining")
+		return nil, nil
+	}
+	if !ws.acquireSession(limit) {
+		ws.logger.Warn("WebSocket connection limit reached", zap.Int("limit", limit))
+		return nil, nil
+	}
+	upstream := ws.wsLoadBalancer.GetUpstreamFor(affinityKey)
+	if upstream == nil || !ws.wsLoadBalancer.AcquireConnection(upstream) {
+		ws.releaseSession()
+		ws.logger.Error("No WebSocket upstream available or below its connection limit")
+		return nil, nil
+	}
+	return upstream, func() {
+		ws.wsLoadBalancer.DecreaseConnections(upstream)
+		ws.releaseSession()
+	}
+}
+
 func (ws *WebSocketProxy) HandleWebSocket(w http.ResponseWriter, r *http.Request) error {
-	// Get WebSocket-specific upstream server from dedicated WebSocket load balancer
-	upstream := ws.wsLoadBalancer.GetUpstream()
+	// Get WebSocket-specific upstream server from dedicated WebSocket load balancer,
+	// within the server's and the upstream's connection limits
+	upstream, release := ws.reserve(ws.config.WebSocketMaxConnections, ws.wsLoadBalancer.affinityKey(r))
 	if upstream == nil {
-		ws.logger.Error("No healthy WebSocket upstream available")
 		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
 		return nil
 	}
-
-	// Increment connection count
-	ws.wsLoadBalancer.IncreaseConnections(upstream)
-	defer ws.wsLoadBalancer.DecreaseConnections(upstream)
+	defer release()
 
 	// Parse upstream URL
 	upstreamURL := upstream.URL
@@ -72,9 +138,10 @@ func (ws *WebSocketProxy) HandleWebSocket(w http.ResponseWriter, r *http.Request
 	if upstreamURL.Scheme == "ws" || upstreamURL.Scheme == "wss" {
 		// Use WebSocket URL directly
 		upstreamWSURL = &url.URL{
-			Scheme: upstreamURL.Scheme,
-			Host:   upstreamURL.Host,
-			Path:   r.URL.Path,
+			Scheme:   upstreamURL.Scheme,
+			Host:     upstreamURL.Host,
+			Path:     r.URL.Path,
+			RawPath:  r.URL.RawPath,
 			RawQuery: r.URL.RawQuery,
 		}
 	} else {
@@ -84,9 +151,10 @@ func (ws *WebSocketProxy) HandleWebSocket(w http.ResponseWriter, r *http.Request
 			scheme = "wss"
 		}
 		upstreamWSURL = &url.URL{
-			Scheme: scheme,
-			Host:   upstreamURL.Host,
-			Path:   r.URL.Path,
+			Scheme:   scheme,
+			Host:     upstreamURL.Host,
+			Path:     r.URL.Path,
+			RawPath:  r.URL.RawPath,
 			RawQuery: r.URL.RawQuery,
 		}
 	}
@@ -100,8 +168,10 @@ func (ws *WebSocketProxy) HandleWebSocket(w http.ResponseWriter, r *http.Request
 	defer clientConn.Close()
 
 	// Connect to upstream WebSocket
-	upstreamConn, _, err := websocket.DefaultDialer.Dial(upstreamWSURL.String(), nil)
+	stats := ws.metrics.WebSocketFor(upstream.Name)
+	upstreamConn, _, err := ws.dialer.Dial(upstreamWSURL.String(), ws.dialHeaders(r))
 	if err != nil {
+		stats.HandshakeFailed()
 		ws.logger.Error("Failed to connect to upstream WebSocket", 
 			zap.Error(err), 
 			zap.String("upstream", upstreamWSURL.String()))
@@ -111,24 +181,51 @@ func (ws *WebSocketProxy) HandleWebSocket(w http.ResponseWriter, r *http.Request
 	}
 	defer upstreamConn.Close()
 
+	// Messages are re-compressed on each side that negotiated permessage-deflate
+	if ws.config.WebSocketCompression {
+		clientConn.SetCompressionLevel(ws.config.WebSocketCompressionLevel)
+		upstreamConn.SetCompressionLevel(ws.config.WebSocketCompressionLevel)
+	}
+
+	// Track the session so the admin API can list and terminate it
+	tracked := ws.connections.Track(r.RemoteAddr, "WebSocket", clientConn.Close)
+	tracked.SetTarget("", upstream.Name)
+	defer ws.connections.Untrack(tracked)
+
 	ws.logger.Info("WebSocket connection established", 
 		zap.String("client", r.RemoteAddr),
 		zap.String("upstream", upstreamWSURL.String()))
 
-	// Set connection timeouts
-	if ws.config.WebSocketTimeout > 0 {
-		clientConn.SetReadDeadline(time.Now().Add(ws.config.WebSocketTimeout))
-		upstreamConn.SetReadDeadline(time.Now().Add(ws.config.WebSocketTimeout))
-	}
+	stats.SessionOpened()
+	defer func(opened time.Time) { stats.SessionClosed(time.Since(opened)) }(time.Now())
+
+	// On shutdown both peers are asked to close; their close frames end the relay
+	unregister := ws.register(func() {
+		deadline := time.Now().Add(time.Second)
+		clientConn.WriteControl(websocket.CloseMessage, wsGoingAwayMessage, deadline)
+		upstreamConn.WriteControl(websocket.CloseMessage, wsGoingAwayMessage, deadline)
+	}, func() {
+		clientConn.Close()
+		upstreamConn.Close()
+	})
+	defer unregister()
+
+	// Peers that stop answering pings time out; connections carrying no data close once idle
+	ws.watchLiveness(clientConn)
+	ws.watchLiveness(upstreamConn)
+	activity := newWSActivity()
+	done := make(chan struct{})
+	defer close(done)
+	go ws.keepAlive(clientConn, upstreamConn, activity, done)
 
 	// Start bidirectional proxying
 	errorChan := make(chan error, 2)
 
 	// Client to upstream
-	go ws.proxyMessages(clientConn, upstreamConn, "client->upstream", errorChan)
+	go ws.proxyMessages(clientConn, upstreamConn, wsClientToUpstream, activity, stats, errorChan)
 
 	// Upstream to client
-	go ws.proxyMessages(upstreamConn, clientConn, "upstream->client", errorChan)
+	go ws.proxyMessages(upstreamConn, clientConn, wsUpstreamToClient, activity, stats, errorChan)
 
 	// Wait for either direction to close or error
 	err = <-errorChan
@@ -139,24 +236,25 @@ func (ws *WebSocketProxy) HandleWebSocket(w http.ResponseWriter, r *http.Request
 	return nil
 }
 
-func (ws *WebSocketProxy) proxyMessages(src, dst *websocket.Conn, direction string, errorChan chan error) {
+func (ws *WebSocketProxy) proxyMessages(src, dst *websocket.Conn, direction int, activity *wsActivity, stats *WebSocketMetrics, errorChan chan error) {
 	for {
-		// Reset read deadline if configured
-		if ws.config.WebSocketTimeout > 0 {
-			src.SetReadDeadline(time.Now().Add(ws.config.WebSocketTimeout))
-		}
-
 		messageType, message, err := src.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				ws.logger.Error("WebSocket read error", 
 					zap.Error(err), 
-					zap.String("direction", direction))
+					zap.String("direction", wsDirectionNames[direction]))
 			}
 			errorChan <- err
 			return
 		}
 
+		// Any message proves the peer alive and the connection in use
+		activity.touch()
+		if ws.config.WebSocketPingInterval > 0 {
+			src.SetReadDeadline(time.Now().Add(2 * ws.config.WebSocketPingInterval))
+		}
+
 		// Reset write deadline if configured
 		if ws.config.WebSocketTimeout > 0 {
 			dst.SetWriteDeadline(time.Now().Add(ws.config.WebSocketTimeout))
@@ -166,14 +264,47 @@ func (ws *WebSocketProxy) proxyMessages(src, dst *websocket.Conn, direction stri
 		if err != nil {
 			ws.logger.Error("WebSocket write error", 
 				zap.Error(err), 
-				zap.String("direction", direction))
+				zap.String("direction", wsDirectionNames[direction]))
 			errorChan <- err
 			return
 		}
+		stats.Traffic(direction, 1, len(message))
 
 		ws.logger.Debug("WebSocket message proxied", 
-			zap.String("direction", direction),
+			zap.String("direction", wsDirectionNames[direction]),
 			zap.Int("messageType", messageType),
 			zap.Int("size", len(message)))
 	}
-}
\ No newline at end of file
+}
+
+// websocketHandshakeHeaders are set by the dialer itself and never copied from the client
+var websocketHandshakeHeaders = map[string]bool{
+	"Upgrade":                  true,
+	"Connection":               true,
+	"Sec-Websocket-Key":        true,
+	"Sec-Websocket-Version":    true,
+	"Sec-Websocket-Extensions": true,
+	"Sec-Websocket-Protocol":   true,
+}
+
+// dialHeaders returns the headers of the upstream handshake: the configured client
+// headers, such as cookies and credentials, and the usual forwarding headers
+func (ws *WebSocketProxy) dialHeaders(r *http.Request) http.Header {
+	headers := make(http.Header)
+	for _, name := range ws.config.WebSocketForwardHeaders {
+		if websocketHandshakeHeaders[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		for _, value := range r.Header.Values(name) {
+			headers.Add(name, value)
+		}
+	}
+	chain, client := forwardedFor(ws.trustedProxies, r.RemoteAddr, strings.Join(r.Header.Values("X-Forwarded-For"), ", "))
+	if chain != "" {
+		headers.Set("X-Forwarded-For", chain)
+		headers.Set("X-Real-IP", client)
+	}
+	headers.Set("X-Forwarded-Proto", "http")
+	headers.Set("X-Forwarded-Host", r.Host)
+	return headers
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// wsDrainPoll is how often a drain checks whether every session has closed
+const wsDrainPoll = 50 * time.Millisecond
+
+// wsGoingAwayMessage is the close payload sent to WebSocket peers on shutdown
+var wsGoingAwayMessage = websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+
+// wsSession is an open WebSocket session as seen by a drain
+type wsSession struct {
+	goAway func() // starts the close handshake with 1001 Going Away
+	close  func() // drops the connection
+}
+
+// register adds an open session to those a drain closes, returning the function
+// that removes it again
+func (ws *WebSocketProxy) register(goAway, close func()) func() {
+	session := &wsSession{goAway: goAway, close: close}
+	ws.liveMu.Lock()
+	ws.live[session] = struct{}{}
+	ws.liveMu.Unlock()
+	return func() {
+		ws.liveMu.Lock()
+		delete(ws.live, session)
+		ws.liveMu.Unlock()
+	}
+}
+
+// openSessions returns the sessions currently registered
+func (ws *WebSocketProxy) openSessions() []*wsSession {
+	ws.liveMu.Lock()
+	defer ws.liveMu.Unlock()
+	sessions := make([]*wsSession, 0, len(ws.live))
+	for session := range ws.live {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// Drain refuses new upgrades, sends a 1001 Going Away close frame to every open
+// session and waits up to timeout, or until ctx is done, for the peers to finish
+// the close handshake. Sessions still open after that are dropped.
+func (ws *WebSocketProxy) Drain(ctx context.Context, timeout time.Duration) {
+	ws.draining.Store(true)
+	sessions := ws.openSessions()
+	if len(sessions) == 0 {
+		return
+	}
+	ws.logger.Info("Draining WebSocket sessions",
+		zap.Int("sessions", len(sessions)),
+		zap.Duration("timeout", timeout))
+	for _, session := range sessions {
+		session.goAway()
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(wsDrainPoll)
+	defer poll.Stop()
+wait:
+	for len(ws.openSessions()) > 0 {
+		select {
+		case <-poll.C:
+		case <-deadline.C:
+			break wait
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	remaining := ws.openSessions()
+	if len(remaining) > 0 {
+		ws.logger.Warn("Dropping WebSocket sessions still open after drain", zap.Int("sessions", len(remaining)))
+	}
+	for _, session := range remaining {
+		session.close()
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+// maxUpgradeResponseSize bounds the upstream's response to a WebSocket handshake
+const maxUpgradeResponseSize = 64 << 10
+
+// wsTunnel relays the raw bytes of an upgraded gnet connection to and from its
+// upstream. Frames are not parsed: after the handshake both sides speak directly.
+type wsTunnel struct {
+	conn       net.Conn
+	reader     *bufio.Reader // upstream bytes, including any read with the handshake response
+	release    func()        // frees the session and upstream connection
+	activity   *wsActivity
+	idle       time.Duration // close after this long without traffic, 0 for never
+	timeout    time.Duration // write timeout towards the upstream, 0 for none
+	closeOnce  sync.Once
+	goingAway  atomic.Bool // set by a drain; the client is sent a close frame
+	unregister func()      // removes the session from those a drain closes
+
+	// Session metrics, nil when the upstream refused the upgrade
+	stats  *WebSocketMetrics
+	opened time.Time
+	frames [2]wsFrameCounter // indexed by direction
+}
+
+// relay forwards the bytes received from the client to the upstream
+func (t *wsTunnel) relay(c gnet.Conn) gnet.Action {
+	data, err := c.Next(-1)
+	if err != nil {
+		return gnet.Close
+	}
+	t.activity.touch()
+	if t.timeout > 0 {
+		t.conn.SetWriteDeadline(time.Now().Add(t.timeout))
+	}
+	if _, err := t.conn.Write(data); err != nil {
+		return gnet.Close
+	}
+	t.observe(wsClientToUpstream, data)
+	return gnet.None
+}
+
+// observe records the messages and bytes relayed in one direction
+func (t *wsTunnel) observe(direction int, data []byte) {
+	if t.stats != nil {
+		t.stats.Traffic(direction, t.frames[direction].count(data), len(data))
+	}
+}
+
+// pump forwards the bytes received from the upstream to the client until either
+// side closes or no traffic crosses the tunnel, in either direction, for the idle
+// timeout. Frames are not parsed, so pings sent by either end count as traffic.
+func (t *wsTunnel) pump(c gnet.Conn, bufferSize int) {
+	buf := make([]byte, bufferSize)
+	closeSent := false
+	for {
+		var deadline time.Time
+		if t.idle > 0 {
+			deadline = time.Now().Add(t.idle - t.activity.idleFor())
+		}
+		t.conn.SetReadDeadline(deadline)
+
+		// A drain's close frame goes between two upstream frames, never inside one.
+		// The client's answer is relayed, so the upstream sees a normal close.
+		if t.goingAway.Load() && !closeSent && t.frames[wsUpstreamToClient].atBoundary() {
+			if c.AsyncWrite(wsCloseFrame(wsGoingAwayMessage), nil) != nil {
+				break
+			}
+			closeSent = true
+		}
+
+		n, err := t.reader.Read(buf)
+		if n > 0 {
+			t.activity.touch()
+			t.observe(wsUpstreamToClient, buf[:n])
+			// AsyncWrite queues the buffer, so it is copied before the next read
+			if c.AsyncWrite(append([]byte(nil), buf[:n]...), nil) != nil {
+				break
+			}
+		}
+		if err != nil {
+			// Client traffic while the upstream was quiet keeps the tunnel open, and
+			// a draining tunnel stays open until the peers close or the drain ends
+			if errors.Is(err, os.ErrDeadlineExceeded) && (t.activity.idleFor() < t.idle || t.goingAway.Load()) {
+				continue
+			}
+			break
+		}
+	}
+	c.Close()
+}
+
+// goAway starts closing the session for a drain. The pump is woken to send the
+// client a close frame once it is between frames.
+func (t *wsTunnel) goAway() {
+	t.goingAway.Store(true)
+	t.conn.SetReadDeadline(time.Now())
+}
+
+// Close closes the upstream side of the tunnel; it is safe to call more than once
+func (t *wsTunnel) Close() {
+	t.closeOnce.Do(func() {
+		t.conn.Close()
+		t.release()
+		if t.unregister != nil {
+			t.unregister()
+		}
+		if t.stats != nil {
+			t.stats.SessionClosed(time.Since(t.opened))
+		}
+	})
+}
+
+// HandleWebSocketTraffic answers a WebSocket upgrade received on a gnet connection.
+// Once the upstream accepts the handshake the connection becomes a raw tunnel.
+func (h *HTTPHandler) HandleWebSocketTraffic(c gnet.Conn, cc *connContext, reqData []byte, ws *WebSocketProxy) gnet.Action {
+	start := time.Now()
+	entry := &AccessEntry{
+		Protocol: "WebSocket",
+		Remote:   remoteAddr(c),
+	}
+
+	action := h.upgradeTraffic(c, cc, reqData, ws, entry)
+
+	if entry.Status != 0 {
+		entry.Duration = time.Since(start)
+		h.metrics.ObserveRequest(entry)
+	}
+	return action
+}
+
+// upgradeTraffic runs the access checks of a WebSocket handshake, passes it to a
+// WebSocket upstream and relays the upstream's answer
+func (h *HTTPHandler) upgradeTraffic(c gnet.Conn, cc *connContext, reqData []byte, ws *WebSocketProxy, entry *AccessEntry) gnet.Action {
+	rc := h.runtime.Load()
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	// Header names are passed on as the client sent them
+	req.Header.DisableNormalizing()
+	if err := req.Read(bufio.NewReader(bytes.NewReader(reqData))); err != nil {
+		h.logger.Debug("Failed to parse WebSocket handshake", zap.Error(err))
+		h.sendTrafficError(c, entry, fasthttp.StatusBadRequest, "Bad Request")
+		return gnet.None
+	}
+
+	entry.Method = string(req.Header.Method())
+	if !normalizeFastHTTPTarget(req, rc.Proxy.PathNormalization) {
+		h.logger.Debug("Request path rejected", zap.ByteString("uri", req.Header.RequestURI()))
+		h.sendTrafficError(c, entry, fasthttp.StatusBadRequest, "Bad Request")
+		return gnet.None
+	}
+	entry.Path = string(req.URI().Path())
+	route := rc.Router.Match(entry.Path)
+	entry.Route = route.RouteName()
+	ip := clientIP(entry.Remote)
+
+	if !rc.AllowClient(route, ip) {
+		h.logger.Debug("Client IP rejected by access list", zap.String("remote", entry.Remote))
+		h.sendTrafficError(c, entry, fasthttp.StatusForbidden, "Forbidden")
+		return gnet.None
+	}
+	if maintenance := rc.MaintenanceFor(route, ip); maintenance != nil {
+		h.sendPage(c, entry, maintenance)
+		return gnet.None
+	}
+	if userAgent := string(req.Header.UserAgent()); !rc.UserAgents.Allowed(userAgent) {
+		h.logger.Debug("User agent rejected", zap.String("remote", entry.Remote), zap.String("user_agent", userAgent))
+		status, body := rc.UserAgents.Rejection()
+		h.sendTrafficError(c, entry, status, body)
+		return gnet.None
+	}
+
+	// WebSocket upgrades have their own rate limits
+	if allowed, retryAfter := rc.RateLimit.AllowWebSocket(ip); !allowed {
+		h.logger.Debug("WebSocket rate limit exceeded", zap.String("remote", entry.Remote))
+		h.sendTooManyRequests(c, entry, retryAfter)
+		return gnet.None
+	}
+
+	if !h.authenticateTraffic(c, entry, rc, route, req) {
+		return gnet.None
+	}
+
+	// Sessions are reserved before dialing, within the server's and the upstream's limits
+	upstream, release := ws.reserve(rc.Proxy.WebSocketMaxConnections, ws.wsLoadBalancer.affinityKeyFastHTTP(req, ip))
+	if upstream == nil {
+		h.sendTrafficError(c, entry, fasthttp.StatusServiceUnavailable, "Service Unavailable")
+		return gnet.None
+	}
+	entry.Upstream = upstream.Name
+	stats := ws.metrics.WebSocketFor(upstream.Name)
+
+	conn, err := dialWebSocketUpstream(upstream, rc.Proxy)
+	if err != nil {
+		release()
+		stats.HandshakeFailed()
+		h.logger.Error("Failed to connect to upstream WebSocket", zap.Error(err), zap.String("upstream", upstream.Name))
+		h.metrics.IncUpstreamErrors()
+		h.sendTrafficError(c, entry, fasthttp.StatusBadGateway, "Bad Gateway")
+		return gnet.None
+	}
+
+	// The handshake is bounded by the upstream's request timeout, like any request
+	if timeout := upstream.Overrides().requestTimeout(rc.Proxy); timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	// The handshake keeps every client header; only the forwarding headers are added
+	chain, client := forwardedFor(rc.TrustedProxies, entry.Remote, peekList(&req.Header, "X-Forwarded-For"))
+	if chain != "" {
+		req.Header.Set("X-Forwarded-For", chain)
+		req.Header.Set("X-Real-IP", client)
+	} else {
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Del("X-Real-IP")
+	}
+	req.Header.Set("X-Forwarded-Proto", "http")
+	req.Header.Set("X-Forwarded-Host", string(req.Header.Host()))
+	req.Header.SetHost(upstream.URL.Host)
+	// Extensions are negotiated end to end, so with compression off the offer is withdrawn
+	if !rc.Proxy.WebSocketCompression {
+		withoutDeflate(&req.Header)
+	}
+	reader := bufio.NewReaderSize(conn, maxUpgradeResponseSize)
+	head, status, err := func() ([]byte, int, error) {
+		if _, err := req.WriteTo(conn); err != nil {
+			return nil, 0, err
+		}
+		return readUpgradeResponse(reader)
+	}()
+	if err != nil {
+		conn.Close()
+		release()
+		stats.HandshakeFailed()
+		h.logger.Error("WebSocket handshake with upstream failed", zap.Error(err), zap.String("upstream", upstream.Name))
+		h.metrics.IncUpstreamErrors()
+		h.sendTrafficError(c, entry, fasthttp.StatusBadGateway, "Bad Gateway")
+		return gnet.None
+	}
+	conn.SetDeadline(time.Time{})
+
+	// The upstream's answer goes to the client as is. Anything but 101 Switching
+	// Protocols is still relayed, and the upstream decides when to close.
+	entry.Status = status
+	if _, err := c.Write(head); err != nil {
+		conn.Close()
+		release()
+		return gnet.Close
+	}
+
+	tunnel := &wsTunnel{
+		conn:     conn,
+		reader:   reader,
+		release:  release,
+		activity: newWSActivity(),
+		idle:     rc.Proxy.WebSocketIdleTimeout,
+		timeout:  rc.Proxy.WebSocketTimeout,
+	}
+	if status == fasthttp.StatusSwitchingProtocols {
+		tunnel.stats, tunnel.opened = stats, time.Now()
+		stats.SessionOpened()
+		tunnel.unregister = ws.register(tunnel.goAway, func() { c.Close() })
+	} else {
+		stats.HandshakeFailed()
+	}
+	cc.tunnel = tunnel
+	cc.tracked.SetProtocol("WebSocket")
+	cc.tracked.SetTarget(entry.Route, upstream.Name)
+
+	bufferSize := rc.Proxy.WebSocketBufferSize
+	if bufferSize <= 0 {
+		bufferSize = 32 << 10
+	}
+	go tunnel.pump(c, bufferSize)
+
+	h.logger.Debug("WebSocket connection established",
+		zap.String("client", entry.Remote),
+		zap.String("upstream", upstream.Name))
+	return gnet.None
+}
+
+// dialWebSocketUpstream opens a connection to a WebSocket upstream, over TLS for
+// https and wss upstreams
+func dialWebSocketUpstream(upstream *Upstream, p ProxyConfig) (net.Conn, error) {
+	if upstream.URL == nil {
+		return nil, errors.New("invalid upstream URL: nil")
+	}
+	host := upstream.URL.Host
+	secure := upstream.URL.Scheme == "https" || upstream.URL.Scheme == "wss"
+	if upstream.URL.Port() == "" {
+		port := "80"
+		if secure {
+			port = "443"
+		}
+		host = net.JoinHostPort(upstream.URL.Hostname(), port)
+	}
+
+	overrides := upstream.Overrides()
+	conn, err := newUpstreamResolver(p).dialContext(&net.Dialer{Timeout: overrides.connectTimeout(p)})(context.Background(), "tcp", host)
+	if err != nil || !secure {
+		return conn, err
+	}
+	return handshakeUpstreamTLS(conn, upstream.URL.Hostname(), overrides.tlsHandshakeTimeout(p))
+}
+
+// readUpgradeResponse reads the status line and headers of the upstream's answer
+// to a handshake, returning them unparsed along with the status code
+func readUpgradeResponse(r *bufio.Reader) ([]byte, int, error) {
+	var head []byte
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) {
+				return nil, 0, errors.New("handshake response too large")
+			}
+			return nil, 0, err
+		}
+		head = append(head, line...)
+		if len(head) > maxUpgradeResponseSize {
+			return nil, 0, errors.New("handshake response too large")
+		}
+		if len(line) <= 2 && strings.TrimSpace(string(line)) == "" {
+			break
+		}
+	}
+
+	statusLine, _, _ := strings.Cut(string(head), "\r\n")
+	fields := strings.Fields(statusLine)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/") {
+		return nil, 0, errors.New("malformed handshake response")
+	}
+	status, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, 0, errors.New("malformed handshake response")
+	}
+	return head, status, nil
+}
+
+// withoutDeflate removes permessage-deflate from the extensions a handshake offers
+func withoutDeflate(h *fasthttp.RequestHeader) {
+	offers := strings.Split(string(h.Peek("Sec-WebSocket-Extensions")), ",")
+	kept := offers[:0]
+	for _, offer := range offers {
+		name, _, _ := strings.Cut(offer, ";")
+		if name = strings.TrimSpace(name); name != "" && !strings.EqualFold(name, "permessage-deflate") {
+			kept = append(kept, strings.TrimSpace(offer))
+		}
+	}
+	h.Del("Sec-WebSocket-Extensions")
+	if len(kept) > 0 {
+		h.Set("Sec-WebSocket-Extensions", strings.Join(kept, ", "))
+	}
+}
+
+// wsFrameCounter follows the frame boundaries of one direction of a tunneled
+// WebSocket to count its messages, reading only frame headers: payloads are
+// skipped, never buffered or unmasked
+type wsFrameCounter struct {
+	header    [14]byte // the largest header: 2 bytes, 8 of length and a 4-byte mask
+	headerLen int      // header bytes seen of the frame being read
+	remaining uint64   // payload bytes of the current frame still to come
+}
+
+// count consumes the next bytes of the stream and returns the number of messages
+// they completed. A message completes with the header of its final data frame.
+func (f *wsFrameCounter) count(data []byte) int {
+	messages := 0
+	for len(data) > 0 {
+		if f.remaining > 0 {
+			skip := uint64(len(data))
+			if skip > f.remaining {
+				skip = f.remaining
+			}
+			f.remaining -= skip
+			data = data[skip:]
+			continue
+		}
+
+		// Collect the fixed part first, then the extended length and mask it announces
+		need := 2
+		if f.headerLen >= 2 {
+			need = wsFrameHeaderLen(f.header[1])
+		}
+		n := copy(f.header[f.headerLen:need], data)
+		f.headerLen += n
+		data = data[n:]
+		if f.headerLen < need || (need == 2 && wsFrameHeaderLen(f.header[1]) > 2) {
+			continue
+		}
+
+		fin, opcode := f.header[0]&0x80 != 0, f.header[0]&0x0f
+		if fin && opcode < 0x8 { // continuation, text or binary; control frames are not messages
+			messages++
+		}
+		switch length := f.header[1] & 0x7f; length {
+		case 126:
+			f.remaining = uint64(binary.BigEndian.Uint16(f.header[2:4]))
+		case 127:
+			f.remaining = binary.BigEndian.Uint64(f.header[2:10])
+		default:
+			f.remaining = uint64(length)
+		}
+		f.headerLen = 0
+	}
+	return messages
+}
+
+// atBoundary reports whether the bytes consumed so far end with a complete frame
+func (f *wsFrameCounter) atBoundary() bool {
+	return f.headerLen == 0 && f.remaining == 0
+}
+
+// wsCloseFrame frames a close payload as sent by a server, unmasked
+func wsCloseFrame(payload []byte) []byte {
+	return append([]byte{0x88, byte(len(payload))}, payload...)
+}
+
+// wsFrameHeaderLen returns the header length of a frame from its second byte
+func wsFrameHeaderLen(b byte) int {
+	n := 2
+	switch b & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if b&0x80 != 0 {
+		n += 4
+	}
+	return n
+}
@@ -15,11 +15,11 @@ type WebSocketHandler struct {
 }
 
 // NewWebSocketHandler creates a new WebSocket handler
-func NewWebSocketHandler(lb *LoadBalancer, logger *zap.Logger, proxyConfig ProxyConfig) *WebSocketHandler {
+func NewWebSocketHandler(lb *LoadBalancer, logger *zap.Logger, metrics *ServerMetrics, connections *ConnectionTracker, proxyConfig ProxyConfig) *WebSocketHandler {
 	var wsProxy *WebSocketProxy
 	if lb != nil {
 		// Use the same load balancer for both parameters since we only have one
-		wsProxy = NewWebSocketProxy(lb, lb, logger, proxyConfig)
+		wsProxy = NewWebSocketProxy(lb, lb, logger, metrics, connections, proxyConfig)
 	}
 
 	return &WebSocketHandler{
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsActivity records when a proxied WebSocket last carried data in either direction
+type wsActivity struct {
+	last atomic.Int64 // unix nanoseconds
+}
+
+// newWSActivity starts tracking a connection that is active now
+func newWSActivity() *wsActivity {
+	a := &wsActivity{}
+	a.touch()
+	return a
+}
+
+// touch records traffic
+func (a *wsActivity) touch() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+// idleFor returns how long the connection has carried no data
+func (a *wsActivity) idleFor() time.Duration {
+	return time.Since(time.Unix(0, a.last.Load()))
+}
+
+// watchLiveness makes a peer that stops answering pings time out. Its read deadline
+// allows one missed ping interval and is pushed back by pongs, pings and messages.
+func (ws *WebSocketProxy) watchLiveness(conn *websocket.Conn) {
+	interval := ws.config.WebSocketPingInterval
+	if interval <= 0 {
+		return
+	}
+	extend := func() {
+		conn.SetReadDeadline(time.Now().Add(2 * interval))
+	}
+	extend()
+	conn.SetPongHandler(func(string) error {
+		extend()
+		return nil
+	})
+	conn.SetPingHandler(func(data string) error {
+		extend()
+		// Answered like the default handler does
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+}
+
+// keepAlive pings both sides of a proxied WebSocket every ping interval and closes
+// the pair once no data has crossed it for the idle timeout. It returns when done
+// is closed or the pair is closed.
+func (ws *WebSocketProxy) keepAlive(client, upstream *websocket.Conn, activity *wsActivity, done <-chan struct{}) {
+	interval, idle := ws.config.WebSocketPingInterval, ws.config.WebSocketIdleTimeout
+
+	var pings, idleCheck <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+	var idleTimer *time.Timer
+	if idle > 0 {
+		idleTimer = time.NewTimer(idle)
+		defer idleTimer.Stop()
+		idleCheck = idleTimer.C
+	}
+	if pings == nil && idleCheck == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-pings:
+			deadline := time.Now().Add(interval)
+			if client.WriteControl(websocket.PingMessage, nil, deadline) != nil ||
+				upstream.WriteControl(websocket.PingMessage, nil, deadline) != nil {
+				client.Close()
+				upstream.Close()
+				return
+			}
+		case <-idleCheck:
+			// Traffic since the timer was armed moves the check to the new idle deadline
+			if remaining := idle - activity.idleFor(); remaining > 0 {
+				idleTimer.Reset(remaining)
+				continue
+			}
+			ws.logger.Debug("Closing idle WebSocket connection")
+			message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "idle timeout")
+			deadline := time.Now().Add(time.Second)
+			client.WriteControl(websocket.CloseMessage, message, deadline)
+			upstream.WriteControl(websocket.CloseMessage, message, deadline)
+			client.Close()
+			upstream.Close()
+			return
+		}
+	}
+}